@@ -754,7 +754,7 @@ func NewDaemon(config *Config, registryService *registry.Service) (daemon *Daemo
 	d.downloadManager = xfer.NewLayerDownloadManager(d.layerStore, maxDownloadConcurrency)
 	d.uploadManager = xfer.NewLayerUploadManager(maxUploadConcurrency)
 
-	ifs, err := image.NewFSStoreBackend(filepath.Join(imageRoot, "imagedb"))
+	ifs, err := image.NewFSStoreBackendWithOptions(filepath.Join(imageRoot, "imagedb"), image.FSOptions{Logger: image.LogrusLogger{}})
 	if err != nil {
 		return nil, err
 	}
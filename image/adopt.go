@@ -0,0 +1,70 @@
+package image
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"golang.org/x/net/context"
+)
+
+// AdoptFile moves the file at path into the store and returns its ID. On the
+// same filesystem the file is renamed into place, so its content is neither
+// read twice nor copied; otherwise it is copied and the source removed. If
+// the content is already stored the source is just removed.
+//
+// The file must not be modified while it is adopted. With
+// FSOptions.VerifyAdopted the content is read again once it is in place, and
+// removed with ErrCorrupt if it changed since it was hashed.
+func (s *fs) AdoptFile(path string) (ID, error) {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return "", storeError("adopt", "", err)
+	}
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return "", storeError("adopt", "", err)
+	}
+	if s.idStrategy != nil {
+		return "", storeError("adopt", "", ErrUnsupportedAlgorithm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", storeError("adopt", "", err)
+	}
+	digester := s.algorithm.New()
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(s.hashWriter(io.MultiWriter(digester.Hash(), crc)), f)
+	f.Close()
+	if err != nil {
+		return "", storeError("adopt", "", err)
+	}
+	if size == 0 && !s.allowEmpty {
+		return "", storeError("adopt", "", ErrEmptyContent)
+	}
+	id := ID(digester.Digest())
+	if !s.algorithmAllowed(s.algorithm) {
+		return "", storeError("adopt", id, ErrUnsupportedAlgorithm)
+	}
+
+	if _, err := s.get(id); err == nil {
+		return id, storeError("adopt", id, os.Remove(path))
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return "", storeError("adopt", id, err)
+	}
+	if err := s.renameIntoPlace(path, id); err != nil {
+		return "", storeError("adopt", id, err)
+	}
+	if s.verifyAdopted {
+		if _, err := s.get(id); err != nil {
+			if errors.Is(err, ErrCorrupt) {
+				os.Remove(s.contentFile(id))
+			}
+			return "", storeError("adopt", id, err)
+		}
+	}
+	s.recordStored(id, size, crc.Sum32(), true)
+	return id, nil
+}
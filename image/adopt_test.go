@@ -0,0 +1,64 @@
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdoptFile(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{VerifyAdopted: true})
+	defer cleanup()
+
+	data := []byte("foobar")
+	src := filepath.Join(fs.root, "old-layout-file")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := fs.AdoptFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected adopted content %q, got %q", data, content)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("Expected source to be moved, got %v", err)
+	}
+	dstInfo, err := os.Stat(fs.contentFile(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(srcInfo, dstInfo) {
+		t.Fatal("Expected the adopted file to be reused on the same filesystem")
+	}
+
+	// Adopting stored content only removes the source.
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.AdoptFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2 != id {
+		t.Fatalf("Expected ID %v, got %v", id, id2)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("Expected source to be removed, got %v", err)
+	}
+	if after, err := os.Stat(fs.contentFile(id)); err != nil || !os.SameFile(dstInfo, after) {
+		t.Fatalf("Expected stored content to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// aliasesDirName holds a file per alias, named after the alias and holding
+// the ID it points to.
+const aliasesDirName = "aliases"
+
+func (s *fs) aliasesDir() string {
+	return filepath.Join(s.root, aliasesDirName+s.namespaceSuffix())
+}
+
+// validateAlias checks that name can be used as a file name in the aliases
+// directory. Names starting with a dot are reserved for temporary files.
+func validateAlias(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid image alias %q", name)
+	}
+	return nil
+}
+
+// SetAlias points the alias name to the content of id, which must be
+// stored. An existing alias of the same name is overwritten. Aliases are
+// kept in the store root and protect their content from garbage
+// collection.
+func (s *fs) SetAlias(name string, id ID) error {
+	if err := validateAlias(name); err != nil {
+		return err
+	}
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("setalias", id, err)
+	}
+	defer s.Unlock()
+
+	return s.setAlias(name, id)
+}
+
+// setAlias points the alias name to id. It must be called with the store
+// write lock held.
+func (s *fs) setAlias(name string, id ID) error {
+	if err := s.contentExists(id); err != nil {
+		return storeError("setalias", id, err)
+	}
+	if err := os.MkdirAll(s.aliasesDir(), 0700); err != nil {
+		return storeError("setalias", id, err)
+	}
+	tempFile, err := ioutil.TempFile(s.aliasesDir(), ".")
+	if err != nil {
+		return storeError("setalias", id, err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.WriteString(id.String())
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filepath.Join(s.aliasesDir(), name))
+	}
+	return storeError("setalias", id, err)
+}
+
+// ResolveAlias returns the ID the alias name points to. The content of the
+// ID isn't guaranteed to be stored, see DanglingAliases.
+func (s *fs) ResolveAlias(name string) (ID, error) {
+	if err := validateAlias(name); err != nil {
+		return "", err
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	id, err := s.readAlias(name)
+	if err != nil {
+		return "", storeError("resolvealias", "", err)
+	}
+	return id, nil
+}
+
+func (s *fs) readAlias(name string) (ID, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.aliasesDir(), name))
+	if err != nil {
+		return "", err
+	}
+	id := ID(data)
+	if err := s.validateID(id); err != nil {
+		return "", fmt.Errorf("invalid target of image alias %q: %v", name, err)
+	}
+	return id, nil
+}
+
+// DeleteAlias removes the alias name.
+func (s *fs) DeleteAlias(name string) error {
+	if err := validateAlias(name); err != nil {
+		return err
+	}
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("deletealias", "", err)
+	}
+	defer s.Unlock()
+
+	return storeError("deletealias", "", os.Remove(filepath.Join(s.aliasesDir(), name)))
+}
+
+// WalkAliases calls f with every alias and the ID it points to, in lexical
+// order of the names. An error returned by f stops the walk.
+func (s *fs) WalkAliases(f func(name string, id ID) error) error {
+	s.RLock()
+	aliases, err := s.aliases()
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := f(name, aliases[name]); err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
+
+// DanglingAliases returns the names of the aliases pointing to content that
+// isn't stored anymore, in lexical order.
+func (s *fs) DanglingAliases() ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	aliases, err := s.aliases()
+	if err != nil {
+		return nil, err
+	}
+	var dangling []string
+	for name, id := range aliases {
+		if err := s.contentExists(id); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, storeError("danglingaliases", id, err)
+			}
+			dangling = append(dangling, name)
+		}
+	}
+	sort.Strings(dangling)
+	return dangling, nil
+}
+
+// aliases returns the IDs of all aliases keyed by name. It must be called
+// with the store lock held.
+func (s *fs) aliases() (map[string]ID, error) {
+	dir, err := ioutil.ReadDir(s.aliasesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	aliases := make(map[string]ID, len(dir))
+	for _, v := range dir {
+		if v.IsDir() || validateAlias(v.Name()) != nil {
+			continue
+		}
+		id, err := s.readAlias(v.Name())
+		if err != nil {
+			s.log.Debug("skipping invalid image alias", "name", v.Name(), "err", err)
+			continue
+		}
+		aliases[v.Name()] = id
+	}
+	return aliases, nil
+}
+
+// aliasTargets returns the set of IDs that aliases point to. It must be
+// called with the store lock held.
+func (s *fs) aliasTargets() (map[ID]bool, error) {
+	aliases, err := s.aliases()
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[ID]bool, len(aliases))
+	for _, id := range aliases {
+		targets[id] = true
+	}
+	return targets, nil
+}
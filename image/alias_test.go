@@ -0,0 +1,116 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestAliases(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id1, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetAlias("base", id1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAlias("latest", id1); err != nil {
+		t.Fatal(err)
+	}
+	// Setting an existing alias overwrites it.
+	if err := fs.SetAlias("latest", id2); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fs.ResolveAlias("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != id2 {
+		t.Fatalf("Expected latest to resolve to %v, got %v", id2, id)
+	}
+
+	walked := make(map[string]ID)
+	if err := fs.WalkAliases(func(name string, id ID) error {
+		walked[name] = id
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]ID{"base": id1, "latest": id2}; !reflect.DeepEqual(walked, expected) {
+		t.Fatalf("Expected aliases %v, got %v", expected, walked)
+	}
+
+	if err := fs.DeleteAlias("base"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ResolveAlias("base"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected deleted alias not to resolve, got %v", err)
+	}
+
+	for _, name := range []string{"", ".hidden", "a/b"} {
+		if err := fs.SetAlias(name, id1); err == nil {
+			t.Fatalf("Expected error for alias name %q", name)
+		}
+	}
+	missing, err := digest.FromBytes([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAlias("missing", ID(missing)); err == nil {
+		t.Fatal("Expected error aliasing content that isn't stored")
+	}
+}
+
+func TestAliasesProtectFromGC(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	aliased, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAlias("keep", aliased); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := fs.GarbageCollect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != orphan {
+		t.Fatalf("Expected only %v collected, got %v", orphan, deleted)
+	}
+
+	dangling, err := fs.DanglingAliases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dangling) != 0 {
+		t.Fatalf("Expected no dangling aliases, got %v", dangling)
+	}
+	if err := fs.Delete(aliased); err != nil {
+		t.Fatal(err)
+	}
+	dangling, err = fs.DanglingAliases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dangling) != 1 || dangling[0] != "keep" {
+		t.Fatalf("Expected dangling alias keep, got %v", dangling)
+	}
+}
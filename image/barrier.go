@@ -0,0 +1,61 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// markUnsynced records that the file at path was placed and must be synced,
+// along with its directory, by the next Barrier.
+func (s *fs) markUnsynced(path string) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if s.unsynced == nil {
+		s.unsynced = make(map[string]struct{})
+	}
+	s.unsynced[path] = struct{}{}
+}
+
+// Barrier makes the content and metadata stored since the last barrier
+// durable. Content isn't synced to stable storage as it is stored, for
+// throughput, so a crash may lose content that Set returned. Callers writing
+// data that references stored content, like the index of a batch import,
+// call Barrier before writing it so that it can't survive a crash that the
+// content doesn't.
+//
+// The content files are synced first, then the directories holding them.
+// Content deleted since it was stored is skipped.
+func (s *fs) Barrier() error {
+	// Writers place content with the write lock held, so the content they
+	// stored before the barrier is recorded once the lock is acquired.
+	s.RLock()
+	defer s.RUnlock()
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	files := make([]string, 0, len(s.unsynced))
+	dirs := make(map[string]struct{})
+	for path := range s.unsynced {
+		files = append(files, path)
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		if err := s.fsys.Sync(path); err != nil && !os.IsNotExist(err) {
+			return storeError("barrier", "", err)
+		}
+	}
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+	for _, dir := range sortedDirs {
+		if err := s.fsys.Sync(dir); err != nil && !os.IsNotExist(err) {
+			return storeError("barrier", "", err)
+		}
+	}
+	s.unsynced = nil
+	return nil
+}
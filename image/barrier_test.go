@@ -0,0 +1,89 @@
+package image
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// syncRecordingFS records the files and directories it syncs, in order.
+type syncRecordingFS struct {
+	osFileSystem
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *syncRecordingFS) Sync(name string) error {
+	f.mu.Lock()
+	f.events = append(f.events, name)
+	f.mu.Unlock()
+	return f.osFileSystem.Sync(name)
+}
+
+func (f *syncRecordingFS) record(event string) {
+	f.mu.Lock()
+	f.events = append(f.events, event)
+	f.mu.Unlock()
+}
+
+func TestFSBarrier(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	fsys := &syncRecordingFS{}
+	fs.fsys = fsys
+
+	var files []string
+	for _, data := range []string{"foo", "bar", "baz"} {
+		id, err := fs.Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fs.contentFile(id))
+	}
+	if len(fsys.events) != 0 {
+		t.Fatalf("Expected Set not to sync content, got %v", fsys.events)
+	}
+	deleted, err := fs.Set([]byte("deleted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Barrier(); err != nil {
+		t.Fatal(err)
+	}
+	// The caller writes its index once the barrier returns.
+	fsys.record("index")
+
+	synced := make(map[string]int)
+	for i, event := range fsys.events {
+		synced[event] = i
+	}
+	dir := filepath.Dir(files[0])
+	dirAt, ok := synced[dir]
+	if !ok {
+		t.Fatalf("Expected content directory %s to be synced, got %v", dir, fsys.events)
+	}
+	for _, file := range files {
+		at, ok := synced[file]
+		if !ok {
+			t.Fatalf("Expected %s to be synced, got %v", file, fsys.events)
+		}
+		if at > dirAt {
+			t.Fatalf("Expected %s to be synced before its directory, got %v", file, fsys.events)
+		}
+	}
+	if index := synced["index"]; index != len(fsys.events)-1 || index <= dirAt {
+		t.Fatalf("Expected the index to be written after the barrier, got %v", fsys.events)
+	}
+
+	fsys.events = nil
+	if err := fs.Barrier(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fsys.events) != 0 {
+		t.Fatalf("Expected no pending content after a barrier, got %v", fsys.events)
+	}
+}
@@ -0,0 +1,156 @@
+package image
+
+import (
+	"hash/fnv"
+	"os"
+)
+
+const (
+	// bloomHashes is the number of bits set per ID, optimal for the false
+	// positive rate of about 1% given by bloomBitsPerID.
+	bloomHashes    = 7
+	bloomBitsPerID = 10
+	// minBloomCapacity is the least number of IDs a filter is sized for.
+	minBloomCapacity = 1024
+)
+
+// bloomFilter is a set of IDs answering membership queries with false
+// positives but never false negatives. IDs can't be removed from it.
+type bloomFilter struct {
+	bits []uint64
+	// capacity is the number of IDs the filter is sized for, count the
+	// number of IDs added.
+	capacity int
+	count    int
+}
+
+// newBloomFilter returns an empty filter sized for twice n IDs, leaving room
+// for the content stored until it is rebuilt.
+func newBloomFilter(n int) *bloomFilter {
+	capacity := 2 * n
+	if capacity < minBloomCapacity {
+		capacity = minBloomCapacity
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, (capacity*bloomBitsPerID+63)/64),
+		capacity: capacity,
+	}
+}
+
+// positions returns the bits of id using double hashing.
+func (bf *bloomFilter) positions(id ID) [bloomHashes]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(len(bf.bits)) * 64
+
+	var pos [bloomHashes]uint64
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % m
+	}
+	return pos
+}
+
+func (bf *bloomFilter) add(id ID) {
+	for _, p := range bf.positions(id) {
+		bf.bits[p/64] |= 1 << (p % 64)
+	}
+	bf.count++
+}
+
+func (bf *bloomFilter) mayContain(id ID) bool {
+	for _, p := range bf.positions(id) {
+		if bf.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stale returns whether the filter should be rebuilt, because it holds more
+// IDs than it was sized for or because deletes, which it keeps answering
+// positively for, add up to a quarter of its IDs.
+func (bf *bloomFilter) stale(deletes int) bool {
+	return bf.count > bf.capacity || deletes > bf.count/4
+}
+
+// rebuildBloom builds the existence filter from the stored content. It must
+// be called with the store lock held. The filter lock is held while the
+// content is listed, so content placed meanwhile is added to the new filter.
+func (s *fs) rebuildBloom() error {
+	s.bloomMu.Lock()
+	defer s.bloomMu.Unlock()
+
+	ids, err := s.listIDs()
+	if err != nil {
+		return err
+	}
+	bf := newBloomFilter(len(ids))
+	for _, id := range ids {
+		bf.add(s.normalizeID(id))
+	}
+	s.bloom = bf
+	s.bloomDeletes = 0
+	return nil
+}
+
+// addToBloom records id as present in the existence filter.
+func (s *fs) addToBloom(id ID) {
+	s.bloomMu.Lock()
+	defer s.bloomMu.Unlock()
+	if s.bloom != nil {
+		s.bloom.add(s.normalizeID(id))
+	}
+}
+
+// countBloomDelete notes the delete of content still matched by the
+// existence filter.
+func (s *fs) countBloomDelete() {
+	s.bloomMu.Lock()
+	s.bloomDeletes++
+	s.bloomMu.Unlock()
+}
+
+// bloomMayContain returns false if id is definitely not stored, rebuilding
+// the existence filter first if it is missing or stale. It must be called
+// with the store lock held.
+func (s *fs) bloomMayContain(id ID) (bool, error) {
+	s.bloomMu.Lock()
+	bf, deletes := s.bloom, s.bloomDeletes
+	s.bloomMu.Unlock()
+	if bf == nil || bf.stale(deletes) {
+		if err := s.rebuildBloom(); err != nil {
+			return false, err
+		}
+	}
+
+	s.bloomMu.Lock()
+	defer s.bloomMu.Unlock()
+	return s.bloom.mayContain(s.normalizeID(id)), nil
+}
+
+// Exists returns whether content is stored under id. With
+// FSOptions.ExistsFilter most IDs that aren't stored are answered from
+// memory, the others are looked up on disk.
+func (s *fs) Exists(id ID) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.existsFilter {
+		ok, err := s.bloomMayContain(id)
+		if err != nil {
+			return false, storeError("exists", id, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if err := s.contentExists(id); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, storeError("exists", id, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,98 @@
+package image
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		bf.add(ID(fmt.Sprintf("present%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		if !bf.mayContain(ID(fmt.Sprintf("present%d", i))) {
+			t.Fatalf("Expected filter to contain present%d", i)
+		}
+	}
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain(ID(fmt.Sprintf("missing%d", i))) {
+			positives++
+		}
+	}
+	if positives > 200 {
+		t.Fatalf("Expected about 1%% false positives, got %d in 10000", positives)
+	}
+}
+
+func TestFSExistsFilter(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{InlineThreshold: 8})
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 20; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content of image %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	inlineID, err := fs.Set([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, inlineID)
+
+	fs, err = newFSStore(fs.root, FSOptions{InlineThreshold: 8, ExistsFilter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content of new image %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		if !fs.bloom.mayContain(id) {
+			t.Fatalf("Expected filter to contain %v", id)
+		}
+		ok, err := fs.Exists(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("Expected %v to exist", id)
+		}
+	}
+
+	missing := computeID(digest.Canonical, []byte("never stored"))
+	if ok, err := fs.Exists(missing); err != nil || ok {
+		t.Fatalf("Expected missing content not to exist, got %v, %v", ok, err)
+	}
+
+	for _, id := range ids[:12] {
+		if err := fs.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := fs.Exists(ids[0]); err != nil || ok {
+		t.Fatalf("Expected deleted content not to exist, got %v, %v", ok, err)
+	}
+	if fs.bloomDeletes != 0 {
+		t.Fatalf("Expected filter to be rebuilt after deletes, got %d deletes", fs.bloomDeletes)
+	}
+	if fs.bloom.mayContain(ids[0]) && fs.bloom.mayContain(ids[1]) && fs.bloom.mayContain(ids[2]) {
+		t.Fatal("Expected rebuilt filter to drop deleted content")
+	}
+	for _, id := range ids[12:] {
+		if ok, err := fs.Exists(id); err != nil || !ok {
+			t.Fatalf("Expected %v to exist after rebuild, got %v, %v", id, ok, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package image
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CacheStats reports the efficiency of a CachingBackend.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Bytes is the size of the cached content.
+	Bytes int64
+}
+
+// CachingBackend is a StoreBackend keeping recently read content in memory,
+// evicting the least recently used content past a byte budget.
+type CachingBackend struct {
+	inner    StoreBackend
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[ID]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	id   ID
+	data []byte
+}
+
+// NewCachingBackend returns a backend caching up to maxBytes of the content
+// read from inner.
+func NewCachingBackend(inner StoreBackend, maxBytes int64) *CachingBackend {
+	return &CachingBackend{
+		inner:    inner,
+		maxBytes: maxBytes,
+		entries:  make(map[ID]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Stats returns the hit and miss counts and cache size.
+func (cb *CachingBackend) Stats() CacheStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.stats
+}
+
+func (cb *CachingBackend) lookup(id ID) ([]byte, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	e, ok := cb.entries[id]
+	if !ok {
+		cb.stats.Misses++
+		return nil, false
+	}
+	cb.stats.Hits++
+	cb.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// add caches data unless it is already cached or larger than the budget.
+// Unless evict is set, it also refuses content not fitting in the free
+// part of the budget.
+func (cb *CachingBackend) add(id ID, data []byte, evict bool) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if _, ok := cb.entries[id]; ok {
+		return true
+	}
+	size := int64(len(data))
+	if size > cb.maxBytes || (!evict && cb.stats.Bytes+size > cb.maxBytes) {
+		return false
+	}
+	for cb.stats.Bytes+size > cb.maxBytes {
+		cb.remove(cb.lru.Back())
+	}
+	cb.entries[id] = cb.lru.PushFront(&cacheEntry{id: id, data: data})
+	cb.stats.Bytes += size
+	return true
+}
+
+func (cb *CachingBackend) remove(e *list.Element) {
+	entry := cb.lru.Remove(e).(*cacheEntry)
+	delete(cb.entries, entry.id)
+	cb.stats.Bytes -= int64(len(entry.data))
+}
+
+func (cb *CachingBackend) cached(id ID) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	_, ok := cb.entries[id]
+	return ok
+}
+
+// WarmError reports the IDs that Warm failed to load.
+type WarmError map[ID]error
+
+func (e WarmError) Error() string {
+	var msgs []string
+	for id, err := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", id, err))
+	}
+	sort.Strings(msgs)
+	return "failed to warm image cache: " + strings.Join(msgs, ", ")
+}
+
+// Warm loads and verifies the content of ids into the cache so later reads
+// are hits. Content already cached or not fitting in the free part of the
+// budget is skipped. Failing IDs don't stop the others from being loaded
+// and are reported in a WarmError.
+func (cb *CachingBackend) Warm(ids ...ID) error {
+	errs := make(WarmError)
+	for _, id := range ids {
+		if cb.cached(id) {
+			continue
+		}
+		data, err := cb.inner.Get(id)
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+		cb.add(id, data, false)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Metrics returns the cache statistics, see MetricsReporter.
+func (cb *CachingBackend) Metrics() map[string]float64 {
+	stats := cb.Stats()
+	return map[string]float64{
+		"cache_hits_total":   float64(stats.Hits),
+		"cache_misses_total": float64(stats.Misses),
+		"cache_bytes":        float64(stats.Bytes),
+	}
+}
+
+func (cb *CachingBackend) wrapped() []StoreBackend {
+	return []StoreBackend{cb.inner}
+}
+
+// Invalidate drops the cached content of ids, for instance after another
+// process changed them in the underlying store, see StartWatcher.
+func (cb *CachingBackend) Invalidate(ids ...ID) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for _, id := range ids {
+		if e, ok := cb.entries[id]; ok {
+			cb.remove(e)
+		}
+	}
+}
+
+// Walk calls the supplied callback for each image ID.
+func (cb *CachingBackend) Walk(f IDWalkFunc) error {
+	return cb.inner.Walk(f)
+}
+
+// Get returns the content stored under a given ID.
+func (cb *CachingBackend) Get(id ID) ([]byte, error) {
+	if data, ok := cb.lookup(id); ok {
+		return append([]byte(nil), data...), nil
+	}
+	data, err := cb.inner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	cb.add(id, append([]byte(nil), data...), true)
+	return data, nil
+}
+
+// Set stores content under a given ID.
+func (cb *CachingBackend) Set(data []byte) (ID, error) {
+	return cb.inner.Set(data)
+}
+
+// Delete removes content and metadata associated with the ID.
+func (cb *CachingBackend) Delete(id ID) error {
+	cb.mu.Lock()
+	if e, ok := cb.entries[id]; ok {
+		cb.remove(e)
+	}
+	cb.mu.Unlock()
+	return cb.inner.Delete(id)
+}
+
+// SetMetadata sets metadata for a given ID.
+func (cb *CachingBackend) SetMetadata(id ID, key string, data []byte) error {
+	return cb.inner.SetMetadata(id, key, data)
+}
+
+// GetMetadata returns metadata for a given ID.
+func (cb *CachingBackend) GetMetadata(id ID, key string) ([]byte, error) {
+	return cb.inner.GetMetadata(id, key)
+}
+
+// DeleteMetadata removes the metadata associated with an ID.
+func (cb *CachingBackend) DeleteMetadata(id ID, key string) error {
+	return cb.inner.DeleteMetadata(id, key)
+}
+
+func (cb *CachingBackend) setReservedMetadata(id ID, key string, data []byte) error {
+	return setBackendMetadata(cb.inner, id, key, data)
+}
+
+func (cb *CachingBackend) allMetadata(id ID) (map[string][]byte, error) {
+	return backendMetadata(cb.inner, id)
+}
@@ -0,0 +1,101 @@
+package image
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func newTestCachingBackend(t *testing.T, maxBytes int64) (*CachingBackend, func()) {
+	fs, cleanup := newTestFSStore(t)
+	return NewCachingBackend(fs, maxBytes), cleanup
+}
+
+func TestCachingGetSet(t *testing.T) {
+	cb, cleanup := newTestCachingBackend(t, 1024*1024)
+	defer cleanup()
+
+	testGetSet(t, cb)
+	testGetSet(t, cb)
+	if stats := cb.Stats(); stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("Expected cache hits and misses, got %+v", stats)
+	}
+}
+
+func TestCachingDelete(t *testing.T) {
+	cb, cleanup := newTestCachingBackend(t, 1024*1024)
+	defer cleanup()
+
+	testDelete(t, cb)
+}
+
+func TestCachingEviction(t *testing.T) {
+	cb, cleanup := newTestCachingBackend(t, 8)
+	defer cleanup()
+
+	id1, err := cb.Set([]byte("aaaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := cb.Set([]byte("bbbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []ID{id1, id2} {
+		if _, err := cb.Get(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cb.cached(id1) || !cb.cached(id2) {
+		t.Fatal("Expected least recently used content to be evicted")
+	}
+	if stats := cb.Stats(); stats.Bytes != 5 {
+		t.Fatalf("Expected 5 cached bytes, got %d", stats.Bytes)
+	}
+}
+
+func TestCachingWarm(t *testing.T) {
+	cb, cleanup := newTestCachingBackend(t, 10)
+	defer cleanup()
+
+	small, err := cb.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := cb.Set([]byte("foobarbazqux"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := digest.FromBytes([]byte("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cb.Warm(small, large, ID(missing))
+	werr, ok := err.(WarmError)
+	if !ok || len(werr) != 1 || werr[ID(missing)] == nil {
+		t.Fatalf("Expected warm error for missing ID only, got %v", err)
+	}
+	if !cb.cached(small) {
+		t.Fatal("Expected warmed content to be cached")
+	}
+	if cb.cached(large) {
+		t.Fatal("Expected oversized content to be skipped")
+	}
+
+	before := cb.Stats()
+	data, err := cb.Get(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("foo")) {
+		t.Fatalf("Expected data %q, got %q", "foo", data)
+	}
+	if after := cb.Stats(); after.Hits != before.Hits+1 {
+		t.Fatalf("Expected get of warmed content to hit, stats %+v", after)
+	}
+	if err := cb.Warm(small); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+const caseProbeFileName = ".case-probe"
+
+// detectCaseInsensitive checks whether the content directory is on a
+// case-insensitive filesystem and, if so, notifies onDetect.
+func (s *fs) detectCaseInsensitive(onDetect func(dir string)) error {
+	probe := filepath.Join(s.contentDir(), caseProbeFileName)
+	if err := ioutil.WriteFile(probe, nil, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(probe)
+
+	_, err := s.fsys.Stat(filepath.Join(s.contentDir(), strings.ToUpper(caseProbeFileName)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.caseInsensitive = err == nil
+	if s.caseInsensitive {
+		s.log.Warn("image store is on a case-insensitive filesystem, normalizing IDs to lowercase", "dir", s.contentDir())
+		if onDetect != nil {
+			onDetect(s.contentDir())
+		}
+	}
+	return nil
+}
+
+// normalizeID lowercases the hex part of id on case-insensitive filesystems.
+func (s *fs) normalizeID(id ID) ID {
+	if !s.caseInsensitive {
+		return id
+	}
+	dgst := digest.Digest(id)
+	if dgst.Validate() != nil {
+		return id
+	}
+	return ID(digest.NewDigestFromHex(string(dgst.Algorithm()), strings.ToLower(dgst.Hex())))
+}
@@ -0,0 +1,206 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+const (
+	// chunksDirName holds the chunks of the content stored with
+	// FSOptions.ChunkSize, shared by all the content of a namespace.
+	chunksDirName = "chunks"
+	// chunkManifestHeader starts the content file of chunked content, which
+	// lists the size of the content and the digests of its chunks.
+	chunkManifestHeader = "docker-image-chunks v1\n"
+)
+
+// chunkManifest describes content stored as a sequence of chunks.
+type chunkManifest struct {
+	size   int64
+	chunks []digest.Digest
+}
+
+func (m *chunkManifest) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(chunkManifestHeader)
+	fmt.Fprintf(&buf, "%d\n", m.size)
+	for _, dgst := range m.chunks {
+		fmt.Fprintf(&buf, "%s\n", dgst)
+	}
+	return buf.Bytes()
+}
+
+// parseChunkManifest returns the manifest encoded in data, or false if data
+// isn't a valid chunk manifest.
+func parseChunkManifest(data []byte) (*chunkManifest, bool) {
+	if !bytes.HasPrefix(data, []byte(chunkManifestHeader)) {
+		return nil, false
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data[len(chunkManifestHeader):]), "\n"), "\n")
+	size, err := strconv.ParseInt(lines[0], 10, 64)
+	if err != nil || size < 0 {
+		return nil, false
+	}
+	m := &chunkManifest{size: size}
+	for _, line := range lines[1:] {
+		dgst := digest.Digest(line)
+		if err := dgst.Validate(); err != nil {
+			return nil, false
+		}
+		m.chunks = append(m.chunks, dgst)
+	}
+	return m, true
+}
+
+func (s *fs) chunkFile(dgst digest.Digest) string {
+	return filepath.Join(s.root, chunksDirName, s.namespace, string(dgst.Algorithm()), dgst.Hex())
+}
+
+// writeChunks splits data into chunks of the configured size and stores the
+// ones not stored yet. It must be called with the store write lock held.
+func (s *fs) writeChunks(data []byte) (*chunkManifest, error) {
+	m := &chunkManifest{size: int64(len(data))}
+	for off := int64(0); off < int64(len(data)); off += s.chunkSize {
+		end := off + s.chunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		chunk := data[off:end]
+		dgst, err := digest.FromBytes(chunk)
+		if err != nil {
+			return nil, err
+		}
+		m.chunks = append(m.chunks, dgst)
+
+		filePath := s.chunkFile(dgst)
+		if _, err := os.Stat(filePath); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return nil, err
+		}
+		tempFilePath := filePath + ".tmp"
+		if err := ioutil.WriteFile(tempFilePath, chunk, 0600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tempFilePath, filePath); err != nil {
+			return nil, err
+		}
+		s.markUnsynced(filePath)
+	}
+	return m, nil
+}
+
+// readChunks reassembles the content described by m, verifying each chunk.
+func (s *fs) readChunks(m *chunkManifest) ([]byte, error) {
+	content := make([]byte, 0, m.size)
+	for _, dgst := range m.chunks {
+		chunk, err := s.readFile(s.chunkFile(dgst))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, ErrCorrupt
+			}
+			return nil, err
+		}
+		validated, err := digest.FromBytes(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if validated != dgst {
+			return nil, ErrCorrupt
+		}
+		content = append(content, chunk...)
+	}
+	if int64(len(content)) != m.size {
+		return nil, ErrCorrupt
+	}
+	return content, nil
+}
+
+// readChunkManifest returns the chunk manifest of id, or nil if its content
+// isn't chunked.
+func (s *fs) readChunkManifest(id ID) (*chunkManifest, error) {
+	if _, ok := s.inline[s.normalizeID(id)]; ok || s.packed() {
+		return nil, nil
+	}
+	f, err := s.openFile(s.contentFile(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(chunkManifestHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(header) != chunkManifestHeader {
+		return nil, nil
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := parseChunkManifest(append(header, rest...))
+	if !ok {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// contentSize returns the size of the content of id, which for chunked
+// content and deltas is the size of the reassembled content rather than the
+// manifest or the delta.
+func (s *fs) contentSize(id ID) (int64, error) {
+	_, size, err := s.statContent(id)
+	return size, err
+}
+
+// pruneChunks removes the chunks among candidates that aren't referenced by
+// the manifest of any stored content. Since it reads the manifests of all
+// stored content, the deletions of a batch collect their chunks to prune
+// them at once. It must be called with the store write lock held.
+func (s *fs) pruneChunks(candidates []digest.Digest) error {
+	if len(candidates) == 0 {
+		return nil
+	}
+	ids, err := s.listIDs()
+	if err != nil {
+		return err
+	}
+	referenced := make(map[digest.Digest]bool)
+	for _, id := range ids {
+		m, err := s.readChunkManifest(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if m == nil {
+			continue
+		}
+		for _, dgst := range m.chunks {
+			referenced[dgst] = true
+		}
+	}
+	for _, dgst := range candidates {
+		if referenced[dgst] {
+			continue
+		}
+		if err := os.Remove(s.chunkFile(dgst)); err != nil && !os.IsNotExist(err) {
+			s.log.Warn("failed to remove image chunk", "digest", dgst, "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestChunkedContent(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{ChunkSize: 4})
+	defer cleanup()
+
+	data1 := []byte("aaaabbbbccccdd")
+	data2 := []byte("aaaabbbbeeee")
+	id1, err := fs.Set(data1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.Set(data2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, data := range map[ID][]byte{id1: data1, id2: data2} {
+		content, err := fs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, data) {
+			t.Fatalf("Expected %q for %v, got %q", data, id, content)
+		}
+	}
+
+	// aaaa and bbbb are shared, so only eeee is added for the second blob.
+	chunks := countChunks(t, fs)
+	if chunks != 5 {
+		t.Fatalf("Expected 5 stored chunks, got %d", chunks)
+	}
+
+	if err := fs.Delete(id1); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, fs); chunks != 3 {
+		t.Fatalf("Expected 3 stored chunks after delete, got %d", chunks)
+	}
+	content, err := fs.Get(id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data2) {
+		t.Fatalf("Expected %q, got %q", data2, content)
+	}
+
+	dgst, err := fs.ProveRange(id2, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := digest.FromBytes([]byte("aabb")); dgst != expected {
+		t.Fatalf("Expected range digest %v, got %v", expected, dgst)
+	}
+}
+
+func TestChunkedContentCorrupt(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{ChunkSize: 4})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("aaaabbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fs.readChunkManifest(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fs.chunkFile(m.chunks[1]), []byte("cccc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Get(id); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+}
+
+func countChunks(t *testing.T, s *fs) int {
+	files, err := filepath.Glob(filepath.Join(s.root, chunksDirName, "sha256", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+// openCountingFS counts the files opened through it.
+type openCountingFS struct {
+	osFileSystem
+	opens int32
+}
+
+func (f *openCountingFS) Open(name string) (io.ReadCloser, error) {
+	atomic.AddInt32(&f.opens, 1)
+	return f.osFileSystem.Open(name)
+}
+
+func TestChunkedContentDeleteBatch(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{ChunkSize: 4})
+	defer cleanup()
+
+	// Every blob shares the chunk aaaa and has one of its own.
+	const n = 20
+	var ids []ID
+	for i := 0; i < n; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("aaaa%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if chunks := countChunks(t, fs); chunks != n+1 {
+		t.Fatalf("Expected %d stored chunks, got %d", n+1, chunks)
+	}
+
+	fsys := &openCountingFS{}
+	fs.fsys = fsys
+	deleted, errs := fs.DeleteMany(ids[1:]...)
+	if errs != nil || len(deleted) != n-1 {
+		t.Fatalf("Expected %d deleted blobs, got %v, %v", n-1, deleted, errs)
+	}
+	// Each deletion reads a couple of files of its blob, and pruning reads
+	// the manifest of the remaining one once for the whole batch rather
+	// than the manifests of all remaining blobs per deletion.
+	if opens := atomic.LoadInt32(&fsys.opens); opens > 3*n {
+		t.Fatalf("Expected the chunks of the batch to be pruned at once, got %d opens for %d deletions", opens, n-1)
+	}
+	if chunks := countChunks(t, fs); chunks != 2 {
+		t.Fatalf("Expected 2 stored chunks after delete, got %d", chunks)
+	}
+	if content, err := fs.Get(ids[0]); err != nil || string(content) != "aaaa0000" {
+		t.Fatalf("Expected remaining blob to be intact, got %q, %v", content, err)
+	}
+
+	if _, err := fs.GarbageCollect(nil); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, fs); chunks != 0 {
+		t.Fatalf("Expected no stored chunks after garbage collection, got %d", chunks)
+	}
+}
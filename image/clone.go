@@ -0,0 +1,102 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var errCloneXattrMetadata = errors.New("cloning is not supported with extended attribute metadata")
+
+// Clone copies the store into the new store root dstRoot and returns a
+// backend for the copy, opened with the options of the store. Changes to
+// either store don't affect the other.
+//
+// Content files are never modified in place, so the clone hard links them
+// where it can, sharing their space with the source until either store
+// deletes them; otherwise they are copied. Metadata is always copied. The
+// clone keeps its content and metadata under dstRoot even if the source
+// stores them elsewhere, see FSOptions.ContentDir. Cloning isn't supported
+// with metadata in extended attributes, since hard links would share the
+// attributes between the stores.
+func (s *fs) Clone(dstRoot string) (StoreBackend, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.metadataInContent {
+		return nil, storeError("clone", "", errCloneXattrMetadata)
+	}
+	if entries, err := ioutil.ReadDir(dstRoot); err == nil && len(entries) > 0 {
+		return nil, storeError("clone", "", fmt.Errorf("clone root %s is not empty", dstRoot))
+	}
+	if err := s.cloneTo(dstRoot); err != nil {
+		os.RemoveAll(dstRoot)
+		return nil, storeError("clone", "", err)
+	}
+
+	opts := s.opts
+	opts.ContentDir, opts.MetadataDir = "", ""
+	return newFSStore(dstRoot, opts)
+}
+
+func (s *fs) cloneTo(dstRoot string) error {
+	trees := []struct {
+		src, dst string
+		link     bool
+		layout   ContentLayout
+	}{
+		{s.contentDir(), filepath.Join(dstRoot, contentDirName, s.namespace), true, s.layout},
+		{filepath.Join(s.root, chunksDirName, s.namespace), filepath.Join(dstRoot, chunksDirName, s.namespace), true, nil},
+		{s.metadataBaseDir(), filepath.Join(dstRoot, metadataDirName, s.namespace), false, nil},
+		{filepath.Join(s.root, inlineDirName, s.namespace), filepath.Join(dstRoot, inlineDirName, s.namespace), false, nil},
+	}
+	for _, tree := range trees {
+		if err := os.MkdirAll(tree.dst, 0700); err != nil {
+			return err
+		}
+		var err error
+		if tree.layout != nil {
+			err = replicateLayout(tree.src, tree.dst, tree.layout, tree.link)
+		} else {
+			err = replicateAlgorithmDirs(tree.src, tree.dst, tree.link)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The files of the store root describing its layout and aliases, and
+	// the pack of a frozen store.
+	files := []string{
+		s.layoutVersionFile(),
+		s.metadataLayoutFile(),
+		filepath.Join(s.packDir(), packFileName),
+		filepath.Join(s.packDir(), packIndexName),
+		filepath.Join(s.packDir(), packManifestName),
+	}
+	aliases, err := ioutil.ReadDir(s.aliasesDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, v := range aliases {
+		if !v.IsDir() && validateAlias(v.Name()) == nil {
+			files = append(files, filepath.Join(s.aliasesDir(), v.Name()))
+		}
+	}
+	for _, src := range files {
+		rel, err := filepath.Rel(s.root, src)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstRoot, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := copyFile(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
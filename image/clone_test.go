@@ -0,0 +1,84 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	for _, opts := range []FSOptions{{}, {ContentLayout: flatLayout{}}} {
+		testClone(t, opts)
+	}
+}
+
+func testClone(t *testing.T, opts FSOptions) {
+	fs, cleanup := newTestFSStoreOptions(t, opts)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	dstRoot, err := ioutil.TempDir("", "images-fs-store-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstRoot)
+	clone, err := fs.Clone(dstRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clone.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("Expected cloned content foo, got %q", data)
+	}
+	if value, err := clone.GetMetadata(id, "key"); err != nil || string(value) != "value" {
+		t.Fatalf("Expected cloned metadata value, got %q, %v", value, err)
+	}
+
+	if err := clone.SetMetadata(id, "key", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := fs.GetMetadata(id, "key"); err != nil || string(value) != "value" {
+		t.Fatalf("Expected original metadata to be unchanged, got %q, %v", value, err)
+	}
+
+	if err := clone.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clone.Get(id); err == nil {
+		t.Fatal("Expected content to be deleted from the clone")
+	}
+	data, err = fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("Expected original content foo, got %q", data)
+	}
+
+	other, err := clone.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(other); err == nil {
+		t.Fatal("Expected content set in the clone to be missing from the original")
+	}
+
+	if _, err := fs.Clone(dstRoot); err == nil {
+		t.Fatal("Expected error cloning into a non-empty root")
+	}
+	if _, err := os.Stat(filepath.Join(dstRoot, contentDirName)); err != nil {
+		t.Fatalf("Expected failed clone to leave the existing root alone, got %v", err)
+	}
+}
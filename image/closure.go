@@ -0,0 +1,71 @@
+package image
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrReferenceCycle is returned by ExportClosure if the references of the
+// content form a cycle.
+var ErrReferenceCycle = errors.New("image content references form a cycle")
+
+// ExportClosure writes the content reachable from root, along with its
+// metadata, to w as a tar archive that Import can read. refs returns the IDs
+// that the content of id refers to, for instance the layers of an image
+// config. Every reachable ID must be stored; if the references lead back to
+// content already being visited, ExportClosure fails with ErrReferenceCycle
+// before anything is written.
+func (s *fs) ExportClosure(root ID, refs func(id ID) ([]ID, error), w io.Writer) error {
+	reachable, err := s.closure(root, refs)
+	if err != nil {
+		return err
+	}
+	_, err = s.export(w, func(id ID) bool { return reachable[id] }, "")
+	return err
+}
+
+// closure returns the set of IDs reachable from root through refs, checking
+// that each of them is stored.
+func (s *fs) closure(root ID, refs func(id ID) ([]ID, error)) (map[ID]bool, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[ID]int)
+	var visit func(id ID) error
+	visit = func(id ID) error {
+		switch state[id] {
+		case visiting:
+			return storeError("exportclosure", id, ErrReferenceCycle)
+		case visited:
+			return nil
+		}
+		if ok, err := s.Exists(id); err != nil {
+			return err
+		} else if !ok {
+			return storeError("exportclosure", id, os.ErrNotExist)
+		}
+		state[id] = visiting
+		children, err := refs(id)
+		if err != nil {
+			return storeError("exportclosure", id, err)
+		}
+		for _, child := range children {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	if err := visit(root); err != nil {
+		return nil, err
+	}
+
+	reachable := make(map[ID]bool, len(state))
+	for id := range state {
+		reachable[id] = true
+	}
+	return reachable, nil
+}
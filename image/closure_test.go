@@ -0,0 +1,77 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestExportClosure(t *testing.T) {
+	src, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	set := func(data string) ID {
+		id, err := src.Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	layer1, layer2, shared := set("layer1"), set("layer2"), set("shared")
+	config := set("config")
+	other := set("other config")
+	otherLayer := set("other layer")
+	if err := src.SetMetadata(config, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+	graph := map[ID][]ID{
+		config: {layer1, layer2},
+		layer1: {shared},
+		layer2: {shared},
+		other:  {otherLayer},
+	}
+	refs := func(id ID) ([]ID, error) { return graph[id], nil }
+
+	var buf bytes.Buffer
+	if err := src.ExportClosure(config, refs, &buf); err != nil {
+		t.Fatal(err)
+	}
+	dst, cleanup := newTestFSStore(t)
+	defer cleanup()
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dst.sortedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ID{config, layer1, layer2, shared}
+	sort.Sort(idSlice(want))
+	if len(got) != len(want) {
+		t.Fatalf("Expected closure %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected closure %v, got %v", want, got)
+		}
+	}
+	if value, err := dst.GetMetadata(config, "tkey"); err != nil || string(value) != "tval" {
+		t.Fatalf("Expected metadata %q, got %q, %v", "tval", value, err)
+	}
+
+	graph[shared] = []ID{config}
+	buf.Reset()
+	if err := src.ExportClosure(config, refs, &buf); !errors.Is(err, ErrReferenceCycle) {
+		t.Fatalf("Expected ErrReferenceCycle, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected nothing to be written on a cycle, got %d bytes", buf.Len())
+	}
+
+	graph[shared] = []ID{computeID(src.algorithm, []byte("missing"))}
+	if err := src.ExportClosure(config, refs, &buf); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected missing reference to fail with os.ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ContentLayout maps the IDs of a fs store to the paths of their content
+// files, relative to the content directory, to share the directory with
+// tools following other content-addressable storage conventions. Paths use
+// forward slashes. ID must be the inverse of Path, and return false for the
+// paths it doesn't map to an ID, which Walk then skips.
+//
+// The default layout stores the content of an ID in a directory per digest
+// algorithm, named after the hex of the digest.
+type ContentLayout interface {
+	Path(id ID) string
+	ID(path string) (ID, bool)
+}
+
+// contentLayoutFile returns the content file of id in the configured layout.
+func (s *fs) contentLayoutFile(id ID) string {
+	return filepath.Join(s.contentDir(), filepath.FromSlash(s.layout.Path(s.normalizeID(id))))
+}
+
+// contentFileID returns the ID whose content file is path.
+func (s *fs) contentFileID(path string) (ID, bool) {
+	var id ID
+	if s.layout != nil {
+		rel, err := filepath.Rel(s.contentDir(), path)
+		if err != nil {
+			return "", false
+		}
+		var ok bool
+		if id, ok = s.layout.ID(filepath.ToSlash(rel)); !ok {
+			return "", false
+		}
+	} else {
+		id = ID(digest.NewDigestFromHex(filepath.Base(filepath.Dir(path)), filepath.Base(path)))
+	}
+	return id, s.validateID(id) == nil
+}
+
+// layoutEntries classifies the files under the content directory using the
+// configured layout. It must be called with the store lock held.
+func (s *fs) layoutEntries() ([]Entry, error) {
+	var entries []Entry
+	dir := s.contentDir()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry := Entry{Kind: InvalidEntry, Path: path}
+		id, ok := s.layout.ID(filepath.ToSlash(rel))
+		switch {
+		case !ok:
+			entry.Reason = "not a path of the content layout"
+		case s.validateID(id) != nil:
+			entry.Reason = fmt.Sprintf("invalid digest: %v", s.validateID(id))
+		case !s.algorithmAllowed(digest.Digest(id).Algorithm()):
+			entry.Reason = ErrUnsupportedAlgorithm.Error()
+		default:
+			entry.Kind = ValidContent
+			entry.ID = id
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// listLayoutIDs returns the IDs of the content files in the configured
+// layout, skipping inline content. It must be called with the store lock
+// held.
+func (s *fs) listLayoutIDs() ([]ID, error) {
+	entries, err := s.layoutEntries()
+	if err != nil {
+		return nil, err
+	}
+	var ids []ID
+	for _, entry := range entries {
+		if entry.Kind != ValidContent {
+			s.log.Debug("skipping invalid image content entry", "path", entry.Path, "reason", entry.Reason)
+			continue
+		}
+		if _, ok := s.inline[entry.ID]; ok {
+			continue
+		}
+		ids = append(ids, entry.ID)
+	}
+	sort.Sort(idSlice(ids))
+	return ids, nil
+}
+
+// layoutDirs returns the directories under dir, relative to it, holding
+// files of layout, and the directory new content addressed with alg goes
+// to. dir is the content directory of a store in the layout.
+func layoutDirs(dir string, layout ContentLayout, alg digest.Algorithm) ([]string, error) {
+	sample := filepath.Dir(filepath.FromSlash(layout.Path(computeID(alg, nil))))
+	seen := map[string]bool{sample: true}
+	dirs := []string{sample}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := layout.ID(filepath.ToSlash(rel)); !ok {
+			return nil
+		}
+		if rel = filepath.Dir(rel); !seen[rel] {
+			seen[rel] = true
+			dirs = append(dirs, rel)
+		}
+		return nil
+	})
+	sort.Strings(dirs)
+	return dirs, err
+}
+
+// defaultLayoutDirs returns the names of the directories of the content
+// root holding files of the content layout of the default namespace, which
+// isn't in a directory of its own. It returns nil without a layout.
+func (s *fs) defaultLayoutDirs() (map[string]bool, error) {
+	if s.layout == nil {
+		return nil, nil
+	}
+	dirs, err := layoutDirs(s.contentRoot, s.layout, s.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	top := make(map[string]bool)
+	for _, d := range dirs {
+		top[strings.SplitN(filepath.ToSlash(d), "/", 2)[0]] = true
+	}
+	return top, nil
+}
+
+// replicateLayout recreates the files of layout under src at the same paths
+// under dst, hard linking them if link is set and linking works, and
+// copying them otherwise, like replicateAlgorithmDirs does for the default
+// layout.
+func replicateLayout(src, dst string, layout ContentLayout, link bool) error {
+	return walkLayout(src, dst, layout, func(path, target string) error {
+		if link {
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+		}
+		return copyFile(path, target)
+	})
+}
+
+// moveLayout renames the files of layout under src to the same paths under
+// dst, like moveAlgorithmDirs does for the default layout.
+func moveLayout(src, dst string, layout ContentLayout) error {
+	return walkLayout(src, dst, layout, os.Rename)
+}
+
+func walkLayout(src, dst string, layout ContentLayout, f func(path, target string) error) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := layout.ID(filepath.ToSlash(rel)); !ok {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		return f(path, target)
+	})
+}
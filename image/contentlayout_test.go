@@ -0,0 +1,74 @@
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+// flatLayout names content files after the full digest of their ID.
+type flatLayout struct{}
+
+func (flatLayout) Path(id ID) string {
+	return "blobs/" + string(id)
+}
+
+func (flatLayout) ID(path string) (ID, bool) {
+	if !strings.HasPrefix(path, "blobs/") {
+		return "", false
+	}
+	return ID(strings.TrimPrefix(path, "blobs/")), true
+}
+
+func TestFSContentLayout(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{ContentLayout: flatLayout{}})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.root, contentDirName, "blobs", string(id))); err != nil {
+		t.Fatalf("Expected content file in the layout, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.root, contentDirName, string(digest.Canonical), digest.Digest(id).Hex())); !os.IsNotExist(err) {
+		t.Fatalf("Expected no content file in the default layout, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fs.root, contentDirName, "blobs", "foreign"), []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = newFSStore(fs.root, FSOptions{ContentLayout: flatLayout{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("Expected content %q, got %q", "foo", data)
+	}
+	var walked []ID
+	if err := fs.Walk(func(id ID) error {
+		walked = append(walked, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || walked[0] != id {
+		t.Fatalf("Expected Walk to visit %v, got %v", id, walked)
+	}
+
+	if err := fs.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(id); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected deleted content to be missing, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package image
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Count returns the number of images in the store, the number of IDs Walk
+// visits. The pack index of a frozen store answers it directly; other stores
+// list their content like Walk.
+func (s *fs) Count() (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.packed() && s.allowedAlgorithms == nil {
+		return len(s.pack.ids), nil
+	}
+	ids, err := s.listIDs()
+	if err != nil {
+		return 0, storeError("count", "", err)
+	}
+	return len(ids), nil
+}
+
+// IsEmpty returns whether the store holds no images, that is whether Walk
+// would not visit any ID. It stops reading the content directories at the
+// first ID.
+func (s *fs) IsEmpty() (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.packed() || s.layout != nil {
+		ids, err := s.listIDs()
+		return len(ids) == 0, err
+	}
+	if len(s.inline) > 0 && s.algorithmAllowed(digest.Canonical) && s.idStrategy == nil {
+		return false, nil
+	}
+	algs, err := s.algorithmDirs(s.contentDir())
+	if err != nil {
+		return false, storeError("isempty", "", err)
+	}
+	for _, alg := range algs {
+		if !s.algorithmAllowed(digest.Algorithm(alg)) {
+			continue
+		}
+		found, err := s.hasAlgorithmID(alg)
+		if err != nil {
+			return false, storeError("isempty", "", err)
+		}
+		if found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// hasAlgorithmID returns whether the content directory of alg holds a valid
+// ID, reading it walkBatchSize entries at a time until it finds one.
+func (s *fs) hasAlgorithmID(alg string) (bool, error) {
+	dir, err := s.fsys.OpenDir(filepath.Join(s.contentDir(), alg))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer dir.Close()
+
+	batch := s.walkBatchSize
+	if batch <= 0 {
+		batch = defaultWalkBatchSize
+	}
+	for {
+		names, err := dir.Readdirnames(batch)
+		for _, name := range names {
+			if s.validateID(ID(digest.NewDigestFromHex(alg, name))) == nil {
+				return true, nil
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFSCount(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	walkCount := func() int {
+		n := 0
+		if err := fs.Walk(func(ID) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	check := func(expected int) {
+		count, err := fs.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected || count != walkCount() {
+			t.Fatalf("Expected count %d matching Walk, got %d", expected, count)
+		}
+		empty, err := fs.IsEmpty()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if empty != (expected == 0) {
+			t.Fatalf("Expected IsEmpty to be %v with %d images", expected == 0, expected)
+		}
+	}
+
+	check(0)
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(1)
+	var ids []ID
+	for i := 0; i < 5; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := fs.Set([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	check(6)
+	for i, id := range ids {
+		if err := fs.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		check(5 - i)
+	}
+	if err := fs.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	check(0)
+}
@@ -0,0 +1,356 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// ErrDeltaBase is returned when deleting content that stored deltas are
+// based on.
+var ErrDeltaBase = errors.New("content is the base of stored deltas")
+
+const (
+	// deltaHeader starts the content file of content stored as a delta,
+	// followed by the ID of the base content and the delta operations.
+	deltaHeader = "docker-image-delta v1\n"
+	// deltaDependentsKey is the metadata key listing the IDs of the deltas
+	// based on the content.
+	deltaDependentsKey = "delta-dependents"
+	// deltaBlockSize is the size of the base content blocks that deltas
+	// refer to.
+	deltaBlockSize = 64
+
+	deltaOpCopy   = 'C'
+	deltaOpInsert = 'I'
+)
+
+// encodeDelta returns the delta reconstructing data from the content of base.
+// Runs of data matching blocks of base are encoded as copies of base, the
+// rest is inserted literally.
+func encodeDelta(base ID, baseContent, data []byte) []byte {
+	blocks := make(map[string]int)
+	for off := 0; off+deltaBlockSize <= len(baseContent); off += deltaBlockSize {
+		block := string(baseContent[off : off+deltaBlockSize])
+		if _, ok := blocks[block]; !ok {
+			blocks[block] = off
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(deltaHeader)
+	buf.WriteString(base.String() + "\n")
+	varint := make([]byte, binary.MaxVarintLen64)
+	writeOp := func(op byte, args ...int) {
+		buf.WriteByte(op)
+		for _, arg := range args {
+			buf.Write(varint[:binary.PutUvarint(varint, uint64(arg))])
+		}
+	}
+
+	literal := 0
+	flush := func(end int) {
+		if end > literal {
+			writeOp(deltaOpInsert, end-literal)
+			buf.Write(data[literal:end])
+		}
+	}
+	for i := 0; i+deltaBlockSize <= len(data); {
+		off, ok := blocks[string(data[i:i+deltaBlockSize])]
+		if !ok {
+			i++
+			continue
+		}
+		n := deltaBlockSize
+		for off+n < len(baseContent) && i+n < len(data) && baseContent[off+n] == data[i+n] {
+			n++
+		}
+		flush(i)
+		writeOp(deltaOpCopy, off, n)
+		i += n
+		literal = i
+	}
+	flush(len(data))
+	return buf.Bytes()
+}
+
+// delta is content stored as a delta against base.
+type delta struct {
+	base ID
+	ops  []byte
+}
+
+// parseDelta returns the delta encoded in data, or false if data isn't a
+// delta.
+func parseDelta(data []byte) (*delta, bool) {
+	if !bytes.HasPrefix(data, []byte(deltaHeader)) {
+		return nil, false
+	}
+	rest := data[len(deltaHeader):]
+	i := bytes.IndexByte(rest, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	base := digest.Digest(rest[:i])
+	if base.Validate() != nil {
+		return nil, false
+	}
+	return &delta{base: ID(base), ops: rest[i+1:]}, true
+}
+
+// apply reconstructs the content of d from the content of its base.
+func (d *delta) apply(baseContent []byte) ([]byte, error) {
+	var content []byte
+	r := bytes.NewReader(d.ops)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case deltaOpCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || off+n > uint64(len(baseContent)) {
+				return nil, ErrCorrupt
+			}
+			content = append(content, baseContent[off:off+n]...)
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, ErrCorrupt
+			}
+			literal := make([]byte, n)
+			if _, err := io.ReadFull(r, literal); err != nil {
+				return nil, ErrCorrupt
+			}
+			content = append(content, literal...)
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+}
+
+// size returns the size of the content reconstructed by d.
+func (d *delta) size() (int64, error) {
+	var size uint64
+	r := bytes.NewReader(d.ops)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return int64(size), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case deltaOpCopy:
+			_, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil {
+				return 0, ErrCorrupt
+			}
+			size += n
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return 0, ErrCorrupt
+			}
+			r.Seek(int64(n), os.SEEK_CUR)
+			size += n
+		default:
+			return 0, ErrCorrupt
+		}
+	}
+}
+
+// deltaSize returns the size of the content of id if it is stored as a
+// delta, as recorded when it was stored or else from the delta, and -1
+// otherwise. It must be called with the store lock held.
+func (s *fs) deltaSize(id ID) (int64, error) {
+	base, err := s.readDeltaBase(id)
+	if err != nil || base == "" {
+		return -1, err
+	}
+	if size := s.recordedSize(id); size >= 0 {
+		return size, nil
+	}
+	data, err := s.readFile(s.contentFile(id))
+	if err != nil {
+		return 0, err
+	}
+	d, ok := parseDelta(data)
+	if !ok {
+		return 0, ErrCorrupt
+	}
+	return d.size()
+}
+
+// readDeltaBase returns the ID of the base of id, or "" if id isn't stored
+// as a delta.
+func (s *fs) readDeltaBase(id ID) (ID, error) {
+	if _, ok := s.inline[s.normalizeID(id)]; ok || s.packed() {
+		return "", nil
+	}
+	f, err := s.openFile(s.contentFile(id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	header := make([]byte, len(deltaHeader))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != deltaHeader {
+		return "", nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", nil
+	}
+	base := digest.Digest(strings.TrimSuffix(line, "\n"))
+	if base.Validate() != nil {
+		return "", nil
+	}
+	return ID(base), nil
+}
+
+// SetDelta stores data as a delta against the content of base, saving the
+// space of the parts they share, and returns the ID of data. Get applies the
+// delta transparently and verifies the result. If the delta isn't smaller
+// than data, data is stored as is. Deleting base fails with ErrDeltaBase
+// while deltas are based on it.
+func (s *fs) SetDelta(base ID, data []byte) (ID, error) {
+	if len(data) == 0 {
+		return s.Set(data)
+	}
+	id := s.computeID(data)
+
+	if err := s.lockMutation(context.Background()); err != nil {
+		return "", storeError("setdelta", "", err)
+	}
+	if err := s.checkWritable(); err != nil {
+		s.Unlock()
+		return "", storeError("setdelta", "", err)
+	}
+	baseContent, err := s.get(base)
+	if err != nil {
+		s.Unlock()
+		return "", storeError("setdelta", base, err)
+	}
+	encoded := encodeDelta(base, baseContent, data)
+	if id == s.normalizeID(base) || len(encoded) >= len(data) {
+		s.Unlock()
+		return s.Set(data)
+	}
+	defer s.Unlock()
+
+	if !s.algorithmAllowed(s.algorithm) {
+		return "", storeError("setdelta", id, ErrUnsupportedAlgorithm)
+	}
+	if _, err := s.get(id); err == nil {
+		return id, nil
+	}
+	tempFile, err := s.fsys.TempFile(s.tempDir(), "")
+	if err != nil {
+		return "", storeError("setdelta", id, err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(encoded)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", storeError("setdelta", id, err)
+	}
+	if err := s.addDeltaDependent(base, id); err != nil {
+		return "", storeError("setdelta", id, err)
+	}
+	if err := s.renameIntoPlace(tempFile.Name(), id); err != nil {
+		return "", storeError("setdelta", id, err)
+	}
+	s.recordStored(id, int64(len(data)), crc32.ChecksumIEEE(data), true)
+	return id, nil
+}
+
+// deltaDependents returns the IDs listed as deltas based on id. It must be
+// called with the store lock held.
+func (s *fs) deltaDependents(id ID) ([]ID, error) {
+	data, err := s.metadata.Get(id, deltaDependentsKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []ID
+	for _, line := range strings.Fields(string(data)) {
+		ids = append(ids, ID(line))
+	}
+	return ids, nil
+}
+
+func (s *fs) setDeltaDependents(id ID, ids []ID) error {
+	if len(ids) == 0 {
+		return s.metadata.Delete(id, deltaDependentsKey)
+	}
+	var buf bytes.Buffer
+	for _, dep := range ids {
+		buf.WriteString(dep.String() + "\n")
+	}
+	return s.metadata.Set(id, deltaDependentsKey, buf.Bytes())
+}
+
+// addDeltaDependent records dep as a delta based on id. It must be called
+// with the store write lock held.
+func (s *fs) addDeltaDependent(id, dep ID) error {
+	deps, err := s.deltaDependents(id)
+	if err != nil {
+		return err
+	}
+	for _, d := range deps {
+		if d == dep {
+			return nil
+		}
+	}
+	return s.setDeltaDependents(id, append(deps, dep))
+}
+
+// checkDeltaDependents returns ErrDeltaBase if stored deltas are based on
+// id, dropping the recorded dependents that aren't. It must be called with
+// the store write lock held.
+func (s *fs) checkDeltaDependents(id ID) error {
+	deps, err := s.deltaDependents(id)
+	if err != nil || len(deps) == 0 {
+		return err
+	}
+	var live []ID
+	for _, dep := range deps {
+		base, err := s.readDeltaBase(dep)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if base == s.normalizeID(id) {
+			live = append(live, dep)
+		}
+	}
+	if len(live) != len(deps) {
+		if err := s.setDeltaDependents(id, live); err != nil {
+			return err
+		}
+	}
+	if len(live) > 0 {
+		return ErrDeltaBase
+	}
+	return nil
+}
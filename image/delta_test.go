@@ -0,0 +1,188 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestSetDelta(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var base bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&base, "layer entry %04d\n", i)
+	}
+	baseID, err := fs.Set(base.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte("prefix\n"), base.Bytes()...)
+	data = append(data[:2000], append([]byte("changed"), data[2000:]...)...)
+
+	id, err := fs.SetDelta(baseID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(fs.contentFile(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) >= len(data)/4 {
+		t.Fatalf("Expected delta much smaller than %d bytes, got %d", len(data), len(stored))
+	}
+	got, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Expected delta content to be reconstructed byte for byte")
+	}
+
+	if err := fs.Delete(baseID); !errors.Is(err, ErrDeltaBase) {
+		t.Fatalf("Expected ErrDeltaBase deleting the base, got %v", err)
+	}
+	if _, err := fs.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := fs.ListMetadata(baseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Expected no visible metadata on the base, got %v", keys)
+	}
+
+	if err := fs.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(baseID); err != nil {
+		t.Fatalf("Expected base deletion after its delta is gone, got %v", err)
+	}
+}
+
+func TestSetDeltaCorruptBase(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	base := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	baseID, err := fs.Set(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(append([]byte{}, base...), "tail"...)
+	id, err := fs.SetDelta(baseID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corruptContent(t, fs, baseID)
+	if _, err := fs.Get(id); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt with a corrupt base, got %v", err)
+	}
+}
+
+func TestSetDeltaNotSmaller(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	baseID, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("unrelated content")
+	id, err := fs.SetDelta(baseID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(fs.contentFile(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("Expected content to be stored as is when the delta isn't smaller")
+	}
+	if err := fs.Delete(baseID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetDeltaRecorded(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{WeakChecksums: true})
+	defer cleanup()
+
+	base := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	baseID, err := fs.Set(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(append([]byte{}, base...), "tail"...)
+	fakeFS := &tornWriteFS{tear: true}
+	fs.fsys = fakeFS
+	if _, err := fs.SetDelta(baseID, data); err == nil {
+		t.Fatal("Expected interrupted write of the delta to fail")
+	}
+
+	fakeFS.tear = false
+	id, err := fs.SetDelta(baseID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := fs.ExistsWeak(crc32.ChecksumIEEE(data), int64(len(data))); err != nil || len(ids) != 1 || ids[0] != id {
+		t.Fatalf("Expected weak checksum candidates [%v], got %v, %v", id, ids, err)
+	}
+	if size := fs.recordedSize(id); size != int64(len(data)) {
+		t.Fatalf("Expected recorded size %d, got %d", len(data), size)
+	}
+}
+
+func TestSetDeltaSize(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	base := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	baseID, err := fs.Set(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(append([]byte{}, base...), "tail"...)
+	id, err := fs.SetDelta(baseID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The size is decoded from the delta without a recorded size.
+	for _, recorded := range []bool{true, false} {
+		if !recorded {
+			if err := fs.metadata.Delete(id, sizeKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stat, err := fs.Stat(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size != int64(len(data)) {
+			t.Fatalf("Expected size %d with recorded size %v, got %d", len(data), recorded, stat.Size)
+		}
+	}
+
+	off, n := int64(len(base)-4), int64(8)
+	proof, err := fs.ProveRange(id, off, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := digest.FromBytes(data[off : off+n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof != expected {
+		t.Fatalf("Expected proof %v of the content, got %v", expected, proof)
+	}
+}
@@ -0,0 +1,54 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// volatileMetadataKeys are the metadata keys whose values change without
+// the stored content changing.
+var volatileMetadataKeys = map[string]bool{
+	lastUsedKey:   true,
+	hitsKey:       true,
+	provenanceKey: true,
+}
+
+// DumpCanonical writes a stable text listing of the store to w: the sorted
+// IDs with their sizes, each followed by its sorted metadata keys and
+// values. Two stores with the same content and metadata produce identical
+// dumps, which makes them suitable for golden files. Volatile metadata such
+// as last use times is only included if includeVolatile is set.
+func (s *fs) DumpCanonical(w io.Writer, includeVolatile bool) error {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, id := range ids {
+		content, err := s.Get(id)
+		if err != nil {
+			return err
+		}
+		md, err := s.allMetadata(id)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(md))
+		for key := range md {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(bw, "%s size=%d\n", id, len(content))
+		for _, key := range keys {
+			if volatileMetadataKeys[key] && !includeVolatile {
+				continue
+			}
+			fmt.Fprintf(bw, "\t%s=%q\n", key, md[key])
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,59 @@
+package image
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpCanonical(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	fs.trackLastUsed = true
+
+	for _, data := range []string{"foo", "bar", "baz"} {
+		id, err := fs.Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"zkey", "akey", "mkey"} {
+			if err := fs.SetMetadata(id, key, []byte(key+"-"+data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := fs.Get(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dump1, dump2 bytes.Buffer
+	if err := fs.DumpCanonical(&dump1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DumpCanonical(&dump2, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dump1.Bytes(), dump2.Bytes()) {
+		t.Fatalf("Expected identical dumps, got\n%s\nand\n%s", dump1.String(), dump2.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(dump1.String()), "\n")
+	// Each ID is followed by its keys and the schema version.
+	if len(lines) != 15 {
+		t.Fatalf("Expected 15 dump lines, got %d:\n%s", len(lines), dump1.String())
+	}
+	if !strings.HasPrefix(lines[1], "\takey=") || !strings.HasPrefix(lines[3], "\t"+schemaVersionKey+"=") || !strings.HasPrefix(lines[4], "\tzkey=") {
+		t.Fatalf("Expected sorted metadata keys, got\n%s", dump1.String())
+	}
+	if strings.Contains(dump1.String(), lastUsedKey) {
+		t.Fatal("Expected volatile metadata to be left out")
+	}
+
+	var volatile bytes.Buffer
+	if err := fs.DumpCanonical(&volatile, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(volatile.String(), lastUsedKey) {
+		t.Fatal("Expected volatile metadata when requested")
+	}
+}
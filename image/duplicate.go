@@ -0,0 +1,51 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ErrDigestCollision is returned by Set with FSOptions.VerifyOnDuplicate when
+// the content stored under the ID of the data differs from it although it
+// matches the ID, which is an actual collision of the digest or of the IDs
+// of an IDStrategy.
+var ErrDigestCollision = errors.New("stored content differs from data with the same digest")
+
+// checkDuplicate compares data with the content already stored under id, if
+// any, and returns ErrDigestCollision if they differ. Stored content that
+// doesn't match its ID is corrupt rather than colliding, and is left for
+// data to replace. It must be called with the store write lock held.
+func (s *fs) checkDuplicate(id ID, data []byte) error {
+	if err := s.contentExists(id); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	existing, err := s.get(id)
+	if err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			s.log.Warn("replacing corrupt image content", "id", id)
+			return nil
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Equal(existing, data) {
+		return ErrDigestCollision
+	}
+	return nil
+}
+
+// duplicateID returns the ID that setMulti computes for data with alg.
+func (s *fs) duplicateID(alg digest.Algorithm, data []byte) ID {
+	if s.idStrategy != nil {
+		return s.idStrategy.Compute(data)
+	}
+	return computeID(alg, data)
+}
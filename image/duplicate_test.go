@@ -0,0 +1,116 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+// lengthStrategy identifies content by its length, so that content of the
+// same length collides.
+type lengthStrategy struct{}
+
+var lengthIDPattern = regexp.MustCompile(`^len:[0-9]{8}$`)
+
+func (lengthStrategy) Algorithm() digest.Algorithm {
+	return "len"
+}
+
+func (lengthStrategy) Compute(data []byte) ID {
+	return ID(fmt.Sprintf("len:%08d", len(data)))
+}
+
+func (lengthStrategy) Validate(id ID) error {
+	if !lengthIDPattern.MatchString(string(id)) {
+		return fmt.Errorf("invalid length ID %q", id)
+	}
+	return nil
+}
+
+func TestFSVerifyOnDuplicate(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{VerifyOnDuplicate: true})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup, err := fs.Set([]byte("foo")); err != nil || dup != id {
+		t.Fatalf("Expected duplicate Set to return %v, got %v, %v", id, dup, err)
+	}
+
+	// Corrupt content doesn't match its ID, and is replaced.
+	corruptContent(t, fs, id)
+	if dup, err := fs.Set([]byte("foo")); err != nil || dup != id {
+		t.Fatalf("Expected Set to replace corrupt content of %v, got %v, %v", id, dup, err)
+	}
+	if content, err := fs.Get(id); err != nil || string(content) != "foo" {
+		t.Fatalf("Expected content to be replaced, got %q, %v", content, err)
+	}
+}
+
+func TestFSVerifyOnDuplicateCollision(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{IDStrategy: lengthStrategy{}, VerifyOnDuplicate: true})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Set([]byte("bar")); !errors.Is(err, ErrDigestCollision) {
+		t.Fatalf("Expected ErrDigestCollision, got %v", err)
+	}
+	if content, err := fs.Get(id); err != nil || string(content) != "foo" {
+		t.Fatalf("Expected the stored content to be left alone, got %q, %v", content, err)
+	}
+
+	// Without the option the content is replaced.
+	fs.verifyOnDuplicate = false
+	if _, err := fs.Set([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := fs.Get(id); err != nil || string(content) != "bar" {
+		t.Fatalf("Expected content to be replaced, got %q, %v", content, err)
+	}
+}
+
+func TestTieredReadRepairVerifyOnDuplicate(t *testing.T) {
+	primary, cleanup := newTestFSStoreOptions(t, FSOptions{Namespace: "primary", VerifyOnDuplicate: true})
+	defer cleanup()
+	fallback, err := newFSStore(primary.root, FSOptions{Namespace: "fallback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repaired []ID
+	tb := NewTieredBackend(primary, fallback, func(id ID, cause error) {
+		repaired = append(repaired, id)
+	})
+
+	data := []byte("foobar")
+	id, err := primary.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fallback.Set(data); err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, primary, id)
+
+	content, err := tb.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected data %q, got %q", data, content)
+	}
+	if len(repaired) != 1 || repaired[0] != id {
+		t.Fatalf("Expected repair of %v to be observed, got %v", id, repaired)
+	}
+	if content, err := primary.Get(id); err != nil || !bytes.Equal(content, data) {
+		t.Fatalf("Expected primary to be repaired, got %q, %v", content, err)
+	}
+}
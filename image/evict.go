@@ -0,0 +1,151 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ErrInsufficientSpace is returned when content can't be stored for lack of
+// space, even after evicting the content that can be.
+var ErrInsufficientSpace = errors.New("insufficient space for image content")
+
+// isNoSpaceError returns true if err reports a full filesystem.
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// EvictionPolicy chooses the content evicted when the store runs out of
+// space, see FSOptions.EvictOnNoSpace.
+type EvictionPolicy interface {
+	// Victims returns the IDs of candidates to evict to free size bytes,
+	// in the order to evict them. Held, pinned, aliased and referenced
+	// content isn't among the candidates. Eviction stops once size bytes
+	// are freed, and IDs that aren't candidates are ignored.
+	Victims(candidates []ContentInfo, size int64) []ID
+}
+
+// LRUEvictionPolicy evicts the least recently used content first, in
+// lexical ID order for content last used at the same time. It is the
+// default policy.
+type LRUEvictionPolicy struct{}
+
+// Victims returns the IDs of candidates, least recently used first.
+func (LRUEvictionPolicy) Victims(candidates []ContentInfo, size int64) []ID {
+	sorted := append([]ContentInfo(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].LastUsed.Equal(sorted[j].LastUsed) {
+			return sorted[i].LastUsed.Before(sorted[j].LastUsed)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	victims := make([]ID, len(sorted))
+	for i, c := range sorted {
+		victims[i] = c.ID
+	}
+	return victims
+}
+
+// evict deletes unprotected content in the order of the eviction policy
+// until at least size bytes are freed. Held, pinned, aliased and referenced
+// content is protected. If the victims of the policy are smaller than size,
+// nothing is deleted and ErrInsufficientSpace is returned. It must be called
+// with the store write lock held.
+func (s *fs) evict(size int64) error {
+	ids, err := s.listIDs()
+	if err != nil {
+		return err
+	}
+	stored := make(map[ID]bool, len(ids))
+	for _, id := range ids {
+		stored[id] = true
+	}
+	referenced, err := s.aliasTargets()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.addReferences(referenced, stored, id); err != nil {
+			return err
+		}
+	}
+
+	candidates := make(map[ID]ContentInfo)
+	var infos []ContentInfo
+	for _, id := range ids {
+		if referenced[id] || s.isHeld(id) || s.isPinned(id) {
+			continue
+		}
+		deps, err := s.deltaDependents(id)
+		if err != nil {
+			return err
+		}
+		if len(deps) > 0 {
+			continue
+		}
+		size, err := s.contentSize(id)
+		if err != nil {
+			return err
+		}
+		s.lastUsedMu.Lock()
+		last, ok := s.lastUsed[id]
+		s.lastUsedMu.Unlock()
+		if !ok {
+			if last, err = s.persistedLastUsed(id); err != nil {
+				return err
+			}
+		}
+		path := s.contentFile(id)
+		if _, ok := s.inline[s.normalizeID(id)]; ok {
+			path = s.inlineIndexFile()
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		info := ContentInfo{ID: id, Size: size, Created: fi.ModTime(), LastUsed: last}
+		candidates[id] = info
+		infos = append(infos, info)
+	}
+
+	policy := s.evictionPolicy
+	if policy == nil {
+		policy = LRUEvictionPolicy{}
+	}
+	var (
+		victims []ContentInfo
+		freed   int64
+	)
+	for _, id := range policy.Victims(infos, size) {
+		if freed >= size {
+			break
+		}
+		info, ok := candidates[id]
+		if !ok {
+			continue
+		}
+		delete(candidates, id)
+		victims = append(victims, info)
+		freed += info.Size
+	}
+	if freed < size {
+		return ErrInsufficientSpace
+	}
+
+	var chunks []digest.Digest
+	for _, v := range victims {
+		deletedChunks, err := s.deleteContent(v.ID)
+		if err != nil && !os.IsNotExist(err) {
+			if perr := s.pruneChunks(chunks); perr != nil {
+				s.log.Warn("failed to prune image chunks", "err", perr)
+			}
+			return err
+		}
+		chunks = append(chunks, deletedChunks...)
+		s.log.Info("evicted image content", "id", v.ID, "size", v.Size)
+	}
+	return s.pruneChunks(chunks)
+}
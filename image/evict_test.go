@@ -0,0 +1,181 @@
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fullFS reports ENOSPC for writes of content, to temporary files in
+// tempDir, that would grow the content directory past capacity.
+type fullFS struct {
+	osFileSystem
+	dir      string
+	tempDir  string
+	capacity int64
+}
+
+func (f fullFS) TempFile(dir, prefix string) (tempFile, error) {
+	file, err := f.osFileSystem.TempFile(dir, prefix)
+	if err != nil || dir != f.tempDir {
+		return file, err
+	}
+	return &fullTempFile{tempFile: file, fs: f}, nil
+}
+
+func (f fullFS) used() int64 {
+	var used int64
+	filepath.Walk(f.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			used += info.Size()
+		}
+		return nil
+	})
+	return used
+}
+
+type fullTempFile struct {
+	tempFile
+	fs      fullFS
+	written int64
+}
+
+func (f *fullTempFile) Write(p []byte) (int, error) {
+	if f.fs.used()+f.written+int64(len(p)) > f.fs.capacity {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+	}
+	f.written += int64(len(p))
+	return f.tempFile.Write(p)
+}
+
+func TestEvictOnNoSpace(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{EvictOnNoSpace: true})
+	defer cleanup()
+	fs.fsys = fullFS{dir: fs.contentDir(), tempDir: fs.tempDir(), capacity: 10}
+
+	oldID, err := fs.Set([]byte("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recentID, err := fs.Set([]byte("bbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(fs.contentFile(oldID), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := fs.Set([]byte("cccc"))
+	if err != nil {
+		t.Fatalf("Expected Set to succeed after eviction, got %v", err)
+	}
+	if _, err := fs.Get(oldID); err == nil {
+		t.Fatalf("Expected least recently used %v to be evicted", oldID)
+	}
+	for _, kept := range []ID{recentID, id} {
+		if _, err := fs.Get(kept); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.Pin(recentID); err != nil {
+		t.Fatal(err)
+	}
+	release := fs.Hold(id)
+	defer release()
+	if _, err := fs.Set([]byte("dddddd")); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Expected ErrInsufficientSpace, got %v", err)
+	}
+	for _, kept := range []ID{recentID, id} {
+		if _, err := fs.Get(kept); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leftover, err := ioutil.ReadDir(fs.tempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftover) != 0 {
+		t.Fatalf("Expected temporary files to be removed, found %d", len(leftover))
+	}
+}
+
+func TestNoSpaceWithoutEviction(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	fs.fsys = fullFS{dir: fs.contentDir(), tempDir: fs.tempDir(), capacity: 4}
+
+	if _, err := fs.Set([]byte("aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Set([]byte("bbbb")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC without eviction, got %v", err)
+	}
+}
+
+// largestFirstPolicy evicts the largest content first.
+type largestFirstPolicy struct {
+	candidates []ContentInfo
+}
+
+func (p *largestFirstPolicy) Victims(candidates []ContentInfo, size int64) []ID {
+	p.candidates = candidates
+	sorted := append([]ContentInfo(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+	var victims []ID
+	for _, c := range sorted {
+		victims = append(victims, c.ID)
+	}
+	return victims
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	policy := &largestFirstPolicy{}
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{EvictOnNoSpace: true, EvictionPolicy: policy})
+	defer cleanup()
+	fs.fsys = fullFS{dir: fs.contentDir(), tempDir: fs.tempDir(), capacity: 16}
+
+	smallID, err := fs.Set([]byte("aa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeID, err := fs.Set([]byte("bbbbbbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinnedID, err := fs.Set([]byte("cccccc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Pin(pinnedID); err != nil {
+		t.Fatal(err)
+	}
+	// The least recently used content is the small one, which LRU would
+	// evict first.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(fs.contentFile(smallID), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := fs.Set([]byte("dddd"))
+	if err != nil {
+		t.Fatalf("Expected Set to succeed after eviction, got %v", err)
+	}
+	if len(policy.candidates) != 2 {
+		t.Fatalf("Expected the pinned content not to be a candidate, got %v", policy.candidates)
+	}
+	if _, err := fs.Get(largeID); err == nil {
+		t.Fatalf("Expected largest %v to be evicted", largeID)
+	}
+	for _, kept := range []ID{smallID, pinnedID, id} {
+		if _, err := fs.Get(kept); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// exportIDMapName is the archive entry listing, for an export re-digested
+// with ExportAs, the ID of every blob in the store followed by its ID in the
+// archive, one pair per line.
+const exportIDMapName = "id-map"
+
+// Export writes all content and metadata of the store to w as a tar
+// archive that Import can read.
+func (s *fs) Export(w io.Writer) error {
+	_, err := s.ExportFiltered(w, nil)
+	return err
+}
+
+// ExportFiltered writes the content for which filter returns true, along
+// with its metadata, to w as a tar archive that Import can read. A nil
+// filter exports everything. It returns the IDs of stored content that
+// exported metadata refers to but that was filtered out, to tell the
+// caller that the archive is partial.
+func (s *fs) ExportFiltered(w io.Writer, filter func(id ID) bool) (excluded []ID, err error) {
+	return s.export(w, filter, "")
+}
+
+// ExportAs writes all content and metadata of the store to w like Export,
+// but addressed with the digest algorithm alg: every blob is hashed again
+// while it is exported and recorded in the archive under its ID in alg. The
+// archive maps the IDs in the store to the exported ones. The store itself
+// isn't modified.
+func (s *fs) ExportAs(w io.Writer, alg digest.Algorithm) error {
+	if !alg.Available() {
+		return fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	_, err := s.export(w, nil, alg)
+	return err
+}
+
+// export writes the content for which filter returns true to w, addressed
+// with alg unless it is empty.
+func (s *fs) export(w io.Writer, filter func(id ID) bool, alg digest.Algorithm) (excluded []ID, err error) {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+	included := make(map[ID]bool, len(ids))
+	for _, id := range ids {
+		included[id] = filter == nil || filter(id)
+	}
+
+	tw := tar.NewWriter(w)
+	reported := make(map[ID]struct{})
+	var idMap bytes.Buffer
+	for _, id := range ids {
+		if !included[id] {
+			continue
+		}
+		exportedID, refs, err := s.exportContent(tw, id, alg)
+		if err != nil {
+			return nil, err
+		}
+		if alg != "" {
+			fmt.Fprintf(&idMap, "%s %s\n", id, exportedID)
+		}
+		for _, ref := range refs {
+			exported, known := included[ref]
+			if _, ok := reported[ref]; ok || !known || exported {
+				continue
+			}
+			reported[ref] = struct{}{}
+			excluded = append(excluded, ref)
+		}
+	}
+	if alg != "" {
+		if err := writeTarFile(tw, exportIDMapName, idMap.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return excluded, nil
+}
+
+// exportContent writes the content and metadata of id to tw, addressed with
+// alg unless it is empty, and returns the ID it was written under and the
+// IDs that its metadata refers to.
+func (s *fs) exportContent(tw *tar.Writer, id ID, alg digest.Algorithm) (ID, []ID, error) {
+	content, err := s.Get(id)
+	if err != nil {
+		return "", nil, err
+	}
+	exportedID := id
+	if alg != "" {
+		exportedID = computeID(alg, content)
+	}
+	dgst := digest.Digest(exportedID)
+	if err := writeTarFile(tw, path.Join(contentDirName, string(dgst.Algorithm()), dgst.Hex()), content); err != nil {
+		return "", nil, err
+	}
+
+	md, err := s.allMetadata(id)
+	if err != nil {
+		return "", nil, err
+	}
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var refs []ID
+	for _, key := range keys {
+		data := md[key]
+		if err := writeTarFile(tw, path.Join(metadataDirName, string(dgst.Algorithm()), dgst.Hex(), key), data); err != nil {
+			return "", nil, err
+		}
+		if ref := digest.Digest(data); ref.Validate() == nil {
+			refs = append(refs, ID(ref))
+		}
+	}
+	return exportedID, refs, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Import reads a tar archive written by Export or ExportAs and stores its
+// content and metadata under the IDs recorded in the archive, whatever their
+// digest algorithm. Content whose data doesn't match its recorded ID is
+// rejected.
+func (s *fs) Import(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := s.importEntry(hdr.Name, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fs) importEntry(name string, data []byte) error {
+	parts := strings.Split(path.Clean(name), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == exportIDMapName:
+		// The ID mapping is informational for the consumers of the archive.
+	case len(parts) == 3 && parts[0] == contentDirName:
+		expected := digest.NewDigestFromHex(parts[1], parts[2])
+		if err := expected.Validate(); err != nil {
+			return fmt.Errorf("invalid image content entry %s: %v", name, err)
+		}
+		// Content is checked before it is stored, as the data of a corrupt
+		// entry may be the content of another ID already in the store.
+		if computeID(expected.Algorithm(), data) != ID(expected) {
+			return storeError("import", ID(expected), ErrCorrupt)
+		}
+		if _, err := s.setEvicting(context.Background(), int64(len(data)), func() (ID, error) {
+			id, _, err := s.setMulti(expected.Algorithm(), data)
+			return id, err
+		}); err != nil {
+			return err
+		}
+	case len(parts) == 4 && parts[0] == metadataDirName:
+		id := ID(digest.NewDigestFromHex(parts[1], parts[2]))
+		if err := digest.Digest(id).Validate(); err != nil {
+			return fmt.Errorf("invalid image metadata entry %s: %v", name, err)
+		}
+		if err := validateMetadataKey(parts[3]); err != nil {
+			return fmt.Errorf("invalid image metadata entry %s: %v", name, err)
+		}
+		if storageMetadataKeys[parts[3]] {
+			// Recorded when the content was imported.
+			return nil
+		}
+		return s.setReservedMetadata(id, parts[3], data)
+	default:
+		return fmt.Errorf("unexpected image store archive entry %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestExportImport(t *testing.T) {
+	src, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := src.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetMetadata(id, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Pin(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Set([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, cleanup := newTestFSStore(t)
+	defer cleanup()
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	srcDigest, err := src.StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstDigest, err := dst.StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcDigest != dstDigest {
+		t.Fatalf("Expected imported store to match, got %v and %v", srcDigest, dstDigest)
+	}
+	value, err := dst.GetMetadata(id, "tkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("tval")) {
+		t.Fatalf("Expected metadata %q, got %q", "tval", value)
+	}
+	if !dst.isPinned(id) {
+		t.Fatal("Expected the pin to be imported")
+	}
+}
+
+func TestImportCorruptEntry(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("existing")
+	id, err := fs.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry holds the content of id under another name.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	name := contentDirName + "/" + string(digest.Canonical) + "/" + strings.Repeat("a", 64)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Import(&buf); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatalf("Expected existing content to be kept, got %v", err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected content %q, got %q", data, content)
+	}
+}
+
+func TestExportFiltered(t *testing.T) {
+	src, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	parent, err := src.Set([]byte("parent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := src.Set([]byte("child"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetMetadata(child, "parent", []byte(parent)); err != nil {
+		t.Fatal(err)
+	}
+	other, err := src.Set([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	excluded, err := src.ExportFiltered(&buf, func(id ID) bool {
+		return id == child
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(excluded) != 1 || excluded[0] != parent {
+		t.Fatalf("Expected filtered out reference %v to be reported, got %v", parent, excluded)
+	}
+
+	dst, cleanup := newTestFSStore(t)
+	defer cleanup()
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := countWalk(t, dst); n != 1 {
+		t.Fatalf("Expected 1 imported blob, got %d", n)
+	}
+	if _, err := dst.Get(child); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []ID{parent, other} {
+		if _, err := dst.Get(id); err == nil {
+			t.Fatalf("Expected filtered out %v to be absent", id)
+		}
+	}
+	if value, err := dst.GetMetadata(child, "parent"); err != nil || ID(value) != parent {
+		t.Fatalf("Expected parent metadata %v, got %q, %v", parent, value, err)
+	}
+}
+
+func TestExportAs(t *testing.T) {
+	src, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("foo")
+	id, err := src.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetMetadata(id, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportAs(&buf, digest.SHA512); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Walk(func(walked ID) error {
+		if walked != id {
+			t.Fatalf("Expected the source store to be left alone, found %v", walked)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	newID := computeID(digest.SHA512, data)
+	var idMap []byte
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == exportIDMapName {
+			if idMap, err = ioutil.ReadAll(tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if expected := id.String() + " " + newID.String() + "\n"; string(idMap) != expected {
+		t.Fatalf("Expected ID map %q, got %q", expected, idMap)
+	}
+
+	dst, dstCleanup := newTestFSStoreOptions(t, FSOptions{Algorithm: digest.SHA512})
+	defer dstCleanup()
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	content, err := dst.Get(newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected content %q, got %q", data, content)
+	}
+	value, err := dst.GetMetadata(newID, "tkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("tval")) {
+		t.Fatalf("Expected metadata %q, got %q", "tval", value)
+	}
+	if setID, err := dst.Set(data); err != nil || setID != newID {
+		t.Fatalf("Expected Set in a sha512 store to return %v, got %v, %v", newID, setID, err)
+	}
+}
@@ -0,0 +1,153 @@
+package image
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// fileSystem is the subset of filesystem operations of the fs store that
+// tests need to fake.
+type fileSystem interface {
+	Open(name string) (io.ReadCloser, error)
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+	TempFile(dir, prefix string) (tempFile, error)
+	OpenDir(name string) (dirReader, error)
+	// Sync commits the file or directory name to stable storage.
+	Sync(name string) error
+	// Preallocate allocates size bytes for the file name, where the
+	// platform supports it.
+	Preallocate(name string, size int64) error
+}
+
+// dirReader reads the entry names of a directory opened by
+// fileSystem.OpenDir, n at a time, like os.File.Readdirnames.
+type dirReader interface {
+	Readdirnames(n int) ([]string, error)
+	Close() error
+}
+
+// tempFile is a new file opened for writing by fileSystem.TempFile.
+type tempFile interface {
+	io.WriteCloser
+	Name() string
+}
+
+// osFileSystem implements fileSystem with the os package.
+type osFileSystem struct{}
+
+func (osFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) TempFile(dir, prefix string) (tempFile, error) {
+	return ioutil.TempFile(dir, prefix)
+}
+
+func (osFileSystem) OpenDir(name string) (dirReader, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Sync(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (osFileSystem) Preallocate(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := preallocate(f, size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// isCrossDeviceError returns true if err reports a rename that the
+// filesystem can't perform across directories or devices.
+func isCrossDeviceError(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == syscall.EXDEV
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openFile opens name for reading through the filesystem of the store. With
+// FSOptions.MaxOpenFiles it waits until fewer files are open.
+func (s *fs) openFile(name string) (io.ReadCloser, error) {
+	if s.openFiles == nil {
+		return s.fsys.Open(name)
+	}
+	s.openFiles <- struct{}{}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		<-s.openFiles
+		return nil, err
+	}
+	return &budgetedFile{ReadCloser: f, budget: s.openFiles}, nil
+}
+
+// readFile reads the file name with openFile.
+func (s *fs) readFile(name string) ([]byte, error) {
+	f, err := s.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// budgetedFile returns its slot of the open files budget when closed.
+type budgetedFile struct {
+	io.ReadCloser
+	budget chan struct{}
+	once   sync.Once
+}
+
+func (f *budgetedFile) Close() error {
+	err := f.ReadCloser.Close()
+	f.once.Do(func() { <-f.budget })
+	return err
+}
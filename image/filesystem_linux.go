@@ -0,0 +1,23 @@
+package image
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize keeps the size of the file preallocated, so that it is the
+// size of the content written.
+const fallocKeepSize = 0x1
+
+// preallocate allocates size bytes for f with fallocate. Filesystems that
+// don't support it are left alone.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// crossDirRenameFS fails every rename between different directories.
+type crossDirRenameFS struct {
+	osFileSystem
+	crossDirRenames int
+}
+
+func (f *crossDirRenameFS) Rename(oldpath, newpath string) error {
+	if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+		f.crossDirRenames++
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return f.osFileSystem.Rename(oldpath, newpath)
+}
+
+func TestFSSetCrossDirRename(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	fakeFS := &crossDirRenameFS{}
+	fs.fsys = fakeFS
+
+	data := []byte("foobar")
+	id, err := fs.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fakeFS.crossDirRenames == 0 {
+		t.Fatal("Expected Set to attempt a cross directory rename")
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected data %q, got %q", data, content)
+	}
+
+	for _, dir := range []string{fs.tempDir(), filepath.Dir(fs.contentFile(id))} {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if filepath.Join(dir, e.Name()) != fs.contentFile(id) {
+				t.Fatalf("Expected temporary files to be cleaned up, found %s", e.Name())
+			}
+		}
+	}
+
+	staged, err := fs.StageSet([]byte("staged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CommitStaged(staged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(staged); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// caseInsensitiveFS resolves file names regardless of their case.
+type caseInsensitiveFS struct {
+	osFileSystem
+}
+
+func (caseInsensitiveFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(filepath.Dir(name), strings.ToLower(filepath.Base(name))))
+}
+
+func TestFSCaseInsensitive(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	if fs.caseInsensitive {
+		t.Skip("test requires a case-sensitive filesystem")
+	}
+
+	var detected []string
+	fs.fsys = caseInsensitiveFS{}
+	if err := fs.detectCaseInsensitive(func(dir string) {
+		detected = append(detected, dir)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(detected) != 1 || detected[0] != fs.contentDir() {
+		t.Fatalf("Expected case-insensitivity to be reported for %s, got %v", fs.contentDir(), detected)
+	}
+
+	id, err := fs.Set([]byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.Digest(id)
+	upper := ID(digest.NewDigestFromHex(string(dgst.Algorithm()), strings.ToUpper(dgst.Hex())))
+	if fs.normalizeID(upper) != id {
+		t.Fatalf("Expected %v to normalize to %v, got %v", upper, id, fs.normalizeID(upper))
+	}
+	if _, err := fs.Get(upper); err != nil {
+		t.Fatalf("Expected get of differently cased ID to succeed, got %v", err)
+	}
+	if err := fs.SetMetadata(upper, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.GetMetadata(id, "tkey"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fdCountingFS tracks the number of files open through it.
+type fdCountingFS struct {
+	osFileSystem
+	open, peak int32
+}
+
+type countedFile struct {
+	io.ReadCloser
+	fsys *fdCountingFS
+}
+
+func (f *countedFile) Close() error {
+	atomic.AddInt32(&f.fsys.open, -1)
+	return f.ReadCloser.Close()
+}
+
+func (f *fdCountingFS) Open(name string) (io.ReadCloser, error) {
+	rc, err := f.osFileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt32(&f.open, 1)
+	for {
+		peak := atomic.LoadInt32(&f.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&f.peak, peak, n) {
+			break
+		}
+	}
+	return &countedFile{ReadCloser: rc, fsys: f}, nil
+}
+
+func TestFSMaxOpenFiles(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{MaxOpenFiles: 2, ChunkSize: 4})
+	defer cleanup()
+	fakeFS := &fdCountingFS{}
+	fs.fsys = fakeFS
+
+	var ids []ID
+	for i := 0; i < 50; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	corruptContent(t, fs, ids[3])
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			corrupt, err := fs.Fsck()
+			if err != nil {
+				t.Error(err)
+			}
+			if len(corrupt) != 1 || corrupt[0] != ids[3] {
+				t.Errorf("Expected corrupt IDs [%v], got %v", ids[3], corrupt)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := atomic.LoadInt32(&fakeFS.peak); peak > 2 {
+		t.Fatalf("Expected at most 2 open files, got %d", peak)
+	}
+	if open := atomic.LoadInt32(&fakeFS.open); open != 0 {
+		t.Fatalf("Expected no leaked files, got %d open", open)
+	}
+}
+
+// slowDirFS delays every read of directory entries, standing in for a
+// high-latency filesystem.
+type slowDirFS struct {
+	osFileSystem
+	delay time.Duration
+	reads int32
+}
+
+type slowDir struct {
+	dirReader
+	fsys *slowDirFS
+}
+
+func (d slowDir) Readdirnames(n int) ([]string, error) {
+	time.Sleep(d.fsys.delay)
+	atomic.AddInt32(&d.fsys.reads, 1)
+	return d.dirReader.Readdirnames(n)
+}
+
+func (f *slowDirFS) OpenDir(name string) (dirReader, error) {
+	d, err := f.osFileSystem.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowDir{dirReader: d, fsys: f}, nil
+}
+
+func TestFSWalkBatchSize(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	expected := make(map[ID]bool)
+	for i := 0; i < 10; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[id] = true
+	}
+
+	for _, size := range []int{1, 3, 10, 1000} {
+		fsys := &slowDirFS{}
+		fs.fsys, fs.walkBatchSize = fsys, size
+		seen := make(map[ID]bool)
+		if err := fs.Walk(func(id ID) error {
+			if seen[id] {
+				t.Fatalf("Batch size %d: %v walked twice", size, id)
+			}
+			seen[id] = true
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != len(expected) {
+			t.Fatalf("Batch size %d: expected %d IDs, got %d", size, len(expected), len(seen))
+		}
+		// The last read reports the end of the directory.
+		if batches := (len(expected)+size-1)/size + 1; int(fsys.reads) != batches {
+			t.Fatalf("Batch size %d: expected %d reads, got %d", size, batches, fsys.reads)
+		}
+	}
+
+	if _, err := newFSStore(fs.root, FSOptions{WalkBatchSize: -1}); err == nil {
+		t.Fatal("Expected error for negative walk batch size")
+	}
+}
+
+func BenchmarkFSWalkBatchSize(b *testing.B) {
+	fs, cleanup := newTestFSStore(b)
+	defer cleanup()
+	for i := 0; i < 1000; i++ {
+		if _, err := fs.Set([]byte(fmt.Sprintf("content%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	fs.fsys = &slowDirFS{delay: time.Millisecond}
+
+	for _, size := range []int{1, 16, 256, 4096} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			fs.walkBatchSize = size
+			for i := 0; i < b.N; i++ {
+				if err := fs.Walk(func(ID) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// preallocRecordingFS records the preallocations, failing them with err.
+type preallocRecordingFS struct {
+	osFileSystem
+	err    error
+	allocs []int64
+}
+
+func (f *preallocRecordingFS) Preallocate(name string, size int64) error {
+	f.allocs = append(f.allocs, size)
+	if f.err != nil {
+		return &os.PathError{Op: "fallocate", Path: name, Err: f.err}
+	}
+	return f.osFileSystem.Preallocate(name, size)
+}
+
+func TestFSPreallocate(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{Preallocate: true})
+	defer cleanup()
+	fakeFS := &preallocRecordingFS{}
+	fs.fsys = fakeFS
+
+	data := bytes.Repeat([]byte("foobar"), 1000)
+	expected := computeID(digest.Canonical, data)
+	id, err := fs.SetExpected(bytes.NewReader(data), expected, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeFS.allocs) != 1 || fakeFS.allocs[0] != int64(len(data)) {
+		t.Fatalf("Expected one preallocation of %d bytes, got %v", len(data), fakeFS.allocs)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("Expected preallocated content to be stored as written")
+	}
+
+	fakeFS.err = syscall.ENOSPC
+	other := []byte("other content")
+	r := bytes.NewReader(other)
+	if _, err := fs.SetExpected(r, computeID(digest.Canonical, other), int64(len(other))); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Expected ErrInsufficientSpace, got %v", err)
+	}
+	if r.Len() != len(other) {
+		t.Fatal("Expected failed preallocation to fail before streaming")
+	}
+
+	fs.preallocate = false
+	fakeFS.allocs = nil
+	if _, err := fs.SetExpected(bytes.NewReader(other), computeID(digest.Canonical, other), int64(len(other))); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeFS.allocs) != 0 {
+		t.Fatalf("Expected no preallocation without the option, got %v", fakeFS.allocs)
+	}
+}
+
+// tornWriteFS records the renames, and with tear set, its temporary files
+// fail after writing half of the first write, like a crash mid-write.
+type tornWriteFS struct {
+	osFileSystem
+	tear    bool
+	renames [][2]string
+}
+
+type tornFile struct {
+	tempFile
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	n, _ := f.tempFile.Write(p[:len(p)/2])
+	return n, errors.New("write interrupted")
+}
+
+func (f *tornWriteFS) TempFile(dir, prefix string) (tempFile, error) {
+	tf, err := f.osFileSystem.TempFile(dir, prefix)
+	if err != nil || !f.tear {
+		return tf, err
+	}
+	return &tornFile{tf}, nil
+}
+
+func (f *tornWriteFS) Rename(oldpath, newpath string) error {
+	f.renames = append(f.renames, [2]string{oldpath, newpath})
+	return f.osFileSystem.Rename(oldpath, newpath)
+}
+
+func TestFSSetMetadataAtomic(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeFS := &tornWriteFS{}
+	fs.fsys = fakeFS
+
+	old := []byte("previous value")
+	if err := fs.SetMetadata(id, "key", old); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(fs.metadataDir(id), "key")
+	if len(fakeFS.renames) != 1 || fakeFS.renames[0][1] != keyPath || filepath.Dir(fakeFS.renames[0][0]) != filepath.Dir(keyPath) {
+		t.Fatalf("Expected the value to be renamed into %s from a temporary file beside it, got %v", keyPath, fakeFS.renames)
+	}
+
+	fakeFS.tear = true
+	fakeFS.renames = nil
+	if err := fs.SetMetadata(id, "key", []byte("new value")); err == nil {
+		t.Fatal("Expected interrupted write to fail")
+	}
+	if len(fakeFS.renames) != 0 {
+		t.Fatalf("Expected interrupted write not to be renamed into place, got %v", fakeFS.renames)
+	}
+	value, err := fs.GetMetadata(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, old) {
+		t.Fatalf("Expected previous value %q to be intact, got %q", old, value)
+	}
+	entries, err := ioutil.ReadDir(fs.metadataDir(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Fatalf("Expected the temporary file to be removed, found %s", e.Name())
+		}
+	}
+}
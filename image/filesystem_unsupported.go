@@ -0,0 +1,10 @@
+// +build !linux
+
+package image
+
+import "os"
+
+// preallocate does nothing on platforms without fallocate.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+package image
+
+import "sync"
+
+// flightGroup coalesces concurrent fetches of the same ID into one.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[ID]*flightCall
+	// coalesced counts the callers that shared the call of another one.
+	coalesced uint64
+}
+
+type flightCall struct {
+	wg      sync.WaitGroup
+	content []byte
+	err     error
+	// dups counts the callers waiting for the result of the call.
+	dups int
+}
+
+// do calls fn unless a call for id is already in flight, in which case it
+// waits for that call and returns its result. Every caller gets its own copy
+// of the content.
+func (g *flightGroup) do(id ID, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[ID]*flightCall)
+	}
+	if c, ok := g.calls[id]; ok {
+		c.dups++
+		g.coalesced++
+		g.mu.Unlock()
+		c.wg.Wait()
+		if c.err != nil {
+			return nil, c.err
+		}
+		return append([]byte(nil), c.content...), nil
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[id] = c
+	g.mu.Unlock()
+
+	c.content, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, id)
+	g.mu.Unlock()
+	c.wg.Done()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	return append([]byte(nil), c.content...), nil
+}
+
+// coalescedCalls returns the number of callers that shared the call of
+// another one.
+func (g *flightGroup) coalescedCalls() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.coalesced
+}
+
+// waiting returns the number of callers waiting for the call for id in
+// flight.
+func (g *flightGroup) waiting(id ID) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[id]; ok {
+		return c.dups
+	}
+	return 0
+}
@@ -1,19 +1,92 @@
 package image
 
 import (
+	// Register sha384 and sha512 for the digest algorithms.
+	_ "crypto/sha512"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/pkg/filenotify"
+	"golang.org/x/net/context"
 )
 
+// ErrCorrupt is returned when stored content doesn't match its ID.
+var ErrCorrupt = errors.New("content does not match its digest")
+
+// ErrUnsupportedAlgorithm is returned for IDs using a digest algorithm the
+// store isn't allowed to serve.
+var ErrUnsupportedAlgorithm = errors.New("digest algorithm not allowed")
+
+// ErrBusy is returned when content can't be deleted because it is held or
+// mapped by a reader.
+var ErrBusy = errors.New("content is in use")
+
+// ErrRootOverlap is returned when the content and metadata directories of a
+// store are the same or nested, which would let metadata files pass for
+// content and the other way around.
+var ErrRootOverlap = errors.New("image content and metadata directories overlap")
+
+// ErrEmptyContent is returned when storing zero-length content without
+// FSOptions.AllowEmptyContent.
+var ErrEmptyContent = errors.New("Invalid empty data")
+
+// EmptyContentID is the ID of zero-length content, the canonical digest of
+// the empty input. Valid content like an empty config or layer has this ID.
+const EmptyContentID = ID(digest.DigestSha256EmptyTar)
+
+// StoreError records an error and the operation and image ID that caused it.
+type StoreError struct {
+	Op  string
+	ID  ID
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	if e.ID == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.ID.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+func storeError(op string, id ID, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StoreError{Op: op, ID: id, Err: err}
+}
+
 // IDWalkFunc is function called by StoreBackend.Walk
 type IDWalkFunc func(id ID) error
 
+// ErrStopWalk is returned by the callback of a walk to stop it early
+// without an error. The walk then returns nil.
+var ErrStopWalk = errors.New("stop walk")
+
+// stopWalk returns the error a walk returns when its callback returns err.
+func stopWalk(err error) error {
+	if errors.Is(err, ErrStopWalk) {
+		return nil
+	}
+	return err
+}
+
 // StoreBackend provides interface for image.Store persistence
 type StoreBackend interface {
 	Walk(f IDWalkFunc) error
@@ -28,165 +101,1221 @@ type StoreBackend interface {
 // fs implements StoreBackend using the filesystem.
 type fs struct {
 	sync.RWMutex
-	root string
+	root      string
+	namespace string
+	fsys      fileSystem
+	log       Logger
+	metadata  metadataStore
+	// metadataInContent is set when the metadata is stored on the content
+	// files themselves and rewriting them would lose it.
+	metadataInContent bool
+	// metadataLocks serializes metadata writers of an ID while letting its
+	// readers proceed in parallel. Holders of the store write lock don't
+	// need them.
+	metadataLocks idLocks
+
+	holdsMu sync.Mutex
+	holds   map[ID]int
+
+	trackLastUsed bool
+	lastUsedMu    sync.Mutex
+	lastUsed      map[ID]time.Time
+	// hits counts the reads of each ID not persisted yet.
+	trackHits bool
+	hitsMu    sync.Mutex
+	hits      map[ID]uint64
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+	// newWatcher returns the watcher used by StartWatcher, it is replaced
+	// in tests.
+	newWatcher func() (filenotify.FileWatcher, error)
+
+	// caseInsensitive is set if the content is on a case-insensitive
+	// filesystem.
+	caseInsensitive bool
+
+	weakChecksums bool
+	weakMu        sync.Mutex
+	weakIndex     *weakIndex
+	// stagedChecksums holds the weak checksums of the content staged by
+	// StageSet, recorded when it is committed. It is guarded by the store
+	// write lock.
+	stagedChecksums map[ID]uint32
+
+	// existsFilter answers Exists for most missing IDs from bloom, which
+	// is rebuilt when it is nil or stale. bloomDeletes counts the deletes
+	// since it was built.
+	existsFilter bool
+	bloomMu      sync.Mutex
+	bloom        *bloomFilter
+	bloomDeletes int
+
+	chunkSize int64
+
+	// allowedAlgorithms restricts the digest algorithms of the IDs served
+	// by the store. A nil map allows any algorithm.
+	allowedAlgorithms map[digest.Algorithm]bool
+
+	verifyAdopted     bool
+	verifyOnDuplicate bool
+
+	// inlineThreshold is the size up to which content is stored inline.
+	inlineThreshold int
+	// inline holds the content stored inline, guarded by the store lock.
+	inline map[ID][]byte
+	// pack holds the content of a store frozen with Freeze, which is then
+	// read-only. It is nil for other stores.
+	pack *pack
+
+	// layoutVersion is the on-disk layout version of the store root.
+	layoutVersion int
+
+	// openFiles bounds the number of content files open at once. A nil
+	// channel doesn't bound them.
+	openFiles chan struct{}
+	// hashSlots bounds the number of goroutines hashing content at once,
+	// see withHashSlot. A nil channel doesn't bound them.
+	hashSlots chan struct{}
+
+	// allowEmpty lets zero-length content be stored.
+	allowEmpty bool
+	// preallocate allocates the space of streamed content of known size
+	// before it is written.
+	preallocate bool
+
+	// algorithm is the digest algorithm addressing new content.
+	algorithm digest.Algorithm
+
+	evictOnNoSpace bool
+	evictionPolicy EvictionPolicy
+
+	// contentRoot and metadataRoot hold the content and metadata of all
+	// namespaces.
+	contentRoot  string
+	metadataRoot string
+
+	// verificationCache remembers the content files verified by get, it
+	// may be shared with other stores.
+	verificationCache *VerificationCache
+
+	deferVerification bool
+	onCorrupt         func(id ID, err error)
+
+	// verifyBufferSize is the size of the blocks hashed by verifyID.
+	verifyBufferSize int
+	// walkBatchSize is the number of directory entries read at a time by
+	// listAlgorithmIDs.
+	walkBatchSize int
+
+	// idStrategy computes the IDs of content if it is set, instead of the
+	// digest with algorithm.
+	idStrategy IDStrategy
+	// layout maps IDs to content files if it is set, instead of the
+	// directories per digest algorithm.
+	layout ContentLayout
+
+	// opts are the options the store was opened with.
+	opts FSOptions
+
+	// sharedWrites are the writes of SetExpected in progress, by ID.
+	sharedWritesMu sync.Mutex
+	sharedWrites   map[ID]*sharedWrite
+
+	// unsynced are the files placed since the last Barrier, which syncs
+	// them and their directories.
+	syncMu   sync.Mutex
+	unsynced map[string]struct{}
+
+	// validators check metadata values by key before they are set.
+	validatorsMu sync.RWMutex
+	validators   map[string]func([]byte) error
+
+	// maintenance is closed when the store leaves maintenance, see
+	// EnterMaintenance; it is nil outside of maintenance. maintenanceDepth
+	// counts the nested calls of EnterMaintenance.
+	maintenanceMu    sync.Mutex
+	maintenance      chan struct{}
+	maintenanceDepth int
 }
 
 const (
 	contentDirName  = "content"
 	metadataDirName = "metadata"
+	tempDirName     = "tmp"
 )
 
+// defaultWalkBatchSize is the number of directory entries read at a time by
+// Walk unless FSOptions.WalkBatchSize sets it.
+const defaultWalkBatchSize = 256
+
+// FSOptions holds the optional configuration of a filesystem based
+// StoreBackend.
+type FSOptions struct {
+	// Namespace isolates the content and metadata of the backend under
+	// content/<Namespace> and metadata/<Namespace> so several logical stores
+	// can share one root. Content is not deduplicated across namespaces.
+	Namespace string
+	// XattrMetadata stores metadata as extended attributes of the content
+	// files instead of one file per key. The file based layout is used when
+	// the filesystem doesn't support extended attributes.
+	XattrMetadata bool
+	// TrackLastUsed records when content was last read, at a resolution of
+	// a minute, so LastUsed doesn't fall back to the creation time.
+	TrackLastUsed bool
+	// TrackHits counts the reads of content with Get, see Hits. The counts
+	// are persisted every few reads of an ID, so the latest reads are lost
+	// when the process exits.
+	TrackHits bool
+	// EvictOnNoSpace makes Set evict content when the filesystem runs out
+	// of space, in the order of EvictionPolicy, and retry once. Held, pinned,
+	// aliased and referenced content is never evicted. Set fails with
+	// ErrInsufficientSpace if evicting can't make room for the content.
+	EvictOnNoSpace bool
+	// EvictionPolicy chooses the content evicted with EvictOnNoSpace. It
+	// defaults to LRUEvictionPolicy.
+	EvictionPolicy EvictionPolicy
+	// WeakChecksums records a CRC-32 checksum of the content on Set, so
+	// callers can look up candidate IDs with ExistsWeak before hashing.
+	WeakChecksums bool
+	// ExistsFilter keeps a bloom filter of the stored IDs in memory, so
+	// that Exists answers most lookups of missing content without touching
+	// the disk. It is built when the store is opened and rebuilt as deletes
+	// accumulate. Content stored by other processes is only seen after a
+	// rebuild or through StartWatcher.
+	ExistsFilter bool
+	// OnCaseInsensitive is called with the content directory if it turns
+	// out to be on a case-insensitive filesystem. IDs are then normalized to
+	// lowercase hex so that differently cased IDs can't alias each other.
+	OnCaseInsensitive func(dir string)
+	// LockTimeout bounds the time an operation waits for the lock of an
+	// image ID held by another one before failing with ErrLockTimeout.
+	// Zero waits indefinitely.
+	LockTimeout time.Duration
+	// ChunkSize splits content larger than ChunkSize bytes into chunks of
+	// that size, stored once per namespace however many images contain
+	// them. The content file then only lists the chunks. Zero disables
+	// chunking; chunked content stays readable either way.
+	ChunkSize int64
+	// AllowedAlgorithms restricts the digest algorithms of the IDs the
+	// store serves. Get and Set fail with ErrUnsupportedAlgorithm for other
+	// IDs, and Walk skips them. An empty list allows any algorithm.
+	AllowedAlgorithms []digest.Algorithm
+	// Algorithm is the digest algorithm addressing the content stored with
+	// Set. It defaults to digest.Canonical. Stored content of other
+	// algorithms stays readable. Only digest.Canonical content is stored
+	// inline.
+	Algorithm digest.Algorithm
+	// VerifyAdopted makes AdoptFile read adopted files again once they are
+	// in place, to catch modifications made while they were hashed.
+	VerifyAdopted bool
+	// VerifyOnDuplicate makes Set compare the data with the content already
+	// stored under its ID, failing with ErrDigestCollision if they differ
+	// instead of replacing it. Stored content that is corrupt is still
+	// replaced. The stored content is read on every duplicate Set.
+	VerifyOnDuplicate bool
+	// InlineThreshold stores content of at most InlineThreshold bytes in a
+	// shared index file instead of a content file each, saving inodes for
+	// small blobs. The index is rewritten on every change, so the threshold
+	// should stay small. It is ignored with metadata in extended attributes,
+	// which need a content file. Inline content stays readable either way.
+	InlineThreshold int
+	// MaxOpenFiles bounds the number of content files the backend has open
+	// for reading at once, so that walks over many blobs like Fsck don't
+	// exhaust file descriptors. Zero doesn't bound them.
+	MaxOpenFiles int
+	// WalkBatchSize is the number of directory entries Walk reads at a
+	// time. Larger batches save round trips on high-latency filesystems
+	// like network mounts. It defaults to defaultWalkBatchSize.
+	WalkBatchSize int
+	// AllowEmptyContent lets Set store zero-length content, under
+	// EmptyContentID. Empty input is rejected with ErrEmptyContent
+	// otherwise.
+	AllowEmptyContent bool
+	// Preallocate allocates the space of content streamed with a known
+	// size, like with SetExpected, before writing it, which avoids
+	// fragmenting the content files and fails the write with
+	// ErrInsufficientSpace before anything is streamed if the space is
+	// lacking. It does nothing on platforms or filesystems without
+	// fallocate.
+	Preallocate bool
+	// ContentDir and MetadataDir place the content and the metadata of the
+	// store outside of the store root, for instance on different devices.
+	// They default to the content and metadata directories of the root.
+	// They must not overlap, see ErrRootOverlap.
+	ContentDir  string
+	MetadataDir string
+	// VerificationCache remembers the content files whose digest Get
+	// verified, so that reads of unchanged files don't hash them again. It
+	// can be shared by the stores of a process. Fsck and the scrubber
+	// always hash the content.
+	VerificationCache *VerificationCache
+	// DeferVerification makes Get return content files as soon as they
+	// are read and verify their digest in the background. Corrupt content
+	// is moved to a quarantine directory of the store root, where Get
+	// doesn't find it anymore, and reported to OnCorrupt. Callers may thus
+	// receive corrupt content; only enable it for trusted storage.
+	DeferVerification bool
+	// OnCorrupt is called with the ID of the content found corrupt by a
+	// deferred verification.
+	OnCorrupt func(id ID, err error)
+	// IDStrategy computes the IDs of stored content instead of its digest
+	// with Algorithm, which is then ignored, for instance to get
+	// predictable IDs in tests. Inline content and the operations hashing
+	// content as they stream it, like AdoptFile and SetExpected, need the
+	// default digest IDs.
+	IDStrategy IDStrategy
+	// ContentLayout names the content files after their IDs instead of
+	// the default directory per digest algorithm, for instance to share
+	// the content directory with other tools. Stores must always be
+	// opened with the layout they were written with. Watchers started
+	// with StartWatcher only see the files directly in the content
+	// directory.
+	ContentLayout ContentLayout
+	// HashConcurrency bounds the number of goroutines hashing content at
+	// once across the operations of the backend, like the verification of
+	// Get and the digesting of Set, so that heavy concurrent use doesn't
+	// oversubscribe the CPU. Operations wait for their turn as they hash,
+	// not while they do I/O. It defaults to GOMAXPROCS; a negative value
+	// doesn't bound hashing.
+	HashConcurrency int
+	// VerifyBufferSize is the number of bytes hashed at a time when
+	// content is verified on read. Zero hashes the content in one pass for
+	// Get and in the reads of the caller for readers.
+	VerifyBufferSize int
+	// Logger receives the log events of the backend, like skipped invalid
+	// entries and detected corruption. They are discarded if it is nil, see
+	// LogrusLogger.
+	Logger Logger
+}
+
 // NewFSStoreBackend returns new filesystem based backend for image.Store
 func NewFSStoreBackend(root string) (StoreBackend, error) {
-	return newFSStore(root)
+	return newFSStore(root, FSOptions{})
 }
 
-func newFSStore(root string) (*fs, error) {
+// NewFSStoreBackendWithOptions returns new filesystem based backend for
+// image.Store configured with opts.
+func NewFSStoreBackendWithOptions(root string, opts FSOptions) (StoreBackend, error) {
+	return newFSStore(root, opts)
+}
+
+func newFSStore(root string, opts FSOptions) (*fs, error) {
+	if err := validateNamespace(opts.Namespace); err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize < 0 {
+		return nil, fmt.Errorf("invalid image chunk size %d", opts.ChunkSize)
+	}
+	if opts.WalkBatchSize < 0 {
+		return nil, fmt.Errorf("invalid image walk batch size %d", opts.WalkBatchSize)
+	}
+	if opts.VerifyBufferSize < 0 {
+		return nil, fmt.Errorf("invalid image verify buffer size %d", opts.VerifyBufferSize)
+	}
+	contentRoot, metadataRoot := opts.ContentDir, opts.MetadataDir
+	if contentRoot == "" {
+		contentRoot = filepath.Join(root, contentDirName)
+	}
+	if metadataRoot == "" {
+		metadataRoot = filepath.Join(root, metadataDirName)
+	}
+	if err := checkRootOverlap(contentRoot, metadataRoot); err != nil {
+		return nil, err
+	}
+	if opts.Algorithm == "" {
+		opts.Algorithm = digest.Canonical
+	}
+	if opts.IDStrategy != nil {
+		opts.Algorithm = opts.IDStrategy.Algorithm()
+	} else if !opts.Algorithm.Available() {
+		return nil, fmt.Errorf("unsupported image digest algorithm %q", opts.Algorithm)
+	}
 	s := &fs{
-		root: root,
+		root:         root,
+		contentRoot:  contentRoot,
+		metadataRoot: metadataRoot,
+		namespace:    opts.Namespace,
+		fsys:         osFileSystem{},
+		log:          opts.Logger,
+
+		trackLastUsed:     opts.TrackLastUsed,
+		trackHits:         opts.TrackHits,
+		evictOnNoSpace:    opts.EvictOnNoSpace,
+		evictionPolicy:    opts.EvictionPolicy,
+		weakChecksums:     opts.WeakChecksums,
+		existsFilter:      opts.ExistsFilter,
+		chunkSize:         opts.ChunkSize,
+		verifyAdopted:     opts.VerifyAdopted,
+		verifyOnDuplicate: opts.VerifyOnDuplicate,
+		allowEmpty:        opts.AllowEmptyContent,
+		preallocate:       opts.Preallocate,
+		verificationCache: opts.VerificationCache,
+		deferVerification: opts.DeferVerification,
+		onCorrupt:         opts.OnCorrupt,
+		verifyBufferSize:  opts.VerifyBufferSize,
+		walkBatchSize:     opts.WalkBatchSize,
+		idStrategy:        opts.IDStrategy,
+		layout:            opts.ContentLayout,
+		algorithm:         opts.Algorithm,
+		now:               time.Now,
+		newWatcher:        filenotify.NewEventWatcher,
+		opts:              opts,
+	}
+	if s.log == nil {
+		s.log = nopLogger{}
+	}
+	if err := s.loadInline(); err != nil {
+		return nil, err
+	}
+	pack, err := s.loadPack()
+	if err != nil {
+		return nil, err
+	}
+	s.pack = pack
+	if opts.MaxOpenFiles > 0 {
+		s.openFiles = make(chan struct{}, opts.MaxOpenFiles)
+	}
+	switch {
+	case opts.HashConcurrency > 0:
+		s.hashSlots = make(chan struct{}, opts.HashConcurrency)
+	case opts.HashConcurrency == 0:
+		s.hashSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+	}
+	s.metadataLocks.timeout = opts.LockTimeout
+	if len(opts.AllowedAlgorithms) > 0 {
+		s.allowedAlgorithms = make(map[digest.Algorithm]bool)
+		for _, alg := range opts.AllowedAlgorithms {
+			s.allowedAlgorithms[alg] = true
+		}
+	}
+	version, created, err := s.readLayoutVersion()
+	if err != nil {
+		return nil, err
+	}
+	s.layoutVersion = version
+	if err := s.makeAlgorithmDirs(s.algorithm); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.tempDir(), 0700); err != nil {
+		return nil, err
+	}
+	if created {
+		if err := s.writeRootFile(layoutVersionFileName, []byte(strconv.Itoa(currentLayoutVersion))); err != nil {
+			return nil, err
+		}
+	}
+	metadata, err := s.loadMetadataLayout()
+	if err != nil {
+		return nil, err
+	}
+	s.metadata = metadata
+	if opts.XattrMetadata {
+		xattrs, err := newXattrMetadataStore(s)
+		if err != nil {
+			s.log.Warn("extended attributes unavailable for image metadata, using files", "err", err)
+		} else {
+			s.metadata = xattrs
+			s.metadataInContent = true
+		}
+	}
+	if !s.metadataInContent && s.algorithm == digest.Canonical && s.idStrategy == nil {
+		s.inlineThreshold = opts.InlineThreshold
 	}
-	if err := os.MkdirAll(filepath.Join(root, contentDirName, string(digest.Canonical)), 0700); err != nil {
+	if err := s.detectCaseInsensitive(opts.OnCaseInsensitive); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(filepath.Join(root, metadataDirName, string(digest.Canonical)), 0700); err != nil {
+	if err := s.RecoverTombstones(); err != nil {
 		return nil, err
 	}
+	if s.existsFilter {
+		if err := s.rebuildBloom(); err != nil {
+			return nil, err
+		}
+	}
 	return s, nil
 }
 
+// checkRootOverlap returns ErrRootOverlap if the directories content and
+// metadata are the same or one contains the other, following symbolic links
+// as far as the directories exist.
+func checkRootOverlap(content, metadata string) error {
+	resolve := func(dir string) (string, error) {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", err
+		}
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return resolved, nil
+		}
+		return dir, nil
+	}
+	c, err := resolve(content)
+	if err != nil {
+		return err
+	}
+	m, err := resolve(metadata)
+	if err != nil {
+		return err
+	}
+	within := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	if within(c, m) || within(m, c) {
+		return fmt.Errorf("%w: content %s, metadata %s", ErrRootOverlap, content, metadata)
+	}
+	return nil
+}
+
+// validateNamespace checks that ns can be used as a single directory name
+// that doesn't clash with the digest algorithm directories.
+func validateNamespace(ns string) error {
+	if ns == "" {
+		return nil
+	}
+	if ns == "." || ns == ".." || strings.ContainsAny(ns, `/\`) || digest.Algorithm(ns).Available() {
+		return fmt.Errorf("invalid store namespace %q", ns)
+	}
+	return nil
+}
+
+// algorithmAllowed reports whether the store serves IDs using alg.
+func (s *fs) algorithmAllowed(alg digest.Algorithm) bool {
+	if s.idStrategy != nil {
+		return alg == s.algorithm
+	}
+	return alg.Available() && (s.allowedAlgorithms == nil || s.allowedAlgorithms[alg])
+}
+
+// makeAlgorithmDirs creates the content and metadata directories of
+// content addressed with alg.
+func (s *fs) makeAlgorithmDirs(alg digest.Algorithm) error {
+	if err := os.MkdirAll(filepath.Join(s.contentDir(), string(alg)), 0700); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(s.metadataBaseDir(), string(alg)), 0700)
+}
+
+// computeID returns the ID of content addressed with alg, which must be
+// available.
+func computeID(alg digest.Algorithm, content []byte) ID {
+	digester := alg.New()
+	// Writes to hashes never fail.
+	digester.Hash().Write(content)
+	return ID(digester.Digest())
+}
+
+// verifyID computes the ID of content read from the store, hashing blocks
+// of verifyBufferSize bytes if it is set.
+func (s *fs) verifyID(alg digest.Algorithm, content []byte) (id ID) {
+	s.withHashSlot(func() {
+		id = s.hashContent(alg, content)
+	})
+	return id
+}
+
+func (s *fs) hashContent(alg digest.Algorithm, content []byte) ID {
+	if s.idStrategy != nil {
+		return s.idStrategy.Compute(content)
+	}
+	if s.verifyBufferSize == 0 {
+		return computeID(alg, content)
+	}
+	digester := alg.New()
+	for len(content) > 0 {
+		n := s.verifyBufferSize
+		if n > len(content) {
+			n = len(content)
+		}
+		digester.Hash().Write(content[:n])
+		content = content[n:]
+	}
+	return ID(digester.Digest())
+}
+
+func (s *fs) contentDir() string {
+	return filepath.Join(s.contentRoot, s.namespace)
+}
+
+func (s *fs) metadataBaseDir() string {
+	return filepath.Join(s.metadataRoot, s.namespace)
+}
+
+// tempDir holds the files being written before they are moved into place.
+func (s *fs) tempDir() string {
+	return filepath.Join(s.root, tempDirName)
+}
+
 func (s *fs) contentFile(id ID) string {
-	dgst := digest.Digest(id)
-	return filepath.Join(s.root, contentDirName, string(dgst.Algorithm()), dgst.Hex())
+	if s.layout != nil {
+		return s.contentLayoutFile(id)
+	}
+	dgst := digest.Digest(s.normalizeID(id))
+	return filepath.Join(s.contentDir(), string(dgst.Algorithm()), dgst.Hex())
 }
 
 func (s *fs) metadataDir(id ID) string {
-	dgst := digest.Digest(id)
-	return filepath.Join(s.root, metadataDirName, string(dgst.Algorithm()), dgst.Hex())
+	dgst := digest.Digest(s.normalizeID(id))
+	return filepath.Join(s.metadataBaseDir(), string(dgst.Algorithm()), dgst.Hex())
 }
 
 // Walk calls the supplied callback for each image ID in the storage backend.
+// Content deleted while the walk is in progress is skipped once it is gone,
+// so walks can run concurrently with deletes.
 func (s *fs) Walk(f IDWalkFunc) error {
-	// Only Canonical digest (sha256) is currently supported
 	s.RLock()
-	dir, err := ioutil.ReadDir(filepath.Join(s.root, contentDirName, string(digest.Canonical)))
+	ids, err := s.listIDs()
 	s.RUnlock()
 	if err != nil {
 		return err
 	}
-	for _, v := range dir {
-		dgst := digest.NewDigestFromHex(string(digest.Canonical), v.Name())
-		if err := dgst.Validate(); err != nil {
-			logrus.Debugf("Skipping invalid digest %s: %s", dgst, err)
+	for _, id := range ids {
+		if s.deletedSinceListed(id) {
 			continue
 		}
-		if err := f(ID(dgst)); err != nil {
-			return err
+		if err := f(id); err != nil {
+			return stopWalk(err)
 		}
 	}
 	return nil
 }
 
+// deletedSinceListed returns whether the content of id, listed by listIDs,
+// has been deleted since. The content of frozen stores is never deleted.
+func (s *fs) deletedSinceListed(id ID) bool {
+	if s.packed() {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return os.IsNotExist(s.contentExists(id))
+}
+
+// listIDs returns the IDs of the stored content. It must be called with the
+// store lock held. Algorithm directories removed while they are listed are
+// skipped.
+func (s *fs) listIDs() ([]ID, error) {
+	if s.packed() {
+		var ids []ID
+		for _, id := range s.pack.ids {
+			if s.algorithmAllowed(digest.Digest(id).Algorithm()) {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+	var ids []ID
+	if s.layout != nil {
+		layoutIDs, err := s.listLayoutIDs()
+		if err != nil {
+			return nil, err
+		}
+		ids = layoutIDs
+	} else {
+		algs, err := s.algorithmDirs(s.contentDir())
+		if err != nil {
+			return nil, err
+		}
+		for _, alg := range algs {
+			if !s.algorithmAllowed(digest.Algorithm(alg)) {
+				continue
+			}
+			algIDs, err := s.listAlgorithmIDs(alg)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			ids = append(ids, algIDs...)
+		}
+	}
+	if s.algorithmAllowed(digest.Canonical) && s.idStrategy == nil {
+		for id := range s.inline {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// listAlgorithmIDs returns the IDs of the content files addressed with alg in
+// lexical order. The directory entries are read walkBatchSize at a time.
+func (s *fs) listAlgorithmIDs(alg string) ([]ID, error) {
+	dirPath := filepath.Join(s.contentDir(), alg)
+	dir, err := s.fsys.OpenDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	batch := s.walkBatchSize
+	if batch <= 0 {
+		batch = defaultWalkBatchSize
+	}
+	var ids []ID
+	for {
+		names, err := dir.Readdirnames(batch)
+		for _, name := range names {
+			id := ID(digest.NewDigestFromHex(alg, name))
+			if err := s.validateID(id); err != nil {
+				s.log.Debug("skipping invalid image content entry", "path", filepath.Join(dirPath, name), "err", err)
+				continue
+			}
+			if _, ok := s.inline[id]; ok {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(idSlice(ids))
+	return ids, nil
+}
+
 // Get returns the content stored under a given ID.
 func (s *fs) Get(id ID) ([]byte, error) {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.get(id)
+	get := s.get
+	if s.deferVerification {
+		get = s.getDeferred
+	}
+	content, err := get(id)
+	if err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			s.log.Error("image content does not match its digest", "id", id, "path", s.contentFile(id))
+		}
+		return nil, storeError("get", id, err)
+	}
+	if s.trackLastUsed {
+		s.touch(id)
+	}
+	if s.trackHits {
+		s.recordHit(id)
+	}
+	return content, nil
 }
 
 func (s *fs) get(id ID) ([]byte, error) {
-	content, err := ioutil.ReadFile(s.contentFile(id))
-	if err != nil {
-		return nil, err
+	return s.getContent(id, s.verificationCache)
+}
+
+// getVerified returns the content of id like get, but always hashes it,
+// whatever the verification cache says.
+func (s *fs) getVerified(id ID) ([]byte, error) {
+	return s.getContent(id, nil)
+}
+
+func (s *fs) getContent(id ID, cache *VerificationCache) ([]byte, error) {
+	if !s.algorithmAllowed(digest.Digest(id).Algorithm()) {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	if s.packed() {
+		content, err := s.pack.read(s.normalizeID(id))
+		if err != nil {
+			return nil, err
+		}
+		if s.verifyID(digest.Digest(id).Algorithm(), content) != s.normalizeID(id) {
+			return nil, s.mismatchError(id, content)
+		}
+		return content, nil
+	}
+	content, ok := s.getInline(id)
+	var key verificationKey
+	if !ok {
+		path := s.contentFile(id)
+		var err error
+		if content, err = s.readFile(path); err != nil {
+			return nil, err
+		}
+		// The file is checked after reading, so that changes made in
+		// between don't match the cached verification.
+		if cache != nil {
+			if fi, err := s.fsys.Stat(path); err == nil && fi.Size() == int64(len(content)) {
+				key = verificationKey{path: path, modTime: fi.ModTime(), size: fi.Size()}
+				if cache.verified(key) {
+					return content, nil
+				}
+			}
+		}
 	}
 
 	// todo: maybe optional
-	validated, err := digest.FromBytes(content)
+	alg := digest.Digest(id).Algorithm()
+	if s.verifyID(alg, content) == s.normalizeID(id) {
+		if key.path != "" {
+			cache.add(key)
+		}
+		return content, nil
+	}
+
+	var err error
+	if m, ok := parseChunkManifest(content); ok {
+		content, err = s.readChunks(m)
+	} else if d, ok := parseDelta(content); ok {
+		var baseContent []byte
+		if baseContent, err = s.get(d.base); err == nil {
+			content, err = d.apply(baseContent)
+		}
+	} else {
+		return nil, s.mismatchError(id, content)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if ID(validated) != id {
-		return nil, fmt.Errorf("failed to verify image: %v", id)
+	if s.verifyID(alg, content) != s.normalizeID(id) {
+		return nil, ErrCorrupt
 	}
-
 	return content, nil
 }
 
 // Set stores content under a given ID.
 func (s *fs) Set(data []byte) (ID, error) {
-	s.Lock()
+	id, _, err := s.SetMulti(data)
+	return id, err
+}
+
+// SetMulti stores content like Set and additionally returns its digests for
+// the extra algorithms, computed in the same pass as the write.
+func (s *fs) SetMulti(data []byte, extra ...digest.Algorithm) (ID, map[digest.Algorithm]digest.Digest, error) {
+	return s.setMultiContext(context.Background(), data, extra...)
+}
+
+func (s *fs) setMultiContext(ctx context.Context, data []byte, extra ...digest.Algorithm) (ID, map[digest.Algorithm]digest.Digest, error) {
+	var digests map[digest.Algorithm]digest.Digest
+	id, err := s.setEvicting(ctx, int64(len(data)), func() (id ID, err error) {
+		id, digests, err = s.setMulti(s.algorithm, data, extra...)
+		return id, err
+	})
+	return id, digests, err
+}
+
+// setEvicting takes the store write lock like lockMutation and runs set,
+// which stores size bytes of content. If the store runs out of space and
+// FSOptions.EvictOnNoSpace is set, content is evicted and set runs again.
+func (s *fs) setEvicting(ctx context.Context, size int64, set func() (ID, error)) (ID, error) {
+	if err := s.lockMutation(ctx); err != nil {
+		return "", storeError("set", "", err)
+	}
 	defer s.Unlock()
 
-	if len(data) == 0 {
-		return "", fmt.Errorf("Invalid empty data")
+	id, err := set()
+	if err != nil && s.evictOnNoSpace && isNoSpaceError(err) {
+		s.log.Info("out of space storing image content, evicting", "size", size)
+		if err := s.evict(size); err != nil {
+			return "", storeError("set", "", err)
+		}
+		if id, err = set(); isNoSpaceError(err) {
+			err = storeError("set", id, ErrInsufficientSpace)
+		}
+	}
+	return id, err
+}
+
+// chunked returns whether content of size bytes is stored in chunks.
+func (s *fs) chunked(size int64) bool {
+	return s.chunkSize > 0 && size > s.chunkSize
+}
+
+// storedInline returns whether content of size bytes addressed with alg is
+// stored in the inline index.
+func (s *fs) storedInline(size int64, alg digest.Algorithm) bool {
+	return s.inlineThreshold > 0 && size <= int64(s.inlineThreshold) && alg == digest.Canonical
+}
+
+// setMulti stores content addressed with alg. It must be called with the
+// store write lock held.
+func (s *fs) setMulti(alg digest.Algorithm, data []byte, extra ...digest.Algorithm) (ID, map[digest.Algorithm]digest.Digest, error) {
+	if err := s.checkWritable(); err != nil {
+		return "", nil, storeError("set", "", err)
+	}
+	if len(data) == 0 && !s.allowEmpty {
+		return "", nil, storeError("set", "", ErrEmptyContent)
+	}
+	if !s.algorithmAllowed(alg) {
+		return "", nil, storeError("set", "", ErrUnsupportedAlgorithm)
+	}
+	if alg != s.algorithm {
+		if err := s.makeAlgorithmDirs(alg); err != nil {
+			return "", nil, storeError("set", "", err)
+		}
+	}
+
+	if s.verifyOnDuplicate {
+		id := s.duplicateID(alg, data)
+		if err := s.checkDuplicate(id, data); err != nil {
+			return "", nil, storeError("set", id, err)
+		}
+	}
+
+	var digester digest.Digester
+	var writers []io.Writer
+	sum := func() (id ID) {
+		s.withHashSlot(func() { id = s.idStrategy.Compute(data) })
+		return id
+	}
+	if s.idStrategy == nil {
+		digester = alg.New()
+		writers = append(writers, digester.Hash())
+		sum = func() ID { return ID(digester.Digest()) }
+	}
+	extraDigesters := make(map[digest.Algorithm]digest.Digester, len(extra))
+	for _, alg := range extra {
+		if !alg.Available() {
+			return "", nil, storeError("set", "", fmt.Errorf("unsupported digest algorithm %q", alg))
+		}
+		if _, ok := extraDigesters[alg]; ok {
+			continue
+		}
+		extraDigesters[alg] = alg.New()
+		writers = append(writers, extraDigesters[alg].Hash())
+	}
+	crc := crc32.NewIEEE()
+	if s.weakChecksums {
+		writers = append(writers, crc)
+	}
+	writers = []io.Writer{s.hashWriter(io.MultiWriter(writers...))}
+
+	var id ID
+	inline := s.storedInline(int64(len(data)), alg)
+	if inline {
+		// Writes to hashes never fail.
+		io.MultiWriter(writers...).Write(data)
+		id = sum()
+		if err := s.setInline(id, data); err != nil {
+			return "", nil, storeError("set", id, err)
+		}
+	} else {
+		var err error
+		if id, err = s.writeContentFile(data, sum, writers); err != nil {
+			return "", nil, storeError("set", id, err)
+		}
 	}
 
-	dgst, err := digest.FromBytes(data)
+	digests := make(map[digest.Algorithm]digest.Digest, len(extraDigesters))
+	for alg, d := range extraDigesters {
+		digests[alg] = d.Digest()
+	}
+
+	s.recordStored(id, int64(len(data)), crc.Sum32(), !inline && !s.chunked(int64(len(data))))
+
+	return id, digests, nil
+}
+
+// writeContentFile writes data to the content file of its ID, passing it
+// through writers on the way, and returns the ID computed by sum once they
+// have seen all of data.
+func (s *fs) writeContentFile(data []byte, sum func() ID, writers []io.Writer) (ID, error) {
+	tempFile, err := s.fsys.TempFile(s.tempDir(), "")
 	if err != nil {
 		return "", err
 	}
-	id := ID(dgst)
+	defer os.Remove(tempFile.Name())
+	// Chunked content is hashed as a whole, but only its manifest is
+	// written to the content file.
+	chunked := s.chunked(int64(len(data)))
+	out := io.MultiWriter(append(writers, tempFile)...)
+	if chunked {
+		out = io.MultiWriter(writers...)
+	}
+	_, err = out.Write(data)
+	if err == nil && chunked {
+		var m *chunkManifest
+		if m, err = s.writeChunks(data); err == nil {
+			_, err = tempFile.Write(m.encode())
+		}
+	}
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	id := sum()
+	if err != nil {
+		return id, err
+	}
+
+	if s.keepsStoredContent(id) {
+		return id, nil
+	}
+	return id, s.renameIntoPlace(tempFile.Name(), id)
+}
+
+// keepsStoredContent returns whether stored content of id must be kept as it
+// is instead of being replaced by a new copy, which is the case when its
+// metadata is in extended attributes of the content file that renaming over
+// it would drop. It must be called with the store lock held.
+func (s *fs) keepsStoredContent(id ID) bool {
+	if !s.metadataInContent {
+		return false
+	}
+	_, err := s.get(id)
+	return err == nil
+}
+
+// renameIntoPlace moves the file at tempPath to the content file of id. When
+// the filesystem can't rename across directories the file is copied next to
+// the content file and renamed from there, and the result is verified
+// before it is accepted.
+func (s *fs) renameIntoPlace(tempPath string, id ID) error {
 	filePath := s.contentFile(id)
-	tempFilePath := s.contentFile(id) + ".tmp"
-	if err := ioutil.WriteFile(tempFilePath, data, 0600); err != nil {
-		return "", err
+	if s.layout != nil {
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return err
+		}
 	}
-	if err := os.Rename(tempFilePath, filePath); err != nil {
-		return "", err
+	err := s.fsys.Rename(tempPath, filePath)
+	if err == nil {
+		s.addToBloom(id)
+		s.markUnsynced(filePath)
+		return nil
+	}
+	if !isCrossDeviceError(err) {
+		return err
 	}
 
-	return id, nil
+	s.log.Debug("retrying move of image content into place with a copy", "id", id, "err", err)
+	copyPath := filePath + ".tmp"
+	if err := copyFile(tempPath, copyPath); err != nil {
+		os.Remove(copyPath)
+		return err
+	}
+	if err := s.fsys.Rename(copyPath, filePath); err != nil {
+		os.Remove(copyPath)
+		return err
+	}
+	if _, err := s.get(id); err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	s.addToBloom(id)
+	s.markUnsynced(filePath)
+	return os.Remove(tempPath)
 }
 
 // Delete removes content and metadata files associated with the ID.
 func (s *fs) Delete(id ID) error {
-	s.Lock()
+	return s.DeleteContext(context.Background(), id)
+}
+
+// DeleteMany deletes the content and metadata of ids under a single lock and
+// keeps going past failures. It returns the IDs deleted and the errors of the
+// ones that couldn't be, which is nil if all succeeded. Held or mapped content
+// fails with ErrBusy. IDs that are already absent count as deleted, and
+// duplicate IDs are only deleted and reported once.
+func (s *fs) DeleteMany(ids ...ID) (deleted []ID, errs map[ID]error) {
+	if err := s.lockMutation(context.Background()); err != nil {
+		errs = make(map[ID]error, len(ids))
+		for _, id := range ids {
+			errs[id] = storeError("delete", id, err)
+		}
+		return nil, errs
+	}
 	defer s.Unlock()
 
-	if err := os.RemoveAll(s.metadataDir(id)); err != nil {
-		return err
+	seen := make(map[ID]bool, len(ids))
+	var chunks []digest.Digest
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		err := ErrBusy
+		if !s.isHeld(id) {
+			var deletedChunks []digest.Digest
+			deletedChunks, err = s.deleteContent(id)
+			chunks = append(chunks, deletedChunks...)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			if errs == nil {
+				errs = make(map[ID]error)
+			}
+			errs[id] = storeError("delete", id, err)
+			continue
+		}
+		deleted = append(deleted, id)
+	}
+	if err := s.pruneChunks(chunks); err != nil {
+		s.log.Warn("failed to prune image chunks", "err", err)
 	}
-	if err := os.Remove(s.contentFile(id)); err != nil {
+	return deleted, errs
+}
+
+func (s *fs) delete(id ID) error {
+	chunks, err := s.deleteContent(id)
+	if err != nil {
 		return err
 	}
-	return nil
+	return s.pruneChunks(chunks)
+}
+
+// deleteContent deletes the content and metadata of id like delete, but
+// leaves its chunks and returns them instead, for the caller to prune with
+// pruneChunks. Deleting a batch of content, the chunks are pruned once for
+// the whole batch. It must be called with the store write lock held.
+func (s *fs) deleteContent(id ID) ([]digest.Digest, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDeltaDependents(id); err != nil {
+		return nil, err
+	}
+	m, err := s.readChunkManifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	base, err := s.readDeltaBase(id)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	tombstone := s.tombstoneFile(id)
+	if err := os.MkdirAll(filepath.Dir(tombstone), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(tombstone, nil, 0600); err != nil {
+		return nil, err
+	}
+	inline, err := s.deleteInline(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(s.contentFile(id)); err != nil && !(inline && os.IsNotExist(err)) {
+		if ferr := s.finishDelete(id); ferr != nil {
+			s.log.Error("failed to clean up image", "id", id, "err", ferr)
+		}
+		return nil, err
+	}
+	if err := s.finishDelete(id); err != nil {
+		return nil, err
+	}
+	if base != "" {
+		if err := s.checkDeltaDependents(base); err != nil && !errors.Is(err, ErrDeltaBase) {
+			s.log.Warn("failed to update delta dependents of image", "id", base, "err", err)
+		}
+	}
+	if m != nil {
+		return m.chunks, nil
+	}
+	return nil, nil
 }
 
 // SetMetadata sets metadata for a given ID. It fails if there's no base file.
 func (s *fs) SetMetadata(id ID, key string, data []byte) error {
-	s.Lock()
-	defer s.Unlock()
-	if _, err := s.get(id); err != nil {
-		return err
+	if err := validateWritableMetadataKey(key); err != nil {
+		return storeError("setmetadata", id, err)
 	}
+	return s.setReservedMetadata(id, key, data)
+}
 
-	baseDir := filepath.Join(s.metadataDir(id))
-	if err := os.MkdirAll(baseDir, 0700); err != nil {
+// setReservedMetadata sets metadata like SetMetadata, but also takes the
+// reserved keys, for the store and the backends wrapping it to maintain
+// them.
+func (s *fs) setReservedMetadata(id ID, key string, data []byte) error {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		return storeError("setmetadata", id, err)
+	}
+	defer unlock()
+
+	return storeError("setmetadata", id, s.setMetadata(id, key, data))
+}
+
+func (s *fs) setMetadata(id ID, key string, data []byte) error {
+	if err := s.checkWritable(); err != nil {
 		return err
 	}
-	filePath := filepath.Join(s.metadataDir(id), key)
-	tempFilePath := filePath + ".tmp"
-	if err := ioutil.WriteFile(tempFilePath, data, 0600); err != nil {
+	if err := s.validateMetadata(key, data); err != nil {
 		return err
 	}
-	return os.Rename(tempFilePath, filePath)
+	if _, err := s.get(id); err != nil {
+		return err
+	}
+
+	return s.metadata.Set(id, key, data)
 }
 
 // GetMetadata returns metadata for a given ID.
 func (s *fs) GetMetadata(id ID, key string) ([]byte, error) {
 	s.RLock()
 	defer s.RUnlock()
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return nil, storeError("getmetadata", id, err)
+	}
+	defer unlock()
+
+	data, err := s.getMetadata(id, key)
+	if err != nil {
+		return nil, storeError("getmetadata", id, err)
+	}
+	return data, nil
+}
 
+func (s *fs) getMetadata(id ID, key string) ([]byte, error) {
+	if err := validateMetadataKey(key); err != nil {
+		return nil, err
+	}
 	if _, err := s.get(id); err != nil {
 		return nil, err
 	}
-	return ioutil.ReadFile(filepath.Join(s.metadataDir(id), key))
+	return s.metadata.Get(id, key)
+}
+
+// ListMetadata returns the metadata keys set for a given ID, leaving out the
+// reserved keys the store maintains itself.
+func (s *fs) ListMetadata(id ID) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return nil, storeError("listmetadata", id, err)
+	}
+	defer unlock()
+
+	if _, err := s.get(id); err != nil {
+		return nil, storeError("listmetadata", id, err)
+	}
+	all, err := s.metadata.List(id)
+	if err != nil {
+		return nil, storeError("listmetadata", id, err)
+	}
+	keys := all[:0]
+	for _, key := range all {
+		if !isReservedMetadataKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
 }
 
 // DeleteMetadata removes the metadata associated with an ID.
 func (s *fs) DeleteMetadata(id ID, key string) error {
-	s.Lock()
-	defer s.Unlock()
+	if err := validateWritableMetadataKey(key); err != nil {
+		return storeError("deletemetadata", id, err)
+	}
+	return s.deleteReservedMetadata(id, key)
+}
+
+// deleteReservedMetadata removes metadata like DeleteMetadata, but also
+// takes the reserved keys.
+func (s *fs) deleteReservedMetadata(id ID, key string) error {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		return storeError("deletemetadata", id, err)
+	}
+	defer unlock()
 
-	return os.RemoveAll(filepath.Join(s.metadataDir(id), key))
+	if err := s.checkWritable(); err != nil {
+		return storeError("deletemetadata", id, err)
+	}
+	return storeError("deletemetadata", id, s.metadata.Delete(id, key))
 }
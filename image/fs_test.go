@@ -4,16 +4,39 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution/digest"
 )
 
+// newTestFSStore returns a store in a new temporary directory, and the
+// function removing it.
+func newTestFSStore(t testing.TB) (*fs, func()) {
+	return newTestFSStoreOptions(t, FSOptions{})
+}
+
+func newTestFSStoreOptions(t testing.TB, opts FSOptions) (*fs, func()) {
+	tmpdir, err := ioutil.TempDir("", "images-fs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := newFSStore(tmpdir, opts)
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		t.Fatal(err)
+	}
+	return fs, func() { os.RemoveAll(tmpdir) }
+}
+
 func TestFSGetSet(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "images-fs-store")
 	if err != nil {
@@ -56,6 +79,29 @@ func TestFSGetInvalidData(t *testing.T) {
 	}
 }
 
+func TestFSGetCorruptStoreError(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, fs, id)
+
+	_, err = fs.Get(id)
+	var serr *StoreError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Expected StoreError, got %v", err)
+	}
+	if serr.Op != "get" || serr.ID != id {
+		t.Fatalf("Expected StoreError for get %v, got op %q id %v", id, serr.Op, serr.ID)
+	}
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected error to match ErrCorrupt, got %v", err)
+	}
+}
+
 func TestFSInvalidSet(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "images-fs-store")
 	if err != nil {
@@ -120,6 +166,101 @@ func TestFSInvalidRoot(t *testing.T) {
 
 }
 
+func TestFSRootOverlap(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "images-fs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	root := filepath.Join(tmpdir, "root")
+	shared := filepath.Join(tmpdir, "shared")
+	for _, opts := range []FSOptions{
+		{ContentDir: shared, MetadataDir: shared},
+		{ContentDir: shared, MetadataDir: filepath.Join(shared, "metadata")},
+		{ContentDir: filepath.Join(shared, "content"), MetadataDir: shared},
+		{MetadataDir: filepath.Join(root, "content", "metadata")},
+		{ContentDir: filepath.Join(root, "content", ".."), MetadataDir: root + "/./"},
+	} {
+		if _, err := newFSStore(root, opts); !errors.Is(err, ErrRootOverlap) {
+			t.Fatalf("Expected ErrRootOverlap for %+v, got %v", opts, err)
+		}
+		for _, dir := range []string{root, shared} {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Fatalf("Expected nothing written to %s for %+v, got %v", dir, opts, err)
+			}
+		}
+	}
+
+	fs, err := newFSStore(root, FSOptions{ContentDir: filepath.Join(shared, "content"), MetadataDir: filepath.Join(shared, "metadata")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.Digest(id)
+	if _, err := os.Stat(filepath.Join(shared, "content", string(dgst.Algorithm()), dgst.Hex())); err != nil {
+		t.Fatalf("Expected content in the configured directory, got %v", err)
+	}
+}
+
+func TestFSNamespaces(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "images-fs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	fs1, err := NewFSStoreBackendWithOptions(tmpdir, FSOptions{Namespace: "ns1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs2, err := NewFSStoreBackendWithOptions(tmpdir, FSOptions{Namespace: "ns2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id1, err := fs1.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs2.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.Set([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked []ID
+	if err := fs1.Walk(func(id ID) error {
+		walked = append(walked, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || walked[0] != id1 {
+		t.Fatalf("Expected namespace walk to visit only %v, got %v", id1, walked)
+	}
+	if _, err := fs1.Get(id2); err == nil {
+		t.Fatalf("Expected get of %v from other namespace to fail", id2)
+	}
+
+	if err := fs1.Delete(id1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.Get(id1); err != nil {
+		t.Fatalf("Expected delete to leave other namespace intact, got %v", err)
+	}
+
+	for _, ns := range []string{"..", "foo/bar", "sha256"} {
+		if _, err := NewFSStoreBackendWithOptions(tmpdir, FSOptions{Namespace: ns}); err == nil {
+			t.Fatalf("Expected error for invalid namespace %q", ns)
+		}
+	}
+}
+
 func testMetadataGetSet(t *testing.T, store StoreBackend) {
 	id, err := store.Set([]byte("foo"))
 	if err != nil {
@@ -190,6 +331,115 @@ func TestFSMetadataGetSet(t *testing.T) {
 	testMetadataGetSet(t, fs)
 }
 
+func TestFSXattrMetadataGetSet(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{XattrMetadata: true})
+	defer cleanup()
+	if !fs.metadataInContent {
+		t.Skip("extended attributes are not supported")
+	}
+
+	testMetadataGetSet(t, fs)
+	testMetadataList(t, fs)
+}
+
+func TestFSMetadataList(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	testMetadataList(t, fs)
+}
+
+func testMetadataList(t *testing.T, store *fs) {
+	id, err := store.Set([]byte("list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := store.ListMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Expected no metadata keys, got %v", keys)
+	}
+
+	for _, key := range []string{"tkey2", "tkey"} {
+		if err := store.SetMetadata(id, key, []byte("tval")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeleteMetadata(id, "tkey2"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = store.ListMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "tkey" {
+		t.Fatalf("Expected metadata keys [tkey], got %v", keys)
+	}
+
+	// storing the content again must keep its metadata
+	if _, err := store.Set([]byte("list")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetMetadata(id, "tkey"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSConcurrentMetadata(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "images-fs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	fs, err := NewFSStoreBackend(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "tkey", []byte("value-000")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := fs.SetMetadata(id, "tkey", []byte(fmt.Sprintf("value-%d%02d", w, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 20; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				value, err := fs.GetMetadata(id, "tkey")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(value) != len("value-000") || !bytes.HasPrefix(value, []byte("value-")) {
+					t.Errorf("Inconsistent metadata value %q", value)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func TestFSDelete(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "images-fs-store")
 	if err != nil {
@@ -254,6 +504,48 @@ func TestFSInvalidWalker(t *testing.T) {
 	}
 }
 
+func TestFSWalkConcurrentDelete(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 50; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	walked := make(map[ID]bool)
+	err := fs.Walk(func(id ID) error {
+		if len(walked) == 0 {
+			// Delete every other ID. The walk is at the first one, which
+			// may be among them.
+			for i, id := range ids {
+				if i%2 == 0 {
+					if err := fs.Delete(id); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		walked[id] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected walk to complete despite deletes, got %v", err)
+	}
+	for i, id := range ids {
+		if i%2 == 1 && !walked[id] {
+			t.Fatalf("Expected walk to visit %v", id)
+		}
+	}
+	if len(walked) > len(ids)/2+1 {
+		t.Fatalf("Expected walk to skip deleted content, visited %d IDs", len(walked))
+	}
+}
+
 func testGetSet(t *testing.T, store StoreBackend) {
 	type tcase struct {
 		input    []byte
@@ -388,4 +680,202 @@ func testWalker(t *testing.T, store StoreBackend) {
 	if err == nil {
 		t.Fatalf("Exected error from walker.")
 	}
+
+	// stop early without error
+	n = 0
+	err = store.Walk(func(id ID) error {
+		n++
+		return ErrStopWalk
+	})
+	if err != nil {
+		t.Fatalf("Expected ErrStopWalk to stop the walk without error, got %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 walk initialization, got %d", n)
+	}
+}
+
+func TestFSLastUsed(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{TrackLastUsed: true})
+	defer cleanup()
+	now := time.Now().Add(time.Hour)
+	fs.now = func() time.Time { return now }
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := fs.LastUsed(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Before(now) {
+		t.Fatalf("Expected unused content to report its creation time, got %v", last)
+	}
+
+	if _, err := fs.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	// a reopened store reads the persisted time
+	fs2, err := newFSStore(fs.root, FSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err = fs2.LastUsed(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Equal(now) {
+		t.Fatalf("Expected last use %v, got %v", now, last)
+	}
+}
+
+func TestFSSetMulti(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("foobar")
+	id, digests, err := fs.SetMulti(data, digest.SHA512, digest.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ID("sha256:c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2") {
+		t.Fatalf("Unexpected ID %v", id)
+	}
+	// skipping use of digest pkg because its used by the implementation
+	sha512Sum := sha512.Sum512(data)
+	sha384Sum := sha512.Sum384(data)
+	expected := map[digest.Algorithm]digest.Digest{
+		digest.SHA512: digest.Digest("sha512:" + hex.EncodeToString(sha512Sum[:])),
+		digest.SHA384: digest.Digest("sha384:" + hex.EncodeToString(sha384Sum[:])),
+	}
+	if len(digests) != len(expected) {
+		t.Fatalf("Expected %d extra digests, got %v", len(expected), digests)
+	}
+	for alg, dgst := range expected {
+		if digests[alg] != dgst {
+			t.Fatalf("Expected %s digest %v, got %v", alg, dgst, digests[alg])
+		}
+	}
+	if _, err := fs.Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := fs.SetMulti(data, digest.Algorithm("md5")); err == nil {
+		t.Fatal("Expected error for unsupported algorithm")
+	}
+}
+
+func TestFSAllowedAlgorithms(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strict, err := newFSStore(fs.root, FSOptions{AllowedAlgorithms: []digest.Algorithm{digest.SHA512}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.Get(id); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("Expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+	if _, err := strict.GetMetadata(id, "parent"); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("Expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+	if _, err := strict.Set([]byte("bar")); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("Expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+	if err := strict.Walk(func(id ID) error {
+		t.Fatalf("Expected disallowed %v to be skipped", id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, err := newFSStore(fs.root, FSOptions{AllowedAlgorithms: []digest.Algorithm{digest.SHA256, digest.SHA512}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allowed.Get(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSDeleteMany(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	present, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := digest.FromBytes([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	absent := ID(dgst)
+	release := fs.Hold(busy)
+	defer release()
+
+	deleted, errs := fs.DeleteMany(present, busy, absent, present)
+	if len(deleted) != 2 || deleted[0] != present || deleted[1] != absent {
+		t.Fatalf("Expected deleted [%v %v], got %v", present, absent, deleted)
+	}
+	if len(errs) != 1 || !errors.Is(errs[busy], ErrBusy) {
+		t.Fatalf("Expected ErrBusy for %v, got %v", busy, errs)
+	}
+	if _, err := fs.Get(present); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Fatalf("Expected %v to be deleted, got %v", present, err)
+	}
+	if _, err := fs.Get(busy); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSAllowEmptyContent(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	if _, err := fs.Set(nil); !errors.Is(err, ErrEmptyContent) {
+		t.Fatalf("Expected ErrEmptyContent by default, got %v", err)
+	}
+
+	for _, opts := range []FSOptions{
+		{AllowEmptyContent: true},
+		{AllowEmptyContent: true, InlineThreshold: 16, Namespace: "inline"},
+	} {
+		fs, err := newFSStore(fs.root, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := fs.Set([]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != EmptyContentID {
+			t.Fatalf("Expected ID %v, got %v", EmptyContentID, id)
+		}
+		data, err := fs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 0 {
+			t.Fatalf("Expected empty content, got %q", data)
+		}
+		var ids []ID
+		if err := fs.Walk(func(id ID) error {
+			ids = append(ids, id)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != EmptyContentID {
+			t.Fatalf("Expected walk to find %v, got %v", EmptyContentID, ids)
+		}
+	}
 }
@@ -0,0 +1,212 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const fsckCursorFileName = "fsck-cursor"
+
+// Fsck verifies the content of every image in the store and returns the IDs
+// whose data doesn't match their digest.
+func (s *fs) Fsck() ([]ID, error) {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+	return s.verify(ids)
+}
+
+// FsckParallel verifies the content of every image in the store like Fsck,
+// hashing with the given number of workers. The result is sorted like the
+// one of Fsck. It stops early with the error of ctx if ctx is done.
+func (s *fs) FsckParallel(ctx context.Context, workers int) ([]ID, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid fsck worker count %d", workers)
+	}
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	work := make(chan ID)
+	var (
+		mu      sync.Mutex
+		corrupt []ID
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				found, _ := s.verify([]ID{id})
+				if len(found) > 0 {
+					mu.Lock()
+					corrupt = append(corrupt, found...)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, id := range ids {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		select {
+		case work <- id:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(idSlice(corrupt))
+	return corrupt, nil
+}
+
+// FsckAll verifies the content of every namespace sharing the store root and
+// returns the corrupt IDs keyed by namespace. The default namespace is "".
+func (s *fs) FsckAll() (map[string][]ID, error) {
+	dir, err := ioutil.ReadDir(s.contentRoot)
+	if err != nil {
+		return nil, err
+	}
+	layoutDirs, err := s.defaultLayoutDirs()
+	if err != nil {
+		return nil, err
+	}
+	namespaces := []string{""}
+	for _, v := range dir {
+		if !v.IsDir() || validateNamespace(v.Name()) != nil || layoutDirs[v.Name()] {
+			continue
+		}
+		namespaces = append(namespaces, v.Name())
+	}
+
+	result := make(map[string][]ID)
+	for _, ns := range namespaces {
+		nsStore := s
+		if ns != s.namespace {
+			opts := s.opts
+			opts.Namespace = ns
+			if nsStore, err = newFSStore(s.root, opts); err != nil {
+				return nil, err
+			}
+			// The other namespaces are read through the same filesystem
+			// and within the same limit of open files.
+			nsStore.fsys, nsStore.openFiles = s.fsys, s.openFiles
+		}
+		corrupt, err := nsStore.Fsck()
+		if err != nil {
+			return nil, err
+		}
+		if len(corrupt) > 0 {
+			result[ns] = corrupt
+		}
+	}
+	return result, nil
+}
+
+// FsckSample verifies only the given fraction of the stored content. Runs are
+// round-robin: the last verified ID is persisted in the store root, per
+// namespace, so the next run continues where the previous one stopped, and
+// every blob is eventually checked.
+func (s *fs) FsckSample(fraction float64) (corrupt []ID, checked int, err error) {
+	if fraction <= 0 || fraction > 1 {
+		return nil, 0, fmt.Errorf("invalid fsck sample fraction %v", fraction)
+	}
+
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ids) == 0 {
+		return nil, 0, nil
+	}
+
+	cursorName := fsckCursorFileName + s.namespaceSuffix()
+	cursor, err := ioutil.ReadFile(filepath.Join(s.root, cursorName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	start := sort.Search(len(ids), func(i int) bool {
+		return ids[i] > ID(cursor)
+	})
+
+	n := int(math.Ceil(fraction * float64(len(ids))))
+	sample := make([]ID, 0, n)
+	for i := 0; i < n; i++ {
+		sample = append(sample, ids[(start+i)%len(ids)])
+	}
+
+	corrupt, err = s.verify(sample)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.writeRootFile(cursorName, []byte(sample[len(sample)-1])); err != nil {
+		return nil, 0, err
+	}
+	return corrupt, len(sample), nil
+}
+
+// verify re-hashes the content of ids and returns the ones that fail
+// verification. IDs removed since they were listed are ignored.
+func (s *fs) verify(ids []ID) ([]ID, error) {
+	var corrupt []ID
+	for _, id := range ids {
+		s.RLock()
+		_, err := s.getVerified(id)
+		s.RUnlock()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			corrupt = append(corrupt, id)
+		}
+	}
+	return corrupt, nil
+}
+
+// sortedIDs returns the IDs of all content in the store in lexical order.
+func (s *fs) sortedIDs() ([]ID, error) {
+	var ids []ID
+	if err := s.Walk(func(id ID) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Sort(idSlice(ids))
+	return ids, nil
+}
+
+func (s *fs) writeRootFile(name string, data []byte) error {
+	filePath := filepath.Join(s.root, name)
+	tempFilePath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempFilePath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFilePath, filePath)
+}
+
+type idSlice []ID
+
+func (ids idSlice) Len() int           { return len(ids) }
+func (ids idSlice) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids idSlice) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
@@ -0,0 +1,242 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+func TestFsck(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	if _, err := fs.Set([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, fs, id)
+
+	corrupt, err := fs.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != id {
+		t.Fatalf("Expected corrupt IDs [%v], got %v", id, corrupt)
+	}
+}
+
+func TestFsckSample(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 10; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	corruptContent(t, fs, ids[7])
+
+	found := false
+	for run := 0; run < 4; run++ {
+		corrupt, checked, err := fs.FsckSample(0.3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checked != 3 {
+			t.Fatalf("Expected 3 checked blobs, got %d", checked)
+		}
+		for _, id := range corrupt {
+			if id != ids[7] {
+				t.Fatalf("Unexpected corrupt ID %v", id)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expected corrupt blob to be found across sampled runs")
+	}
+
+	if _, _, err := fs.FsckSample(0); err == nil {
+		t.Fatal("Expected error for zero sample fraction")
+	}
+}
+
+func TestFsckSampleNamespaces(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	nsfs, err := newFSStore(fs.root, FSOptions{Namespace: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []ID
+	for i := 0; i < 4; i++ {
+		data := []byte(fmt.Sprintf("content%d", i))
+		id, err := fs.Set(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nsfs.Set(data); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(idSlice(ids))
+	corruptContent(t, nsfs, ids[0])
+
+	// Each namespace keeps its own cursor, so sampling the default one
+	// doesn't skip the first half of the other.
+	if _, _, err := fs.FsckSample(0.5); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, checked, err := nsfs.FsckSample(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 || len(corrupt) != 1 || corrupt[0] != ids[0] {
+		t.Fatalf("Expected 2 checked blobs with %v corrupt, got %d with %v", ids[0], checked, corrupt)
+	}
+}
+
+func TestFsckAllNamespaces(t *testing.T) {
+	// The other namespaces are verified with the options of the store, like
+	// its content layout.
+	for _, opts := range []FSOptions{{}, {ContentLayout: flatLayout{}}} {
+		fs, cleanup := newTestFSStoreOptions(t, opts)
+		defer cleanup()
+		nsOpts := opts
+		nsOpts.Namespace = "other"
+		nsfs, err := newFSStore(fs.root, nsOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fs.Set([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		id, err := nsfs.Set([]byte("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corruptContent(t, nsfs, id)
+
+		corrupt, err := fs.FsckAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(corrupt) != 1 || len(corrupt["other"]) != 1 || corrupt["other"][0] != id {
+			t.Fatalf("Expected corrupt %v in namespace other, got %v", id, corrupt)
+		}
+		// The directories of the layout aren't namespaces.
+		if _, err := os.Stat(filepath.Join(fs.contentRoot, "blobs", string(digest.Canonical))); !os.IsNotExist(err) {
+			t.Fatalf("Expected no namespace store for the layout directory, got %v", err)
+		}
+	}
+}
+
+func corruptContent(t *testing.T, s *fs, id ID) {
+	if err := ioutil.WriteFile(s.contentFile(id), []byte("corrupt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowOpenFS delays every open, standing in for slow storage.
+type slowOpenFS struct {
+	osFileSystem
+	delay time.Duration
+}
+
+func (f slowOpenFS) Open(name string) (io.ReadCloser, error) {
+	time.Sleep(f.delay)
+	return f.osFileSystem.Open(name)
+}
+
+// overlapOpenFS holds every open until another one is in flight, or for a
+// second at most, and records the most opens in flight at once.
+type overlapOpenFS struct {
+	osFileSystem
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	overlapped  chan struct{}
+}
+
+func (f *overlapOpenFS) Open(name string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+		if f.maxInFlight == 2 {
+			close(f.overlapped)
+		}
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	select {
+	case <-f.overlapped:
+	case <-time.After(time.Second):
+	}
+	return f.osFileSystem.Open(name)
+}
+
+func TestFsckParallel(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 20; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	corruptContent(t, fs, ids[4])
+	corruptContent(t, fs, ids[15])
+
+	serial, err := fs.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := &overlapOpenFS{overlapped: make(chan struct{})}
+	fs.fsys = fsys
+	parallel, err := fs.FsckParallel(context.Background(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parallel, serial) || len(serial) != 2 {
+		t.Fatalf("Expected parallel result %v to match serial result %v", parallel, serial)
+	}
+	if fsys.maxInFlight < 2 {
+		t.Fatalf("Expected parallel fsck to read content concurrently, got at most %d reads at once", fsys.maxInFlight)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.FsckParallel(ctx, 2); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// Hold protects ids from garbage collection until the returned release
+// function is called. Holds are counted, so an ID stays protected while any
+// of its holds is active. Callers should release with defer so that the
+// holds are dropped even if the operation panics:
+//
+//	release := s.Hold(ids...)
+//	defer release()
+func (s *fs) Hold(ids ...ID) (release func()) {
+	// Taking the store lock orders the hold against a garbage collection
+	// deleting the same content.
+	s.RLock()
+	s.holdsMu.Lock()
+	if s.holds == nil {
+		s.holds = make(map[ID]int)
+	}
+	for _, id := range ids {
+		s.holds[id]++
+	}
+	s.holdsMu.Unlock()
+	s.RUnlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.holdsMu.Lock()
+			defer s.holdsMu.Unlock()
+			for _, id := range ids {
+				if s.holds[id]--; s.holds[id] <= 0 {
+					delete(s.holds, id)
+				}
+			}
+		})
+	}
+}
+
+func (s *fs) isHeld(id ID) bool {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	return s.holds[id] > 0
+}
+
+// protected returns whether id is held or pinned.
+func (s *fs) protected(id ID) bool {
+	if s.isHeld(id) {
+		return true
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.isPinned(id)
+}
+
+// pinnedKey is the metadata key marking content as pinned.
+const pinnedKey = "pinned"
+
+// Pin protects the content of id from garbage collection until it is
+// unpinned. Unlike holds, pins are persisted.
+func (s *fs) Pin(id ID) error {
+	return s.setReservedMetadata(id, pinnedKey, []byte("1"))
+}
+
+// Unpin removes the pin of id.
+func (s *fs) Unpin(id ID) error {
+	return s.deleteReservedMetadata(id, pinnedKey)
+}
+
+// isPinned must be called with the store lock held.
+func (s *fs) isPinned(id ID) bool {
+	_, err := s.metadata.Get(id, pinnedKey)
+	return err == nil
+}
+
+// Classify sorts all content into pinned, referenced and orphaned. Content
+// is referenced if its ID is in live, currently held or aliased. Pinned
+// takes precedence over referenced, so every ID is in exactly one of the
+// lists.
+func (s *fs) Classify(live []ID) (pinned, referenced, orphaned []ID, err error) {
+	liveSet, err := s.liveSet(live)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, id := range ids {
+		s.RLock()
+		isPinned := s.isPinned(id)
+		s.RUnlock()
+		_, isLive := liveSet[id]
+		switch {
+		case isPinned:
+			pinned = append(pinned, id)
+		case isLive || s.isHeld(id):
+			referenced = append(referenced, id)
+		default:
+			orphaned = append(orphaned, id)
+		}
+	}
+	return pinned, referenced, orphaned, nil
+}
+
+// GarbageCollect deletes all content whose ID isn't in live and isn't held,
+// pinned or aliased, and returns the IDs of the deleted content. The store
+// is in maintenance while it runs, see EnterMaintenance.
+func (s *fs) GarbageCollect(live []ID) ([]ID, error) {
+	s.EnterMaintenance()
+	defer s.ExitMaintenance()
+
+	liveSet, err := s.liveSet(live)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		deleted []ID
+		chunks  []digest.Digest
+	)
+	defer func() {
+		if len(chunks) == 0 {
+			return
+		}
+		s.Lock()
+		defer s.Unlock()
+		if err := s.pruneChunks(chunks); err != nil {
+			s.log.Warn("failed to prune image chunks", "err", err)
+		}
+	}()
+	for _, id := range ids {
+		if _, ok := liveSet[id]; ok {
+			continue
+		}
+		s.Lock()
+		ok, err := s.collect(id, &chunks)
+		s.Unlock()
+		if err != nil {
+			return deleted, storeError("gc", id, err)
+		}
+		if ok {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, nil
+}
+
+// liveSet returns the set of live and aliased IDs.
+func (s *fs) liveSet(live []ID) (map[ID]struct{}, error) {
+	s.RLock()
+	aliased, err := s.aliasTargets()
+	s.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	liveSet := make(map[ID]struct{}, len(live)+len(aliased))
+	for _, id := range live {
+		liveSet[id] = struct{}{}
+	}
+	for id := range aliased {
+		liveSet[id] = struct{}{}
+	}
+	return liveSet, nil
+}
+
+// collect deletes the content of id unless it is held or pinned, and adds
+// its chunks to the ones to prune once the collection ends. It must be
+// called with the store write lock held.
+func (s *fs) collect(id ID, chunks *[]digest.Digest) (bool, error) {
+	if s.isHeld(id) || s.isPinned(id) {
+		return false, nil
+	}
+	deletedChunks, err := s.deleteContent(id)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, ErrDeltaBase) {
+			return false, nil
+		}
+		return false, err
+	}
+	*chunks = append(*chunks, deletedChunks...)
+	return true, nil
+}
+
+// ContentInfo describes stored content to the predicate of DeleteWhere.
+type ContentInfo struct {
+	ID   ID
+	Size int64
+	// Created is when the content was stored.
+	Created time.Time
+	// LastUsed is when the content was last read, as returned by LastUsed.
+	LastUsed time.Time
+}
+
+// DeleteWhere deletes the content for which pred returns true and returns
+// the IDs of the deleted content. Content that is held, pinned, aliased, or
+// referred to by the metadata of other content, like the parent of an image,
+// is protected and never passed to pred; neither is staged content. With
+// dryRun nothing is deleted, and the IDs that would have been are returned.
+func (s *fs) DeleteWhere(pred func(info ContentInfo) bool, dryRun bool) ([]ID, error) {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := s.referencedIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		deleted []ID
+		chunks  []digest.Digest
+	)
+	defer func() {
+		if len(chunks) == 0 {
+			return
+		}
+		if err := s.lockMutation(context.Background()); err != nil {
+			return
+		}
+		defer s.Unlock()
+		if err := s.pruneChunks(chunks); err != nil {
+			s.log.Warn("failed to prune image chunks", "err", err)
+		}
+	}()
+	for _, id := range ids {
+		if referenced[id] {
+			continue
+		}
+		s.RLock()
+		protected := s.isHeld(id) || s.isPinned(id)
+		s.RUnlock()
+		if protected {
+			continue
+		}
+		info, err := s.contentInfo(id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return deleted, storeError("deletewhere", id, err)
+		}
+		if !pred(info) {
+			continue
+		}
+		if dryRun {
+			deleted = append(deleted, id)
+			continue
+		}
+		if err := s.lockMutation(context.Background()); err != nil {
+			return deleted, storeError("deletewhere", id, err)
+		}
+		ok, err := s.collect(id, &chunks)
+		s.Unlock()
+		if err != nil {
+			return deleted, storeError("deletewhere", id, err)
+		}
+		if ok {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, nil
+}
+
+// PruneKeepingRecent deletes the content created more than maxAge ago and
+// returns the IDs of the deleted content, like DeleteWhere. The keepMin most
+// recently created blobs are kept whatever their age, so that an idle period
+// doesn't empty the store.
+func (s *fs) PruneKeepingRecent(maxAge time.Duration, keepMin int) ([]ID, error) {
+	if keepMin < 0 {
+		return nil, fmt.Errorf("invalid number of images to keep %d", keepMin)
+	}
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ContentInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := s.contentInfo(id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, storeError("prune", id, err)
+		}
+		infos = append(infos, info)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Created.After(infos[j].Created)
+	})
+	recent := make(map[ID]bool, keepMin)
+	for i := 0; i < keepMin && i < len(infos); i++ {
+		recent[infos[i].ID] = true
+	}
+
+	now := s.now()
+	return s.DeleteWhere(func(info ContentInfo) bool {
+		return !recent[info.ID] && now.Sub(info.Created) > maxAge
+	}, false)
+}
+
+// referencedIDs returns the IDs among ids that aliases or the metadata of
+// stored content refer to.
+func (s *fs) referencedIDs(ids []ID) (map[ID]bool, error) {
+	stored := make(map[ID]bool, len(ids))
+	for _, id := range ids {
+		stored[id] = true
+	}
+	s.RLock()
+	referenced, err := s.aliasTargets()
+	s.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.RLock()
+		err := s.addReferences(referenced, stored, id)
+		s.RUnlock()
+		if err != nil {
+			return nil, storeError("deletewhere", id, err)
+		}
+	}
+	return referenced, nil
+}
+
+// addReferences sets the IDs among stored that the metadata of id refers
+// to in referenced. It must be called with the store lock held.
+func (s *fs) addReferences(referenced, stored map[ID]bool, id ID) error {
+	keys, err := s.metadata.List(id)
+	for _, key := range keys {
+		var data []byte
+		if data, err = s.metadata.Get(id, key); err != nil {
+			break
+		}
+		if ref := ID(data); stored[ref] && ref != id && digest.Digest(ref).Validate() == nil {
+			referenced[ref] = true
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fs) contentInfo(id ID) (ContentInfo, error) {
+	info := ContentInfo{ID: id}
+	s.RLock()
+	size, err := s.contentSize(id)
+	path := s.contentFile(id)
+	if _, ok := s.inline[s.normalizeID(id)]; ok {
+		path = s.inlineIndexFile()
+	}
+	s.RUnlock()
+	if err != nil {
+		return info, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return info, err
+	}
+	if info.LastUsed, err = s.LastUsed(id); err != nil {
+		return info, err
+	}
+	info.Size, info.Created = size, fi.ModTime()
+	return info, nil
+}
@@ -0,0 +1,245 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	liveID, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadID, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := fs.GarbageCollect([]ID{liveID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != deadID {
+		t.Fatalf("Expected %v to be collected, got %v", deadID, deleted)
+	}
+	if _, err := fs.Get(liveID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGarbageCollectHold(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := fs.Hold(id)
+	deleted, err := fs.GarbageCollect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("Expected held content to survive, got %v collected", deleted)
+	}
+	if _, err := fs.Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	release()
+	release()
+	deleted, err = fs.GarbageCollect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != id {
+		t.Fatalf("Expected %v to be collected after release, got %v", id, deleted)
+	}
+}
+
+func TestGarbageCollectPinned(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Pin(id); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := fs.GarbageCollect(nil); err != nil || len(deleted) != 0 {
+		t.Fatalf("Expected pinned content to survive, got %v, %v", deleted, err)
+	}
+	if err := fs.Unpin(id); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := fs.GarbageCollect(nil); err != nil || len(deleted) != 1 {
+		t.Fatalf("Expected unpinned content to be collected, got %v, %v", deleted, err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	ids := make(map[string]ID)
+	for _, name := range []string{"pinned", "pinnedlive", "live", "held", "orphan"} {
+		id, err := fs.Set([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	for _, name := range []string{"pinned", "pinnedlive"} {
+		if err := fs.Pin(ids[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release := fs.Hold(ids["held"])
+	defer release()
+
+	pinned, referenced, orphaned, err := fs.Classify([]ID{ids["pinnedlive"], ids["live"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[ID]string{
+		ids["pinned"]:     "pinned",
+		ids["pinnedlive"]: "pinned",
+		ids["live"]:       "referenced",
+		ids["held"]:       "referenced",
+		ids["orphan"]:     "orphaned",
+	}
+	actual := make(map[ID]string)
+	for category, list := range map[string][]ID{"pinned": pinned, "referenced": referenced, "orphaned": orphaned} {
+		for _, id := range list {
+			if _, ok := actual[id]; ok {
+				t.Fatalf("Expected %v in exactly one category", id)
+			}
+			actual[id] = category
+		}
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d classified IDs, got %d", len(expected), len(actual))
+	}
+	for id, category := range expected {
+		if actual[id] != category {
+			t.Fatalf("Expected %v to be %s, got %q", id, category, actual[id])
+		}
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	set := func(data string, age time.Duration) ID {
+		id, err := fs.Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := now.Add(-age)
+		if err := os.Chtimes(fs.contentFile(id), created, created); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	month := 30 * 24 * time.Hour
+	newID := set("new", time.Hour)
+	oldID := set("old", 2*month)
+	pinnedID := set("pinned", 2*month)
+	heldID := set("held", 2*month)
+	parentID := set("parent", 2*month)
+	childID := set("child", time.Hour)
+	if err := fs.Pin(pinnedID); err != nil {
+		t.Fatal(err)
+	}
+	release := fs.Hold(heldID)
+	defer release()
+	if err := fs.SetMetadata(childID, "parent", []byte(parentID)); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []ID
+	olderThanMonth := func(info ContentInfo) bool {
+		seen = append(seen, info.ID)
+		if info.Size == 0 {
+			t.Fatalf("Expected the size of %v", info.ID)
+		}
+		return now.Sub(info.Created) > month
+	}
+	for _, dryRun := range []bool{true, false} {
+		seen = nil
+		deleted, err := fs.DeleteWhere(olderThanMonth, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 1 || deleted[0] != oldID {
+			t.Fatalf("Expected only %v deleted with dry run %v, got %v", oldID, dryRun, deleted)
+		}
+		for _, id := range seen {
+			if id == pinnedID || id == heldID || id == parentID {
+				t.Fatalf("Expected protected %v not to be passed to the predicate", id)
+			}
+		}
+		_, err = fs.Get(oldID)
+		if dryRun && err != nil {
+			t.Fatalf("Expected dry run to keep %v, got %v", oldID, err)
+		}
+		if !dryRun && err == nil {
+			t.Fatalf("Expected %v to be deleted", oldID)
+		}
+	}
+	for _, id := range []ID{newID, pinnedID, heldID, parentID, childID} {
+		if _, err := fs.Get(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPruneKeepingRecent(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	var ids []ID
+	for i := 0; i < 5; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// content4 is the most recent, all of them are older than a day.
+		created := now.Add(-48*time.Hour + time.Duration(i)*time.Hour)
+		if err := os.Chtimes(fs.contentFile(id), created, created); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	deleted, err := fs.PruneKeepingRecent(24*time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 3 {
+		t.Fatalf("Expected 3 deleted images, got %v", deleted)
+	}
+	for i, id := range ids {
+		_, err := fs.Get(id)
+		if kept := i >= 3; kept != (err == nil) {
+			t.Fatalf("Expected content%d to be kept: %v, got error %v", i, kept, err)
+		}
+	}
+
+	if _, err := fs.PruneKeepingRecent(time.Hour, -1); err == nil {
+		t.Fatal("Expected error for negative number of images to keep")
+	}
+}
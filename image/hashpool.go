@@ -0,0 +1,39 @@
+package image
+
+import "io"
+
+// withHashSlot runs f, which hashes content in memory, once fewer than
+// FSOptions.HashConcurrency goroutines of the store are hashing. f must not
+// block on anything but the CPU, so that operations waiting for a slot
+// while they hold other resources can't deadlock.
+func (s *fs) withHashSlot(f func()) {
+	if s.hashSlots == nil {
+		f()
+		return
+	}
+	s.hashSlots <- struct{}{}
+	defer func() { <-s.hashSlots }()
+	f()
+}
+
+// hashWriter returns a writer passing the writes to w, which hashes them,
+// in hash slots. Only the hashing takes a slot, not the I/O interleaved
+// with it.
+func (s *fs) hashWriter(w io.Writer) io.Writer {
+	if s.hashSlots == nil {
+		return w
+	}
+	return &slottedWriter{s: s, w: w}
+}
+
+type slottedWriter struct {
+	s *fs
+	w io.Writer
+}
+
+func (w *slottedWriter) Write(p []byte) (n int, err error) {
+	w.s.withHashSlot(func() {
+		n, err = w.w.Write(p)
+	})
+	return n, err
+}
@@ -0,0 +1,118 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// slowStrategy computes digest IDs slowly, recording how many computations
+// run at once.
+type slowStrategy struct {
+	active, max int32
+}
+
+func (s *slowStrategy) Algorithm() digest.Algorithm {
+	return digest.Canonical
+}
+
+func (s *slowStrategy) Compute(data []byte) ID {
+	n := atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return computeID(digest.Canonical, data)
+}
+
+func (s *slowStrategy) Validate(id ID) error {
+	return digest.Digest(id).Validate()
+}
+
+func TestFSHashConcurrency(t *testing.T) {
+	strategy := &slowStrategy{}
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{IDStrategy: strategy, HashConcurrency: 2})
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 8; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(id ID) {
+			defer wg.Done()
+			if _, err := fs.Get(id); err != nil {
+				errs <- err
+			}
+		}(ids[i%len(ids)])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if max := atomic.LoadInt32(&strategy.max); max > 2 {
+		t.Fatalf("Expected at most 2 concurrent hashes, got %d", max)
+	}
+}
+
+func TestFSHashConcurrencyStreams(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{HashConcurrency: 1, VerifyBufferSize: 4})
+	defer cleanup()
+	for i := 0; i < 8; i++ {
+		if _, err := fs.Set([]byte(fmt.Sprintf("content of image %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Readers hash their content as they read it, concurrently with Sets
+	// and streamed writes hashing theirs.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				fs.WalkReaders(func(id ID, r io.ReadCloser) error {
+					_, err := ioutil.ReadAll(r)
+					return err
+				})
+			}()
+			go func(i int) {
+				defer wg.Done()
+				fs.Set([]byte(fmt.Sprintf("new content %d", i)))
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				fs.AcceptPush(strings.NewReader(fmt.Sprintf("pushed content %d", i)))
+			}(i)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected concurrent reads and writes not to deadlock")
+	}
+}
@@ -0,0 +1,46 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// SizeHistogram counts the stored content by size. The buckets are the
+// lower bounds of the size ranges: every blob is counted under the largest
+// bound not greater than its size, so the largest bound starts an
+// open-ended range. A bucket starting at 0 is always included. The bounds
+// may be given in any order and every one of them is in the result.
+func (s *fs) SizeHistogram(buckets []int64) (map[int64]int, error) {
+	bounds := append([]int64{0}, buckets...)
+	for _, b := range bounds {
+		if b < 0 {
+			return nil, fmt.Errorf("invalid size histogram bucket %d", b)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	counts := make(map[int64]int, len(bounds))
+	for _, b := range bounds {
+		counts[b] = 0
+	}
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.RLock()
+		size, err := s.contentSize(id)
+		s.RUnlock()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, storeError("sizehistogram", id, err)
+		}
+		i := sort.Search(len(bounds), func(i int) bool { return bounds[i] > size })
+		counts[bounds[i-1]]++
+	}
+	return counts, nil
+}
@@ -0,0 +1,41 @@
+package image
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	for i, size := range []int{1, 1023, 1024, 5000, 65536, 200000} {
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		if _, err := fs.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	histogram, err := fs.SizeHistogram([]int64{65536, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int64]int{0: 2, 1024: 2, 65536: 2}
+	if !reflect.DeepEqual(histogram, expected) {
+		t.Fatalf("Expected histogram %v, got %v", expected, histogram)
+	}
+
+	histogram, err = fs.SizeHistogram([]int64{1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[int64]int{0: 6, 1 << 20: 0}
+	if !reflect.DeepEqual(histogram, expected) {
+		t.Fatalf("Expected histogram %v, got %v", expected, histogram)
+	}
+
+	if _, err := fs.SizeHistogram([]int64{-1}); err == nil {
+		t.Fatal("Expected error for a negative bucket")
+	}
+}
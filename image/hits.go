@@ -0,0 +1,108 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	hitsKey = "hits"
+	// hitsFlushThreshold is the number of reads of the same content after
+	// which its hit count is persisted.
+	hitsFlushThreshold = 16
+)
+
+// recordHit counts a read of the content of id. It must be called with the
+// store read lock held.
+func (s *fs) recordHit(id ID) {
+	s.hitsMu.Lock()
+	if s.hits == nil {
+		s.hits = make(map[ID]uint64)
+	}
+	s.hits[id]++
+	pending := s.hits[id]
+	if pending < hitsFlushThreshold {
+		s.hitsMu.Unlock()
+		return
+	}
+	delete(s.hits, id)
+	s.hitsMu.Unlock()
+
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		s.log.Warn("failed to record hits of image", "id", id, "err", err)
+		return
+	}
+	defer unlock()
+	persisted, err := s.persistedHits(id)
+	if err == nil {
+		err = s.metadata.Set(id, hitsKey, []byte(strconv.FormatUint(persisted+pending, 10)))
+	}
+	if err != nil {
+		s.log.Warn("failed to record hits of image", "id", id, "err", err)
+	}
+}
+
+// persistedHits returns the hit count of id recorded in its metadata.
+func (s *fs) persistedHits(id ID) (uint64, error) {
+	data, err := s.metadata.Get(id, hitsKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+// Hits returns the number of times the content of id was read with Get
+// since hits are tracked, see FSOptions.TrackHits.
+func (s *fs) Hits(id ID) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if _, err := s.get(id); err != nil {
+		return 0, storeError("hits", id, err)
+	}
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return 0, storeError("hits", id, err)
+	}
+	persisted, err := s.persistedHits(id)
+	unlock()
+	if err != nil {
+		return 0, storeError("hits", id, err)
+	}
+	s.hitsMu.Lock()
+	defer s.hitsMu.Unlock()
+	return persisted + s.hits[id], nil
+}
+
+// WalkOrdered calls f for every image in the store like Walk, most read
+// first according to Hits. Images with the same hit count are walked in
+// lexical ID order.
+func (s *fs) WalkOrdered(f IDWalkFunc) error {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return err
+	}
+	hits := make(map[ID]uint64, len(ids))
+	for _, id := range ids {
+		n, err := s.Hits(id)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		hits[id] = n
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return hits[ids[i]] > hits[ids[j]]
+	})
+	for _, id := range ids {
+		if err := f(id); err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
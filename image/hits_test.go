@@ -0,0 +1,64 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestHits(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{TrackHits: true})
+	defer cleanup()
+
+	popular, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rare, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unread, err := fs.Set([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := 2*hitsFlushThreshold + 3
+	for i := 0; i < reads; i++ {
+		if _, err := fs.Get(popular); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Get(rare); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := fs.Hits(popular)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != uint64(reads) {
+		t.Fatalf("Expected %d hits, got %d", reads, hits)
+	}
+
+	var order []ID
+	if err := fs.WalkOrdered(func(id ID) error {
+		order = append(order, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[0] != popular || order[1] != rare || order[2] != unread {
+		t.Fatalf("Expected walk order [%v %v %v], got %v", popular, rare, unread, order)
+	}
+
+	// Only the flushed hits survive reopening the store.
+	fs, err = newFSStore(fs.root, FSOptions{TrackHits: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err = fs.Hits(popular)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 2*hitsFlushThreshold {
+		t.Fatalf("Expected %d persisted hits, got %d", 2*hitsFlushThreshold, hits)
+	}
+}
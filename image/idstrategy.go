@@ -0,0 +1,54 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// IDStrategy computes and validates the IDs of the content of a fs store,
+// see FSOptions.IDStrategy. IDs have the form <algorithm>:<hex>, naming the
+// directory and the file of the content.
+type IDStrategy interface {
+	// Algorithm is the algorithm of the IDs computed by the strategy.
+	Algorithm() digest.Algorithm
+	// Compute returns the ID of data. It must return the same ID every
+	// time it is called with the same data, since reads are verified by
+	// computing the ID of the content again.
+	Compute(data []byte) ID
+	// Validate returns an error unless id is a valid ID of the strategy.
+	Validate(id ID) error
+}
+
+// computeID returns the ID of data stored with Set.
+func (s *fs) computeID(data []byte) ID {
+	if s.idStrategy != nil {
+		return s.idStrategy.Compute(data)
+	}
+	return computeID(s.algorithm, data)
+}
+
+// validateID returns an error unless id is a valid ID of the store.
+func (s *fs) validateID(id ID) error {
+	if s.idStrategy != nil {
+		return s.idStrategy.Validate(id)
+	}
+	return digest.Digest(id).Validate()
+}
+
+// algorithmDirs returns the algorithm directories of dir holding IDs of the
+// store.
+func (s *fs) algorithmDirs(dir string) ([]string, error) {
+	if s.idStrategy == nil {
+		return algorithmDirs(dir)
+	}
+	alg := string(s.algorithm)
+	if _, err := os.Stat(filepath.Join(dir, alg)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []string{alg}, nil
+}
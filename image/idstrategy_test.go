@@ -0,0 +1,83 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+// sequentialStrategy numbers content in the order it is first seen.
+type sequentialStrategy struct {
+	mu  sync.Mutex
+	ids map[string]ID
+}
+
+var sequentialIDPattern = regexp.MustCompile(`^seq:[0-9]{8}$`)
+
+func (s *sequentialStrategy) Algorithm() digest.Algorithm {
+	return "seq"
+}
+
+func (s *sequentialStrategy) Compute(data []byte) ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[string]ID)
+	}
+	id, ok := s.ids[string(data)]
+	if !ok {
+		id = ID(fmt.Sprintf("seq:%08d", len(s.ids)+1))
+		s.ids[string(data)] = id
+	}
+	return id
+}
+
+func (s *sequentialStrategy) Validate(id ID) error {
+	if !sequentialIDPattern.MatchString(string(id)) {
+		return fmt.Errorf("invalid sequential ID %q", id)
+	}
+	return nil
+}
+
+func newSequentialFSStore(t *testing.T) (*fs, func()) {
+	return newTestFSStoreOptions(t, FSOptions{IDStrategy: &sequentialStrategy{}})
+}
+
+func TestFSIDStrategy(t *testing.T) {
+	for _, fixture := range []func(*testing.T, StoreBackend){testMetadataGetSet, testDelete, testWalker} {
+		fs, cleanup := newSequentialFSStore(t)
+		fixture(t, fs)
+		cleanup()
+	}
+
+	fs, cleanup := newSequentialFSStore(t)
+	defer cleanup()
+	for i, content := range []string{"foo", "bar", "foo"} {
+		id, err := fs.Set([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ID(fmt.Sprintf("seq:%08d", i%2+1))
+		if id != expected {
+			t.Fatalf("Expected ID %v for %q, got %v", expected, content, id)
+		}
+	}
+	if _, err := fs.Get("seq:00000002"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Set([]byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptContent(t, fs, "seq:00000001")
+	if _, err := fs.Get("seq:00000001"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+	if _, err := fs.Get(ID(digest.DigestSha256EmptyTar)); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("Expected ErrUnsupportedAlgorithm for a digest ID, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ErrNotInManifest is reported by ImportVerified for blobs of the archive
+// that the manifest doesn't list.
+var ErrNotInManifest = errors.New("blob is not listed in the manifest")
+
+// ManifestError reports the blobs of an archive imported by ImportVerified
+// that don't match the manifest: the ones of the wrong size, with
+// ErrSizeMismatch, the ones the archive lacks, with os.ErrNotExist, and the
+// ones the manifest doesn't list, with ErrNotInManifest.
+type ManifestError map[ID]error
+
+func (e ManifestError) Error() string {
+	var msgs []string
+	for id, err := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", id, err))
+	}
+	sort.Strings(msgs)
+	return "image archive does not match its manifest: " + strings.Join(msgs, ", ")
+}
+
+// ImportVerified imports an archive like Import, checking its blobs against
+// manifest, which lists the ID and size of every blob expected, like the
+// manifest of a registry. Blobs of the wrong size or not listed aren't
+// stored, nor is the metadata of IDs the manifest doesn't list; the others
+// are. The mismatches and the
+// blobs of manifest missing from the archive are reported in a
+// ManifestError once the whole archive is read.
+func (s *fs) ImportVerified(r io.Reader, manifest map[ID]int64) error {
+	mismatches := make(ManifestError)
+	imported := make(map[ID]bool, len(manifest))
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(path.Clean(hdr.Name), "/")
+		if len(parts) >= 3 && (parts[0] == contentDirName || parts[0] == metadataDirName) {
+			id := ID(digest.NewDigestFromHex(parts[1], parts[2]))
+			size, listed := manifest[id]
+			if _, rejected := mismatches[id]; rejected || !listed && parts[0] == metadataDirName {
+				continue
+			}
+			if parts[0] == contentDirName {
+				switch {
+				case !listed:
+					mismatches[id] = ErrNotInManifest
+					continue
+				case size != int64(len(data)):
+					mismatches[id] = fmt.Errorf("%w: the manifest lists %d bytes, the archive holds %d", ErrSizeMismatch, size, len(data))
+					continue
+				}
+				imported[id] = true
+			}
+		}
+		if err := s.importEntry(hdr.Name, data); err != nil {
+			return err
+		}
+	}
+
+	for id := range manifest {
+		if !imported[id] {
+			if _, ok := mismatches[id]; !ok {
+				mismatches[id] = fmt.Errorf("blob is missing from the archive: %w", os.ErrNotExist)
+			}
+		}
+	}
+	if len(mismatches) > 0 {
+		return mismatches
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestImportVerified(t *testing.T) {
+	src, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	good, err := src.Set([]byte("good"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetMetadata(good, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+	resized, err := src.Set([]byte("resized"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlisted, err := src.Set([]byte("unlisted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := computeID(digest.Canonical, []byte("missing"))
+	manifest := map[ID]int64{
+		good:    int64(len("good")),
+		resized: 42,
+		missing: int64(len("missing")),
+	}
+	dst, cleanup := newTestFSStore(t)
+	defer cleanup()
+	err = dst.ImportVerified(&buf, manifest)
+	var mismatches ManifestError
+	if !errors.As(err, &mismatches) {
+		t.Fatalf("Expected ManifestError, got %v", err)
+	}
+	if len(mismatches) != 3 {
+		t.Fatalf("Expected 3 mismatches, got %v", mismatches)
+	}
+	if !errors.Is(mismatches[resized], ErrSizeMismatch) {
+		t.Fatalf("Expected size mismatch for %v, got %v", resized, mismatches[resized])
+	}
+	if !errors.Is(mismatches[missing], os.ErrNotExist) {
+		t.Fatalf("Expected %v to be reported missing, got %v", missing, mismatches[missing])
+	}
+	if !errors.Is(mismatches[unlisted], ErrNotInManifest) {
+		t.Fatalf("Expected %v to be reported unlisted, got %v", unlisted, mismatches[unlisted])
+	}
+
+	if value, err := dst.GetMetadata(good, "tkey"); err != nil || string(value) != "tval" {
+		t.Fatalf("Expected matching blob to be imported with its metadata, got %q, %v", value, err)
+	}
+	for _, id := range []ID{resized, unlisted} {
+		if _, err := dst.Get(id); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected mismatching blob %v not to be imported, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/net/context"
+)
+
+// indexVersion is the content of a version of an index saved with
+// SaveIndex. Previous is part of the content, so the history of an index
+// is verified like its entries.
+type indexVersion struct {
+	Previous ID            `json:"previous,omitempty"`
+	Entries  map[string]ID `json:"entries"`
+}
+
+// SaveIndex stores index, a map of names to IDs maintained by the callers
+// of the store, as a new version of the index of the alias name, and
+// returns the ID of the version. Each version is stored as content that
+// refers to the previous one, and the alias points to the latest, so the
+// index gets the integrity checks of the content and its history is kept,
+// see IndexHistory. Saving the entries of the latest version again doesn't
+// store a new one. Only the latest version is protected from garbage
+// collection by the alias.
+func (s *fs) SaveIndex(name string, index map[string]ID) (ID, error) {
+	if err := validateAlias(name); err != nil {
+		return "", err
+	}
+	if index == nil {
+		index = map[string]ID{}
+	}
+	if err := s.lockMutation(context.Background()); err != nil {
+		return "", storeError("saveindex", "", err)
+	}
+	defer s.Unlock()
+
+	previous, current, err := s.loadIndex(name)
+	if err != nil && !os.IsNotExist(err) {
+		return "", storeError("saveindex", "", err)
+	}
+	if err == nil {
+		old, err := json.Marshal(current.Entries)
+		if err != nil {
+			return "", storeError("saveindex", previous, err)
+		}
+		updated, err := json.Marshal(index)
+		if err != nil {
+			return "", storeError("saveindex", "", err)
+		}
+		if bytes.Equal(old, updated) {
+			return previous, nil
+		}
+	}
+
+	data, err := json.Marshal(indexVersion{Previous: previous, Entries: index})
+	if err != nil {
+		return "", storeError("saveindex", "", err)
+	}
+	id, _, err := s.setMulti(s.algorithm, data)
+	if err != nil {
+		return "", err
+	}
+	if err := s.setAlias(name, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// LoadIndex returns the entries of the latest version of the index of the
+// alias name, saved with SaveIndex.
+func (s *fs) LoadIndex(name string) (map[string]ID, error) {
+	if err := validateAlias(name); err != nil {
+		return nil, err
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	id, version, err := s.loadIndex(name)
+	if err != nil {
+		return nil, storeError("loadindex", id, err)
+	}
+	return version.Entries, nil
+}
+
+// IndexHistory returns the IDs of the versions of the index of the alias
+// name, from the latest to the oldest still stored. Garbage collection may
+// have removed the older versions.
+func (s *fs) IndexHistory(name string) ([]ID, error) {
+	if err := validateAlias(name); err != nil {
+		return nil, err
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	id, err := s.readAlias(name)
+	if err != nil {
+		return nil, storeError("indexhistory", "", err)
+	}
+	var history []ID
+	seen := make(map[ID]bool)
+	for id != "" && !seen[id] {
+		version, err := s.readIndexVersion(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return history, storeError("indexhistory", id, err)
+		}
+		seen[id] = true
+		history = append(history, id)
+		id = version.Previous
+	}
+	return history, nil
+}
+
+// loadIndex returns the ID and the content of the version of the index the
+// alias name points to. It must be called with the store lock held.
+func (s *fs) loadIndex(name string) (ID, *indexVersion, error) {
+	id, err := s.readAlias(name)
+	if err != nil {
+		return "", nil, err
+	}
+	version, err := s.readIndexVersion(id)
+	if err != nil {
+		return id, nil, err
+	}
+	return id, version, nil
+}
+
+func (s *fs) readIndexVersion(id ID) (*indexVersion, error) {
+	data, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	var version indexVersion
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, fmt.Errorf("invalid image index version: %v", err)
+	}
+	if version.Entries == nil {
+		version.Entries = map[string]ID{}
+	}
+	return &version, nil
+}
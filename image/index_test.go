@@ -0,0 +1,84 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFSIndex(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	if _, err := fs.LoadIndex("tags"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected missing index to fail with os.ErrNotExist, got %v", err)
+	}
+
+	foo, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := map[string]ID{"foo:latest": foo}
+	v1, err := fs.SaveIndex("tags", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := fs.LoadIndex("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(index, first) {
+		t.Fatalf("Expected index %v, got %v", first, index)
+	}
+
+	second := map[string]ID{"foo:latest": foo, "bar:latest": bar}
+	v2, err := fs.SaveIndex("tags", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 == v1 {
+		t.Fatal("Expected the update to store a new version")
+	}
+	if target, err := fs.ResolveAlias("tags"); err != nil || target != v2 {
+		t.Fatalf("Expected alias to point to %v, got %v, %v", v2, target, err)
+	}
+	index, err = fs.LoadIndex("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(index, second) {
+		t.Fatalf("Expected index %v, got %v", second, index)
+	}
+
+	if v, err := fs.SaveIndex("tags", second); err != nil || v != v2 {
+		t.Fatalf("Expected saving the same entries to keep version %v, got %v, %v", v2, v, err)
+	}
+
+	// Going back to the first entries makes a new version, keeping the
+	// history linear.
+	v3, err := fs.SaveIndex("tags", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3 == v1 || v3 == v2 {
+		t.Fatal("Expected the update to store a new version")
+	}
+	history, err := fs.IndexHistory("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []ID{v3, v2, v1}; !reflect.DeepEqual(history, expected) {
+		t.Fatalf("Expected history %v, got %v", expected, history)
+	}
+
+	corruptContent(t, fs, v3)
+	if _, err := fs.LoadIndex("tags"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected corrupt index to fail with ErrCorrupt, got %v", err)
+	}
+}
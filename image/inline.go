@@ -0,0 +1,126 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// inlineDirName holds the index of the content stored inline with
+// FSOptions.InlineThreshold.
+const inlineDirName = "inline"
+
+// inlineIndexFile is the file under inline/<namespace>/sha256 mapping the
+// hex digests of inline content to the content.
+func (s *fs) inlineIndexFile() string {
+	return filepath.Join(s.root, inlineDirName, s.namespace, string(digest.Canonical), "index")
+}
+
+// loadInline reads the index of inline content. It must be called with the
+// store write lock held, or before the store is in use.
+func (s *fs) loadInline() error {
+	s.inline = make(map[ID][]byte)
+	data, err := ioutil.ReadFile(s.inlineIndexFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var index map[string][]byte
+	if err := json.Unmarshal(data, &index); err != nil {
+		return err
+	}
+	for hex, content := range index {
+		s.inline[ID(digest.NewDigestFromHex(string(digest.Canonical), hex))] = content
+	}
+	return nil
+}
+
+// saveInline rewrites the index of inline content. It must be called with
+// the store write lock held.
+func (s *fs) saveInline() error {
+	index := make(map[string][]byte, len(s.inline))
+	for id, content := range s.inline {
+		index[digest.Digest(id).Hex()] = content
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	filePath := s.inlineIndexFile()
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return err
+	}
+	tempFilePath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempFilePath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFilePath, filePath); err != nil {
+		return err
+	}
+	s.markUnsynced(filePath)
+	return nil
+}
+
+// setInline stores data inline under id unless it is already stored. It
+// must be called with the store write lock held.
+func (s *fs) setInline(id ID, data []byte) error {
+	if _, ok := s.inline[id]; ok {
+		return nil
+	}
+	if _, err := os.Stat(s.contentFile(id)); err == nil {
+		return nil
+	}
+	s.inline[id] = append([]byte(nil), data...)
+	if err := s.saveInline(); err != nil {
+		delete(s.inline, id)
+		return err
+	}
+	s.addToBloom(id)
+	return nil
+}
+
+// deleteInline removes the inline content of id and reports whether there
+// was any. It must be called with the store write lock held.
+func (s *fs) deleteInline(id ID) (bool, error) {
+	content, ok := s.inline[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.inline, id)
+	if err := s.saveInline(); err != nil {
+		s.inline[id] = content
+		return true, err
+	}
+	return true, nil
+}
+
+// getInline returns a copy of the inline content of id, if any.
+func (s *fs) getInline(id ID) ([]byte, bool) {
+	content, ok := s.inline[s.normalizeID(id)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), content...), true
+}
+
+// contentExists returns an error satisfying os.IsNotExist if id has neither
+// inline content nor a content file.
+func (s *fs) contentExists(id ID) error {
+	if s.packed() {
+		_, err := s.pack.read(s.normalizeID(id))
+		if !os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := s.inline[s.normalizeID(id)]; ok {
+		return nil
+	}
+	_, err := os.Stat(s.contentFile(id))
+	return err
+}
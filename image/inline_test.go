@@ -0,0 +1,61 @@
+package image
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestInlineContent(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{InlineThreshold: 16})
+	defer cleanup()
+
+	tiny := []byte("foo")
+	large := bytes.Repeat([]byte("bar"), 10)
+	tinyID, err := fs.Set(tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeID, err := fs.Set(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(fs.contentFile(tinyID)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no content file for inline content, got %v", err)
+	}
+	if _, err := os.Stat(fs.contentFile(largeID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(tinyID, "parent", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store opened without the option still reads inline content.
+	reopened, err := newFSStore(fs.root, FSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, data := range map[ID][]byte{tinyID: tiny, largeID: large} {
+		content, err := reopened.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, data) {
+			t.Fatalf("Expected %q for %v, got %q", data, id, content)
+		}
+	}
+	if n := countWalk(t, reopened); n != 2 {
+		t.Fatalf("Expected 2 walked IDs, got %d", n)
+	}
+
+	if err := reopened.Delete(tinyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Get(tinyID); err == nil {
+		t.Fatal("Expected deleted inline content to be gone")
+	}
+	if _, err := reopened.GetMetadata(tinyID, "parent"); err == nil {
+		t.Fatal("Expected metadata of deleted inline content to be gone")
+	}
+}
@@ -0,0 +1,93 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lastUsedKey = "last-used"
+	// lastUsedResolution bounds how often reads of the same content
+	// persist their last use time.
+	lastUsedResolution = time.Minute
+)
+
+// touch records that the content of id was used now. It must be called with
+// the store read lock held.
+func (s *fs) touch(id ID) {
+	now := s.now()
+
+	s.lastUsedMu.Lock()
+	if s.lastUsed == nil {
+		s.lastUsed = make(map[ID]time.Time)
+	}
+	if last, ok := s.lastUsed[id]; ok && now.Sub(last) < lastUsedResolution {
+		s.lastUsedMu.Unlock()
+		return
+	}
+	s.lastUsed[id] = now
+	s.lastUsedMu.Unlock()
+
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		s.log.Warn("failed to record last use of image", "id", id, "err", err)
+		return
+	}
+	defer unlock()
+	if err := s.metadata.Set(id, lastUsedKey, []byte(now.UTC().Format(time.RFC3339Nano))); err != nil {
+		s.log.Warn("failed to record last use of image", "id", id, "err", err)
+	}
+}
+
+// LastUsed returns when the content of id was last read. Without recorded
+// reads it returns the time the content was stored.
+func (s *fs) LastUsed(id ID) (time.Time, error) {
+	s.lastUsedMu.Lock()
+	last, ok := s.lastUsed[id]
+	s.lastUsedMu.Unlock()
+	if ok {
+		return last, nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	last, err := s.persistedLastUsed(id)
+	if err != nil {
+		return time.Time{}, storeError("lastused", id, err)
+	}
+	return last, nil
+}
+
+// persistedLastUsed returns the last use of id recorded in its metadata, or
+// the time it was stored. It must be called with the store lock held.
+func (s *fs) persistedLastUsed(id ID) (time.Time, error) {
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	data, err := s.metadata.Get(id, lastUsedKey)
+	unlock()
+	if err == nil {
+		if last, err := time.Parse(time.RFC3339Nano, string(data)); err == nil {
+			return last, nil
+		}
+	}
+
+	// Inline content shares the index file, whose time is the last time
+	// any inline content was stored or deleted.
+	path := s.contentFile(id)
+	if _, ok := s.inline[s.normalizeID(id)]; ok {
+		path = s.inlineIndexFile()
+	}
+	// Packed content was all stored by Freeze.
+	if s.packed() {
+		path = filepath.Join(s.packDir(), packFileName)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
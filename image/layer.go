@@ -0,0 +1,88 @@
+package image
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/docker/distribution/digest"
+)
+
+// diffIDKey is the metadata key recording the digest of the uncompressed
+// content of a layer stored with SetLayer.
+const diffIDKey = "diff-id"
+
+var errLayerAborted = errors.New("layer write aborted")
+
+// SetLayer stores the gzip compressed layer read from r like AcceptPush
+// and returns its ID along with its diffID, the canonical digest of the
+// uncompressed layer. The layer is decompressed as it is streamed into the
+// store, so it is read once, and the diffID is recorded as metadata of the
+// layer for GetDiffID. Nothing is stored if r doesn't hold gzip content.
+func (s *fs) SetLayer(r io.Reader) (compressedID ID, diffID digest.Digest, err error) {
+	pr, pw := io.Pipe()
+	digester := digest.Canonical.New()
+	done := make(chan error, 1)
+	go func() {
+		gz, err := gzip.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(s.hashWriter(digester.Hash()), gz)
+			gz.Close()
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid gzip layer: %v", err)
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	defer pw.CloseWithError(errLayerAborted)
+
+	id, _, err := s.acceptPush("setlayer", &diffReader{r: r, pw: pw, done: done})
+	if err != nil {
+		return "", "", err
+	}
+	diffID = digester.Digest()
+	if err := s.setReservedMetadata(id, diffIDKey, []byte(diffID)); err != nil {
+		return "", "", err
+	}
+	return id, diffID, nil
+}
+
+// GetDiffID returns the diffID recorded for the layer id by SetLayer.
+func (s *fs) GetDiffID(id ID) (digest.Digest, error) {
+	data, err := s.GetMetadata(id, diffIDKey)
+	if err != nil {
+		return "", err
+	}
+	diffID, err := digest.ParseDigest(string(data))
+	if err != nil {
+		return "", storeError("getdiffid", id, err)
+	}
+	return diffID, nil
+}
+
+// diffReader copies the content read from r to the decompression of a
+// layer, and only reports the end of r once that is done, so that content
+// failing to decompress isn't stored.
+type diffReader struct {
+	r    io.Reader
+	pw   *io.PipeWriter
+	done <-chan error
+}
+
+func (d *diffReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		if _, werr := d.pw.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	if err == io.EOF {
+		d.pw.Close()
+		if derr := <-d.done; derr != nil {
+			return n, derr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestSetLayer(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(bytes.Repeat([]byte("layer content "), 10000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compressed := buf.Bytes()
+
+	id, diffID, err := fs.SetLayer(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := computeID(digest.Canonical, compressed); id != expected {
+		t.Fatalf("Expected ID %v, got %v", expected, id)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := digest.FromBytes(uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID != expected {
+		t.Fatalf("Expected diffID %v, got %v", expected, diffID)
+	}
+	stored, err := fs.GetDiffID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != expected {
+		t.Fatalf("Expected stored diffID %v, got %v", expected, stored)
+	}
+
+	for _, invalid := range [][]byte{
+		[]byte("not gzip"),
+		compressed[:len(compressed)/2],
+		append(append([]byte{}, compressed...), "trailing"...),
+	} {
+		if _, _, err := fs.SetLayer(bytes.NewReader(invalid)); err == nil {
+			t.Fatal("Expected invalid layer to be rejected")
+		}
+		if _, err := fs.Get(computeID(digest.Canonical, invalid)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected invalid layer not to be stored, got %v", err)
+		}
+	}
+
+	other, err := fs.Set([]byte("not a layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.GetDiffID(other); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no diffID for content stored with Set, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// layoutVersionFileName records the on-disk layout version of a store
+	// root.
+	layoutVersionFileName = "layout-version"
+	// currentLayoutVersion is the layout version written by this code.
+	// Stores created before versions were recorded are at version 0.
+	currentLayoutVersion = 1
+)
+
+// layoutUpgrades[v] converts a store from layout version v to v+1. Version 1
+// only adds the version marker to the layout of version 0, so there's nothing
+// to convert yet.
+var layoutUpgrades = []func(s *fs) error{
+	func(s *fs) error { return nil },
+}
+
+func (s *fs) layoutVersionFile() string {
+	return filepath.Join(s.root, layoutVersionFileName)
+}
+
+// readLayoutVersion returns the layout version of the store root, which is
+// the current one for roots without a store yet.
+func (s *fs) readLayoutVersion() (version int, created bool, err error) {
+	if _, err := os.Stat(s.contentRoot); os.IsNotExist(err) {
+		return currentLayoutVersion, true, nil
+	}
+	data, err := ioutil.ReadFile(s.layoutVersionFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	version, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version < 0 {
+		return 0, false, fmt.Errorf("invalid image store layout version %q in %s", data, s.layoutVersionFile())
+	}
+	if version > currentLayoutVersion {
+		return 0, false, fmt.Errorf("image store %s has layout version %d, newer than the supported version %d", s.root, version, currentLayoutVersion)
+	}
+	return version, false, nil
+}
+
+// LayoutVersion returns the on-disk layout version of the store.
+func (s *fs) LayoutVersion() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.layoutVersion
+}
+
+// UpgradeLayout converts a store of an older layout version to the current
+// one. Each step records the version it reaches, so an interrupted upgrade
+// continues from there.
+func (s *fs) UpgradeLayout() error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	for s.layoutVersion < currentLayoutVersion {
+		if err := layoutUpgrades[s.layoutVersion](s); err != nil {
+			return fmt.Errorf("failed to upgrade image store layout from version %d: %v", s.layoutVersion, err)
+		}
+		next := s.layoutVersion + 1
+		if err := s.writeRootFile(layoutVersionFileName, []byte(strconv.Itoa(next))); err != nil {
+			return err
+		}
+		s.layoutVersion = next
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLayoutVersion(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	if v := fs.LayoutVersion(); v != currentLayoutVersion {
+		t.Fatalf("Expected new store at layout version %d, got %d", currentLayoutVersion, v)
+	}
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening a store of the current layout.
+	if fs, err = newFSStore(fs.root, FSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v := fs.LayoutVersion(); v != currentLayoutVersion {
+		t.Fatalf("Expected layout version %d, got %d", currentLayoutVersion, v)
+	}
+
+	// A store from before layout versions opens at version 0 and can be
+	// upgraded.
+	if err := os.Remove(fs.layoutVersionFile()); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = newFSStore(fs.root, FSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v := fs.LayoutVersion(); v != 0 {
+		t.Fatalf("Expected layout version 0, got %d", v)
+	}
+	if err := fs.UpgradeLayout(); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = newFSStore(fs.root, FSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v := fs.LayoutVersion(); v != currentLayoutVersion {
+		t.Fatalf("Expected upgraded layout version %d, got %d", currentLayoutVersion, v)
+	}
+	if _, err := fs.Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newer layouts are refused.
+	if err := ioutil.WriteFile(fs.layoutVersionFile(), []byte("99"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFSStore(fs.root, FSOptions{}); err == nil || !strings.Contains(err.Error(), "newer than the supported version") {
+		t.Fatalf("Expected error opening a newer layout, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package image
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ErrExtraData is returned when stored content continues past its recorded
+// size, with the content up to that size matching its digest. It wraps
+// ErrCorrupt.
+var ErrExtraData = fmt.Errorf("%w: extra data after the end", ErrCorrupt)
+
+// ErrTruncated is returned when stored content is shorter than its recorded
+// size. It wraps ErrCorrupt.
+var ErrTruncated = fmt.Errorf("%w: truncated", ErrCorrupt)
+
+// sizeKey is the reserved metadata key recording the size of the content of
+// an ID when it was stored.
+const sizeKey = "size"
+
+// recordStored records the metadata kept about the content of id, of size
+// bytes with the weak checksum crc, once it is stored, as a content file of
+// its own if file is set. Only content files get their size recorded, the
+// size of the other content is known from where it is stored. It must be
+// called with the store write lock held.
+func (s *fs) recordStored(id ID, size int64, crc uint32, file bool) {
+	s.recordSchemaVersion(id)
+	if file {
+		s.recordSize(id, size)
+	}
+	if s.weakChecksums {
+		s.recordWeakChecksum(id, crc, size)
+	}
+}
+
+// recordSize must be called with the store write lock held.
+func (s *fs) recordSize(id ID, size int64) {
+	if err := s.metadata.Set(id, sizeKey, []byte(strconv.FormatInt(size, 10))); err != nil {
+		s.log.Warn("failed to record size of image", "id", id, "err", err)
+	}
+}
+
+// recordedSize returns the size of the content of id, from the inline index
+// or the pack, or else as recorded when it was stored. It returns -1 for
+// content files stored before sizes were recorded.
+func (s *fs) recordedSize(id ID) int64 {
+	if content, ok := s.getInline(id); ok {
+		return int64(len(content))
+	}
+	if s.packed() {
+		if e, ok := s.pack.entries[s.normalizeID(id)]; ok {
+			return e.Size
+		}
+	}
+	data, err := s.metadata.Get(id, sizeKey)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// mismatchError returns the error for content of id not matching its
+// digest, telling appended data and truncation apart from other corruption
+// by the recorded size.
+func (s *fs) mismatchError(id ID, content []byte) error {
+	size := s.recordedSize(id)
+	switch {
+	case size < 0:
+		return ErrCorrupt
+	case int64(len(content)) < size:
+		return ErrTruncated
+	case int64(len(content)) > size && s.verifyID(digest.Digest(id).Algorithm(), content[:size]) == s.normalizeID(id):
+		return ErrExtraData
+	}
+	return ErrCorrupt
+}
@@ -0,0 +1,103 @@
+package image
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFSLengthMismatch(t *testing.T) {
+	content := []byte("0123456789")
+	for _, tc := range []struct {
+		name     string
+		modify   func([]byte) []byte
+		expected error
+	}{
+		{"append", func(b []byte) []byte { return append(b, "extra"...) }, ErrExtraData},
+		{"truncate", func(b []byte) []byte { return b[:4] }, ErrTruncated},
+		{"flip", func(b []byte) []byte { b[5] ^= 0xff; return b }, ErrCorrupt},
+	} {
+		fs, cleanup := newTestFSStore(t)
+		id, err := fs.Set(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modified := tc.modify(append([]byte(nil), content...))
+		if err := ioutil.WriteFile(fs.contentFile(id), modified, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = fs.Get(id)
+		checkMismatchError(t, tc.name+" get", err, tc.expected)
+
+		err = fs.WalkReaders(func(id ID, r io.ReadCloser) error {
+			_, err := ioutil.ReadAll(r)
+			return err
+		})
+		checkMismatchError(t, tc.name+" reader", err, tc.expected)
+		cleanup()
+	}
+}
+
+func checkMismatchError(t *testing.T, name string, err, expected error) {
+	if !errors.Is(err, expected) {
+		t.Fatalf("%s: expected %v, got %v", name, expected, err)
+	}
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("%s: expected %v to wrap ErrCorrupt", name, err)
+	}
+	for _, other := range []error{ErrExtraData, ErrTruncated} {
+		if other != expected && errors.Is(err, other) {
+			t.Fatalf("%s: expected %v not to be %v", name, err, other)
+		}
+	}
+}
+
+func TestFSLengthMismatchUnrecorded(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(fs.metadataDir(id), sizeKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fs.contentFile(id), []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Get(id)
+	checkMismatchError(t, "unrecorded", err, ErrCorrupt)
+}
+
+func TestFSSizeKeyReserved(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	content := []byte("0123456789")
+	id, err := fs.Set(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetMetadata(id, sizeKey, []byte("4")); !errors.Is(err, ErrReservedMetadataKey) {
+		t.Fatalf("Expected ErrReservedMetadataKey setting the size, got %v", err)
+	}
+	if err := fs.MigrateMetadata(1, 2, func(id ID, md map[string][]byte) (map[string][]byte, error) {
+		if _, ok := md[sizeKey]; ok {
+			t.Fatal("Expected the size to be left out of migrated metadata")
+		}
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(fs.contentFile(id), content[:4], 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Get(id)
+	checkMismatchError(t, "truncate after migration", err, ErrTruncated)
+}
@@ -0,0 +1,142 @@
+package image
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// LimitedBackend is a StoreBackend bounding the number of operations in
+// flight on its inner backend. Operations block while the limit is reached.
+type LimitedBackend struct {
+	inner    StoreBackend
+	sem      chan struct{}
+	inFlight int32
+}
+
+// NewLimitedBackend returns a backend allowing at most maxConcurrent
+// simultaneous operations on inner.
+func NewLimitedBackend(inner StoreBackend, maxConcurrent int) *LimitedBackend {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &LimitedBackend{
+		inner: inner,
+		sem:   make(chan struct{}, maxConcurrent),
+	}
+}
+
+// contextBackend is implemented by backends whose writes stop waiting when
+// a context is done, like the filesystem store in maintenance.
+type contextBackend interface {
+	SetContext(ctx context.Context, data []byte) (ID, error)
+	DeleteContext(ctx context.Context, id ID) error
+}
+
+func (lb *LimitedBackend) wrapped() []StoreBackend {
+	return []StoreBackend{lb.inner}
+}
+
+// Acquire waits for an operation slot and returns the function releasing
+// it. It fails if ctx is done before a slot is available.
+func (lb *LimitedBackend) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case lb.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	atomic.AddInt32(&lb.inFlight, 1)
+	return func() {
+		atomic.AddInt32(&lb.inFlight, -1)
+		<-lb.sem
+	}, nil
+}
+
+// InFlight returns the number of operations currently running.
+func (lb *LimitedBackend) InFlight() int {
+	return int(atomic.LoadInt32(&lb.inFlight))
+}
+
+func (lb *LimitedBackend) acquire() func() {
+	release, _ := lb.Acquire(context.Background())
+	return release
+}
+
+// Walk calls the supplied callback for each image ID. It doesn't take an
+// operation slot, so the callback may use the backend.
+func (lb *LimitedBackend) Walk(f IDWalkFunc) error {
+	return lb.inner.Walk(f)
+}
+
+// Get returns the content stored under a given ID.
+func (lb *LimitedBackend) Get(id ID) ([]byte, error) {
+	defer lb.acquire()()
+	return lb.inner.Get(id)
+}
+
+// Set stores content under a given ID.
+func (lb *LimitedBackend) Set(data []byte) (ID, error) {
+	return lb.SetContext(context.Background(), data)
+}
+
+// SetContext stores content like Set, giving up when ctx is done before an
+// operation slot is available or, if the inner backend supports it, while
+// the write waits in it.
+func (lb *LimitedBackend) SetContext(ctx context.Context, data []byte) (ID, error) {
+	release, err := lb.Acquire(ctx)
+	if err != nil {
+		return "", storeError("set", "", err)
+	}
+	defer release()
+	if cb, ok := lb.inner.(contextBackend); ok {
+		return cb.SetContext(ctx, data)
+	}
+	return lb.inner.Set(data)
+}
+
+// Delete removes content and metadata files associated with the ID.
+func (lb *LimitedBackend) Delete(id ID) error {
+	return lb.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext deletes content like Delete, giving up when ctx is done
+// like SetContext.
+func (lb *LimitedBackend) DeleteContext(ctx context.Context, id ID) error {
+	release, err := lb.Acquire(ctx)
+	if err != nil {
+		return storeError("delete", id, err)
+	}
+	defer release()
+	if cb, ok := lb.inner.(contextBackend); ok {
+		return cb.DeleteContext(ctx, id)
+	}
+	return lb.inner.Delete(id)
+}
+
+// SetMetadata sets metadata for a given ID.
+func (lb *LimitedBackend) SetMetadata(id ID, key string, data []byte) error {
+	defer lb.acquire()()
+	return lb.inner.SetMetadata(id, key, data)
+}
+
+// GetMetadata returns metadata for a given ID.
+func (lb *LimitedBackend) GetMetadata(id ID, key string) ([]byte, error) {
+	defer lb.acquire()()
+	return lb.inner.GetMetadata(id, key)
+}
+
+// DeleteMetadata removes the metadata associated with an ID.
+func (lb *LimitedBackend) DeleteMetadata(id ID, key string) error {
+	defer lb.acquire()()
+	return lb.inner.DeleteMetadata(id, key)
+}
+
+func (lb *LimitedBackend) setReservedMetadata(id ID, key string, data []byte) error {
+	defer lb.acquire()()
+	return setBackendMetadata(lb.inner, id, key, data)
+}
+
+func (lb *LimitedBackend) allMetadata(id ID) (map[string][]byte, error) {
+	defer lb.acquire()()
+	return backendMetadata(lb.inner, id)
+}
@@ -0,0 +1,108 @@
+package image
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// slowBackend records the peak number of concurrent Get calls.
+type slowBackend struct {
+	StoreBackend
+	current, peak int32
+}
+
+func (b *slowBackend) Get(id ID) ([]byte, error) {
+	n := atomic.AddInt32(&b.current, 1)
+	for {
+		peak := atomic.LoadInt32(&b.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&b.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&b.current, -1)
+	return b.StoreBackend.Get(id)
+}
+
+func TestLimitedBackend(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &slowBackend{StoreBackend: fs}
+	lb := NewLimitedBackend(inner, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := lb.Get(id); err != nil {
+				t.Error(err)
+			}
+			if n := lb.InFlight(); n > 3 {
+				t.Errorf("Expected at most 3 operations in flight, got %d", n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := atomic.LoadInt32(&inner.peak); peak > 3 || peak < 1 {
+		t.Fatalf("Expected peak concurrency between 1 and 3, got %d", peak)
+	}
+	if n := lb.InFlight(); n != 0 {
+		t.Fatalf("Expected no operations in flight, got %d", n)
+	}
+}
+
+func TestLimitedBackendAcquireCancel(t *testing.T) {
+	lb := NewLimitedBackend(nil, 1)
+	release, err := lb.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lb.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestLimitedBackendContext(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLimitedBackend(fs, 1)
+
+	// The context reaches the inner store, which waits out maintenance.
+	fs.EnterMaintenance()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lb.SetContext(ctx, []byte("bar")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded from set, got %v", err)
+	}
+	if err := lb.DeleteContext(ctx, id); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded from delete, got %v", err)
+	}
+	if n := lb.InFlight(); n != 0 {
+		t.Fatalf("Expected no operations in flight, got %d", n)
+	}
+	fs.ExitMaintenance()
+
+	if err := lb.DeleteContext(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,201 @@
+package image
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrLockTimeout is returned when the lock of an image ID couldn't be taken
+// within the configured timeout.
+var ErrLockTimeout = errors.New("timed out waiting for image lock")
+
+// idLocks hands out a read-write lock per image ID. Locks are reference
+// counted and dropped once no caller holds or waits for them.
+type idLocks struct {
+	mu    sync.Mutex
+	locks map[ID]*idLock
+	// timeout bounds the time spent waiting for a lock. Zero waits
+	// indefinitely.
+	timeout time.Duration
+}
+
+type idLock struct {
+	sync.RWMutex
+	refs int
+	// holders is the number of callers holding the lock, exclusive
+	// whether one of them holds it for writing, and since the time it
+	// has been held since. They are guarded by idLocks.mu.
+	holders   int
+	exclusive bool
+	since     time.Time
+}
+
+// LockInfo describes a per-ID lock held in a store, for diagnostics.
+type LockInfo struct {
+	ID ID
+	// Exclusive is true if the lock is held for writing, and Holders the
+	// number of holders, one for writing.
+	Exclusive bool
+	Holders   int
+	// Waiting is the number of callers waiting for the lock.
+	Waiting int
+	// Held is how long the lock has been held without interruption.
+	Held time.Duration
+}
+
+func (l *idLocks) acquire(id ID) *idLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[ID]*idLock)
+	}
+	lk, ok := l.locks[id]
+	if !ok {
+		lk = &idLock{}
+		l.locks[id] = lk
+	}
+	lk.refs++
+	return lk
+}
+
+func (l *idLocks) release(id ID, lk *idLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk.refs--
+	if lk.refs == 0 {
+		delete(l.locks, id)
+	}
+}
+
+// held records a new holder of lk.
+func (l *idLocks) held(lk *idLock, exclusive bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lk.holders == 0 {
+		lk.since = time.Now()
+	}
+	lk.holders++
+	lk.exclusive = exclusive
+}
+
+// unheld records that a holder of lk is releasing it.
+func (l *idLocks) unheld(lk *idLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk.holders--
+}
+
+// debug returns the locks held, in lexical order of their IDs.
+func (l *idLocks) debug() []LockInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var infos []LockInfo
+	for id, lk := range l.locks {
+		if lk.holders == 0 {
+			continue
+		}
+		infos = append(infos, LockInfo{
+			ID:        id,
+			Exclusive: lk.exclusive,
+			Holders:   lk.holders,
+			Waiting:   lk.refs - lk.holders,
+			Held:      now.Sub(lk.since),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// wait calls lock, giving up with ErrLockTimeout after the configured
+// timeout. A lock obtained after the timeout is released with unlock.
+func (l *idLocks) wait(lock, unlock func()) error {
+	if l.timeout == 0 {
+		lock()
+		return nil
+	}
+
+	var (
+		mu       sync.Mutex
+		timedOut bool
+	)
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		mu.Lock()
+		defer mu.Unlock()
+		if timedOut {
+			unlock()
+			return
+		}
+		close(locked)
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-locked:
+		return nil
+	case <-timer.C:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	select {
+	case <-locked:
+		return nil
+	default:
+		timedOut = true
+		return ErrLockTimeout
+	}
+}
+
+// Lock takes the write lock for id and returns the function releasing it.
+func (l *idLocks) Lock(id ID) (func(), error) {
+	lk := l.acquire(id)
+	lock := func() {
+		lk.Lock()
+		l.held(lk, true)
+	}
+	unlock := func() {
+		l.unheld(lk)
+		lk.Unlock()
+		l.release(id, lk)
+	}
+	if err := l.wait(lock, unlock); err != nil {
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// RLock takes the read lock for id and returns the function releasing it.
+func (l *idLocks) RLock(id ID) (func(), error) {
+	lk := l.acquire(id)
+	lock := func() {
+		lk.RLock()
+		l.held(lk, false)
+	}
+	unlock := func() {
+		l.unheld(lk)
+		lk.RUnlock()
+		l.release(id, lk)
+	}
+	if err := l.wait(lock, unlock); err != nil {
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// DebugLocks returns the per-ID metadata locks held in the store, with the
+// number of callers holding and waiting for each of them and how long they
+// have been held, to diagnose hangs. It doesn't wait for any of the locks.
+func (s *fs) DebugLocks() []LockInfo {
+	return s.metadataLocks.debug()
+}
@@ -0,0 +1,85 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFSLockTimeout(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{LockTimeout: 50 * time.Millisecond})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := fs.metadataLocks.Lock(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "parent", []byte("abc")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Expected ErrLockTimeout, got %v", err)
+	}
+	if _, err := fs.GetMetadata(id, "parent"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Expected ErrLockTimeout, got %v", err)
+	}
+	unlock()
+
+	// The locks taken after the timeouts are released again.
+	if err := fs.SetMetadata(id, "parent", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.GetMetadata(id, "parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abc" {
+		t.Fatalf("Expected %q, got %q", "abc", data)
+	}
+}
+
+func TestFSDebugLocks(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locks := fs.DebugLocks(); len(locks) != 0 {
+		t.Fatalf("Expected no locks held, got %v", locks)
+	}
+
+	unlock, err := fs.metadataLocks.Lock(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan error, 1)
+	go func() {
+		_, err := fs.GetMetadata(id, "parent")
+		got <- err
+	}()
+	var locks []LockInfo
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if locks = fs.DebugLocks(); len(locks) == 1 && locks[0].Waiting == 1 {
+			break
+		}
+	}
+	if len(locks) != 1 {
+		t.Fatalf("Expected 1 lock held, got %v", locks)
+	}
+	if l := locks[0]; l.ID != id || !l.Exclusive || l.Holders != 1 || l.Waiting != 1 || l.Held <= 0 {
+		t.Fatalf("Expected exclusive lock of %v held with 1 waiter, got %+v", id, l)
+	}
+
+	unlock()
+	if err := <-got; !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected waiting reader to proceed, got %v", err)
+	}
+	if locks := fs.DebugLocks(); len(locks) != 0 {
+		t.Fatalf("Expected no locks held after release, got %v", locks)
+	}
+}
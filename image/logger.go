@@ -0,0 +1,59 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Logger receives the log events of a filesystem based StoreBackend. fields
+// alternate between keys and values, as in "id", id, "err", err.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// nopLogger is the default Logger, discarding the events.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...interface{}) {}
+func (nopLogger) Info(msg string, fields ...interface{})  {}
+func (nopLogger) Warn(msg string, fields ...interface{})  {}
+func (nopLogger) Error(msg string, fields ...interface{}) {}
+
+// LogrusLogger is a Logger writing to the standard logrus logger, with the
+// fields of the events as logrus fields.
+type LogrusLogger struct{}
+
+func (LogrusLogger) Debug(msg string, fields ...interface{}) { logrusEntry(fields).Debug(msg) }
+func (LogrusLogger) Info(msg string, fields ...interface{})  { logrusEntry(fields).Info(msg) }
+func (LogrusLogger) Warn(msg string, fields ...interface{})  { logrusEntry(fields).Warn(msg) }
+func (LogrusLogger) Error(msg string, fields ...interface{}) { logrusEntry(fields).Error(msg) }
+
+func logrusEntry(fields []interface{}) *logrus.Entry {
+	f := make(logrus.Fields, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		f[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+	return logrus.WithFields(f)
+}
+
+// loggingBackend is implemented by backends with a Logger, which the backends
+// wrapping them log to.
+type loggingBackend interface {
+	logger() Logger
+}
+
+func (s *fs) logger() Logger {
+	return s.log
+}
+
+// backendLogger returns the Logger of b, or the default one if b has none.
+func backendLogger(b StoreBackend) Logger {
+	if lb, ok := b.(loggingBackend); ok {
+		return lb.logger()
+	}
+	return nopLogger{}
+}
@@ -0,0 +1,107 @@
+package image
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type logEvent struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// capturingLogger records the log events it receives.
+type capturingLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+}
+
+func (l *capturingLogger) log(level, msg string, fields []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := make(map[string]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		f[fields[i].(string)] = fields[i+1]
+	}
+	l.events = append(l.events, logEvent{level: level, msg: msg, fields: f})
+}
+
+func (l *capturingLogger) Debug(msg string, fields ...interface{}) { l.log("debug", msg, fields) }
+func (l *capturingLogger) Info(msg string, fields ...interface{})  { l.log("info", msg, fields) }
+func (l *capturingLogger) Warn(msg string, fields ...interface{})  { l.log("warn", msg, fields) }
+func (l *capturingLogger) Error(msg string, fields ...interface{}) { l.log("error", msg, fields) }
+
+func (l *capturingLogger) find(level, msg string) *logEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.events {
+		if l.events[i].level == level && l.events[i].msg == msg {
+			return &l.events[i]
+		}
+	}
+	return nil
+}
+
+func TestFSLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{Logger: logger})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := filepath.Join(fs.root, contentDirName, "sha256/foobar")
+	if err := ioutil.WriteFile(junk, []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Walk(func(ID) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	ev := logger.find("debug", "skipping invalid image content entry")
+	if ev == nil || ev.fields["path"] != junk {
+		t.Fatalf("Expected skipped entry event for %s, got %+v", junk, logger.events)
+	}
+
+	corruptContent(t, fs, id)
+	if _, err := fs.Get(id); err == nil {
+		t.Fatal("Expected error getting corrupt content")
+	}
+	ev = logger.find("error", "image content does not match its digest")
+	if ev == nil || ev.fields["id"] != id {
+		t.Fatalf("Expected corruption event for %v, got %+v", id, logger.events)
+	}
+}
+
+func TestFSLoggerDefault(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	if _, ok := fs.log.(nopLogger); !ok {
+		t.Fatalf("Expected a no-op logger by default, got %T", fs.log)
+	}
+	if _, ok := backendLogger(fs).(nopLogger); !ok {
+		t.Fatalf("Expected a no-op backend logger by default, got %T", backendLogger(fs))
+	}
+}
+
+func TestTransformingBackendLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{Logger: logger})
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTransformingBackend(fs); err != nil {
+		t.Fatal(err)
+	}
+	ev := logger.find("debug", "skipping untransformed image content")
+	if ev == nil || ev.fields["id"] != id {
+		t.Fatalf("Expected skipped content event for %v, got %+v", id, logger.events)
+	}
+}
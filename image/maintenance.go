@@ -0,0 +1,87 @@
+package image
+
+import "golang.org/x/net/context"
+
+// EnterMaintenance puts the store in maintenance until ExitMaintenance is
+// called, for instance to collect garbage on a stable view of the store.
+// Sets and deletes, through Set, SetContext, Delete, DeleteMany and the other
+// operations storing or removing content, aliases or staged content, block
+// while the store is in maintenance and are applied once it ends; reads and
+// metadata updates proceed normally. EnterMaintenance waits for
+// the sets and deletes in progress. Calls nest, the store leaves
+// maintenance with the last matching ExitMaintenance.
+func (s *fs) EnterMaintenance() {
+	s.maintenanceMu.Lock()
+	if s.maintenanceDepth == 0 {
+		s.maintenance = make(chan struct{})
+	}
+	s.maintenanceDepth++
+	s.maintenanceMu.Unlock()
+
+	// Taking the write lock waits for the sets and deletes that were
+	// applied before the store entered maintenance.
+	s.Lock()
+	s.Unlock()
+}
+
+// ExitMaintenance ends the maintenance entered with EnterMaintenance and
+// lets the blocked sets and deletes proceed.
+func (s *fs) ExitMaintenance() {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	if s.maintenanceDepth == 0 {
+		return
+	}
+	s.maintenanceDepth--
+	if s.maintenanceDepth == 0 {
+		close(s.maintenance)
+		s.maintenance = nil
+	}
+}
+
+// InMaintenance returns whether the store is in maintenance.
+func (s *fs) InMaintenance() bool {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+	return s.maintenanceDepth > 0
+}
+
+// lockMutation takes the store write lock for a set or delete, waiting for
+// the store to leave maintenance or for ctx to be done.
+func (s *fs) lockMutation(ctx context.Context) error {
+	for {
+		s.Lock()
+		s.maintenanceMu.Lock()
+		done := s.maintenance
+		s.maintenanceMu.Unlock()
+		if done == nil {
+			return nil
+		}
+		s.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SetContext stores data like Set, waiting for the store to leave
+// maintenance until ctx is done.
+func (s *fs) SetContext(ctx context.Context, data []byte) (ID, error) {
+	id, _, err := s.setMultiContext(ctx, data)
+	return id, err
+}
+
+// DeleteContext deletes the content and metadata of id like Delete,
+// waiting for the store to leave maintenance until ctx is done.
+func (s *fs) DeleteContext(ctx context.Context, id ID) error {
+	if err := s.lockMutation(ctx); err != nil {
+		return storeError("delete", id, err)
+	}
+	defer s.Unlock()
+
+	return storeError("delete", id, s.delete(id))
+}
@@ -0,0 +1,316 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+func TestFSMaintenance(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	live, err := fs.Set([]byte("live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage, err := fs.Set([]byte("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.EnterMaintenance()
+	if !fs.InMaintenance() {
+		t.Fatal("Expected store to be in maintenance")
+	}
+	type result struct {
+		id  ID
+		err error
+	}
+	set := make(chan result, 1)
+	go func() {
+		id, err := fs.Set([]byte("queued"))
+		set <- result{id, err}
+	}()
+
+	select {
+	case r := <-set:
+		t.Fatalf("Expected Set to block in maintenance, got %v, %v", r.id, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := fs.Get(live); err != nil {
+		t.Fatalf("Expected reads to proceed in maintenance, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fs.DeleteContext(ctx, live); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected blocked delete to fail with its context, got %v", err)
+	}
+
+	deleted, err := fs.GarbageCollect([]ID{live})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != garbage {
+		t.Fatalf("Expected GC to delete %v, got %v", garbage, deleted)
+	}
+	if !fs.InMaintenance() {
+		t.Fatal("Expected store to stay in maintenance after GC")
+	}
+	select {
+	case r := <-set:
+		t.Fatalf("Expected Set to block until maintenance ends, got %v, %v", r.id, r.err)
+	default:
+	}
+
+	fs.ExitMaintenance()
+	var r result
+	select {
+	case r = <-set:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Set to complete after maintenance")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if expected := computeID(digest.Canonical, []byte("queued")); r.id != expected {
+		t.Fatalf("Expected ID %v, got %v", expected, r.id)
+	}
+	data, err := fs.Get(r.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "queued" {
+		t.Fatalf("Expected content %q, got %q", "queued", data)
+	}
+	if fs.InMaintenance() {
+		t.Fatal("Expected store to leave maintenance")
+	}
+}
+
+func TestFSMutationsWaitForMaintenance(t *testing.T) {
+	data := []byte("mutation")
+	id := computeID(digest.Canonical, data)
+
+	// Each case prepares the store and returns the mutation to run while
+	// it is in maintenance.
+	for _, tc := range []struct {
+		name    string
+		prepare func(t *testing.T, fs *fs) func() error
+	}{
+		{"SetWithProvenance", func(t *testing.T, fs *fs) func() error {
+			return func() error {
+				_, err := fs.SetWithProvenance(data, Provenance{Actor: "test"})
+				return err
+			}
+		}},
+		{"SetExpected", func(t *testing.T, fs *fs) func() error {
+			return func() error {
+				_, err := fs.SetExpected(bytes.NewReader(data), id, int64(len(data)))
+				return err
+			}
+		}},
+		{"AcceptPush", func(t *testing.T, fs *fs) func() error {
+			return func() error {
+				_, _, err := fs.AcceptPush(bytes.NewReader(data))
+				return err
+			}
+		}},
+		{"RangeWriter.Commit", func(t *testing.T, fs *fs) func() error {
+			w, err := fs.NewRangeWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.WriteAt(data, 0); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := w.Commit(id)
+				return err
+			}
+		}},
+		{"Upload.Commit", func(t *testing.T, fs *fs) func() error {
+			u, err := fs.BeginUpload("", int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := u.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := u.Commit(id)
+				return err
+			}
+		}},
+		{"StageSet", func(t *testing.T, fs *fs) func() error {
+			return func() error {
+				_, err := fs.StageSet(data)
+				return err
+			}
+		}},
+		{"CommitStaged", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.StageSet(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error { return fs.CommitStaged(id) }
+		}},
+		{"AbortStaged", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.StageSet(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error { return fs.AbortStaged(id) }
+		}},
+		{"PruneStaged", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.StageSet(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := fs.PruneStaged(0)
+				return err
+			}
+		}},
+		{"SetDelta", func(t *testing.T, fs *fs) func() error {
+			base, err := fs.Set(bytes.Repeat([]byte("base "), 100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := fs.SetDelta(base, append(bytes.Repeat([]byte("base "), 100), "delta"...))
+				return err
+			}
+		}},
+		{"AdoptFile", func(t *testing.T, fs *fs) func() error {
+			src := filepath.Join(fs.root, "adopted")
+			if err := ioutil.WriteFile(src, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := fs.AdoptFile(src)
+				return err
+			}
+		}},
+		{"SetAlias", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error { return fs.SetAlias("latest", id) }
+		}},
+		{"DeleteAlias", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.SetAlias("latest", id); err != nil {
+				t.Fatal(err)
+			}
+			return func() error { return fs.DeleteAlias("latest") }
+		}},
+		{"SaveIndex", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := fs.SaveIndex("index", map[string]ID{"latest": id})
+				return err
+			}
+		}},
+		{"DeleteWhere", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := fs.DeleteWhere(func(ContentInfo) bool { return true }, false)
+				return err
+			}
+		}},
+		{"PruneKeepingRecent", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, err := fs.PruneKeepingRecent(-time.Hour, 0)
+				return err
+			}
+		}},
+		{"DeleteMany", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return func() error {
+				_, errs := fs.DeleteMany(id)
+				return errs[id]
+			}
+		}},
+		{"Import", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := fs.Export(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			return func() error { return fs.Import(&buf) }
+		}},
+		{"Restore", func(t *testing.T, fs *fs) func() error {
+			sid, err := fs.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() error { return fs.Restore(sid) }
+		}},
+		{"Freeze", func(t *testing.T, fs *fs) func() error {
+			if _, err := fs.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return fs.Freeze
+		}},
+		{"Relocate", func(t *testing.T, fs *fs) func() error {
+			newRoot := fs.root + "-relocated"
+			return func() error {
+				defer os.RemoveAll(newRoot)
+				return fs.Relocate(newRoot)
+			}
+		}},
+		{"RecoverTombstones", func(t *testing.T, fs *fs) func() error {
+			return fs.RecoverTombstones
+		}},
+		{"UpgradeLayout", func(t *testing.T, fs *fs) func() error {
+			return fs.UpgradeLayout
+		}},
+	} {
+		fs, cleanup := newTestFSStore(t)
+		mutate := tc.prepare(t, fs)
+
+		fs.EnterMaintenance()
+		done := make(chan error, 1)
+		go func() { done <- mutate() }()
+		select {
+		case err := <-done:
+			fs.ExitMaintenance()
+			cleanup()
+			t.Fatalf("Expected %s to wait for maintenance, got %v", tc.name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		fs.ExitMaintenance()
+		select {
+		case err := <-done:
+			if err != nil {
+				cleanup()
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			cleanup()
+			t.Fatalf("Expected %s to complete after maintenance", tc.name)
+		}
+		cleanup()
+	}
+}
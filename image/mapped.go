@@ -0,0 +1,68 @@
+package image
+
+import (
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// GetMapped returns the content of id like Get, but mapped into memory
+// instead of read, so repeated reads of large content are served from the
+// page cache without copies. The digest is verified once when mapping.
+//
+// The returned slice is only valid until release is called and must not be
+// written to. The content is held against garbage collection until then.
+func (s *fs) GetMapped(id ID) (data []byte, release func(), err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if !s.algorithmAllowed(digest.Digest(id).Algorithm()) {
+		return nil, nil, storeError("getmapped", id, ErrUnsupportedAlgorithm)
+	}
+	var unmap func()
+	if content, ok := s.getInline(id); ok {
+		data, unmap = content, func() {}
+	} else if s.packed() {
+		// The pack is read rather than mapped, it is verified below.
+		if data, err = s.pack.read(s.normalizeID(id)); err != nil {
+			return nil, nil, storeError("getmapped", id, err)
+		}
+		unmap = func() {}
+	} else {
+		data, unmap, err = s.mapFile(s.contentFile(id))
+		if err != nil {
+			return nil, nil, storeError("getmapped", id, err)
+		}
+	}
+	if s.verifyID(digest.Digest(id).Algorithm(), data) != s.normalizeID(id) {
+		unmap()
+		// Chunked content isn't contiguous on disk; it is read instead.
+		content, err := s.get(id)
+		if err != nil {
+			return nil, nil, storeError("getmapped", id, err)
+		}
+		data, unmap = content, func() {}
+	}
+	if s.trackLastUsed {
+		s.touch(id)
+	}
+
+	s.holdsMu.Lock()
+	if s.holds == nil {
+		s.holds = make(map[ID]int)
+	}
+	s.holds[id]++
+	s.holdsMu.Unlock()
+
+	var once sync.Once
+	return data, func() {
+		once.Do(func() {
+			unmap()
+			s.holdsMu.Lock()
+			defer s.holdsMu.Unlock()
+			if s.holds[id]--; s.holds[id] <= 0 {
+				delete(s.holds, id)
+			}
+		})
+	}, nil
+}
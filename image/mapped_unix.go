@@ -0,0 +1,34 @@
+// +build !windows
+
+package image
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file at path read-only into memory.
+func (s *fs) mapFile(path string) ([]byte, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		return []byte{}, func() {}, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() {
+		if err := syscall.Munmap(data); err != nil {
+			s.log.Warn("failed to unmap image content", "path", path, "err", err)
+		}
+	}, nil
+}
@@ -0,0 +1,47 @@
+// +build !windows
+
+package image
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetMapped(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, release, err := fs.GetMapped(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expected mapped content %q, got %q", content, data)
+	}
+	if !fs.isHeld(id) {
+		t.Fatal("Expected mapped content to be held")
+	}
+	release()
+	if fs.isHeld(id) {
+		t.Fatal("Expected content to be released")
+	}
+	// Releasing twice must not unmap again.
+	release()
+
+	corruptContent(t, fs, id)
+	if _, _, err := fs.GetMapped(id); err == nil {
+		t.Fatal("Expected error mapping corrupt content")
+	}
+	if fs.isHeld(id) {
+		t.Fatal("Expected failed mapping not to hold content")
+	}
+}
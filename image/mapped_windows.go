@@ -0,0 +1,14 @@
+// +build windows
+
+package image
+
+import "io/ioutil"
+
+// mapFile reads the file at path; content isn't memory mapped on Windows.
+func (s *fs) mapFile(path string) ([]byte, func(), error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() {}, nil
+}
@@ -0,0 +1,112 @@
+package image
+
+import (
+	"io"
+	"os"
+
+	"github.com/docker/distribution/digest"
+)
+
+// merkleLeaf and merkleNode hash the leaves and the inner nodes of the
+// Merkle tree of MerkleRoot. The prefixes keep a leaf from passing for an
+// inner node. The children of a node are hashed in lexical order, so that
+// a proof needs no positions.
+func merkleLeaf(id ID) digest.Digest {
+	return merkleHash("leaf ", string(id))
+}
+
+func merkleNode(a, b digest.Digest) digest.Digest {
+	if b < a {
+		a, b = b, a
+	}
+	return merkleHash("node ", string(a), " ", string(b))
+}
+
+func merkleHash(parts ...string) digest.Digest {
+	digester := digest.Canonical.New()
+	for _, p := range parts {
+		io.WriteString(digester.Hash(), p)
+	}
+	return digester.Digest()
+}
+
+// merkleLevels returns the levels of the Merkle tree over ids, from the
+// leaves up to the root. The last node of a level with an odd number of
+// nodes is carried up to the next one.
+func merkleLevels(ids []ID) [][]digest.Digest {
+	level := make([]digest.Digest, len(ids))
+	for i, id := range ids {
+		level[i] = merkleLeaf(id)
+	}
+	levels := [][]digest.Digest{level}
+	for len(level) > 1 {
+		next := make([]digest.Digest, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// MerkleRoot returns the root of a Merkle tree over the IDs of the stored
+// content, in lexical order. Unlike StateDigest, it lets MembershipProof
+// prove that the store holds an ID with a path of digests logarithmic in the
+// number of IDs. The root of an empty store is the canonical digest of no
+// data.
+func (s *fs) MerkleRoot() (digest.Digest, error) {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return digest.Canonical.New().Digest(), nil
+	}
+	levels := merkleLevels(ids)
+	return levels[len(levels)-1][0], nil
+}
+
+// MembershipProof returns the digests of the siblings of id on the path
+// from its leaf to the root of the Merkle tree of MerkleRoot, which
+// VerifyMembership checks against the root. It fails with os.ErrNotExist if
+// id isn't stored.
+func (s *fs) MembershipProof(id ID) ([]digest.Digest, error) {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	for i, v := range ids {
+		if v == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, storeError("membershipproof", id, os.ErrNotExist)
+	}
+
+	var proof []digest.Digest
+	levels := merkleLevels(ids)
+	for _, level := range levels[:len(levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMembership returns whether proof, returned by MembershipProof,
+// proves that id is in the store whose Merkle root is root.
+func VerifyMembership(root digest.Digest, id ID, proof []digest.Digest) bool {
+	node := merkleLeaf(id)
+	for _, sibling := range proof {
+		node = merkleNode(node, sibling)
+	}
+	return node == root
+}
@@ -0,0 +1,74 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestFSMerkleRoot(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	empty, err := fs.MerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []ID
+	for i := 0; i < 7; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	root, err := fs.MerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == empty {
+		t.Fatal("Expected the root to change with the content")
+	}
+	if again, err := fs.MerkleRoot(); err != nil || again != root {
+		t.Fatalf("Expected a deterministic root %v, got %v, %v", root, again, err)
+	}
+
+	for _, id := range ids {
+		proof, err := fs.MembershipProof(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof) > 3 {
+			t.Fatalf("Expected a proof of at most 3 digests for 7 IDs, got %d", len(proof))
+		}
+		if !VerifyMembership(root, id, proof) {
+			t.Fatalf("Expected proof of %v to verify", id)
+		}
+	}
+
+	absent := computeID(digest.Canonical, []byte("absent"))
+	if _, err := fs.MembershipProof(absent); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected proof of absent ID to fail with os.ErrNotExist, got %v", err)
+	}
+	proof, err := fs.MembershipProof(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyMembership(root, absent, proof) {
+		t.Fatal("Expected proof not to verify for an absent ID")
+	}
+
+	if err := fs.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := fs.MerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyMembership(updated, ids[0], proof) {
+		t.Fatal("Expected proof not to verify against the root after the delete")
+	}
+}
@@ -0,0 +1,244 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metadataStore persists the metadata of the content held by a fs store.
+// Callers are responsible for locking.
+type metadataStore interface {
+	Get(id ID, key string) ([]byte, error)
+	Set(id ID, key string, data []byte) error
+	List(id ID) ([]string, error)
+	Delete(id ID, key string) error
+	DeleteAll(id ID) error
+}
+
+// WalkMissingMetadata calls f for each image ID lacking the metadata key.
+// An error returned by f stops the walk.
+func (s *fs) WalkMissingMetadata(key string, f IDWalkFunc) error {
+	if err := validateMetadataKey(key); err != nil {
+		return storeError("walkmissingmetadata", "", err)
+	}
+	return s.Walk(func(id ID) error {
+		has, err := s.hasMetadata(id, key)
+		if err != nil {
+			return err
+		}
+		if has {
+			return nil
+		}
+		return f(id)
+	})
+}
+
+func (s *fs) hasMetadata(id ID, key string) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return false, storeError("walkmissingmetadata", id, err)
+	}
+	defer unlock()
+
+	_, err = s.metadata.Get(id, key)
+	return err == nil, nil
+}
+
+// CompareAndSwapMetadata sets the metadata key of id to new only if its
+// current value is old, and reports whether it did. A nil old requires the
+// key not to be set. The comparison and the write happen under the write
+// lock of id, so of several concurrent swaps from the same value only one
+// succeeds.
+func (s *fs) CompareAndSwapMetadata(id ID, key string, old, new []byte) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		return false, storeError("casmetadata", id, err)
+	}
+	defer unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return false, storeError("casmetadata", id, err)
+	}
+	if err := validateWritableMetadataKey(key); err != nil {
+		return false, storeError("casmetadata", id, err)
+	}
+	if err := s.validateMetadata(key, new); err != nil {
+		return false, storeError("casmetadata", id, err)
+	}
+	if _, err := s.get(id); err != nil {
+		return false, storeError("casmetadata", id, err)
+	}
+	current, err := s.metadata.Get(id, key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, storeError("casmetadata", id, err)
+		}
+		if old != nil {
+			return false, nil
+		}
+	} else if old == nil || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	if err := s.metadata.Set(id, key, new); err != nil {
+		return false, storeError("casmetadata", id, err)
+	}
+	return true, nil
+}
+
+// storageMetadataKeys are the reserved keys describing how the content of
+// an ID is stored, which the store records wherever it stores the content
+// and which copies of the metadata leave out.
+var storageMetadataKeys = map[string]bool{
+	sizeKey:            true,
+	weakChecksumKey:    true,
+	deltaDependentsKey: true,
+}
+
+// allMetadata returns the metadata of id with the reserved keys, except the
+// storage keys, to copy it whole to another store.
+func (s *fs) allMetadata(id ID) (map[string][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return nil, storeError("listmetadata", id, err)
+	}
+	defer unlock()
+
+	if err := s.contentExists(id); err != nil {
+		return nil, storeError("listmetadata", id, err)
+	}
+	keys, err := s.metadata.List(id)
+	if err != nil {
+		return nil, storeError("listmetadata", id, err)
+	}
+	md := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if storageMetadataKeys[key] {
+			continue
+		}
+		data, err := s.metadata.Get(id, key)
+		if err != nil {
+			return nil, storeError("listmetadata", id, err)
+		}
+		md[key] = data
+	}
+	return md, nil
+}
+
+// reservedMetadataBackend is implemented by the backends that reserve
+// metadata keys, and by the backends wrapping them, for the backends
+// layered on top to maintain their own reserved keys and to copy metadata
+// whole.
+type reservedMetadataBackend interface {
+	setReservedMetadata(id ID, key string, data []byte) error
+	allMetadata(id ID) (map[string][]byte, error)
+}
+
+// setBackendMetadata sets the metadata key of id in b, which may be a
+// reserved key.
+func setBackendMetadata(b StoreBackend, id ID, key string, data []byte) error {
+	if rb, ok := b.(reservedMetadataBackend); ok && isReservedMetadataKey(key) {
+		return rb.setReservedMetadata(id, key, data)
+	}
+	return b.SetMetadata(id, key, data)
+}
+
+// backendMetadata returns the metadata of id in b, with the reserved keys
+// of the backends that have them. It fails if b can't list metadata.
+func backendMetadata(b StoreBackend, id ID) (map[string][]byte, error) {
+	if rb, ok := b.(reservedMetadataBackend); ok {
+		return rb.allMetadata(id)
+	}
+	lister, ok := b.(metadataLister)
+	if !ok {
+		return nil, storeError("listmetadata", id, errors.New("image store can't list metadata"))
+	}
+	keys, err := lister.ListMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	md := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		data, err := b.GetMetadata(id, key)
+		if err != nil {
+			return nil, err
+		}
+		md[key] = data
+	}
+	return md, nil
+}
+
+// fileMetadataStore keeps every metadata key in its own file under
+// metadata/<algorithm>/<hex>/<key>.
+type fileMetadataStore struct {
+	s *fs
+}
+
+func (m *fileMetadataStore) Get(id ID, key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(m.s.metadataDir(id), key))
+}
+
+// Set writes the value to a temporary file renamed over the key, so that
+// readers never see a partial value and a write interrupted midway leaves
+// the previous one. The temporary files start with a dot, which keys can't.
+// Like content, the value is made durable by the next Barrier.
+func (m *fileMetadataStore) Set(id ID, key string, data []byte) error {
+	baseDir := m.s.metadataDir(id)
+	if err := os.MkdirAll(baseDir, 0700); err != nil {
+		return err
+	}
+	tempFile, err := m.s.fsys.TempFile(baseDir, "."+key+".")
+	if err != nil {
+		return err
+	}
+	tempFilePath := tempFile.Name()
+	_, err = tempFile.Write(data)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	filePath := filepath.Join(baseDir, key)
+	if err == nil {
+		err = m.s.fsys.Rename(tempFilePath, filePath)
+	}
+	if err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	m.s.markUnsynced(filePath)
+	return nil
+}
+
+func (m *fileMetadataStore) List(id ID) ([]string, error) {
+	dir, err := ioutil.ReadDir(m.s.metadataDir(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []string
+	for _, v := range dir {
+		if v.IsDir() || strings.HasPrefix(v.Name(), ".") {
+			continue
+		}
+		keys = append(keys, v.Name())
+	}
+	return keys, nil
+}
+
+func (m *fileMetadataStore) Delete(id ID, key string) error {
+	return os.RemoveAll(filepath.Join(m.s.metadataDir(id), key))
+}
+
+func (m *fileMetadataStore) DeleteAll(id ID) error {
+	return os.RemoveAll(m.s.metadataDir(id))
+}
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// jsonMetadataStore keeps all the metadata of an ID in a single JSON file
+// metadata/<algorithm>/<hex>.json, saving a file per key.
+type jsonMetadataStore struct {
+	s *fs
+}
+
+func (m *jsonMetadataStore) file(id ID) string {
+	return m.s.metadataDir(id) + ".json"
+}
+
+func (m *jsonMetadataStore) load(id ID) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(m.file(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string][]byte{}, nil
+		}
+		return nil, err
+	}
+	md := make(map[string][]byte)
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func (m *jsonMetadataStore) save(id ID, md map[string][]byte) error {
+	if len(md) == 0 {
+		return m.DeleteAll(id)
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	filePath := m.file(id)
+	tempFilePath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempFilePath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFilePath, filePath)
+}
+
+func (m *jsonMetadataStore) Get(id ID, key string) ([]byte, error) {
+	md, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := md[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: m.file(id) + ":" + key, Err: os.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (m *jsonMetadataStore) Set(id ID, key string, data []byte) error {
+	md, err := m.load(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.file(id)), 0700); err != nil {
+		return err
+	}
+	md[key] = data
+	return m.save(id, md)
+}
+
+func (m *jsonMetadataStore) List(id ID) ([]string, error) {
+	md, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range md {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (m *jsonMetadataStore) Delete(id ID, key string) error {
+	md, err := m.load(id)
+	if err != nil {
+		return err
+	}
+	if _, ok := md[key]; !ok {
+		return nil
+	}
+	delete(md, key)
+	return m.save(id, md)
+}
+
+func (m *jsonMetadataStore) DeleteAll(id ID) error {
+	if err := os.Remove(m.file(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metadataLayoutFileName records the metadata layout of a store, and the
+// layout being migrated from while a migration is in progress.
+const metadataLayoutFileName = "metadata-layout"
+
+// MetadataLayout is the on-disk layout of the metadata of a fs store.
+type MetadataLayout string
+
+const (
+	// MetadataLayoutFiles stores each metadata key in its own file.
+	MetadataLayoutFiles MetadataLayout = "files"
+	// MetadataLayoutJSON stores all the metadata of an ID in one JSON file.
+	MetadataLayoutJSON MetadataLayout = "json"
+)
+
+func (s *fs) newMetadataStore(layout MetadataLayout) (metadataStore, error) {
+	switch layout {
+	case MetadataLayoutFiles:
+		return &fileMetadataStore{s: s}, nil
+	case MetadataLayoutJSON:
+		return &jsonMetadataStore{s: s}, nil
+	}
+	return nil, fmt.Errorf("unknown image metadata layout %q", layout)
+}
+
+func (s *fs) metadataLayoutFile() string {
+	return filepath.Join(s.root, metadataLayoutFileName+s.namespaceSuffix())
+}
+
+// namespaceSuffix distinguishes the files of a namespace in the store root.
+func (s *fs) namespaceSuffix() string {
+	if s.namespace == "" {
+		return ""
+	}
+	return "." + s.namespace
+}
+
+// loadMetadataLayout returns the metadata store of the recorded layout,
+// resuming the fall through to the previous layout of an interrupted
+// migration.
+func (s *fs) loadMetadataLayout() (metadataStore, error) {
+	data, err := ioutil.ReadFile(s.metadataLayoutFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &fileMetadataStore{s: s}, nil
+		}
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid image metadata layout %q", data)
+	}
+	to, err := s.newMetadataStore(MetadataLayout(fields[0]))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 1 {
+		return to, nil
+	}
+	from, err := s.newMetadataStore(MetadataLayout(fields[1]))
+	if err != nil {
+		return nil, err
+	}
+	return &migratingMetadataStore{to: to, from: from, layout: MetadataLayout(fields[0])}, nil
+}
+
+func (s *fs) metadataLayout() MetadataLayout {
+	switch m := s.metadata.(type) {
+	case *jsonMetadataStore:
+		return MetadataLayoutJSON
+	case *migratingMetadataStore:
+		return m.layout
+	}
+	return MetadataLayoutFiles
+}
+
+// MigrateMetadataLayout converts the metadata of the store to the target
+// layout while the store stays in use. IDs are converted one at a time under
+// their metadata lock, and until all are, reads fall through to the previous
+// layout for the keys not converted yet. An interrupted migration is resumed
+// when the store is opened again and completed by calling
+// MigrateMetadataLayout with the same target.
+func (s *fs) MigrateMetadataLayout(target MetadataLayout) error {
+	m, err := s.beginMetadataLayoutMigration(target)
+	if err != nil || m == nil {
+		return err
+	}
+
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.migrateMetadataLayout(m, id); err != nil {
+			return storeError("migratemetadatalayout", id, err)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.writeRootFile(filepath.Base(s.metadataLayoutFile()), []byte(target)); err != nil {
+		return err
+	}
+	s.metadata = m.to
+	return nil
+}
+
+// beginMetadataLayoutMigration switches the store to fall through from the
+// target layout to the current one. It returns nil if the store already
+// uses the target layout.
+func (s *fs) beginMetadataLayoutMigration(target MetadataLayout) (*migratingMetadataStore, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.metadataInContent {
+		return nil, errors.New("image metadata is stored in extended attributes")
+	}
+	if m, ok := s.metadata.(*migratingMetadataStore); ok {
+		if m.layout != target {
+			return nil, fmt.Errorf("image metadata migration to %s is in progress", m.layout)
+		}
+		return m, nil
+	}
+	current := s.metadataLayout()
+	if current == target {
+		return nil, nil
+	}
+	to, err := s.newMetadataStore(target)
+	if err != nil {
+		return nil, err
+	}
+	m := &migratingMetadataStore{to: to, from: s.metadata, layout: target}
+	if err := s.writeRootFile(filepath.Base(s.metadataLayoutFile()), []byte(string(target)+" "+string(current))); err != nil {
+		return nil, err
+	}
+	s.metadata = m
+	return m, nil
+}
+
+func (s *fs) migrateMetadataLayout(m *migratingMetadataStore, id ID) error {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.migrate(id)
+}
+
+// migratingMetadataStore serves metadata during a layout migration. Writes
+// go to the new layout, and reads fall through to the previous one.
+type migratingMetadataStore struct {
+	to, from metadataStore
+	layout   MetadataLayout
+}
+
+// migrate moves the metadata of id that is only in the previous layout to
+// the new one. Keys already written to the new layout are newer and kept.
+func (m *migratingMetadataStore) migrate(id ID) error {
+	keys, err := m.from.List(id)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := m.to.Get(id, key); err == nil {
+			continue
+		}
+		data, err := m.from.Get(id, key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := m.to.Set(id, key, data); err != nil {
+			return err
+		}
+	}
+	return m.from.DeleteAll(id)
+}
+
+func (m *migratingMetadataStore) Get(id ID, key string) ([]byte, error) {
+	data, err := m.to.Get(id, key)
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	return m.from.Get(id, key)
+}
+
+func (m *migratingMetadataStore) Set(id ID, key string, data []byte) error {
+	return m.to.Set(id, key, data)
+}
+
+func (m *migratingMetadataStore) List(id ID) ([]string, error) {
+	keys, err := m.to.List(id)
+	if err != nil {
+		return nil, err
+	}
+	old, err := m.from.List(id)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for _, key := range old {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *migratingMetadataStore) Delete(id ID, key string) error {
+	if err := m.to.Delete(id, key); err != nil {
+		return err
+	}
+	return m.from.Delete(id, key)
+}
+
+func (m *migratingMetadataStore) DeleteAll(id ID) error {
+	if err := m.to.DeleteAll(id); err != nil {
+		return err
+	}
+	return m.from.DeleteAll(id)
+}
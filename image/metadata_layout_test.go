@@ -0,0 +1,102 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMigrateMetadataLayout(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 4; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := fs.SetMetadata(id, key, []byte(key+id.String())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, id)
+	}
+
+	// Convert only the first ID, as if the migration was interrupted.
+	m, err := fs.beginMetadataLayoutMigration(MetadataLayoutJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.migrateMetadataLayout(m, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads fall through to whichever layout holds the key, and writes
+	// during the migration aren't lost.
+	for _, id := range ids {
+		data, err := fs.GetMetadata(id, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "a"+id.String() {
+			t.Fatalf("Expected %q, got %q", "a"+id.String(), data)
+		}
+	}
+	if err := fs.SetMetadata(ids[1], "a", []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(ids[2], "c", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteMetadata(ids[3], "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The migration is resumed by a store opened on the same root.
+	fs, err = newFSStore(fs.root, FSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.GetMetadata(ids[1], "a"); err != nil || string(data) != "updated" {
+		t.Fatalf("Expected updated value mid-migration, got %q, %v", data, err)
+	}
+	if err := fs.MigrateMetadataLayout(MetadataLayoutJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MigrateMetadataLayout(MetadataLayoutJSON); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.metadata.(*jsonMetadataStore); !ok {
+		t.Fatalf("Expected JSON metadata layout, got %T", fs.metadata)
+	}
+
+	expected := map[ID]map[string]string{
+		ids[0]: {"a": "a" + ids[0].String(), "b": "b" + ids[0].String()},
+		ids[1]: {"a": "updated", "b": "b" + ids[1].String()},
+		ids[2]: {"a": "a" + ids[2].String(), "b": "b" + ids[2].String(), "c": "new"},
+		ids[3]: {"a": "a" + ids[3].String()},
+	}
+	for id, md := range expected {
+		keys, err := fs.ListMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(md) {
+			t.Fatalf("Expected keys of %v for %v, got %v", md, id, keys)
+		}
+		for key, value := range md {
+			data, err := fs.GetMetadata(id, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != value {
+				t.Fatalf("Expected %s of %v to be %q, got %q", key, id, value, data)
+			}
+		}
+		if _, err := os.Stat(fs.metadataDir(id)); !os.IsNotExist(err) {
+			t.Fatalf("Expected per-key metadata of %v to be removed, got %v", id, err)
+		}
+	}
+}
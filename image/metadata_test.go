@@ -0,0 +1,135 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestWalkMissingMetadata(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	missing := make(map[ID]struct{})
+	for i := 0; i < 6; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := fs.SetMetadata(id, "created", []byte("now")); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		missing[id] = struct{}{}
+	}
+
+	n := 0
+	err := fs.WalkMissingMetadata("created", func(id ID) error {
+		if _, ok := missing[id]; !ok {
+			t.Fatalf("Unexpected walk of %v having the metadata key", id)
+		}
+		n++
+		// backfilling during the walk must not deadlock
+		return fs.SetMetadata(id, "created", []byte("later"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(missing) {
+		t.Fatalf("Expected %d walked IDs, got %d", len(missing), n)
+	}
+
+	if err := fs.DeleteMetadata(firstKey(missing), "created"); err != nil {
+		t.Fatal(err)
+	}
+	err = fs.WalkMissingMetadata("created", func(id ID) error {
+		return errors.New("stop")
+	})
+	if err == nil {
+		t.Fatal("Expected error from walker")
+	}
+}
+
+func firstKey(m map[ID]struct{}) ID {
+	for id := range m {
+		return id
+	}
+	return ""
+}
+
+func TestCompareAndSwapMetadata(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := fs.CompareAndSwapMetadata(id, "tags", []byte("x"), []byte("a")); err != nil || ok {
+		t.Fatalf("Expected swap of unset key from a value to fail, got %v, %v", ok, err)
+	}
+	if ok, err := fs.CompareAndSwapMetadata(id, "tags", nil, []byte("a")); err != nil || !ok {
+		t.Fatalf("Expected swap of unset key to succeed, got %v, %v", ok, err)
+	}
+	if ok, err := fs.CompareAndSwapMetadata(id, "tags", nil, []byte("b")); err != nil || ok {
+		t.Fatalf("Expected swap of set key from nil to fail, got %v, %v", ok, err)
+	}
+
+	const racers = 2
+	var wg sync.WaitGroup
+	results := make(chan bool, racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := fs.CompareAndSwapMetadata(id, "tags", []byte("a"), []byte(fmt.Sprintf("a,%d", i)))
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for ok := range results {
+		if ok {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("Expected exactly one swap to succeed, got %d", succeeded)
+	}
+	data, err := fs.GetMetadata(id, "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a,0" && string(data) != "a,1" {
+		t.Fatalf("Expected a swapped value, got %q", data)
+	}
+}
+
+func TestListMetadataTmpSuffix(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "a.tmp", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := fs.ListMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "a.tmp" {
+		t.Fatalf("Expected key a.tmp to be listed, got %v", keys)
+	}
+}
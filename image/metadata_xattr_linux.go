@@ -0,0 +1,101 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const xattrMetadataPrefix = "user.docker.image."
+
+// xattrMetadataStore keeps metadata as extended attributes of the content
+// files, so it is removed together with the content.
+type xattrMetadataStore struct {
+	s *fs
+}
+
+// newXattrMetadataStore returns an xattr based metadataStore for s, or an
+// error if the filesystem holding the content doesn't support user
+// extended attributes.
+func newXattrMetadataStore(s *fs) (metadataStore, error) {
+	f, err := ioutil.TempFile(s.contentDir(), ".xattr-probe")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	if err := syscall.Setxattr(f.Name(), xattrMetadataPrefix+"probe", []byte("1"), 0); err != nil {
+		return nil, &os.PathError{Op: "setxattr", Path: f.Name(), Err: err}
+	}
+	return &xattrMetadataStore{s: s}, nil
+}
+
+func (m *xattrMetadataStore) Get(id ID, key string) ([]byte, error) {
+	path := m.s.contentFile(id)
+	for {
+		sz, err := syscall.Getxattr(path, xattrMetadataPrefix+key, nil)
+		if err == nil {
+			data := make([]byte, sz)
+			sz, err = syscall.Getxattr(path, xattrMetadataPrefix+key, data)
+			if err == nil {
+				return data[:sz], nil
+			}
+		}
+		switch err {
+		case syscall.ERANGE:
+			continue
+		case syscall.ENODATA:
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: os.ErrNotExist}
+		}
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+}
+
+func (m *xattrMetadataStore) Set(id ID, key string, data []byte) error {
+	path := m.s.contentFile(id)
+	if err := syscall.Setxattr(path, xattrMetadataPrefix+key, data, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (m *xattrMetadataStore) List(id ID) ([]string, error) {
+	path := m.s.contentFile(id)
+	for {
+		sz, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		buf := make([]byte, sz)
+		sz, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+
+		var keys []string
+		for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+			if strings.HasPrefix(name, xattrMetadataPrefix) {
+				keys = append(keys, strings.TrimPrefix(name, xattrMetadataPrefix))
+			}
+		}
+		return keys, nil
+	}
+}
+
+func (m *xattrMetadataStore) Delete(id ID, key string) error {
+	path := m.s.contentFile(id)
+	if err := syscall.Removexattr(path, xattrMetadataPrefix+key); err != nil && err != syscall.ENODATA {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// DeleteAll is a no-op, the attributes go away with the content file.
+func (m *xattrMetadataStore) DeleteAll(id ID) error {
+	return nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package image
+
+import "errors"
+
+func newXattrMetadataStore(s *fs) (metadataStore, error) {
+	return nil, errors.New("extended attribute metadata is not supported on this platform")
+}
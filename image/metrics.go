@@ -0,0 +1,150 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// MetricsReporter is implemented by the backends keeping statistics, like
+// CachingBackend and TieredBackend. MetricsBackend discovers the reporters
+// among the backends it wraps and exports their metrics.
+type MetricsReporter interface {
+	// Metrics returns the current value of each metric of the backend by
+	// name. Counters end in _total.
+	Metrics() map[string]float64
+}
+
+// wrapper is implemented by the backends wrapping other backends, so that
+// MetricsBackend can discover the reporters among them.
+type wrapper interface {
+	wrapped() []StoreBackend
+}
+
+// MetricsBackend is a StoreBackend counting the operations on its inner
+// backend. It reports them along with the metrics of every MetricsReporter
+// it wraps, directly or through other wrapping backends.
+type MetricsBackend struct {
+	inner StoreBackend
+
+	gets, sets, deletes, errors uint64
+}
+
+// NewMetricsBackend returns a backend reporting the metrics of inner.
+func NewMetricsBackend(inner StoreBackend) *MetricsBackend {
+	return &MetricsBackend{inner: inner}
+}
+
+// Metrics returns the operation counts of the backend and the metrics of the
+// reporters it wraps. The values of metrics reported by several backends are
+// added up.
+func (mb *MetricsBackend) Metrics() map[string]float64 {
+	metrics := map[string]float64{
+		"store_gets_total":    float64(atomic.LoadUint64(&mb.gets)),
+		"store_sets_total":    float64(atomic.LoadUint64(&mb.sets)),
+		"store_deletes_total": float64(atomic.LoadUint64(&mb.deletes)),
+		"store_errors_total":  float64(atomic.LoadUint64(&mb.errors)),
+	}
+	seen := make(map[StoreBackend]bool)
+	var collect func(b StoreBackend)
+	collect = func(b StoreBackend) {
+		// Backends shared by several wrappers are only counted once.
+		if reflect.TypeOf(b).Comparable() {
+			if seen[b] {
+				return
+			}
+			seen[b] = true
+		}
+		if r, ok := b.(MetricsReporter); ok {
+			for name, value := range r.Metrics() {
+				metrics[name] += value
+			}
+		}
+		if w, ok := b.(wrapper); ok {
+			for _, inner := range w.wrapped() {
+				collect(inner)
+			}
+		}
+	}
+	collect(mb.inner)
+	return metrics
+}
+
+// WriteMetrics writes the metrics to w in the Prometheus text format, one
+// metric per line in lexical order.
+func (mb *MetricsBackend) WriteMetrics(w io.Writer) error {
+	metrics := mb.Metrics()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %v\n", name, metrics[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mb *MetricsBackend) count(counter *uint64, err error) {
+	atomic.AddUint64(counter, 1)
+	if err != nil {
+		atomic.AddUint64(&mb.errors, 1)
+	}
+}
+
+func (mb *MetricsBackend) wrapped() []StoreBackend {
+	return []StoreBackend{mb.inner}
+}
+
+// Walk calls the supplied callback for each image ID.
+func (mb *MetricsBackend) Walk(f IDWalkFunc) error {
+	return mb.inner.Walk(f)
+}
+
+// Get returns the content stored under a given ID.
+func (mb *MetricsBackend) Get(id ID) ([]byte, error) {
+	data, err := mb.inner.Get(id)
+	mb.count(&mb.gets, err)
+	return data, err
+}
+
+// Set stores content under a given ID.
+func (mb *MetricsBackend) Set(data []byte) (ID, error) {
+	id, err := mb.inner.Set(data)
+	mb.count(&mb.sets, err)
+	return id, err
+}
+
+// Delete removes content and metadata associated with the ID.
+func (mb *MetricsBackend) Delete(id ID) error {
+	err := mb.inner.Delete(id)
+	mb.count(&mb.deletes, err)
+	return err
+}
+
+// SetMetadata sets metadata for a given ID.
+func (mb *MetricsBackend) SetMetadata(id ID, key string, data []byte) error {
+	return mb.inner.SetMetadata(id, key, data)
+}
+
+// GetMetadata returns metadata for a given ID.
+func (mb *MetricsBackend) GetMetadata(id ID, key string) ([]byte, error) {
+	return mb.inner.GetMetadata(id, key)
+}
+
+// DeleteMetadata removes the metadata associated with an ID.
+func (mb *MetricsBackend) DeleteMetadata(id ID, key string) error {
+	return mb.inner.DeleteMetadata(id, key)
+}
+
+func (mb *MetricsBackend) setReservedMetadata(id ID, key string, data []byte) error {
+	return setBackendMetadata(mb.inner, id, key, data)
+}
+
+func (mb *MetricsBackend) allMetadata(id ID) (map[string][]byte, error) {
+	return backendMetadata(mb.inner, id)
+}
@@ -0,0 +1,50 @@
+package image
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsBackend(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	cache := NewCachingBackend(fs, 1024)
+	mb := NewMetricsBackend(NewLimitedBackend(cache, 2))
+
+	id, err := mb.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := mb.Get(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mb.Get("sha256:0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("Expected error getting unknown content")
+	}
+
+	metrics := mb.Metrics()
+	for name, expected := range map[string]float64{
+		"cache_hits_total":   2,
+		"cache_misses_total": 2,
+		"cache_bytes":        3,
+		"store_gets_total":   4,
+		"store_sets_total":   1,
+		"store_errors_total": 1,
+	} {
+		if metrics[name] != expected {
+			t.Fatalf("Expected %s %v, got %v", name, expected, metrics[name])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := mb.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "cache_hits_total 2\n") {
+		t.Fatalf("Expected exported cache hits, got %q", buf.String())
+	}
+}
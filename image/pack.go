@@ -0,0 +1,243 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// packDirName holds the pack file of a frozen store, its index and the
+// manifest digest of the index.
+const packDirName = "pack"
+
+const (
+	packFileName     = "content"
+	packIndexName    = "index.json"
+	packManifestName = "manifest"
+)
+
+// ErrReadOnly is returned by the operations modifying a store frozen with
+// Freeze.
+var ErrReadOnly = errors.New("image store is frozen")
+
+var errFreezeXattrMetadata = errors.New("freezing is not supported with extended attribute metadata")
+
+// packEntry locates the content of an ID in the pack file.
+type packEntry struct {
+	ID     ID    `json:"id"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// pack is the content of a frozen store, read by offset from one file.
+type pack struct {
+	f       *os.File
+	entries map[ID]packEntry
+	ids     []ID
+}
+
+func (s *fs) packDir() string {
+	return filepath.Join(s.root, packDirName+s.namespaceSuffix())
+}
+
+// read returns the content of id from the pack, unverified.
+func (p *pack) read(id ID) ([]byte, error) {
+	e, ok := p.entries[id]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p.f.Name() + ":" + string(id), Err: os.ErrNotExist}
+	}
+	content := make([]byte, e.Size)
+	if _, err := p.f.ReadAt(content, e.Offset); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// packed returns whether the store is frozen. The content of a frozen store
+// is only read from its pack.
+func (s *fs) packed() bool {
+	return s.pack != nil
+}
+
+// checkWritable returns ErrReadOnly if the store is frozen.
+func (s *fs) checkWritable() error {
+	if s.packed() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Freeze packs the content of the store into a single read-only pack file
+// and turns the store into a frozen store, for instance to ship a base image
+// store as one bundle. Get and Walk keep working the same, reading the
+// content from the pack by offset and verifying its digest; Set, Delete and
+// the other operations modifying the store fail with ErrReadOnly, and so
+// does Freeze. The store stays frozen when it is opened again.
+//
+// The pack index lists the ID, offset and size of every blob, and the
+// manifest file next to it holds the digest of the index, which makes the
+// whole bundle tamper-evident. Metadata is kept as it is.
+func (s *fs) Freeze() error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("freeze", "", err)
+	}
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return storeError("freeze", "", err)
+	}
+	if s.metadataInContent {
+		return storeError("freeze", "", errFreezeXattrMetadata)
+	}
+	ids, err := s.listIDs()
+	if err != nil {
+		return storeError("freeze", "", err)
+	}
+	sort.Sort(idSlice(ids))
+
+	staging, err := ioutil.TempDir(s.tempDir(), "freeze-")
+	if err != nil {
+		return storeError("freeze", "", err)
+	}
+	defer os.RemoveAll(staging)
+	if err := s.writePack(staging, ids); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, s.packDir()); err != nil {
+		return storeError("freeze", "", err)
+	}
+	p, err := s.loadPack()
+	if err != nil {
+		return storeError("freeze", "", err)
+	}
+	s.pack = p
+	s.removeUnpacked()
+	return nil
+}
+
+// writePack writes the content of ids, their index and its manifest digest
+// to dir.
+func (s *fs) writePack(dir string, ids []ID) error {
+	f, err := os.OpenFile(filepath.Join(dir, packFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return storeError("freeze", "", err)
+	}
+	defer f.Close()
+
+	entries := make([]packEntry, 0, len(ids))
+	var offset int64
+	for _, id := range ids {
+		content, err := s.get(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return storeError("freeze", id, err)
+		}
+		if _, err := f.Write(content); err != nil {
+			return storeError("freeze", id, err)
+		}
+		entries = append(entries, packEntry{ID: id, Offset: offset, Size: int64(len(content))})
+		offset += int64(len(content))
+	}
+	if err := f.Sync(); err != nil {
+		return storeError("freeze", "", err)
+	}
+
+	index, err := json.Marshal(entries)
+	if err != nil {
+		return storeError("freeze", "", err)
+	}
+	manifest, err := digest.FromBytes(index)
+	if err != nil {
+		return storeError("freeze", "", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, packIndexName), index, 0400); err != nil {
+		return storeError("freeze", "", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, packManifestName), []byte(manifest), 0400); err != nil {
+		return storeError("freeze", "", err)
+	}
+	return nil
+}
+
+// loadPack opens the pack of a frozen store, checking its index against the
+// manifest digest. It returns nil if the store isn't frozen.
+func (s *fs) loadPack() (*pack, error) {
+	dir := s.packDir()
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, packManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dir, packIndexName))
+	if err != nil {
+		return nil, err
+	}
+	dgst, err := digest.ParseDigest(string(manifest))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image pack manifest: %v", err)
+	}
+	if computeID(dgst.Algorithm(), index) != ID(dgst) {
+		return nil, fmt.Errorf("image pack index does not match its manifest %s: %w", dgst, ErrCorrupt)
+	}
+	var entries []packEntry
+	if err := json.Unmarshal(index, &entries); err != nil {
+		return nil, fmt.Errorf("invalid image pack index: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, packFileName))
+	if err != nil {
+		return nil, err
+	}
+	p := &pack{f: f, entries: make(map[ID]packEntry, len(entries))}
+	for _, e := range entries {
+		p.entries[e.ID] = e
+		p.ids = append(p.ids, e.ID)
+	}
+	return p, nil
+}
+
+// removeUnpacked removes the content files, chunks and inline content of a
+// store whose content was packed by Freeze.
+func (s *fs) removeUnpacked() {
+	if s.layout != nil {
+		entries, err := s.layoutEntries()
+		if err != nil {
+			s.log.Warn("failed to remove unpacked image content", "dir", s.contentDir(), "err", err)
+		}
+		for _, entry := range entries {
+			if entry.Kind != ValidContent {
+				continue
+			}
+			if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				s.log.Warn("failed to remove unpacked image content", "path", entry.Path, "err", err)
+			}
+		}
+	}
+	for _, dir := range []string{s.contentDir(), filepath.Join(s.root, chunksDirName, s.namespace)} {
+		algs, err := algorithmDirs(dir)
+		if err != nil {
+			s.log.Warn("failed to remove unpacked image content", "dir", dir, "err", err)
+			continue
+		}
+		for _, alg := range algs {
+			if err := os.RemoveAll(filepath.Join(dir, alg)); err != nil {
+				s.log.Warn("failed to remove unpacked image content", "dir", filepath.Join(dir, alg), "err", err)
+			}
+		}
+	}
+	if err := os.Remove(s.inlineIndexFile()); err != nil && !os.IsNotExist(err) {
+		s.log.Warn("failed to remove unpacked inline image content", "err", err)
+	}
+	s.inline = make(map[ID][]byte)
+}
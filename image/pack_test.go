@@ -0,0 +1,122 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFSFreeze(t *testing.T) {
+	for _, opts := range []FSOptions{
+		{InlineThreshold: 8, ChunkSize: 16},
+		{InlineThreshold: 8, ChunkSize: 16, ContentLayout: flatLayout{}},
+	} {
+		testFSFreeze(t, opts)
+	}
+}
+
+func testFSFreeze(t *testing.T, opts FSOptions) {
+	fs, cleanup := newTestFSStoreOptions(t, opts)
+	defer cleanup()
+
+	contents := make(map[ID][]byte)
+	for i, data := range []string{"small", "content of image", "chunked content of some image"} {
+		id, err := fs.Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.SetMetadata(id, "index", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		contents[id] = []byte(data)
+	}
+	before, err := fs.sortedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newFSStore(fs.root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []StoreBackend{fs, reopened} {
+		var after []ID
+		if err := s.Walk(func(id ID) error {
+			after = append(after, id)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(after, before) {
+			t.Fatalf("Expected frozen store to walk %v, got %v", before, after)
+		}
+		for id, data := range contents {
+			content, err := s.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, data) {
+				t.Fatalf("Expected content %q of %v, got %q", data, id, content)
+			}
+			if _, err := s.GetMetadata(id, "index"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.Set([]byte("new content")); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Expected ErrReadOnly from Set, got %v", err)
+		}
+		if err := s.Delete(before[0]); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Expected ErrReadOnly from Delete, got %v", err)
+		}
+		if err := s.SetMetadata(before[0], "index", nil); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Expected ErrReadOnly from SetMetadata, got %v", err)
+		}
+	}
+	if err := fs.Freeze(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Freeze, got %v", err)
+	}
+
+	// Unpacked content is gone, the pack is verified on read.
+	for _, id := range before {
+		if _, err := os.Stat(fs.contentFile(id)); !os.IsNotExist(err) {
+			t.Fatalf("Expected no content file left for %v, got %v", id, err)
+		}
+	}
+	packFile := filepath.Join(fs.packDir(), packFileName)
+	if err := os.Chmod(packFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(packFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := reopened.pack.entries[before[0]]
+	if _, err := f.WriteAt([]byte("X"), e.Offset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := reopened.Get(before[0]); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt for tampered pack, got %v", err)
+	}
+
+	// A tampered index doesn't match the manifest.
+	indexFile := filepath.Join(fs.packDir(), packIndexName)
+	if err := os.Chmod(indexFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(indexFile, []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFSStore(fs.root, opts); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt for tampered index, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Proof returns the size and digest components of the verified content of
+// id, which an auditor can compare with its own records.
+func (s *fs) Proof(id ID) (size int64, algo string, hex string, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	content, err := s.get(id)
+	if err != nil {
+		return 0, "", "", storeError("proof", id, err)
+	}
+	dgst := digest.Digest(id)
+	return int64(len(content)), string(dgst.Algorithm()), dgst.Hex(), nil
+}
+
+// ProveRange returns the canonical digest of the n bytes of the content of
+// id starting at off. An auditor holding the content can challenge the store
+// with random ranges without transferring the content itself.
+func (s *fs) ProveRange(id ID, off, n int64) (digest.Digest, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	m, err := s.readChunkManifest(id)
+	if err != nil {
+		return "", storeError("proverange", id, err)
+	}
+	base, err := s.readDeltaBase(id)
+	if err != nil {
+		return "", storeError("proverange", id, err)
+	}
+
+	var (
+		r    io.ReaderAt
+		size int64
+	)
+	if _, inline := s.inline[s.normalizeID(id)]; m != nil || base != "" || inline || s.packed() {
+		content, err := s.get(id)
+		if err != nil {
+			return "", storeError("proverange", id, err)
+		}
+		r, size = bytes.NewReader(content), int64(len(content))
+	} else {
+		f, err := os.Open(s.contentFile(id))
+		if err != nil {
+			return "", storeError("proverange", id, err)
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return "", storeError("proverange", id, err)
+		}
+		r, size = f, fi.Size()
+	}
+	if off < 0 || n < 0 || off+n > size {
+		return "", storeError("proverange", id, fmt.Errorf("range %d+%d out of bounds for size %d", off, n, size))
+	}
+
+	digester := digest.Canonical.New()
+	if _, err := io.Copy(digester.Hash(), io.NewSectionReader(r, off, n)); err != nil {
+		return "", storeError("proverange", id, err)
+	}
+	return digester.Digest(), nil
+}
@@ -0,0 +1,54 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestProof(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	id, err := fs.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, algo, hex, err := fs.Proof(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || digest.NewDigestFromHex(algo, hex) != digest.Digest(id) {
+		t.Fatalf("Unexpected proof %d %s:%s for %v", size, algo, hex, id)
+	}
+
+	tcases := []struct {
+		off, n int64
+	}{
+		{0, int64(len(data))},
+		{4, 5},
+		{int64(len(data)) - 3, 3},
+		{10, 0},
+	}
+	for _, tc := range tcases {
+		proof, err := fs.ProveRange(id, tc.off, tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := digest.FromBytes(data[tc.off : tc.off+tc.n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof != expected {
+			t.Fatalf("Expected range %d+%d proof %v, got %v", tc.off, tc.n, expected, proof)
+		}
+	}
+
+	for _, tc := range [][2]int64{{0, int64(len(data)) + 1}, {-1, 2}, {int64(len(data)), 1}} {
+		if _, err := fs.ProveRange(id, tc[0], tc[1]); err == nil {
+			t.Fatalf("Expected error for out of range proof %d+%d", tc[0], tc[1])
+		}
+	}
+}
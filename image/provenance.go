@@ -0,0 +1,98 @@
+package image
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// provenanceKey is the reserved metadata key recording the provenance of
+// the content of an ID.
+const provenanceKey = "provenance"
+
+// ProvenanceKind tells how content came into the store.
+type ProvenanceKind string
+
+const (
+	// ProvenanceUnknown is the kind of content stored without provenance.
+	ProvenanceUnknown ProvenanceKind = ""
+	// ProvenancePull is the kind of content pulled from a registry.
+	ProvenancePull ProvenanceKind = "pull"
+	// ProvenanceBuild is the kind of content produced by a build.
+	ProvenanceBuild ProvenanceKind = "build"
+)
+
+// Provenance records who or what stored content, for audits.
+type Provenance struct {
+	// SourceURL is where the content came from, like the URL of the
+	// registry blob it was pulled from.
+	SourceURL string `json:",omitempty"`
+	// Actor is the user or component that stored the content.
+	Actor string         `json:",omitempty"`
+	Kind  ProvenanceKind `json:",omitempty"`
+	// Time is when the content was stored. SetWithProvenance sets it to
+	// the current time if it is zero.
+	Time time.Time
+}
+
+// writeProvenance must be called with the store write lock held.
+func (s *fs) writeProvenance(id ID, prov Provenance) {
+	if prov.Time.IsZero() {
+		prov.Time = s.now()
+	}
+	prov.Time = prov.Time.UTC()
+	data, err := json.Marshal(prov)
+	if err == nil {
+		err = s.metadata.Set(id, provenanceKey, data)
+	}
+	if err != nil {
+		s.log.Warn("failed to record provenance of image", "id", id, "err", err)
+	}
+}
+
+// SetWithProvenance stores data like Set and records prov as its
+// provenance. Provenance is first-writer-wins: if the content is stored
+// already, its provenance is kept and prov is ignored, so that audits see
+// who stored the content first. Nothing is recorded for an empty prov, nor
+// for content stored with Set and the other operations, whose provenance is
+// of unknown kind.
+func (s *fs) SetWithProvenance(data []byte, prov Provenance) (ID, error) {
+	return s.setEvicting(context.Background(), int64(len(data)), func() (ID, error) {
+		stored := s.contentExists(s.duplicateID(s.algorithm, data)) == nil
+		id, _, err := s.setMulti(s.algorithm, data)
+		if err != nil {
+			return "", err
+		}
+		if !stored && prov != (Provenance{}) {
+			s.writeProvenance(id, prov)
+		}
+		return id, nil
+	})
+}
+
+// GetProvenance returns the provenance recorded for id. Content stored
+// without provenance has a provenance of unknown kind, with the time the
+// content was stored.
+func (s *fs) GetProvenance(id ID) (Provenance, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	fi, _, err := s.statContent(id)
+	if err != nil {
+		return Provenance{}, storeError("getprovenance", id, err)
+	}
+	data, err := s.metadata.Get(id, provenanceKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Provenance{Time: fi.ModTime().UTC()}, nil
+		}
+		return Provenance{}, storeError("getprovenance", id, err)
+	}
+	var prov Provenance
+	if err := json.Unmarshal(data, &prov); err != nil {
+		return Provenance{}, storeError("getprovenance", id, err)
+	}
+	return prov, nil
+}
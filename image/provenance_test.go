@@ -0,0 +1,106 @@
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFSProvenance(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	fs.now = func() time.Time { return now }
+
+	prov := Provenance{
+		SourceURL: "https://registry.example.com/v2/library/busybox/blobs/sha256:0",
+		Actor:     "puller",
+		Kind:      ProvenancePull,
+		Time:      now.Add(-time.Hour),
+	}
+	id, err := fs.SetWithProvenance([]byte("foo"), prov)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.GetProvenance(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != prov {
+		t.Fatalf("Expected provenance %+v, got %+v", prov, got)
+	}
+
+	// The first writer wins.
+	if _, err := fs.SetWithProvenance([]byte("foo"), Provenance{Actor: "builder", Kind: ProvenanceBuild}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Set([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.GetProvenance(id); err != nil || got != prov {
+		t.Fatalf("Expected provenance %+v to be preserved, got %+v, %v", prov, got, err)
+	}
+
+	// Plain Set records no provenance, the time content was stored is the
+	// time of its file.
+	plain, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.metadata.Get(plain, provenanceKey); !os.IsNotExist(err) {
+		t.Fatalf("Expected no provenance to be recorded by Set, got %v", err)
+	}
+	fi, err := os.Stat(fs.contentFile(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.GetProvenance(plain); err != nil || got != (Provenance{Time: fi.ModTime().UTC()}) {
+		t.Fatalf("Expected default provenance, got %+v, %v", got, err)
+	}
+
+	keys, err := fs.ListMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Expected provenance to be hidden from ListMetadata, got %v", keys)
+	}
+
+	if err := fs.Delete(plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.GetProvenance(plain); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist for missing content, got %v", err)
+	}
+}
+
+func TestFSSetMetadataFiles(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{InlineThreshold: 8})
+	defer cleanup()
+
+	inline, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(fs.metadataDir(inline))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != schemaVersionKey {
+		t.Fatalf("Expected only the schema version to be recorded for inline content, got %d entries", len(entries))
+	}
+
+	file, err := fs.Set([]byte("content stored in a file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = ioutil.ReadDir(fs.metadataDir(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != schemaVersionKey || entries[1].Name() != sizeKey {
+		t.Fatalf("Expected only the schema version and the size to be recorded, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// quarantineDirName holds the content files found corrupt by deferred
+// verification, for inspection.
+const quarantineDirName = "quarantine"
+
+func (s *fs) quarantineFile(id ID) string {
+	dgst := digest.Digest(id)
+	return filepath.Join(s.root, quarantineDirName, s.namespace, string(dgst.Algorithm()), dgst.Hex())
+}
+
+// getDeferred returns the content of id like get, but returns content files
+// without verifying them and verifies them in the background instead. It
+// must be called with the store read lock held.
+func (s *fs) getDeferred(id ID) ([]byte, error) {
+	if _, ok := s.inline[s.normalizeID(id)]; ok || !s.algorithmAllowed(digest.Digest(id).Algorithm()) || s.packed() {
+		return s.get(id)
+	}
+	content, err := s.readFile(s.contentFile(id))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := parseChunkManifest(content); ok {
+		return s.get(id)
+	}
+	if _, ok := parseDelta(content); ok {
+		return s.get(id)
+	}
+
+	// The caller owns the returned slice, the copy is verified.
+	verified := append([]byte(nil), content...)
+	go func() {
+		if s.verifyID(digest.Digest(id).Algorithm(), verified) == s.normalizeID(id) {
+			return
+		}
+		s.log.Error("image content does not match its digest", "id", id, "path", s.contentFile(id))
+		if err := s.quarantine(id); err != nil {
+			s.log.Error("failed to quarantine corrupt image content", "id", id, "err", err)
+		}
+		if s.onCorrupt != nil {
+			s.onCorrupt(id, storeError("get", id, ErrCorrupt))
+		}
+	}()
+	return content, nil
+}
+
+// quarantine moves the content file of id to the quarantine directory if it
+// is still corrupt.
+func (s *fs) quarantine(id ID) error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	if _, err := s.getVerified(id); !errors.Is(err, ErrCorrupt) {
+		return nil
+	}
+	target := s.quarantineFile(id)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	if err := s.fsys.Rename(s.contentFile(id), target); err != nil {
+		return err
+	}
+	s.log.Warn("quarantined corrupt image content", "id", id, "path", target)
+	return nil
+}
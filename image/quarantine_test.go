@@ -0,0 +1,64 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeferVerification(t *testing.T) {
+	corrupted := make(chan ID, 1)
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{
+		DeferVerification: true,
+		OnCorrupt: func(id ID, err error) {
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Expected ErrCorrupt, got %v", err)
+			}
+			corrupted <- id
+		},
+	})
+	defer cleanup()
+
+	valid, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, fs, id)
+
+	if _, err := fs.Get(valid); err != nil {
+		t.Fatal(err)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatalf("Expected deferred verification to return the content, got %v", err)
+	}
+	if !bytes.Equal(content, []byte("corrupt")) {
+		t.Fatalf("Expected the stored bytes, got %q", content)
+	}
+
+	select {
+	case reported := <-corrupted:
+		if reported != id {
+			t.Fatalf("Expected %v reported corrupt, got %v", id, reported)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected OnCorrupt to be called")
+	}
+	if _, err := fs.Get(id); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected quarantined content to be gone, got %v", err)
+	}
+	if _, err := os.Stat(fs.quarantineFile(id)); err != nil {
+		t.Fatalf("Expected quarantined content, got %v", err)
+	}
+	select {
+	case reported := <-corrupted:
+		t.Fatalf("Unexpected corruption report for %v", reported)
+	default:
+	}
+}
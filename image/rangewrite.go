@@ -0,0 +1,164 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ErrMissingRanges is returned when a RangeWriter is committed with parts of
+// the content not written.
+var ErrMissingRanges = errors.New("content has unwritten ranges")
+
+// RangeWriter assembles content written in ranges in any order, like the
+// parts of a parallel download, in a temporary file. The content is stored
+// once all of it is written and Commit verified it. A RangeWriter is safe
+// for concurrent use.
+type RangeWriter struct {
+	s    *fs
+	mu   sync.Mutex
+	f    rangeFile
+	done bool
+	// spans are the written ranges, sorted and merged.
+	spans []span
+}
+
+type span struct {
+	start, end int64
+}
+
+// rangeFile is a temporary file written and read at offsets, like the ones
+// of osFileSystem.
+type rangeFile interface {
+	tempFile
+	io.WriterAt
+	io.ReaderAt
+}
+
+// NewRangeWriter returns a RangeWriter storing content in the store. It must
+// be committed or aborted to remove its temporary file.
+func (s *fs) NewRangeWriter() (*RangeWriter, error) {
+	if err := os.MkdirAll(s.tempDir(), 0700); err != nil {
+		return nil, storeError("writeat", "", err)
+	}
+	tf, err := s.fsys.TempFile(s.tempDir(), "")
+	if err != nil {
+		return nil, storeError("writeat", "", err)
+	}
+	f, ok := tf.(rangeFile)
+	if !ok {
+		tf.Close()
+		os.Remove(tf.Name())
+		return nil, storeError("writeat", "", errors.New("temporary files can't be written at offsets"))
+	}
+	return &RangeWriter{s: s, f: f}, nil
+}
+
+// WriteAt writes p at offset off of the content. Ranges may overlap, the
+// bytes written last win.
+func (w *RangeWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done {
+		return 0, storeError("writeat", "", errors.New("range writer is closed"))
+	}
+	if off < 0 {
+		return 0, storeError("writeat", "", fmt.Errorf("invalid offset %d", off))
+	}
+	n, err := w.f.WriteAt(p, off)
+	if n > 0 {
+		w.add(span{off, off + int64(n)})
+	}
+	if err != nil {
+		return n, storeError("writeat", "", err)
+	}
+	return n, nil
+}
+
+// add records sp as written, merging it with the spans it overlaps or
+// touches.
+func (w *RangeWriter) add(sp span) {
+	i := sort.Search(len(w.spans), func(i int) bool { return w.spans[i].end >= sp.start })
+	j := i
+	for j < len(w.spans) && w.spans[j].start <= sp.end {
+		if w.spans[j].start < sp.start {
+			sp.start = w.spans[j].start
+		}
+		if w.spans[j].end > sp.end {
+			sp.end = w.spans[j].end
+		}
+		j++
+	}
+	w.spans = append(w.spans[:i], append([]span{sp}, w.spans[j:]...)...)
+}
+
+// Commit stores the written content under expectedID and closes the writer.
+// It fails with ErrMissingRanges if the content has gaps, counting from
+// offset zero to the end of the last range, and with ErrCorrupt if the
+// content doesn't match expectedID. Nothing is stored then.
+func (w *RangeWriter) Commit(expectedID ID) (ID, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done {
+		return "", storeError("commitranges", expectedID, errors.New("range writer is closed"))
+	}
+	w.done = true
+	defer os.Remove(w.f.Name())
+
+	dgst := digest.Digest(expectedID)
+	if err := dgst.Validate(); err != nil {
+		w.f.Close()
+		return "", storeError("commitranges", expectedID, err)
+	}
+	if !w.s.algorithmAllowed(dgst.Algorithm()) {
+		w.f.Close()
+		return "", storeError("commitranges", expectedID, ErrUnsupportedAlgorithm)
+	}
+	var size int64
+	switch {
+	case len(w.spans) == 0 && w.s.allowEmpty:
+	case len(w.spans) == 0:
+		w.f.Close()
+		return "", storeError("commitranges", expectedID, ErrEmptyContent)
+	case len(w.spans) > 1 || w.spans[0].start != 0:
+		w.f.Close()
+		return "", storeError("commitranges", expectedID, ErrMissingRanges)
+	default:
+		size = w.spans[0].end
+	}
+
+	digester := dgst.Algorithm().New()
+	crc := crc32.NewIEEE()
+	_, err := io.Copy(w.s.hashWriter(io.MultiWriter(digester.Hash(), crc)), io.NewSectionReader(w.f, 0, size))
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", storeError("commitranges", expectedID, err)
+	}
+	if ID(digester.Digest()) != expectedID {
+		return "", storeError("commitranges", expectedID, ErrCorrupt)
+	}
+	return w.s.placeVerified("commitranges", w.f.Name(), expectedID, size, crc.Sum32())
+}
+
+// Abort discards the written content and closes the writer.
+func (w *RangeWriter) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
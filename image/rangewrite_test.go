@@ -0,0 +1,93 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestRangeWriter(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	content := []byte("0123456789abcdefghij")
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := fs.NewRangeWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{{14, 20}, {0, 5}, {8, 11}} {
+		if _, err := w.WriteAt(content[r[0]:r[1]], int64(r[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Commit(ID(dgst)); !errors.Is(err, ErrMissingRanges) {
+		t.Fatalf("Expected ErrMissingRanges, got %v", err)
+	}
+	if _, err := fs.Get(ID(dgst)); err == nil {
+		t.Fatal("Expected incomplete content not to be stored")
+	}
+
+	w, err = fs.NewRangeWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{{14, 20}, {0, 5}, {8, 11}, {4, 9}, {11, 14}} {
+		if _, err := w.WriteAt(content[r[0]:r[1]], int64(r[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := w.Commit(ID(dgst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ID(dgst) {
+		t.Fatalf("Expected ID %v, got %v", dgst, id)
+	}
+	data, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expected assembled content %q, got %q", content, data)
+	}
+	if _, err := w.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatal("Expected error writing to a committed range writer")
+	}
+
+	w, err = fs.NewRangeWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("wrong"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Commit(ID(dgst)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestRangeWriterFileSystem(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	// The torn temporary files can only be written sequentially.
+	fs.fsys = &tornWriteFS{tear: true}
+
+	if _, err := fs.NewRangeWriter(); err == nil {
+		t.Fatal("Expected range writer to be created through the store filesystem")
+	}
+	names, err := ioutil.ReadDir(fs.tempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("Expected the temporary file to be removed, got %d files", len(names))
+	}
+}
@@ -0,0 +1,158 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// codecKey is the metadata key recording the codec of content re-encoded by
+// TransformingBackend.Recompress. Such content is decoded with the codec
+// instead of the transformers of the backend.
+const codecKey = "codec"
+
+// Codec is a Transformer with a name, under which content encoded with it is
+// recorded.
+type Codec interface {
+	Transformer
+	Name() string
+}
+
+// builtinCodecs are the codecs known to every TransformingBackend.
+var builtinCodecs = map[string]Codec{
+	GzipTransformer{}.Name(): GzipTransformer{},
+	DeflateCodec{}.Name():    DeflateCodec{},
+}
+
+// Name returns "gzip".
+func (GzipTransformer) Name() string {
+	return "gzip"
+}
+
+// DeflateCodec compresses content with raw DEFLATE at the best compression
+// level.
+type DeflateCodec struct{}
+
+// Name returns "deflate".
+func (DeflateCodec) Name() string {
+	return "deflate"
+}
+
+// Encode returns a writer compressing into w.
+func (DeflateCodec) Encode(w io.Writer) io.WriteCloser {
+	fw, err := flate.NewWriter(w, flate.BestCompression)
+	if err != nil {
+		// Only returned for invalid compression levels.
+		panic(err)
+	}
+	return fw
+}
+
+// Decode returns a reader decompressing r.
+func (DeflateCodec) Decode(r io.Reader) io.Reader {
+	return flate.NewReader(r)
+}
+
+// RegisterCodec makes content re-encoded with codec, beyond the built-in
+// ones, readable by tb. Codecs passed to Recompress are registered
+// automatically, but must be registered again after the backend is
+// recreated.
+func (tb *TransformingBackend) RegisterCodec(codec Codec) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.codecs == nil {
+		tb.codecs = make(map[string]Codec)
+	}
+	tb.codecs[codec.Name()] = codec
+}
+
+// codec returns the codec of the stored content phys, or nil if it is
+// encoded with the transformers of tb. It must be called with tb locked.
+func (tb *TransformingBackend) codec(phys ID) (Codec, error) {
+	name, err := tb.inner.GetMetadata(phys, codecKey)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if codec, ok := tb.codecs[string(name)]; ok {
+		return codec, nil
+	}
+	if codec, ok := builtinCodecs[string(name)]; ok {
+		return codec, nil
+	}
+	return nil, fmt.Errorf("unknown image content codec %q", name)
+}
+
+// Recompress re-encodes the content of id with codec in place of its
+// current encoding and returns its new stored size. The logical ID and the
+// metadata of the content don't change. The re-encoded content is stored
+// and verified before it replaces the original, so readers see either one
+// or the other.
+func (tb *TransformingBackend) Recompress(id ID, codec Codec) (newPhysicalSize int64, err error) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.codecs == nil {
+		tb.codecs = make(map[string]Codec)
+	}
+	tb.codecs[codec.Name()] = codec
+
+	phys, ok := tb.physical[id]
+	if !ok {
+		return 0, storeError("recompress", id, os.ErrNotExist)
+	}
+	content, err := tb.get(id, phys)
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	w := codec.Encode(&buf)
+	if _, err := w.Write(content); err != nil {
+		return 0, storeError("recompress", id, err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, storeError("recompress", id, err)
+	}
+	decoded, err := ioutil.ReadAll(codec.Decode(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		return 0, storeError("recompress", id, err)
+	}
+	if !bytes.Equal(decoded, content) {
+		return 0, storeError("recompress", id, fmt.Errorf("codec %q doesn't round-trip", codec.Name()))
+	}
+
+	newPhys, err := tb.inner.Set(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if newPhys == phys {
+		return int64(buf.Len()), nil
+	}
+	md, err := backendMetadata(tb.inner, phys)
+	if err != nil {
+		return 0, err
+	}
+	delete(md, codecKey)
+	for key, data := range md {
+		if err := setBackendMetadata(tb.inner, newPhys, key, data); err != nil {
+			return 0, err
+		}
+	}
+	if err := setBackendMetadata(tb.inner, newPhys, codecKey, []byte(codec.Name())); err != nil {
+		return 0, err
+	}
+
+	tb.physical[id] = newPhys
+	if err := tb.inner.Delete(phys); err != nil {
+		backendLogger(tb.inner).Warn("failed to remove replaced image content", "id", phys, "replacement", newPhys, "err", err)
+	}
+	return int64(buf.Len()), nil
+}
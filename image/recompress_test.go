@@ -0,0 +1,97 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// undeletableBackend fails every delete of content.
+type undeletableBackend struct {
+	*fs
+}
+
+func (b undeletableBackend) Delete(id ID) error {
+	return errors.New("backend is read-only")
+}
+
+func TestRecompress(t *testing.T) {
+	tb, inner, cleanup := newTestTransformingBackend(t, GzipTransformer{})
+	defer cleanup()
+
+	data := bytes.Repeat([]byte("foobar"), 1000)
+	id, err := tb.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.SetMetadata(id, "parent", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	oldPhys := tb.physical[id]
+	oldStored, err := inner.Get(oldPhys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := tb.Recompress(id, DeflateCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size == int64(len(oldStored)) {
+		t.Fatalf("Expected physical size to change from %d", size)
+	}
+	if _, err := inner.Get(oldPhys); err == nil {
+		t.Fatal("Expected replaced content to be removed")
+	}
+
+	content, err := tb.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("Expected recompressed content to read back unchanged")
+	}
+	md, err := tb.GetMetadata(id, "parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(md) != "abc" {
+		t.Fatalf("Expected metadata %q, got %q", "abc", md)
+	}
+
+	// A new backend over the same store decodes the recompressed content.
+	reopened, err := NewTransformingBackend(inner, GzipTransformer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err = reopened.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("Expected recompressed content to read back unchanged after reopening")
+	}
+}
+
+func TestRecompressDeleteFailure(t *testing.T) {
+	logger := &capturingLogger{}
+	inner, cleanup := newTestFSStoreOptions(t, FSOptions{Logger: logger})
+	defer cleanup()
+	tb, err := NewTransformingBackend(undeletableBackend{inner}, GzipTransformer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := tb.Set(bytes.Repeat([]byte("foobar"), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPhys := tb.physical[id]
+	if _, err := tb.Recompress(id, DeflateCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	ev := logger.find("warn", "failed to remove replaced image content")
+	if ev == nil || ev.fields["id"] != oldPhys || ev.fields["replacement"] != tb.physical[id] {
+		t.Fatalf("Expected removal failure event for %v, got %+v", oldPhys, logger.events)
+	}
+}
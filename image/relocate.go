@@ -0,0 +1,161 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+var errRelocateXattrMetadata = errors.New("relocating is not supported with extended attribute metadata")
+
+// Relocate moves the store to the new store root newRoot, which must be
+// empty or not exist, without reopening it. Operations in progress complete
+// against the old root; the ones started meanwhile wait for the move and then
+// run against newRoot. The content and metadata are kept under newRoot even
+// if they were stored elsewhere, see FSOptions.ContentDir. Content files are
+// hard linked where possible and copied otherwise, then the old tree is
+// removed. Watchers started with StartWatcher must be started again.
+//
+// Relocate fails if other namespaces share the root, since their backends
+// would lose their content, and with metadata in extended attributes, which
+// copies would lose.
+func (s *fs) Relocate(newRoot string) error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("relocate", "", err)
+	}
+	defer s.Unlock()
+
+	if s.metadataInContent {
+		return storeError("relocate", "", errRelocateXattrMetadata)
+	}
+	if entries, err := ioutil.ReadDir(newRoot); err == nil && len(entries) > 0 {
+		return storeError("relocate", "", fmt.Errorf("relocation root %s is not empty", newRoot))
+	}
+	if err := checkRootOverlap(s.root, newRoot); err != nil {
+		return storeError("relocate", "", err)
+	}
+	if err := s.checkSoleNamespace(); err != nil {
+		return storeError("relocate", "", err)
+	}
+
+	oldRoot, oldContent, oldMetadata := s.root, s.contentRoot, s.metadataRoot
+	newContent := filepath.Join(newRoot, contentDirName)
+	newMetadata := filepath.Join(newRoot, metadataDirName)
+	trees := []struct{ src, dst string }{
+		{oldRoot, newRoot},
+		{oldContent, newContent},
+		{oldMetadata, newMetadata},
+	}
+	for _, tree := range trees {
+		if err := replicateTree(tree.src, tree.dst, oldRoot); err != nil {
+			os.RemoveAll(newRoot)
+			return storeError("relocate", "", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(newRoot, tempDirName), 0700); err != nil {
+		os.RemoveAll(newRoot)
+		return storeError("relocate", "", err)
+	}
+
+	s.root, s.contentRoot, s.metadataRoot = newRoot, newContent, newMetadata
+	s.opts.ContentDir, s.opts.MetadataDir = "", ""
+	if err := s.detectCaseInsensitive(s.opts.OnCaseInsensitive); err != nil {
+		s.log.Warn("failed to probe case sensitivity of relocated image store", "root", newRoot, "err", err)
+	}
+
+	for _, dir := range []string{oldContent, oldMetadata} {
+		if err := os.RemoveAll(dir); err != nil {
+			s.log.Warn("failed to remove old image store tree", "dir", dir, "err", err)
+		}
+	}
+	s.removeOldRoot(oldRoot)
+	return nil
+}
+
+// checkSoleNamespace returns an error if the content root holds namespaces
+// other than the one of the store. The algorithm directories of the root
+// belong to the default namespace, and so do the directories of its content
+// layout.
+func (s *fs) checkSoleNamespace() error {
+	dir, err := ioutil.ReadDir(s.contentRoot)
+	if err != nil {
+		return err
+	}
+	layoutDirs, err := s.defaultLayoutDirs()
+	if err != nil {
+		return err
+	}
+	for _, v := range dir {
+		if !v.IsDir() || v.Name() == s.namespace || layoutDirs[v.Name()] {
+			continue
+		}
+		if validateNamespace(v.Name()) == nil {
+			return fmt.Errorf("image store root is shared with namespace %q", v.Name())
+		}
+		if s.namespace != "" {
+			return errors.New("image store root is shared with the default namespace")
+		}
+	}
+	return nil
+}
+
+// removeOldRoot removes the old store root. The temporary directory is
+// only removed once it is empty, since writes streaming content may still
+// have files there to move into the new root.
+func (s *fs) removeOldRoot(oldRoot string) {
+	entries, err := ioutil.ReadDir(oldRoot)
+	if err != nil {
+		s.log.Warn("failed to remove old image store root", "root", oldRoot, "err", err)
+		return
+	}
+	for _, v := range entries {
+		if v.Name() == tempDirName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(oldRoot, v.Name())); err != nil {
+			s.log.Warn("failed to remove old image store tree", "dir", filepath.Join(oldRoot, v.Name()), "err", err)
+		}
+	}
+	os.Remove(filepath.Join(oldRoot, tempDirName))
+	os.Remove(oldRoot)
+}
+
+// replicateTree recreates the files under src at the same paths under dst,
+// hard linking them where possible and copying them otherwise. The trees
+// of content and metadata stored in the root are skipped when src is root,
+// they are replicated on their own. So is the temporary directory.
+func replicateTree(src, dst, root string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if src == root && info.IsDir() {
+			switch rel {
+			case contentDirName, metadataDirName, tempDirName:
+				return filepath.SkipDir
+			}
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
@@ -0,0 +1,135 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFSRelocate(t *testing.T) {
+	for _, opts := range []FSOptions{
+		{InlineThreshold: 8},
+		{InlineThreshold: 8, ContentLayout: flatLayout{}},
+	} {
+		testFSRelocate(t, opts)
+	}
+}
+
+func testFSRelocate(t *testing.T, opts FSOptions) {
+	tmpdir, err := ioutil.TempDir("", "images-fs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	oldRoot := filepath.Join(tmpdir, "old")
+	newRoot := filepath.Join(tmpdir, "new")
+	fs, err := newFSStore(oldRoot, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := make(map[ID][]byte)
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("content of image %d", i))
+		if i%10 == 0 {
+			data = []byte(fmt.Sprintf("small%d", i))
+		}
+		id, err := fs.Set(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.SetMetadata(id, "parent", []byte("p")); err != nil {
+			t.Fatal(err)
+		}
+		contents[id] = data
+	}
+
+	stop := make(chan struct{})
+	failures := make(chan error, 1)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for id, data := range contents {
+					got, err := fs.Get(id)
+					if err == nil && !bytes.Equal(got, data) {
+						err = fmt.Errorf("unexpected content of %v: %q", id, got)
+					}
+					if err != nil {
+						select {
+						case failures <- err:
+						default:
+						}
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	if err := fs.Relocate(newRoot); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-failures:
+		t.Fatalf("Expected reads not to fail during relocation, got %v", err)
+	default:
+	}
+
+	if _, err := os.Stat(oldRoot); !os.IsNotExist(err) {
+		t.Fatalf("Expected old root to be removed, got %v", err)
+	}
+	reopened, err := newFSStore(newRoot, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []StoreBackend{fs, reopened} {
+		for id, data := range contents {
+			got, err := s.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Expected content %q of %v, got %q", data, id, got)
+			}
+			if parent, err := s.GetMetadata(id, "parent"); err != nil || string(parent) != "p" {
+				t.Fatalf("Expected metadata of %v to be relocated, got %q, %v", id, parent, err)
+			}
+		}
+	}
+
+	id, err := fs.Set([]byte("stored after relocation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := fs.contentFile(id); !strings.HasPrefix(path, newRoot) {
+		t.Fatalf("Expected new content under the new root, got %s", path)
+	} else if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected new content under the new root, got %v", err)
+	}
+
+	nonEmpty := filepath.Join(tmpdir, "nonempty")
+	if err := os.MkdirAll(nonEmpty, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(nonEmpty, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Relocate(nonEmpty); err == nil {
+		t.Fatal("Expected relocation into a non-empty root to fail")
+	}
+}
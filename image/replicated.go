@@ -0,0 +1,239 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ReplicationError reports the backends of a ReplicatedBackend that failed
+// a write which didn't reach its quorum, by index: 0 is the primary and the
+// peers follow in the order given to NewReplicatedBackend.
+type ReplicationError struct {
+	Succeeded int
+	Quorum    int
+	Failures  map[int]error
+}
+
+func (e *ReplicationError) Error() string {
+	var msgs []string
+	for i, err := range e.Failures {
+		msgs = append(msgs, fmt.Sprintf("backend %d: %v", i, err))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("replicated to %d backends, quorum is %d: %s", e.Succeeded, e.Quorum, strings.Join(msgs, ", "))
+}
+
+// ReplicatedBackend is a StoreBackend mirroring writes synchronously to a
+// primary backend and its peers, and reading from the primary, falling back
+// to the peers in order for content that is missing or corrupt in it.
+type ReplicatedBackend struct {
+	primary StoreBackend
+	peers   []StoreBackend
+	quorum  int
+	log     Logger
+}
+
+// NewReplicatedBackend returns a backend replicating writes to primary and
+// peers. The write quorum defaults to all of them, see SetWriteQuorum.
+func NewReplicatedBackend(primary StoreBackend, peers ...StoreBackend) *ReplicatedBackend {
+	return &ReplicatedBackend{
+		primary: primary,
+		peers:   peers,
+		quorum:  1 + len(peers),
+		log:     backendLogger(primary),
+	}
+}
+
+// SetWriteQuorum sets the number of backends, the primary included, a write
+// must succeed on for the write to succeed. It is clamped to the number of
+// backends, and must be set before the backend is used.
+func (rb *ReplicatedBackend) SetWriteQuorum(quorum int) {
+	if quorum < 1 {
+		quorum = 1
+	}
+	if n := len(rb.wrapped()); quorum > n {
+		quorum = n
+	}
+	rb.quorum = quorum
+}
+
+func (rb *ReplicatedBackend) wrapped() []StoreBackend {
+	return append([]StoreBackend{rb.primary}, rb.peers...)
+}
+
+// replicate runs op on every backend concurrently and waits for all of
+// them. It returns a ReplicationError if op failed on so many backends that
+// the quorum isn't reached; failures below that are only logged.
+func (rb *ReplicatedBackend) replicate(op string, id ID, f func(i int, backend StoreBackend) error) error {
+	backends := rb.wrapped()
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend StoreBackend) {
+			defer wg.Done()
+			errs[i] = f(i, backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	failures := make(map[int]error)
+	for i, err := range errs {
+		if err != nil {
+			failures[i] = err
+		}
+	}
+	succeeded := len(backends) - len(failures)
+	if succeeded < rb.quorum {
+		return storeError(op, id, &ReplicationError{Succeeded: succeeded, Quorum: rb.quorum, Failures: failures})
+	}
+	for i, err := range failures {
+		rb.log.Warn("failed to replicate image", "op", op, "id", id, "backend", i, "err", err)
+	}
+	return nil
+}
+
+// Walk calls the supplied callback for each image ID in any backend.
+func (rb *ReplicatedBackend) Walk(f IDWalkFunc) error {
+	seen := make(map[ID]struct{})
+	stopped := false
+	for _, backend := range rb.wrapped() {
+		if err := backend.Walk(func(id ID) error {
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
+			err := f(id)
+			if errors.Is(err, ErrStopWalk) {
+				stopped = true
+			}
+			return err
+		}); err != nil {
+			return stopWalk(err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Get returns the content stored under a given ID, from the first peer
+// holding a verified copy if the primary lacks it or holds a corrupt one.
+// Unlike TieredBackend, the copy isn't written back to the primary.
+func (rb *ReplicatedBackend) Get(id ID) ([]byte, error) {
+	content, err := rb.primary.Get(id)
+	for _, peer := range rb.peers {
+		if err == nil || (!errors.Is(err, ErrCorrupt) && !errors.Is(err, os.ErrNotExist)) {
+			break
+		}
+		var perr error
+		if content, perr = peer.Get(id); perr == nil {
+			perr = verifyFetched(id, content)
+		}
+		if perr == nil || !errors.Is(perr, os.ErrNotExist) {
+			err = perr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Set stores content in every backend and returns its ID once they all
+// answered, if at least the write quorum of them stored it under its
+// digest. It fails with a ReplicationError otherwise, and the content is
+// left in the backends that stored it.
+func (rb *ReplicatedBackend) Set(data []byte) (ID, error) {
+	ids := make([]ID, len(rb.wrapped()))
+	err := rb.replicate("set", "", func(i int, backend StoreBackend) error {
+		id, err := backend.Set(data)
+		if err != nil {
+			return err
+		}
+		alg := digest.Digest(id).Algorithm()
+		if !alg.Available() {
+			return storeError("set", id, ErrUnsupportedAlgorithm)
+		}
+		if computeID(alg, data) != id {
+			return storeError("set", id, ErrCorrupt)
+		}
+		ids[i] = id
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		if id != "" {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// Delete removes content and metadata from every backend. Backends lacking
+// the content count as successes.
+func (rb *ReplicatedBackend) Delete(id ID) error {
+	return rb.replicate("delete", id, func(i int, backend StoreBackend) error {
+		if err := backend.Delete(id); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// SetMetadata sets metadata for a given ID in every backend, with the write
+// quorum of Set.
+func (rb *ReplicatedBackend) SetMetadata(id ID, key string, data []byte) error {
+	return rb.replicate("setmetadata", id, func(i int, backend StoreBackend) error {
+		return backend.SetMetadata(id, key, data)
+	})
+}
+
+// GetMetadata returns metadata for a given ID, from the first peer holding
+// it if the primary doesn't.
+func (rb *ReplicatedBackend) GetMetadata(id ID, key string) ([]byte, error) {
+	data, err := rb.primary.GetMetadata(id, key)
+	for _, peer := range rb.peers {
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		data, err = peer.GetMetadata(id, key)
+	}
+	return data, err
+}
+
+func (rb *ReplicatedBackend) setReservedMetadata(id ID, key string, data []byte) error {
+	return rb.replicate("setmetadata", id, func(i int, backend StoreBackend) error {
+		return setBackendMetadata(backend, id, key, data)
+	})
+}
+
+// allMetadata returns the metadata of a given ID, from the first peer
+// holding it if the primary doesn't, like GetMetadata.
+func (rb *ReplicatedBackend) allMetadata(id ID) (map[string][]byte, error) {
+	md, err := backendMetadata(rb.primary, id)
+	for _, peer := range rb.peers {
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		md, err = backendMetadata(peer, id)
+	}
+	return md, err
+}
+
+// DeleteMetadata removes the metadata associated with an ID from every
+// backend.
+func (rb *ReplicatedBackend) DeleteMetadata(id ID, key string) error {
+	return rb.replicate("deletemetadata", id, func(i int, backend StoreBackend) error {
+		return backend.DeleteMetadata(id, key)
+	})
+}
@@ -0,0 +1,91 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// failingBackend fails every write of content.
+type failingBackend struct {
+	StoreBackend
+}
+
+func (b *failingBackend) Set(data []byte) (ID, error) {
+	return "", errors.New("backend unavailable")
+}
+
+func newTestReplicatedStores(t *testing.T, n int) (stores []*fs, cleanup func()) {
+	first, cleanup := newTestFSStoreOptions(t, FSOptions{Namespace: "backend0"})
+	stores = append(stores, first)
+	for i := 1; i < n; i++ {
+		s, err := newFSStore(first.root, FSOptions{Namespace: fmt.Sprintf("backend%d", i)})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	return stores, cleanup
+}
+
+func TestReplicatedBackendQuorum(t *testing.T) {
+	stores, cleanup := newTestReplicatedStores(t, 3)
+	defer cleanup()
+	logger := &capturingLogger{}
+	stores[0].log = logger
+
+	rb := NewReplicatedBackend(stores[0], stores[1], &failingBackend{stores[2]})
+	rb.SetWriteQuorum(2)
+
+	data := []byte("foo")
+	id, err := rb.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range stores[:2] {
+		if content, err := s.Get(id); err != nil || !bytes.Equal(content, data) {
+			t.Fatalf("Expected backend %d to hold %q, got %q, %v", i, data, content, err)
+		}
+	}
+	if _, err := stores[2].Get(id); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected not exist error from the failing backend, got %v", err)
+	}
+	ev := logger.find("warn", "failed to replicate image")
+	if ev == nil || ev.fields["op"] != "set" || ev.fields["backend"] != 2 {
+		t.Fatalf("Expected replication failure event for backend 2, got %+v", logger.events)
+	}
+
+	// Get falls back to the peers.
+	if err := stores[0].Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	content, err := rb.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected %q, got %q", data, content)
+	}
+
+	rb = NewReplicatedBackend(stores[0], &failingBackend{stores[1]}, &failingBackend{stores[2]})
+	rb.SetWriteQuorum(2)
+	_, err = rb.Set([]byte("bar"))
+	var rerr *ReplicationError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Expected replication error, got %v", err)
+	}
+	if rerr.Succeeded != 1 || rerr.Quorum != 2 || len(rerr.Failures) != 2 || rerr.Failures[1] == nil || rerr.Failures[2] == nil {
+		t.Fatalf("Expected backends 1 and 2 to fail, got %v", rerr)
+	}
+}
+
+func TestReplicatedBackend(t *testing.T) {
+	for _, fixture := range []func(*testing.T, StoreBackend){testGetSet, testMetadataGetSet, testDelete, testWalker} {
+		stores, cleanup := newTestReplicatedStores(t, 3)
+		fixture(t, NewReplicatedBackend(stores[0], stores[1], stores[2]))
+		cleanup()
+	}
+}
@@ -0,0 +1,124 @@
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// StoreReport describes the health of a store, see Report.
+type StoreReport struct {
+	// Count and Bytes are the number and the total size of the stored
+	// images.
+	Count int
+	Bytes int64
+	// Corrupt lists the images whose content doesn't match their digest.
+	Corrupt []ID
+	// OrphanMetadata lists the IDs with metadata but no content.
+	OrphanMetadata []ID
+	// Pinned is the number of pinned images.
+	Pinned int
+	// Tombstones lists the IDs whose deletion was interrupted, see
+	// RecoverTombstones.
+	Tombstones []ID
+	// Staged lists the content staged and the upload sessions, neither
+	// committed nor aborted.
+	Staged []StagedInfo
+}
+
+// Report verifies all content of the store and returns a report of its
+// health. The content is read once, verification, sizes and pins are
+// collected in the same pass.
+func (s *fs) Report() (StoreReport, error) {
+	var report StoreReport
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return report, err
+	}
+	stored := make(map[ID]bool, len(ids))
+	for _, id := range ids {
+		s.RLock()
+		content, err := s.getVerified(id)
+		size := int64(len(content))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			size, _ = s.contentSize(id)
+		}
+		pinned := s.isPinned(id)
+		s.RUnlock()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		stored[id] = true
+		report.Count++
+		report.Bytes += size
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, id)
+		}
+		if pinned {
+			report.Pinned++
+		}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	if !s.metadataInContent {
+		if report.OrphanMetadata, err = s.orphanMetadata(stored); err != nil {
+			return report, storeError("report", "", err)
+		}
+	}
+	if report.Tombstones, err = listDigests(s.tombstoneDir(), ""); err != nil {
+		return report, storeError("report", "", err)
+	}
+	if report.Staged, err = s.listStaged(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// orphanMetadata returns the IDs with metadata that aren't in stored, in
+// lexical order.
+func (s *fs) orphanMetadata(stored map[ID]bool) ([]ID, error) {
+	ids, err := listDigests(s.metadataBaseDir(), ".json")
+	if err != nil {
+		return nil, err
+	}
+	var orphans []ID
+	for _, id := range ids {
+		if !stored[id] {
+			orphans = append(orphans, id)
+		}
+	}
+	return orphans, nil
+}
+
+// listDigests returns the IDs named by the entries of the algorithm
+// directories of dir, in lexical order. The suffix is trimmed from entry
+// names, and entries not naming a valid digest are skipped.
+func listDigests(dir, suffix string) ([]ID, error) {
+	algs, err := algorithmDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[ID]bool)
+	var ids []ID
+	for _, alg := range algs {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, alg))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range entries {
+			dgst := digest.NewDigestFromHex(alg, strings.TrimSuffix(v.Name(), suffix))
+			if dgst.Validate() != nil || seen[ID(dgst)] {
+				continue
+			}
+			seen[ID(dgst)] = true
+			ids = append(ids, ID(dgst))
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,58 @@
+package image
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestReport(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	foo, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Pin(foo); err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, fs, bar)
+
+	orphan, err := digest.FromBytes([]byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(fs.metadataDir(ID(orphan)), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.Report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count != 2 {
+		t.Fatalf("Expected 2 images, got %d", report.Count)
+	}
+	if report.Bytes != int64(len("foo")+len("corrupt")) {
+		t.Fatalf("Expected %d bytes, got %d", len("foo")+len("corrupt"), report.Bytes)
+	}
+	if !reflect.DeepEqual(report.Corrupt, []ID{bar}) {
+		t.Fatalf("Expected corrupt %v, got %v", []ID{bar}, report.Corrupt)
+	}
+	if !reflect.DeepEqual(report.OrphanMetadata, []ID{ID(orphan)}) {
+		t.Fatalf("Expected orphan metadata %v, got %v", []ID{ID(orphan)}, report.OrphanMetadata)
+	}
+	if report.Pinned != 1 {
+		t.Fatalf("Expected 1 pinned image, got %d", report.Pinned)
+	}
+	if len(report.Tombstones) != 0 || len(report.Staged) != 0 {
+		t.Fatalf("Expected no tombstones or staged content, got %v, %v", report.Tombstones, report.Staged)
+	}
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// minTruncatedLength is the shortest hex prefix ResolveTruncated accepts
+// whatever the minimum length of the caller.
+const minTruncatedLength = 12
+
+// ErrPrefixTooShort is returned by ResolveTruncated for prefixes shorter
+// than the required minimum length.
+var ErrPrefixTooShort = errors.New("digest prefix is too short")
+
+// ErrAmbiguousPrefix is returned by ResolveTruncated when a prefix matches
+// more than one stored ID.
+var ErrAmbiguousPrefix = errors.New("digest prefix matches several images")
+
+// ResolveTruncated returns the ID of the stored content of algorithm alg
+// whose hex digest starts with hexPrefix, for tools referencing content by
+// truncated digests. Prefixes shorter than minLen, or than 12 characters
+// whatever minLen, fail with ErrPrefixTooShort, since they are likely to
+// become ambiguous as content is added. It fails with ErrAmbiguousPrefix if
+// several IDs match and with os.ErrNotExist if none does.
+func (s *fs) ResolveTruncated(alg string, hexPrefix string, minLen int) (ID, error) {
+	if minLen < minTruncatedLength {
+		minLen = minTruncatedLength
+	}
+	if len(hexPrefix) < minLen {
+		return "", storeError("resolve", "", fmt.Errorf("%w: %d characters, need %d", ErrPrefixTooShort, len(hexPrefix), minLen))
+	}
+	if strings.Trim(hexPrefix, "0123456789abcdefABCDEF") != "" {
+		return "", storeError("resolve", "", fmt.Errorf("invalid digest prefix %q", hexPrefix))
+	}
+	if !s.algorithmAllowed(digest.Algorithm(alg)) || (s.idStrategy == nil && !digest.Algorithm(alg).Available()) {
+		return "", storeError("resolve", "", ErrUnsupportedAlgorithm)
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	ids, err := s.listIDs()
+	if err != nil {
+		return "", storeError("resolve", "", err)
+	}
+	prefix := alg + ":" + strings.ToLower(hexPrefix)
+	var match ID
+	for _, id := range ids {
+		if !strings.HasPrefix(strings.ToLower(string(id)), prefix) {
+			continue
+		}
+		if match != "" && match != id {
+			return "", storeError("resolve", "", ErrAmbiguousPrefix)
+		}
+		match = id
+	}
+	if match == "" {
+		return "", storeError("resolve", "", os.ErrNotExist)
+	}
+	return match, nil
+}
@@ -0,0 +1,68 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestFSResolveTruncated(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 5; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	hex := digest.Digest(ids[0]).Hex()
+
+	if _, err := fs.ResolveTruncated("sha256", hex[:8], 4); !errors.Is(err, ErrPrefixTooShort) {
+		t.Fatalf("Expected ErrPrefixTooShort below the floor, got %v", err)
+	}
+	if _, err := fs.ResolveTruncated("sha256", hex[:16], 20); !errors.Is(err, ErrPrefixTooShort) {
+		t.Fatalf("Expected ErrPrefixTooShort below minLen, got %v", err)
+	}
+
+	id, err := fs.ResolveTruncated("sha256", hex[:12], 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ids[0] {
+		t.Fatalf("Expected %v, got %v", ids[0], id)
+	}
+	if id, err := fs.ResolveTruncated("sha256", hex, 12); err != nil || id != ids[0] {
+		t.Fatalf("Expected full digest to resolve to %v, got %v, %v", ids[0], id, err)
+	}
+
+	missing := digest.Digest(computeID(digest.Canonical, []byte("never stored"))).Hex()
+	if _, err := fs.ResolveTruncated("sha256", missing[:12], 12); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := fs.ResolveTruncated("sha256", "zzzzzzzzzzzz", 12); err == nil {
+		t.Fatal("Expected error for non-hex prefix")
+	}
+	if _, err := fs.ResolveTruncated("md5", hex[:12], 12); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("Expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+
+	// Store the content again under an ID sharing the first 12 hex
+	// characters of ids[0].
+	next := "0"
+	if hex[12] == '0' {
+		next = "1"
+	}
+	sibling := ID(digest.NewDigestFromHex("sha256", hex[:12]+next+hex[13:]))
+	if err := os.Link(fs.contentFile(ids[0]), fs.contentFile(sibling)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ResolveTruncated("sha256", hex[:12], 12); !errors.Is(err, ErrAmbiguousPrefix) {
+		t.Fatalf("Expected ErrAmbiguousPrefix, got %v", err)
+	}
+}
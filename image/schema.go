@@ -0,0 +1,133 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// schemaVersionKey is the reserved metadata key recording the version
+	// of the metadata schema of an ID.
+	schemaVersionKey = "schemaVersion"
+	// metadataSchemaVersion is the schema version of new content, recorded
+	// when it is stored. Content stored before versions were recorded is
+	// at this version too.
+	metadataSchemaVersion = 1
+)
+
+// schemaVersion returns the metadata schema version of id, which is
+// metadataSchemaVersion if none was recorded.
+func (s *fs) schemaVersion(id ID) (int, error) {
+	data, err := s.metadata.Get(id, schemaVersionKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return metadataSchemaVersion, nil
+		}
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid metadata schema version %q", data)
+	}
+	return version, nil
+}
+
+// MigrateMetadata rewrites the metadata of every ID at schema version from
+// with the result of fn, and moves it to version to. fn gets the metadata
+// without the reserved keys the store maintains and returns the complete new
+// metadata; keys missing from the result are deleted, while the reserved
+// keys are kept as they are and can't be in the result. The version is
+// written last, so an interrupted migration is retried for the IDs it didn't
+// finish, and fn should not assume it runs only once per ID.
+func (s *fs) MigrateMetadata(from, to int, fn func(id ID, md map[string][]byte) (map[string][]byte, error)) error {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.migrateMetadata(id, from, to, fn); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return storeError("migratemetadata", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *fs) migrateMetadata(id ID, from, to int, fn func(id ID, md map[string][]byte) (map[string][]byte, error)) error {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := s.metadataLocks.Lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.contentExists(id); err != nil {
+		return err
+	}
+	version, err := s.schemaVersion(id)
+	if err != nil {
+		return err
+	}
+	if version != from {
+		return nil
+	}
+
+	keys, err := s.metadata.List(id)
+	if err != nil {
+		return err
+	}
+	md := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if isReservedMetadataKey(key) {
+			continue
+		}
+		data, err := s.metadata.Get(id, key)
+		if err != nil {
+			return err
+		}
+		md[key] = data
+	}
+
+	migrated, err := fn(id, md)
+	if err != nil {
+		return err
+	}
+	for key := range migrated {
+		if err := validateWritableMetadataKey(key); err != nil {
+			return err
+		}
+	}
+	for key, data := range migrated {
+		if err := s.metadata.Set(id, key, data); err != nil {
+			return err
+		}
+	}
+	// fn may have modified md, so the keys to delete are the ones listed
+	// before it ran.
+	for _, key := range keys {
+		if _, ok := migrated[key]; ok || isReservedMetadataKey(key) {
+			continue
+		}
+		if err := s.metadata.Delete(id, key); err != nil {
+			return err
+		}
+	}
+	return s.metadata.Set(id, schemaVersionKey, []byte(strconv.Itoa(to)))
+}
+
+// recordSchemaVersion records the schema version of new content. Content
+// stored again keeps the version it was migrated to. It must be called with
+// the store write lock held.
+func (s *fs) recordSchemaVersion(id ID) {
+	if _, err := s.metadata.Get(id, schemaVersionKey); !os.IsNotExist(err) {
+		return
+	}
+	if err := s.metadata.Set(id, schemaVersionKey, []byte(strconv.Itoa(metadataSchemaVersion))); err != nil {
+		s.log.Warn("failed to record metadata schema version of image", "id", id, "err", err)
+	}
+}
@@ -0,0 +1,168 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMigrateMetadata(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id1, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.metadata.Get(id1, schemaVersionKey); err != nil || string(data) != fmt.Sprint(metadataSchemaVersion) {
+		t.Fatalf("Expected schema version %d to be recorded on Set, got %q, %v", metadataSchemaVersion, data, err)
+	}
+	if version, err := fs.schemaVersion(id1); err != nil || version != metadataSchemaVersion {
+		t.Fatalf("Expected schema version %d for new content, got %d, %v", metadataSchemaVersion, version, err)
+	}
+	for _, id := range []ID{id1, id2} {
+		if err := fs.SetMetadata(id, "parent", []byte("old-"+id.String())); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.SetMetadata(id, "obsolete", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrated := 0
+	migrate := func(id ID, md map[string][]byte) (map[string][]byte, error) {
+		migrated++
+		if _, ok := md[schemaVersionKey]; ok {
+			t.Fatal("Expected schema version to be left out of migrated metadata")
+		}
+		return map[string][]byte{
+			"parent-v2": bytes.TrimPrefix(md["parent"], []byte("old-")),
+		}, nil
+	}
+	if err := fs.MigrateMetadata(1, 2, migrate); err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Fatalf("Expected 2 migrated IDs, got %d", migrated)
+	}
+
+	for _, id := range []ID{id1, id2} {
+		version, err := fs.schemaVersion(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 2 {
+			t.Fatalf("Expected schema version 2 for %v, got %d", id, version)
+		}
+		data, err := fs.GetMetadata(id, "parent-v2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != id.String() {
+			t.Fatalf("Expected migrated value %q, got %q", id, data)
+		}
+		keys, err := fs.ListMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0] != "parent-v2" {
+			t.Fatalf("Expected only key parent-v2, got %v", keys)
+		}
+	}
+
+	// Content already at version 2 isn't migrated again and keeps its
+	// version when it is set again.
+	if _, err := fs.Set([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MigrateMetadata(1, 2, migrate); err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Fatalf("Expected no further migrations, got %d", migrated)
+	}
+	if version, err := fs.schemaVersion(id1); err != nil || version != 2 {
+		t.Fatalf("Expected schema version 2 after Set, got %d, %v", version, err)
+	}
+}
+
+func TestMigrateMetadataReservedKeys(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var base bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&base, "layer entry %04d\n", i)
+	}
+	baseID, err := fs.Set(base.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.SetDelta(baseID, append([]byte("prefix\n"), base.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Pin(baseID); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(baseID, "user", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A migration returning only user keys keeps the reserved ones.
+	if err := fs.MigrateMetadata(1, 2, func(id ID, md map[string][]byte) (map[string][]byte, error) {
+		for key := range md {
+			if isReservedMetadataKey(key) {
+				t.Fatalf("Expected reserved key %q to be left out of migrated metadata", key)
+			}
+		}
+		return map[string][]byte{"user-v2": md["user"]}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.isPinned(baseID) {
+		t.Fatal("Expected the pin to survive the migration")
+	}
+	if err := fs.Delete(baseID); !errors.Is(err, ErrDeltaBase) {
+		t.Fatalf("Expected ErrDeltaBase deleting the base after the migration, got %v", err)
+	}
+
+	if err := fs.MigrateMetadata(2, 3, func(id ID, md map[string][]byte) (map[string][]byte, error) {
+		return map[string][]byte{pinnedKey: nil}, nil
+	}); !errors.Is(err, ErrReservedMetadataKey) {
+		t.Fatalf("Expected ErrReservedMetadataKey migrating to a reserved key, got %v", err)
+	}
+}
+
+func TestMigrateMetadataInPlace(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "old", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A migration renaming a key in the map it is given.
+	if err := fs.MigrateMetadata(1, 2, func(id ID, md map[string][]byte) (map[string][]byte, error) {
+		md["new"] = md["old"]
+		delete(md, "old")
+		return md, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := fs.ListMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "new" {
+		t.Fatalf("Expected only key new, got %v", keys)
+	}
+}
@@ -0,0 +1,88 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// scrubCursorFileName records the last ID verified by the scrubber, so that
+// a restarted scrubber continues where the previous one stopped.
+const scrubCursorFileName = "scrub-cursor"
+
+// StartScrubber starts verifying the stored content in the background,
+// re-hashing at most rate blobs per second and calling onCorrupt with the ID
+// and error of every blob that fails verification. It walks the store in
+// lexical ID order and starts over when it reaches the end. The scrubber has
+// low priority: a blob is skipped until the next tick when a writer holds or
+// waits for the store lock. The returned channel is closed once the scrubber
+// stopped after ctx is done.
+func (s *fs) StartScrubber(ctx context.Context, rate float64, onCorrupt func(ID, error)) (<-chan struct{}, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid scrub rate %v", rate)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.scrub(ctx, time.Duration(float64(time.Second)/rate), onCorrupt)
+	}()
+	return done, nil
+}
+
+func (s *fs) scrub(ctx context.Context, interval time.Duration, onCorrupt func(ID, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	cursor, err := ioutil.ReadFile(s.scrubCursorFile())
+	if err != nil && !os.IsNotExist(err) {
+		s.log.Warn("failed to read image scrub progress", "err", err)
+	}
+	last := ID(cursor)
+	var pending []ID
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if len(pending) == 0 {
+			ids, err := s.sortedIDs()
+			if err != nil {
+				s.log.Warn("failed to list images to scrub", "err", err)
+				continue
+			}
+			pending = ids[sort.Search(len(ids), func(i int) bool {
+				return ids[i] > last
+			}):]
+			if len(pending) == 0 {
+				// Start over on the next tick.
+				last = ""
+				continue
+			}
+		}
+
+		if !s.TryRLock() {
+			continue
+		}
+		id := pending[0]
+		_, err := s.getVerified(id)
+		s.RUnlock()
+		if err != nil && !os.IsNotExist(err) {
+			onCorrupt(id, storeError("scrub", id, err))
+		}
+		pending, last = pending[1:], id
+		if err := s.writeRootFile(filepath.Base(s.scrubCursorFile()), []byte(last)); err != nil {
+			s.log.Warn("failed to record image scrub progress", "err", err)
+		}
+	}
+}
+
+func (s *fs) scrubCursorFile() string {
+	return filepath.Join(s.root, scrubCursorFileName+s.namespaceSuffix())
+}
@@ -0,0 +1,75 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestScrubber(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	var ids []ID
+	for i := 0; i < 5; i++ {
+		id, err := fs.Set([]byte(fmt.Sprintf("content%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	corruptContent(t, fs, ids[2])
+
+	type report struct {
+		id  ID
+		err error
+	}
+	reports := make(chan report, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done, err := fs.StartScrubber(ctx, 1000, func(id ID, err error) {
+		reports <- report{id, err}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-reports:
+		if r.id != ids[2] || !errors.Is(r.err, ErrCorrupt) {
+			t.Fatalf("Expected ErrCorrupt for %v, got %v for %v", ids[2], r.err, r.id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the scrubber to report the corrupt blob")
+	}
+	// Let the scrubber complete more passes over the store.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the scrubber to stop on cancellation")
+	}
+	close(reports)
+	for r := range reports {
+		if r.id != ids[2] {
+			t.Fatalf("Unexpected report for %v: %v", r.id, r.err)
+		}
+	}
+
+	cursor, err := ioutil.ReadFile(filepath.Join(fs.root, scrubCursorFileName))
+	if err != nil {
+		t.Fatalf("Expected scrub progress to be persisted, got %v", err)
+	}
+	if len(cursor) == 0 {
+		t.Fatal("Expected a recorded scrub cursor")
+	}
+
+	if _, err := fs.StartScrubber(context.Background(), 0, nil); err == nil {
+		t.Fatal("Expected error for zero scrub rate")
+	}
+}
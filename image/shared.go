@@ -0,0 +1,182 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// sharedWrite is content being streamed into the store by SetExpected,
+// which readers can tail with GetShared.
+type sharedWrite struct {
+	s  *fs
+	id ID
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	path string
+	// written is the number of bytes in the temporary file at path.
+	written int64
+	// sealed is set once the temporary file is complete and about to be
+	// moved; readers can't open it anymore.
+	sealed bool
+	// done is set when the write finished, with err if it failed.
+	done bool
+	err  error
+}
+
+// beginSharedWrite registers the temporary file at path as receiving the
+// content of id. It returns nil if the content of id is already being
+// written; the methods of a nil sharedWrite do nothing.
+func (s *fs) beginSharedWrite(id ID, path string) *sharedWrite {
+	s.sharedWritesMu.Lock()
+	defer s.sharedWritesMu.Unlock()
+
+	if _, ok := s.sharedWrites[id]; ok {
+		return nil
+	}
+	if s.sharedWrites == nil {
+		s.sharedWrites = make(map[ID]*sharedWrite)
+	}
+	w := &sharedWrite{s: s, id: id, path: path}
+	w.cond = sync.NewCond(&w.mu)
+	s.sharedWrites[id] = w
+	return w
+}
+
+// writer returns a writer to f, the temporary file of w, that lets the
+// readers of w know about the written bytes.
+func (w *sharedWrite) writer(f io.Writer) io.Writer {
+	if w == nil {
+		return f
+	}
+	return &sharedWriter{w: w, f: f}
+}
+
+type sharedWriter struct {
+	w *sharedWrite
+	f io.Writer
+}
+
+func (sw *sharedWriter) Write(p []byte) (int, error) {
+	n, err := sw.f.Write(p)
+	sw.w.mu.Lock()
+	sw.w.written += int64(n)
+	sw.w.cond.Broadcast()
+	sw.w.mu.Unlock()
+	return n, err
+}
+
+// seal stops new readers from opening the temporary file. Readers already
+// tailing it can read it to the end.
+func (w *sharedWrite) seal() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.sealed = true
+	w.mu.Unlock()
+}
+
+// finish records the outcome of the write and wakes up its readers.
+func (w *sharedWrite) finish(err error) {
+	if w == nil {
+		return
+	}
+	w.s.sharedWritesMu.Lock()
+	delete(w.s.sharedWrites, w.id)
+	w.s.sharedWritesMu.Unlock()
+
+	w.mu.Lock()
+	w.sealed, w.done, w.err = true, true, err
+	w.cond.Broadcast()
+	w.mu.Unlock()
+}
+
+// GetShared returns a reader of the content of id. If the content is being
+// stored with SetExpected, the reader streams the bytes as they are written
+// instead of waiting for the write to complete. The digest is verified when
+// the end of the content is reached; the read fails with ErrCorrupt then if
+// it doesn't match, or with the error of the write if the write fails.
+func (s *fs) GetShared(id ID) (io.ReadCloser, error) {
+	s.sharedWritesMu.Lock()
+	w, ok := s.sharedWrites[id]
+	s.sharedWritesMu.Unlock()
+	if !ok {
+		return s.getReader(id)
+	}
+
+	w.mu.Lock()
+	if w.sealed {
+		for !w.done {
+			w.cond.Wait()
+		}
+		err := w.err
+		w.mu.Unlock()
+		if err != nil {
+			return nil, storeError("getshared", id, err)
+		}
+		return s.getReader(id)
+	}
+	// The writer doesn't move the file before it is sealed.
+	f, err := os.Open(w.path)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, storeError("getshared", id, err)
+	}
+	return &sharedReader{w: w, f: f, digester: digest.Digest(id).Algorithm().New()}, nil
+}
+
+func (s *fs) getReader(id ID) (io.ReadCloser, error) {
+	content, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// sharedReader tails the temporary file of a sharedWrite.
+type sharedReader struct {
+	w        *sharedWrite
+	f        *os.File
+	pos      int64
+	digester digest.Digester
+}
+
+func (r *sharedReader) Read(p []byte) (int, error) {
+	w := r.w
+	w.mu.Lock()
+	for r.pos >= w.written && !w.done {
+		w.cond.Wait()
+	}
+	written, err := w.written, w.err
+	w.mu.Unlock()
+
+	if r.pos < written {
+		if available := written - r.pos; int64(len(p)) > available {
+			p = p[:available]
+		}
+		n, err := r.f.ReadAt(p, r.pos)
+		r.pos += int64(n)
+		r.digester.Hash().Write(p[:n])
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if err != nil {
+		return 0, storeError("getshared", w.id, err)
+	}
+	if ID(r.digester.Digest()) != w.id {
+		return 0, storeError("getshared", w.id, ErrCorrupt)
+	}
+	return 0, io.EOF
+}
+
+func (r *sharedReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,134 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// startSlowSet stores data with SetExpected, writing it in chunks through a
+// pipe, and returns once the write is in progress. The chunks are released
+// by sending on the returned channel; closing it aborts the write.
+func startSlowSet(t *testing.T, fs *fs, data []byte, chunks int) (chan<- struct{}, <-chan error) {
+	id := computeID(digest.Canonical, data)
+	pr, pw := io.Pipe()
+	next := make(chan struct{})
+	go func() {
+		size := len(data) / chunks
+		for i := 0; i < chunks; i++ {
+			if _, ok := <-next; !ok {
+				pw.CloseWithError(errors.New("aborted"))
+				return
+			}
+			end := (i + 1) * size
+			if i == chunks-1 {
+				end = len(data)
+			}
+			pw.Write(data[i*size : end])
+		}
+		pw.Close()
+	}()
+	result := make(chan error, 1)
+	go func() {
+		_, err := fs.SetExpected(pr, id, int64(len(data)))
+		result <- err
+	}()
+
+	for i := 0; ; i++ {
+		fs.sharedWritesMu.Lock()
+		_, ok := fs.sharedWrites[id]
+		fs.sharedWritesMu.Unlock()
+		if ok {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("Expected the write to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return next, result
+}
+
+func TestGetShared(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	id := computeID(digest.Canonical, data)
+	next, result := startSlowSet(t, fs, data, 4)
+
+	r, err := fs.GetShared(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The first chunk is readable before the write completes.
+	next <- struct{}{}
+	first := make([]byte, 10)
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, data[:10]) {
+		t.Fatalf("Expected %q, got %q", data[:10], first)
+	}
+
+	go func() {
+		for i := 1; i < 4; i++ {
+			next <- struct{}{}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(first, rest...), data) {
+		t.Fatal("Expected the shared reader to receive the complete content")
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	// Once stored, the content is read from the store.
+	r, err = fs.GetShared(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stored, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("Expected the stored content")
+	}
+}
+
+func TestGetSharedAbortedWrite(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	id := computeID(digest.Canonical, data)
+	next, result := startSlowSet(t, fs, data, 4)
+
+	r, err := fs.GetShared(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	next <- struct{}{}
+	close(next)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("Expected the shared read to fail with the aborted write")
+	}
+	if err := <-result; err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+}
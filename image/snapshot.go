@@ -0,0 +1,271 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/pkg/stringid"
+	"golang.org/x/net/context"
+)
+
+// snapshotsDirName holds the snapshots taken with Snapshot.
+const snapshotsDirName = "snapshots"
+
+var errSnapshotXattrMetadata = errors.New("snapshots are not supported with extended attribute metadata")
+
+// SnapshotID identifies a snapshot of a fs store.
+type SnapshotID string
+
+func (s *fs) snapshotDir(sid SnapshotID) string {
+	return filepath.Join(s.root, snapshotsDirName, s.namespace, string(sid))
+}
+
+// snapshotTree is a directory holding state of the store. Only the digest
+// algorithm directories of a tree are in a snapshot, unless it is flat, like
+// the aliases directory, and taken whole, or it holds content in a layout
+// and only the files of the layout are.
+type snapshotTree struct {
+	dir    string
+	flat   bool
+	layout ContentLayout
+}
+
+// snapshotTrees maps the directories holding the state of the store to the
+// names they have in a snapshot.
+func (s *fs) snapshotTrees() map[string]snapshotTree {
+	return map[string]snapshotTree{
+		contentDirName:  {dir: s.contentDir(), layout: s.layout},
+		metadataDirName: {dir: s.metadataBaseDir()},
+		chunksDirName:   {dir: filepath.Join(s.root, chunksDirName, s.namespace)},
+		inlineDirName:   {dir: filepath.Join(s.root, inlineDirName, s.namespace)},
+		aliasesDirName:  {dir: s.aliasesDir(), flat: true},
+	}
+}
+
+// Snapshot records the current content and metadata of the store so it can
+// be brought back with Restore.
+//
+// Content and metadata files are never modified in place, so the snapshot
+// hard links them and costs only directory entries. Where hard links aren't
+// available, such as a snapshot directory on another device, the files are
+// copied and the snapshot takes as much space as the store itself.
+// Snapshots aren't supported with metadata in extended attributes, since hard
+// links would share the attributes with the live store.
+func (s *fs) Snapshot() (SnapshotID, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.metadataInContent {
+		return "", storeError("snapshot", "", errSnapshotXattrMetadata)
+	}
+
+	sid := SnapshotID(stringid.GenerateNonCryptoID())
+	dir := s.snapshotDir(sid)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", storeError("snapshot", "", err)
+	}
+	for name, tree := range s.snapshotTrees() {
+		if err := linkTree(tree.dir, filepath.Join(dir, name), tree); err != nil {
+			os.RemoveAll(dir)
+			return "", storeError("snapshot", "", err)
+		}
+	}
+	return sid, nil
+}
+
+// Restore brings the content and metadata of the store back to the state
+// recorded by sid. The snapshot is kept and can be restored again.
+func (s *fs) Restore(sid SnapshotID) error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("restore", "", err)
+	}
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return storeError("restore", "", err)
+	}
+	if sid == "" {
+		return storeError("restore", "", fmt.Errorf("invalid snapshot ID %q", sid))
+	}
+	dir := s.snapshotDir(sid)
+	if _, err := os.Stat(dir); err != nil {
+		return storeError("restore", "", err)
+	}
+
+	aside, err := ioutil.TempDir(s.tempDir(), "restore-")
+	if err != nil {
+		return storeError("restore", "", err)
+	}
+	defer os.RemoveAll(aside)
+
+	trees := s.snapshotTrees()
+	for name, tree := range trees {
+		if err := moveTree(tree.dir, filepath.Join(aside, name), tree); err != nil {
+			return storeError("restore", "", err)
+		}
+	}
+	for name, tree := range trees {
+		if err := linkTree(filepath.Join(dir, name), tree.dir, tree); err != nil {
+			for name, tree := range trees {
+				rerr := moveTree(tree.dir, filepath.Join(aside, "failed", name), tree)
+				if rerr == nil {
+					rerr = moveTree(filepath.Join(aside, name), tree.dir, tree)
+				}
+				if rerr != nil {
+					s.log.Error("failed to roll back restore of image store snapshot", "snapshot", sid, "err", rerr)
+				}
+			}
+			return storeError("restore", "", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(s.contentDir(), string(digest.Canonical)), 0700); err != nil {
+		return storeError("restore", "", err)
+	}
+
+	if err := s.loadInline(); err != nil {
+		return storeError("restore", "", err)
+	}
+	s.lastUsedMu.Lock()
+	s.lastUsed = nil
+	s.lastUsedMu.Unlock()
+	s.weakMu.Lock()
+	s.weakIndex = nil
+	s.weakMu.Unlock()
+	s.bloomMu.Lock()
+	s.bloom = nil
+	s.bloomMu.Unlock()
+	return nil
+}
+
+// DeleteSnapshot removes the snapshot sid.
+func (s *fs) DeleteSnapshot(sid SnapshotID) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if sid == "" {
+		return storeError("deletesnapshot", "", fmt.Errorf("invalid snapshot ID %q", sid))
+	}
+	return storeError("deletesnapshot", "", os.RemoveAll(s.snapshotDir(sid)))
+}
+
+// linkAlgorithmDirs recreates the digest algorithm directories of src under
+// dst, hard linking the files or copying them if linking fails. Other
+// directories, like the ones of other namespaces, are left out.
+func linkAlgorithmDirs(src, dst string) error {
+	return replicateAlgorithmDirs(src, dst, true)
+}
+
+// copyAlgorithmDirs recreates the digest algorithm directories of src under
+// dst like linkAlgorithmDirs, but always copies the files.
+func copyAlgorithmDirs(src, dst string) error {
+	return replicateAlgorithmDirs(src, dst, false)
+}
+
+func replicateAlgorithmDirs(src, dst string, link bool) error {
+	dirs, err := algorithmDirs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range dirs {
+		if err := replicateDir(filepath.Join(src, name), filepath.Join(dst, name), link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicateDir recreates src as dst, hard linking or copying its files like
+// replicateAlgorithmDirs. A missing src is left alone.
+func replicateDir(src, dst string, link bool) error {
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if link {
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+		}
+		return copyFile(path, target)
+	})
+	if os.IsNotExist(err) {
+		if _, serr := os.Lstat(src); os.IsNotExist(serr) {
+			return nil
+		}
+	}
+	return err
+}
+
+// linkTree links the snapshot tree src to dst, whole if it is flat.
+func linkTree(src, dst string, tree snapshotTree) error {
+	switch {
+	case tree.flat:
+		return replicateDir(src, dst, true)
+	case tree.layout != nil:
+		return replicateLayout(src, dst, tree.layout, true)
+	}
+	return linkAlgorithmDirs(src, dst)
+}
+
+// moveTree renames the snapshot tree src into dst, whole if it is flat.
+func moveTree(src, dst string, tree snapshotTree) error {
+	if tree.layout != nil {
+		return moveLayout(src, dst, tree.layout)
+	}
+	if !tree.flat {
+		return moveAlgorithmDirs(src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// moveAlgorithmDirs renames the digest algorithm directories of src into dst.
+func moveAlgorithmDirs(src, dst string) error {
+	dirs, err := algorithmDirs(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	for _, name := range dirs {
+		if err := os.Rename(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func algorithmDirs(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var dirs []string
+	for _, v := range entries {
+		if v.IsDir() && digest.Algorithm(v.Name()).Available() {
+			dirs = append(dirs, v.Name())
+		}
+	}
+	return dirs, nil
+}
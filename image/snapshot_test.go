@@ -0,0 +1,94 @@
+package image
+
+import "testing"
+
+func TestSnapshotRestore(t *testing.T) {
+	for _, opts := range []FSOptions{{}, {ContentLayout: flatLayout{}}} {
+		testSnapshotRestore(t, opts)
+	}
+}
+
+func testSnapshotRestore(t *testing.T, opts FSOptions) {
+	fs, cleanup := newTestFSStoreOptions(t, opts)
+	defer cleanup()
+
+	id1, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id1, "parent", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAlias("latest", id1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAlias("stable", id2); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := fs.StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id3, err := fs.Set([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAlias("latest", id3); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteAlias("stable"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(id2); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id1, "parent", []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := fs.StateDigest(); err != nil || after == before {
+		t.Fatalf("Expected state to change, got %v, %v", after, err)
+	}
+
+	if err := fs.Restore(sid); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := fs.StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != before {
+		t.Fatalf("Expected restored state %v, got %v", before, restored)
+	}
+	if _, err := fs.Get(id2); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.GetMetadata(id1, "parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abc" {
+		t.Fatalf("Expected restored metadata %q, got %q", "abc", data)
+	}
+	for name, want := range map[string]ID{"latest": id1, "stable": id2} {
+		if id, err := fs.ResolveAlias(name); err != nil || id != want {
+			t.Fatalf("Expected alias %q to be restored to %v, got %v, %v", name, want, id, err)
+		}
+	}
+
+	if err := fs.DeleteSnapshot(sid); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Restore(sid); err == nil {
+		t.Fatal("Expected error restoring a deleted snapshot")
+	}
+}
@@ -0,0 +1,289 @@
+package image
+
+import (
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+const stagingDirName = "staging"
+
+func (s *fs) stagingDir() string {
+	return filepath.Join(s.root, stagingDirName, s.namespace)
+}
+
+func (s *fs) stagedFile(id ID) string {
+	dgst := digest.Digest(id)
+	return filepath.Join(s.stagingDir(), string(dgst.Algorithm()), dgst.Hex())
+}
+
+// StageSet stores content in the staging area. Staged content is not visible
+// to Walk or Get, and therefore not to garbage collection, until it is
+// promoted with CommitStaged.
+func (s *fs) StageSet(data []byte) (ID, error) {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return "", storeError("stage", "", err)
+	}
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return "", storeError("stage", "", err)
+	}
+	if len(data) == 0 && !s.allowEmpty {
+		return "", storeError("stage", "", ErrEmptyContent)
+	}
+
+	id := s.computeID(data)
+	filePath := s.stagedFile(id)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return "", storeError("stage", id, err)
+	}
+	tempFile, err := s.fsys.TempFile(filepath.Dir(filePath), ".")
+	if err != nil {
+		return "", storeError("stage", id, err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", storeError("stage", id, err)
+	}
+	now := s.now()
+	if err := os.Chtimes(tempFile.Name(), now, now); err != nil {
+		return "", storeError("stage", id, err)
+	}
+	if err := s.fsys.Rename(tempFile.Name(), filePath); err != nil {
+		return "", storeError("stage", id, err)
+	}
+	if s.weakChecksums {
+		if s.stagedChecksums == nil {
+			s.stagedChecksums = make(map[ID]uint32)
+		}
+		s.stagedChecksums[id] = crc32.ChecksumIEEE(data)
+	}
+
+	return id, nil
+}
+
+// stagedChecksum returns the weak checksum of the staged content of id,
+// reading it if it wasn't staged by this backend.
+func (s *fs) stagedChecksum(id ID) (uint32, error) {
+	if crc, ok := s.stagedChecksums[id]; ok {
+		return crc, nil
+	}
+	data, err := s.readFile(s.stagedFile(id))
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+// CommitStaged makes the staged content of ids visible in the store. Either
+// all of ids are committed or, on error, none of them are.
+func (s *fs) CommitStaged(ids ...ID) error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("commit", "", err)
+	}
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return storeError("commit", "", err)
+	}
+	var pending []ID
+	existing := make(map[ID]bool)
+	kept := make(map[ID]bool)
+	for _, id := range ids {
+		if _, seen := existing[id]; seen {
+			continue
+		}
+		if _, err := os.Stat(s.stagedFile(id)); err != nil {
+			return storeError("commit", id, err)
+		}
+		existing[id] = s.contentExists(id) == nil
+		kept[id] = s.keepsStoredContent(id)
+		pending = append(pending, id)
+	}
+	crcs := make(map[ID]uint32)
+	if s.weakChecksums {
+		for _, id := range pending {
+			if kept[id] {
+				continue
+			}
+			crc, err := s.stagedChecksum(id)
+			if err != nil {
+				return storeError("commit", id, err)
+			}
+			crcs[id] = crc
+		}
+	}
+
+	for i, id := range pending {
+		if kept[id] {
+			continue
+		}
+		if err := s.renameIntoPlace(s.stagedFile(id), id); err != nil {
+			for _, committed := range pending[:i] {
+				if existing[committed] {
+					continue
+				}
+				if err := s.fsys.Rename(s.contentFile(committed), s.stagedFile(committed)); err != nil {
+					s.log.Error("failed to roll back commit of staged image", "id", committed, "err", err)
+				}
+			}
+			return storeError("commit", id, err)
+		}
+	}
+	for _, id := range pending {
+		if kept[id] {
+			os.Remove(s.stagedFile(id))
+			delete(s.stagedChecksums, id)
+			continue
+		}
+		if fi, err := os.Stat(s.contentFile(id)); err == nil {
+			s.recordStored(id, fi.Size(), crcs[id], true)
+		}
+		delete(s.stagedChecksums, id)
+	}
+	return nil
+}
+
+// AbortStaged discards the staged content of ids.
+func (s *fs) AbortStaged(ids ...ID) error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return storeError("abort", "", err)
+	}
+	defer s.Unlock()
+
+	for _, id := range ids {
+		if err := os.Remove(s.stagedFile(id)); err != nil && !os.IsNotExist(err) {
+			return storeError("abort", id, err)
+		}
+		delete(s.stagedChecksums, id)
+	}
+	return nil
+}
+
+// StagedInfo describes content in the staging area, or an upload session.
+type StagedInfo struct {
+	ID ID
+	// Token is the token of an upload session begun with BeginUpload, whose
+	// ID isn't known until it is committed and is empty.
+	Token string
+	Size  int64
+	// Age is the time since the content was staged, or since an upload
+	// session was last written to.
+	Age time.Duration
+}
+
+// ListStaged returns the content in the staging area and the upload
+// sessions, which haven't been committed or aborted yet.
+func (s *fs) ListStaged() ([]StagedInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.listStaged()
+}
+
+func (s *fs) listStaged() ([]StagedInfo, error) {
+	dir, err := ioutil.ReadDir(filepath.Join(s.stagingDir(), string(s.algorithm)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, storeError("liststaged", "", err)
+	}
+	now := s.now()
+	var staged []StagedInfo
+	for _, v := range dir {
+		id := ID(digest.NewDigestFromHex(string(s.algorithm), v.Name()))
+		if v.IsDir() || s.validateID(id) != nil {
+			continue
+		}
+		staged = append(staged, StagedInfo{
+			ID:   id,
+			Size: v.Size(),
+			Age:  now.Sub(v.ModTime()),
+		})
+	}
+	sessions, err := s.listUploads(now)
+	if err != nil {
+		return nil, storeError("liststaged", "", err)
+	}
+	return append(staged, sessions...), nil
+}
+
+// listUploads returns the upload sessions in the sessions directory, aged
+// after the last write to their content or state.
+func (s *fs) listUploads(now time.Time) ([]StagedInfo, error) {
+	dir, err := ioutil.ReadDir(s.sessionsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sessions []StagedInfo
+	for _, v := range dir {
+		if _, err := hex.DecodeString(v.Name()); err != nil || !v.IsDir() {
+			continue
+		}
+		info := StagedInfo{Token: v.Name()}
+		modTime := v.ModTime()
+		for _, name := range []string{uploadDataName, uploadStateName} {
+			fi, err := os.Stat(filepath.Join(s.sessionDir(v.Name()), name))
+			if err != nil {
+				continue
+			}
+			if name == uploadDataName {
+				info.Size = fi.Size()
+			}
+			if fi.ModTime().After(modTime) {
+				modTime = fi.ModTime()
+			}
+		}
+		info.Age = now.Sub(modTime)
+		sessions = append(sessions, info)
+	}
+	return sessions, nil
+}
+
+// PruneStaged aborts the staged content and the upload sessions older than
+// olderThan, reclaiming the content of callers that staged or uploaded it
+// and went away. Content held with Hold is considered in use and kept.
+func (s *fs) PruneStaged(olderThan time.Duration) (removed int, err error) {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return 0, storeError("prunestaged", "", err)
+	}
+	defer s.Unlock()
+
+	staged, err := s.listStaged()
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range staged {
+		if info.Age < olderThan {
+			continue
+		}
+		if info.Token != "" {
+			if err := os.RemoveAll(s.sessionDir(info.Token)); err != nil {
+				return removed, storeError("prunestaged", "", err)
+			}
+			removed++
+			continue
+		}
+		if s.isHeld(info.ID) {
+			continue
+		}
+		if err := os.Remove(s.stagedFile(info.ID)); err != nil && !os.IsNotExist(err) {
+			return removed, storeError("prunestaged", info.ID, err)
+		}
+		delete(s.stagedChecksums, info.ID)
+		removed++
+	}
+	return removed, nil
+}
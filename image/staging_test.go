@@ -0,0 +1,316 @@
+package image
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestStageCommit(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.StageSet([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.StageSet([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countWalk(t, fs); n != 0 {
+		t.Fatalf("Expected staged content to be hidden from walk, got %d entries", n)
+	}
+	if _, err := fs.Get(id); err == nil {
+		t.Fatalf("Expected get of staged %v to fail", id)
+	}
+
+	if err := fs.CommitStaged(id, id2); err != nil {
+		t.Fatal(err)
+	}
+	if n := countWalk(t, fs); n != 2 {
+		t.Fatalf("Expected 2 walked entries after commit, got %d", n)
+	}
+	data, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("Expected data %q, got %q", "foo", data)
+	}
+
+	if err := fs.CommitStaged(id); err == nil {
+		t.Fatal("Expected commit of already committed content to fail")
+	}
+}
+
+func TestStageAbort(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.StageSet([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AbortStaged(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fs.stagedFile(id)); !os.IsNotExist(err) {
+		t.Fatalf("Expected staged file to be removed, got %v", err)
+	}
+	if err := fs.CommitStaged(id); err == nil {
+		t.Fatal("Expected commit of aborted content to fail")
+	}
+	if n := countWalk(t, fs); n != 0 {
+		t.Fatalf("Expected no walked entries after abort, got %d", n)
+	}
+}
+
+func countWalk(t *testing.T, store StoreBackend) int {
+	n := 0
+	if err := store.Walk(func(id ID) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPruneStaged(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	fs.now = func() time.Time { return now }
+
+	stale, err := fs.StageSet([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := fs.StageSet([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := fs.StageSet([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CommitStaged(committed); err != nil {
+		t.Fatal(err)
+	}
+	release := fs.Hold(active)
+	defer release()
+
+	now = now.Add(90 * time.Minute)
+	fresh, err := fs.StageSet([]byte("qux"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := fs.ListStaged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 3 {
+		t.Fatalf("Expected 3 staged entries, got %v", staged)
+	}
+	for _, info := range staged {
+		if info.ID == fresh && info.Age != 0 {
+			t.Fatalf("Expected age 0 for %v, got %v", fresh, info.Age)
+		}
+		if info.ID == stale && (info.Age != 90*time.Minute || info.Size != 3) {
+			t.Fatalf("Expected age 90m and size 3 for %v, got %+v", stale, info)
+		}
+	}
+
+	removed, err := fs.PruneStaged(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("Expected 1 pruned entry, got %d", removed)
+	}
+	if err := fs.CommitStaged(stale); err == nil {
+		t.Fatal("Expected pruned content to be gone")
+	}
+	if err := fs.CommitStaged(active, fresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(committed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneStagedUploads(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	stale, err := fs.BeginUpload("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stale.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"", uploadDataName, uploadStateName} {
+		if err := os.Chtimes(filepath.Join(fs.sessionDir(stale.Token()), name), then, then); err != nil {
+			t.Fatal(err)
+		}
+	}
+	active, err := fs.BeginUpload("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := active.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.Report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Staged) != 2 {
+		t.Fatalf("Expected the report to list 2 upload sessions, got %v", report.Staged)
+	}
+	for _, info := range report.Staged {
+		if info.ID != "" || (info.Token != stale.Token() && info.Token != active.Token()) {
+			t.Fatalf("Expected an upload session, got %+v", info)
+		}
+		if info.Size != 3 {
+			t.Fatalf("Expected size 3 for upload session %s, got %d", info.Token, info.Size)
+		}
+		if info.Token == stale.Token() && info.Age < 2*time.Hour {
+			t.Fatalf("Expected upload session %s to be 2h old, got %v", info.Token, info.Age)
+		}
+	}
+
+	removed, err := fs.PruneStaged(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("Expected 1 pruned upload session, got %d", removed)
+	}
+	if _, err := os.Stat(fs.sessionDir(stale.Token())); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale upload session to be removed, got %v", err)
+	}
+	if _, err := active.Commit(computeID(digest.Canonical, []byte("bar"))); err != nil {
+		t.Fatal(err)
+	}
+	if staged, err := fs.ListStaged(); err != nil || len(staged) != 0 {
+		t.Fatalf("Expected nothing staged, got %v, %v", staged, err)
+	}
+}
+
+func TestStageSetFileSystem(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	fakeFS := &tornWriteFS{}
+	fs.fsys = fakeFS
+
+	id, err := fs.StageSet([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeFS.renames) != 1 || fakeFS.renames[0][1] != fs.stagedFile(id) {
+		t.Fatalf("Expected the content to be renamed into %s, got %v", fs.stagedFile(id), fakeFS.renames)
+	}
+
+	fakeFS.tear = true
+	if _, err := fs.StageSet([]byte("bar")); err == nil {
+		t.Fatal("Expected interrupted write to fail")
+	}
+	staged, err := fs.ListStaged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 1 || staged[0].ID != id {
+		t.Fatalf("Expected only %v to be staged, got %v", id, staged)
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(fs.stagedFile(id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected the temporary file to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestCommitStagedXattrMetadata(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{XattrMetadata: true})
+	defer cleanup()
+	if !fs.metadataInContent {
+		t.Skip("extended attributes are not supported")
+	}
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "parent", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StageSet([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CommitStaged(id); err != nil {
+		t.Fatal(err)
+	}
+	// Renaming the staged copy over the content file would drop the
+	// metadata in its extended attributes.
+	if data, err := fs.GetMetadata(id, "parent"); err != nil || string(data) != "abc" {
+		t.Fatalf("Expected metadata %q to survive the commit, got %q, %v", "abc", data, err)
+	}
+	if _, err := os.Stat(fs.stagedFile(id)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the staged copy to be removed, got %v", err)
+	}
+}
+
+func TestCommitStagedWeakChecksums(t *testing.T) {
+	local, cleanup := newTestFSStoreOptions(t, FSOptions{WeakChecksums: true})
+	defer cleanup()
+	remote, err := newFSStore(local.root, FSOptions{WeakChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is loaded before the content is committed.
+	if _, err := local.ExistsWeak(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Content staged by another backend is read to get its checksum.
+	for _, c := range []struct {
+		stager *fs
+		data   []byte
+	}{
+		{local, []byte("foo")},
+		{remote, []byte("bar")},
+	} {
+		data := c.data
+		id, err := c.stager.StageSet(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := local.CommitStaged(id); err != nil {
+			t.Fatal(err)
+		}
+		ids, err := local.ExistsWeak(crc32.ChecksumIEEE(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != id {
+			t.Fatalf("Expected weak checksum candidates [%v], got %v", id, ids)
+		}
+	}
+}
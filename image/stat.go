@@ -0,0 +1,124 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ContentStat describes stored content and what the store records about it.
+// The fields recorded in metadata are zero if they aren't recorded.
+type ContentStat struct {
+	ID   ID
+	Size int64
+	// Created is when the content was stored.
+	Created time.Time
+	// LastUsed is when the content was last read, as returned by LastUsed.
+	LastUsed time.Time
+	// Hits is the number of reads counted by FSOptions.TrackHits.
+	Hits uint64
+	// Pinned is true if the content is protected by Pin.
+	Pinned bool
+	// DiffID is the diffID of a layer stored with SetLayer.
+	DiffID digest.Digest
+}
+
+// Stat returns the size of the content of id along with its times, hits,
+// pin and diffID, like the accessors of each of them but with one stat of
+// the content and one pass over its metadata, and without reading the
+// content. It fails with os.ErrNotExist if id isn't stored.
+func (s *fs) Stat(id ID) (ContentStat, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	stat := ContentStat{ID: id}
+	fi, size, err := s.statContent(id)
+	if err != nil {
+		return ContentStat{}, storeError("stat", id, err)
+	}
+	stat.Size, stat.Created = size, fi.ModTime()
+
+	unlock, err := s.metadataLocks.RLock(id)
+	if err != nil {
+		return ContentStat{}, storeError("stat", id, err)
+	}
+	metadata := make(map[string][]byte)
+	for _, key := range []string{lastUsedKey, hitsKey, pinnedKey, diffIDKey} {
+		if data, err := s.metadata.Get(id, key); err == nil {
+			metadata[key] = data
+		} else if !os.IsNotExist(err) {
+			unlock()
+			return ContentStat{}, storeError("stat", id, err)
+		}
+	}
+	unlock()
+
+	stat.LastUsed = stat.Created
+	if data, ok := metadata[lastUsedKey]; ok {
+		if last, err := time.Parse(time.RFC3339Nano, string(data)); err == nil {
+			stat.LastUsed = last
+		}
+	}
+	s.lastUsedMu.Lock()
+	if last, ok := s.lastUsed[id]; ok {
+		stat.LastUsed = last
+	}
+	s.lastUsedMu.Unlock()
+
+	if data, ok := metadata[hitsKey]; ok {
+		if hits, err := strconv.ParseUint(string(data), 10, 64); err == nil {
+			stat.Hits = hits
+		}
+	}
+	s.hitsMu.Lock()
+	stat.Hits += s.hits[id]
+	s.hitsMu.Unlock()
+
+	_, stat.Pinned = metadata[pinnedKey]
+	if data, ok := metadata[diffIDKey]; ok {
+		if diffID, err := digest.ParseDigest(string(data)); err == nil {
+			stat.DiffID = diffID
+		}
+	}
+	return stat, nil
+}
+
+// statContent stats the file holding the content of id and returns it with
+// the size of the content, like contentSize. It must be called with the
+// store lock held.
+func (s *fs) statContent(id ID) (os.FileInfo, int64, error) {
+	if content, ok := s.getInline(id); ok {
+		fi, err := os.Stat(s.inlineIndexFile())
+		return fi, int64(len(content)), err
+	}
+	if s.packed() {
+		e, ok := s.pack.entries[s.normalizeID(id)]
+		if !ok {
+			return nil, 0, &os.PathError{Op: "stat", Path: s.pack.f.Name() + ":" + string(id), Err: os.ErrNotExist}
+		}
+		fi, err := os.Stat(filepath.Join(s.packDir(), packFileName))
+		return fi, e.Size, err
+	}
+	fi, err := os.Stat(s.contentFile(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := s.readChunkManifest(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if m != nil {
+		return fi, m.size, nil
+	}
+	size, err := s.deltaSize(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size >= 0 {
+		return fi, size, nil
+	}
+	return fi, fi.Size(), nil
+}
@@ -0,0 +1,77 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestFSStat(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{TrackHits: true, TrackLastUsed: true})
+	defer cleanup()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("layer content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, diffID, err := fs.SetLayer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Pin(layer); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := fs.Get(layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stat, err := fs.Stat(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.ID != layer || stat.Size != int64(buf.Len()) {
+		t.Fatalf("Expected %v of size %d, got %v of size %d", layer, buf.Len(), stat.ID, stat.Size)
+	}
+	if stat.Hits != 3 {
+		t.Fatalf("Expected 3 hits, got %d", stat.Hits)
+	}
+	lastUsed, err := fs.LastUsed(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.LastUsed.Equal(lastUsed) || stat.Created.IsZero() {
+		t.Fatalf("Expected last used %v and a creation time, got %v and %v", lastUsed, stat.LastUsed, stat.Created)
+	}
+	if !stat.Pinned || stat.DiffID != diffID {
+		t.Fatalf("Expected pinned layer with diffID %v, got pinned %v with diffID %v", diffID, stat.Pinned, stat.DiffID)
+	}
+
+	plain, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err = fs.Stat(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != 3 || stat.Hits != 0 || stat.Pinned || stat.DiffID != "" {
+		t.Fatalf("Expected plain content of size 3, got %+v", stat)
+	}
+	if !stat.LastUsed.Equal(stat.Created) {
+		t.Fatalf("Expected unread content to be last used when created, got %v and %v", stat.LastUsed, stat.Created)
+	}
+
+	if _, err := fs.Stat(computeID(digest.Canonical, []byte("missing"))); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package image
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/distribution/digest"
+)
+
+// StateDigest returns a digest summarizing the set of content in the store.
+// It is computed over the sorted IDs and sizes of all content, so stores
+// holding the same content have the same state digest regardless of the
+// order in which it was added.
+func (s *fs) StateDigest() (digest.Digest, error) {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return "", err
+	}
+
+	digester := digest.Canonical.New()
+	for _, id := range ids {
+		s.RLock()
+		size, err := s.contentSize(id)
+		s.RUnlock()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if _, err := fmt.Fprintf(digester.Hash(), "%s %d\n", id, size); err != nil {
+			return "", err
+		}
+	}
+	return digester.Digest(), nil
+}
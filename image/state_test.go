@@ -0,0 +1,52 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestStateDigest(t *testing.T) {
+	stores := make([]*fs, 2)
+	for i := range stores {
+		var cleanup func()
+		stores[i], cleanup = newTestFSStore(t)
+		defer cleanup()
+	}
+
+	// add the same content in a different order
+	for _, data := range []string{"foo", "bar", "baz"} {
+		if _, err := stores[0].Set([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var removed ID
+	for _, data := range []string{"baz", "foo", "bar"} {
+		id, err := stores[1].Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed = id
+	}
+
+	dgst1, err := stores[0].StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst2, err := stores[1].StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst1 != dgst2 {
+		t.Fatalf("Expected equal state digests, got %v and %v", dgst1, dgst2)
+	}
+
+	if err := stores[1].Delete(removed); err != nil {
+		t.Fatal(err)
+	}
+	dgst2, err = stores[1].StateDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst1 == dgst2 {
+		t.Fatalf("Expected state digest to change after delete, got %v", dgst2)
+	}
+}
@@ -0,0 +1,159 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// ErrSizeMismatch is returned when streamed content doesn't have the
+// expected size.
+var ErrSizeMismatch = errors.New("content size does not match the expected size")
+
+// SetExpected stores the content read from r, which must have the ID
+// expectedID and be expectedSize bytes long, as given by a descriptor. The
+// read fails with ErrSizeMismatch as soon as r yields more than expectedSize
+// bytes, and once r is drained with ErrSizeMismatch if it yielded fewer, or
+// with ErrCorrupt if the content doesn't match expectedID. Nothing is stored
+// then. The content is streamed to a temporary file without holding the
+// store lock, which GetShared lets other readers of expectedID tail.
+func (s *fs) SetExpected(r io.Reader, expectedID ID, expectedSize int64) (id ID, err error) {
+	dgst := digest.Digest(expectedID)
+	if err := dgst.Validate(); err != nil {
+		return "", storeError("setexpected", expectedID, err)
+	}
+	if !s.algorithmAllowed(dgst.Algorithm()) {
+		return "", storeError("setexpected", expectedID, ErrUnsupportedAlgorithm)
+	}
+	if expectedSize < 0 || expectedSize == 0 && !s.allowEmpty {
+		return "", storeError("setexpected", expectedID, fmt.Errorf("invalid expected size %d", expectedSize))
+	}
+
+	tempFile, err := s.fsys.TempFile(s.tempDir(), "")
+	if err != nil {
+		return "", storeError("setexpected", expectedID, err)
+	}
+	defer os.Remove(tempFile.Name())
+	if err := s.preallocateFile(tempFile.Name(), expectedSize); err != nil {
+		tempFile.Close()
+		return "", storeError("setexpected", expectedID, err)
+	}
+	w := s.beginSharedWrite(expectedID, tempFile.Name())
+	defer func() { w.finish(err) }()
+
+	digester := dgst.Algorithm().New()
+	crc := crc32.NewIEEE()
+	// Reading one byte more than expected tells an oversized stream without
+	// reading it all.
+	size, err := io.Copy(io.MultiWriter(w.writer(tempFile), s.hashWriter(io.MultiWriter(digester.Hash(), crc))), io.LimitReader(r, expectedSize+1))
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	// The temporary file is moved or removed from here on.
+	w.seal()
+	switch {
+	case err != nil:
+		return "", storeError("setexpected", expectedID, err)
+	case size != expectedSize:
+		return "", storeError("setexpected", expectedID, ErrSizeMismatch)
+	case ID(digester.Digest()) != expectedID:
+		return "", storeError("setexpected", expectedID, ErrCorrupt)
+	}
+
+	return s.placeVerified("setexpected", tempFile.Name(), expectedID, size, crc.Sum32())
+}
+
+// AcceptPush stores the content read from r, like the body of a blob push,
+// and returns its ID and size. The content is hashed as it is streamed to a
+// temporary file, so the ID is known as soon as r is drained and the content
+// is read once. If reading r fails, like the body of a request whose client
+// disconnected or whose context is cancelled, nothing is stored and the
+// partial content is removed.
+func (s *fs) AcceptPush(r io.Reader) (ID, int64, error) {
+	return s.acceptPush("push", r)
+}
+
+func (s *fs) acceptPush(op string, r io.Reader) (ID, int64, error) {
+	if s.idStrategy != nil || !s.algorithmAllowed(s.algorithm) {
+		return "", 0, storeError(op, "", ErrUnsupportedAlgorithm)
+	}
+
+	tempFile, err := s.fsys.TempFile(s.tempDir(), "")
+	if err != nil {
+		return "", 0, storeError(op, "", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	digester := s.algorithm.New()
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(tempFile, s.hashWriter(io.MultiWriter(digester.Hash(), crc))), r)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, storeError(op, "", err)
+	}
+	if size == 0 && !s.allowEmpty {
+		return "", 0, storeError(op, "", ErrEmptyContent)
+	}
+
+	id, err := s.placeVerified(op, tempFile.Name(), ID(digester.Digest()), size, crc.Sum32())
+	if err != nil {
+		return "", 0, err
+	}
+	return id, size, nil
+}
+
+// preallocateFile allocates size bytes for the file name being streamed
+// with FSOptions.Preallocate.
+func (s *fs) preallocateFile(name string, size int64) error {
+	if !s.preallocate || size <= 0 {
+		return nil
+	}
+	err := s.fsys.Preallocate(name, size)
+	if isNoSpaceError(err) {
+		return ErrInsufficientSpace
+	}
+	return err
+}
+
+// placeVerified moves the temporary file at path, holding the verified
+// content of id, into place. The content is read back and stored with
+// setMulti instead if it is to be chunked or inlined.
+func (s *fs) placeVerified(op, path string, id ID, size int64, crc uint32) (ID, error) {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return "", storeError(op, id, err)
+	}
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return "", storeError(op, id, err)
+	}
+	alg := digest.Digest(id).Algorithm()
+	if _, err := s.get(id); err == nil {
+		return id, nil
+	}
+	if s.chunked(size) || s.storedInline(size, alg) {
+		// Both are written from memory.
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", storeError(op, id, err)
+		}
+		id, _, err := s.setMulti(alg, data)
+		return id, err
+	}
+	if err := s.makeAlgorithmDirs(alg); err != nil {
+		return "", storeError(op, id, err)
+	}
+	if err := s.renameIntoPlace(path, id); err != nil {
+		return "", storeError(op, id, err)
+	}
+	s.recordStored(id, size, crc, true)
+	return id, nil
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// endlessReader yields an unbounded stream of bytes.
+type endlessReader struct {
+	read int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestSetExpected(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("foobar")
+	expected := computeID(digest.Canonical, data)
+	id, err := fs.SetExpected(bytes.NewReader(data), expected, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != expected {
+		t.Fatalf("Expected ID %v, got %v", expected, id)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected content %q, got %q", data, content)
+	}
+}
+
+func TestSetExpectedMismatch(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("foobar")
+	expected := computeID(digest.Canonical, data)
+
+	r := &endlessReader{}
+	if _, err := fs.SetExpected(r, expected, int64(len(data))); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("Expected ErrSizeMismatch for an oversized stream, got %v", err)
+	}
+	if r.read > 64*1024 {
+		t.Fatalf("Expected an early abort, read %d bytes", r.read)
+	}
+
+	if _, err := fs.SetExpected(bytes.NewReader(data[:3]), expected, int64(len(data))); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("Expected ErrSizeMismatch for a short stream, got %v", err)
+	}
+
+	if _, err := fs.SetExpected(strings.NewReader("foobaz"), expected, int64(len(data))); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt for a digest mismatch, got %v", err)
+	}
+
+	if _, err := fs.Get(expected); err == nil {
+		t.Fatal("Expected nothing to be stored")
+	}
+	leftover, err := ioutil.ReadDir(fs.tempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftover) != 0 {
+		t.Fatalf("Expected temporary files to be removed, found %d", len(leftover))
+	}
+}
+
+// cancelledReader yields data and then fails like the body of a request
+// whose client went away.
+type cancelledReader struct {
+	data []byte
+}
+
+func (r *cancelledReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, context.Canceled
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestAcceptPush(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("pushed blob")
+	id, size, err := fs.AcceptPush(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := computeID(digest.Canonical, data); id != expected || size != int64(len(data)) {
+		t.Fatalf("Expected %v of %d bytes, got %v of %d bytes", expected, len(data), id, size)
+	}
+	if content, err := fs.Get(id); err != nil || !bytes.Equal(content, data) {
+		t.Fatalf("Expected pushed content %q, got %q, %v", data, content, err)
+	}
+
+	partial := []byte(strings.Repeat("partial", 1000))
+	if _, _, err := fs.AcceptPush(&cancelledReader{data: partial}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	temp, err := ioutil.ReadDir(fs.tempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(temp) != 0 {
+		t.Fatalf("Expected no partial content left, got %d temporary files", len(temp))
+	}
+	if _, err := fs.Get(computeID(digest.Canonical, partial)); err == nil {
+		t.Fatal("Expected partial content not to be stored")
+	}
+	ids, err := fs.sortedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Fatalf("Expected only %v to be stored, got %v", id, ids)
+	}
+}
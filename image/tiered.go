@@ -0,0 +1,296 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// RepairObserver is called after a TieredBackend replaced corrupt content in
+// its primary backend. cause is the error returned by the primary.
+type RepairObserver func(id ID, cause error)
+
+// ReplicaRepairObserver is called after a TieredBackend replaced corrupt
+// content in its primary backend with the copy of a replica. replica is the
+// index of the replica that served the copy, cause the error returned by
+// the primary.
+type ReplicaRepairObserver func(id ID, replica int, cause error)
+
+// TieredBackend is a StoreBackend serving content from a primary backend and
+// falling back to replica backends, in order, for content that is missing or
+// corrupt in the primary. Content found in a replica is copied to the
+// primary. Writes only go to the primary.
+type TieredBackend struct {
+	primary  StoreBackend
+	replicas []StoreBackend
+	observer ReplicaRepairObserver
+	fetches  flightGroup
+	log      Logger
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// NewTieredBackend returns a backend reading through primary to fallback.
+// observer may be nil.
+func NewTieredBackend(primary, fallback StoreBackend, observer RepairObserver) *TieredBackend {
+	var replicaObserver ReplicaRepairObserver
+	if observer != nil {
+		replicaObserver = func(id ID, replica int, cause error) { observer(id, cause) }
+	}
+	return NewReplicatedTieredBackend(primary, []StoreBackend{fallback}, replicaObserver)
+}
+
+// NewReplicatedTieredBackend returns a backend reading through primary to
+// replicas, which are tried in order. There must be at least one replica.
+// observer may be nil.
+func NewReplicatedTieredBackend(primary StoreBackend, replicas []StoreBackend, observer ReplicaRepairObserver) *TieredBackend {
+	return &TieredBackend{
+		primary:  primary,
+		replicas: replicas,
+		observer: observer,
+		log:      backendLogger(primary),
+		now:      time.Now,
+	}
+}
+
+// Metrics returns the number of reads that shared the fetch of another
+// one, see MetricsReporter.
+func (tb *TieredBackend) Metrics() map[string]float64 {
+	return map[string]float64{
+		"singleflight_coalesced_total": float64(tb.fetches.coalescedCalls()),
+	}
+}
+
+func (tb *TieredBackend) wrapped() []StoreBackend {
+	return append([]StoreBackend{tb.primary}, tb.replicas...)
+}
+
+// Walk calls the supplied callback for each image ID in any backend.
+func (tb *TieredBackend) Walk(f IDWalkFunc) error {
+	seen := make(map[ID]struct{})
+	stopped := false
+	for _, backend := range tb.wrapped() {
+		if err := backend.Walk(func(id ID) error {
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
+			err := f(id)
+			if errors.Is(err, ErrStopWalk) {
+				stopped = true
+			}
+			return err
+		}); err != nil {
+			return stopWalk(err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Get returns the content stored under a given ID. Content that is missing
+// or corrupt in the primary, including truncated content and content with
+// extra data, is read from the first replica holding a verified copy and
+// written back to the primary. Concurrent reads of the same such content
+// share one fetch.
+func (tb *TieredBackend) Get(id ID) ([]byte, error) {
+	content, err := tb.primary.Get(id)
+	if err == nil {
+		return content, nil
+	}
+	if !errors.Is(err, ErrCorrupt) && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return tb.fetches.do(id, func() ([]byte, error) {
+		return tb.fetch(id, err)
+	})
+}
+
+// fetch reads the content of id from the replicas and copies the first
+// verified copy to the primary, which failed to read it with err. If no
+// replica has a verified copy, the first error other than a missing copy
+// is returned.
+func (tb *TieredBackend) fetch(id ID, err error) ([]byte, error) {
+	var ferr error
+	for i, replica := range tb.replicas {
+		content, rerr := replica.Get(id)
+		if rerr == nil {
+			rerr = verifyFetched(id, content)
+		}
+		if rerr != nil {
+			if ferr == nil || errors.Is(ferr, os.ErrNotExist) {
+				ferr = rerr
+			}
+			continue
+		}
+
+		if _, serr := tb.primary.Set(content); serr != nil {
+			tb.log.Warn("failed to populate primary image store", "id", id, "err", serr)
+			return content, nil
+		}
+		if errors.Is(err, ErrCorrupt) {
+			tb.log.Warn("repaired corrupt image content from replica store", "id", id, "replica", i)
+			if tb.observer != nil {
+				tb.observer(id, i, err)
+			}
+		}
+		return content, nil
+	}
+	return nil, ferr
+}
+
+// verifyFetched returns ErrCorrupt unless content, read from a replica of
+// unknown integrity, has the digest id.
+func verifyFetched(id ID, content []byte) error {
+	alg := digest.Digest(id).Algorithm()
+	if !alg.Available() {
+		return storeError("get", id, ErrUnsupportedAlgorithm)
+	}
+	if computeID(alg, content) != id {
+		return storeError("get", id, ErrCorrupt)
+	}
+	return nil
+}
+
+// Set stores content in the primary backend.
+func (tb *TieredBackend) Set(data []byte) (ID, error) {
+	return tb.primary.Set(data)
+}
+
+// Delete removes content and metadata from the primary backend.
+func (tb *TieredBackend) Delete(id ID) error {
+	return tb.primary.Delete(id)
+}
+
+// SetMetadata sets metadata for a given ID in the primary backend.
+func (tb *TieredBackend) SetMetadata(id ID, key string, data []byte) error {
+	return tb.primary.SetMetadata(id, key, data)
+}
+
+// GetMetadata returns metadata for a given ID, from the first replica
+// holding it if the primary doesn't.
+func (tb *TieredBackend) GetMetadata(id ID, key string) ([]byte, error) {
+	data, err := tb.primary.GetMetadata(id, key)
+	for _, replica := range tb.replicas {
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		data, err = replica.GetMetadata(id, key)
+	}
+	return data, err
+}
+
+// DeleteMetadata removes the metadata associated with an ID from the
+// primary backend.
+func (tb *TieredBackend) DeleteMetadata(id ID, key string) error {
+	return tb.primary.DeleteMetadata(id, key)
+}
+
+func (tb *TieredBackend) setReservedMetadata(id ID, key string, data []byte) error {
+	return setBackendMetadata(tb.primary, id, key, data)
+}
+
+// allMetadata returns the metadata of a given ID, from the first replica
+// holding it if the primary doesn't, like GetMetadata.
+func (tb *TieredBackend) allMetadata(id ID) (map[string][]byte, error) {
+	md, err := backendMetadata(tb.primary, id)
+	for _, replica := range tb.replicas {
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		md, err = backendMetadata(replica, id)
+	}
+	return md, err
+}
+
+type lastUsedBackend interface {
+	LastUsed(id ID) (time.Time, error)
+}
+
+// protectedBackend is implemented by backends whose content can be held or
+// pinned, which DemoteIdle leaves in place.
+type protectedBackend interface {
+	protected(id ID) bool
+}
+
+type metadataLister interface {
+	ListMetadata(id ID) ([]string, error)
+}
+
+// DemoteIdle moves the content of the primary backend that wasn't used
+// within olderThan to cold, together with its metadata. cold must be one of
+// the replicas, so that reads of demoted content are served from it and copy
+// it back to the primary. Held and pinned content is kept in the primary.
+// The primary must report last use, see FSOptions.TrackLastUsed.
+func (tb *TieredBackend) DemoteIdle(olderThan time.Duration, cold StoreBackend) (moved []ID, err error) {
+	lu, ok := tb.primary.(lastUsedBackend)
+	if !ok {
+		return nil, errors.New("primary image store doesn't track last use")
+	}
+	replica := -1
+	for i, r := range tb.replicas {
+		if r == cold {
+			replica = i
+			break
+		}
+	}
+	if replica < 0 {
+		return nil, errors.New("cold image store is not a replica of the tiered backend")
+	}
+	protected, _ := tb.primary.(protectedBackend)
+	cutoff := tb.now().Add(-olderThan)
+
+	var ids []ID
+	if err := tb.primary.Walk(func(id ID) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if protected != nil && protected.protected(id) {
+			continue
+		}
+		last, err := lu.LastUsed(id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return moved, err
+		}
+		if !last.Before(cutoff) {
+			continue
+		}
+		if err := tb.demote(id, cold); err != nil {
+			return moved, err
+		}
+		tb.log.Info("demoted idle image content", "id", id, "replica", replica)
+		moved = append(moved, id)
+	}
+	return moved, nil
+}
+
+func (tb *TieredBackend) demote(id ID, cold StoreBackend) error {
+	content, err := tb.primary.Get(id)
+	if err != nil {
+		return err
+	}
+	if _, err := cold.Set(content); err != nil {
+		return err
+	}
+	md, err := backendMetadata(tb.primary, id)
+	if err != nil {
+		return err
+	}
+	for key, data := range md {
+		if err := setBackendMetadata(cold, id, key, data); err != nil {
+			return err
+		}
+	}
+	return tb.primary.Delete(id)
+}
@@ -0,0 +1,317 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestTieredStores(t *testing.T) (primary, fallback *fs, cleanup func()) {
+	primary, cleanup = newTestFSStoreOptions(t, FSOptions{Namespace: "primary"})
+	fallback, err := newFSStore(primary.root, FSOptions{Namespace: "fallback"})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return primary, fallback, cleanup
+}
+
+func TestTieredReadRepair(t *testing.T) {
+	primary, fallback, cleanup := newTestTieredStores(t)
+	defer cleanup()
+
+	var repaired []ID
+	tb := NewTieredBackend(primary, fallback, func(id ID, cause error) {
+		if !errors.Is(cause, ErrCorrupt) {
+			t.Fatalf("Expected repair cause to be ErrCorrupt, got %v", cause)
+		}
+		repaired = append(repaired, id)
+	})
+
+	data := []byte("foobar")
+	id, err := primary.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fallback.Set(data); err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, primary, id)
+
+	content, err := tb.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected data %q, got %q", data, content)
+	}
+	if len(repaired) != 1 || repaired[0] != id {
+		t.Fatalf("Expected repair of %v to be observed, got %v", id, repaired)
+	}
+	if _, err := primary.Get(id); err != nil {
+		t.Fatalf("Expected primary to be repaired, got %v", err)
+	}
+}
+
+func TestTieredReplicas(t *testing.T) {
+	primary, first, cleanup := newTestTieredStores(t)
+	defer cleanup()
+	second, err := newFSStore(primary.root, FSOptions{Namespace: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type repair struct {
+		id      ID
+		replica int
+	}
+	var repairs []repair
+	tb := NewReplicatedTieredBackend(primary, []StoreBackend{first, second}, func(id ID, replica int, cause error) {
+		if !errors.Is(cause, ErrCorrupt) {
+			t.Fatalf("Expected repair cause to be ErrCorrupt, got %v", cause)
+		}
+		repairs = append(repairs, repair{id, replica})
+	})
+
+	data := []byte("foobar")
+	id, err := primary.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, replica := range []*fs{first, second} {
+		if _, err := replica.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The primary is truncated, the first replica corrupt.
+	if err := ioutil.WriteFile(primary.contentFile(id), data[:3], 0600); err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, first, id)
+
+	content, err := tb.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("Expected data %q, got %q", data, content)
+	}
+	if len(repairs) != 1 || repairs[0] != (repair{id, 1}) {
+		t.Fatalf("Expected repair of %v from replica 1 to be observed, got %v", id, repairs)
+	}
+	if content, err := primary.Get(id); err != nil || !bytes.Equal(content, data) {
+		t.Fatalf("Expected primary to be repaired, got %q, %v", content, err)
+	}
+
+	// Without a verified copy the corruption is reported.
+	other, err := primary.Set([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Set([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, primary, other)
+	corruptContent(t, first, other)
+	if _, err := tb.Get(other); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt without a verified copy, got %v", err)
+	}
+}
+
+func TestTieredReadThrough(t *testing.T) {
+	primary, fallback, cleanup := newTestTieredStores(t)
+	defer cleanup()
+
+	tb := NewTieredBackend(primary, fallback, nil)
+	id, err := fallback.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countWalk(t, tb); n != 1 {
+		t.Fatalf("Expected 1 walked entry, got %d", n)
+	}
+	if _, err := tb.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.Get(id); err != nil {
+		t.Fatalf("Expected content to be copied to primary, got %v", err)
+	}
+	if n := countWalk(t, tb); n != 1 {
+		t.Fatalf("Expected 1 walked entry after copy, got %d", n)
+	}
+}
+
+func TestTieredWalkStop(t *testing.T) {
+	primary, fallback, cleanup := newTestTieredStores(t)
+	defer cleanup()
+
+	tb := NewTieredBackend(primary, fallback, nil)
+	if _, err := primary.Set([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fallback.Set([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := tb.Walk(func(id ID) error {
+		n++
+		return ErrStopWalk
+	}); err != nil {
+		t.Fatalf("Expected ErrStopWalk to stop the walk without error, got %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected the walk to stop across tiers after 1 entry, got %d", n)
+	}
+}
+
+func TestTieredDemoteIdle(t *testing.T) {
+	logger := &capturingLogger{}
+	primary, cleanup := newTestFSStoreOptions(t, FSOptions{Namespace: "primary", TrackLastUsed: true, Logger: logger})
+	defer cleanup()
+	fallback, err := newFSStore(primary.root, FSOptions{Namespace: "fallback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newFSStore(primary.root, FSOptions{Namespace: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	primary.now = clock
+	tb := NewTieredBackend(primary, fallback, nil)
+	tb.now = clock
+
+	idle, err := tb.Set([]byte("idle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.SetMetadata(idle, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+	active, err := tb.Set([]byte("active"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := tb.Set([]byte("pinned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Pin(pinned); err != nil {
+		t.Fatal(err)
+	}
+	held, err := tb.Set([]byte("held"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := primary.Hold(held)
+	defer release()
+
+	now = now.Add(time.Hour)
+	if _, err := tb.Get(active); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(10 * time.Minute)
+
+	if _, err := tb.DemoteIdle(30*time.Minute, other); err == nil {
+		t.Fatal("Expected demotion to a backend that isn't a replica to fail")
+	}
+	moved, err := tb.DemoteIdle(30*time.Minute, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[0] != idle {
+		t.Fatalf("Expected %v to be demoted, got %v", idle, moved)
+	}
+	for _, id := range []ID{pinned, held} {
+		if _, err := primary.Get(id); err != nil {
+			t.Fatalf("Expected %v to be kept in primary, got %v", id, err)
+		}
+	}
+	if e := logger.find("info", "demoted idle image content"); e == nil || e.fields["id"] != idle {
+		t.Fatalf("Expected the demotion to be logged to the primary logger, got %v", logger.events)
+	}
+	if _, err := primary.Get(idle); err == nil {
+		t.Fatal("Expected demoted content to be removed from primary")
+	}
+	if _, err := primary.Get(active); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tb.Get(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("idle")) {
+		t.Fatalf("Expected data %q, got %q", "idle", data)
+	}
+	value, err := tb.GetMetadata(idle, "tkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("tval")) {
+		t.Fatalf("Expected metadata %q, got %q", "tval", value)
+	}
+}
+
+// gatedBackend blocks Get until its gate is closed and counts the calls.
+type gatedBackend struct {
+	StoreBackend
+	gate  chan struct{}
+	calls int32
+}
+
+func (b *gatedBackend) Get(id ID) ([]byte, error) {
+	atomic.AddInt32(&b.calls, 1)
+	<-b.gate
+	return b.StoreBackend.Get(id)
+}
+
+func TestTieredSingleFlight(t *testing.T) {
+	primary, fallback, cleanup := newTestTieredStores(t)
+	defer cleanup()
+
+	data := []byte("foobar")
+	id, err := fallback.Set(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gated := &gatedBackend{StoreBackend: fallback, gate: make(chan struct{})}
+	tb := NewTieredBackend(primary, gated, nil)
+
+	const readers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := tb.Get(id)
+			if err == nil && !bytes.Equal(content, data) {
+				err = fmt.Errorf("Expected data %q, got %q", data, content)
+			}
+			errs <- err
+		}()
+	}
+	for tb.fetches.waiting(id) != readers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gated.gate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&gated.calls); calls != 1 {
+		t.Fatalf("Expected 1 fallback fetch, got %d", calls)
+	}
+}
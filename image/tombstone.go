@@ -0,0 +1,91 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// tombstonesDirName holds a marker for each deletion in progress, so an
+// interrupted deletion can be completed.
+const tombstonesDirName = "tombstones"
+
+func (s *fs) tombstoneDir() string {
+	return filepath.Join(s.root, tombstonesDirName, s.namespace)
+}
+
+func (s *fs) tombstoneFile(id ID) string {
+	dgst := digest.Digest(id)
+	return filepath.Join(s.root, tombstonesDirName, s.namespace, string(dgst.Algorithm()), dgst.Hex())
+}
+
+// finishDelete removes the remaining metadata of the deleted content of id
+// and clears its tombstone.
+func (s *fs) finishDelete(id ID) error {
+	if err := s.metadata.DeleteAll(id); err != nil {
+		return err
+	}
+	s.forget(id)
+	return os.Remove(s.tombstoneFile(id))
+}
+
+// forget drops the state of id kept in memory.
+func (s *fs) forget(id ID) {
+	s.lastUsedMu.Lock()
+	delete(s.lastUsed, id)
+	s.lastUsedMu.Unlock()
+	s.hitsMu.Lock()
+	delete(s.hits, id)
+	s.hitsMu.Unlock()
+	s.forgetWeakChecksum(id)
+	s.countBloomDelete()
+}
+
+// RecoverTombstones completes the deletions interrupted before they removed
+// both the content and the metadata of an ID. It runs when the store is
+// opened.
+func (s *fs) RecoverTombstones() error {
+	if err := s.lockMutation(context.Background()); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	algs, err := s.algorithmDirs(s.tombstoneDir())
+	if err != nil {
+		return err
+	}
+	for _, alg := range algs {
+		if err := s.recoverTombstones(alg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fs) recoverTombstones(alg string) error {
+	dir, err := ioutil.ReadDir(filepath.Join(s.tombstoneDir(), alg))
+	if err != nil {
+		return err
+	}
+	for _, v := range dir {
+		id := ID(digest.NewDigestFromHex(alg, v.Name()))
+		if err := s.validateID(id); err != nil {
+			s.log.Debug("skipping invalid tombstone", "path", filepath.Join(s.tombstoneDir(), alg, v.Name()), "err", err)
+			continue
+		}
+		s.log.Info("completing interrupted deletion of image", "id", id)
+		if _, err := s.deleteInline(id); err != nil {
+			return storeError("recover", id, err)
+		}
+		if err := os.Remove(s.contentFile(id)); err != nil && !os.IsNotExist(err) {
+			return storeError("recover", id, err)
+		}
+		if err := s.finishDelete(id); err != nil {
+			return storeError("recover", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverTombstones(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "tkey", []byte("tval")); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash after the content was removed
+	if err := os.MkdirAll(filepath.Dir(fs.tombstoneFile(id)), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fs.tombstoneFile(id), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(fs.contentFile(id)); err != nil {
+		t.Fatal(err)
+	}
+	// and one before anything was removed
+	if err := ioutil.WriteFile(fs.tombstoneFile(id2), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = newFSStore(fs.root, FSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{fs.metadataDir(id), fs.contentFile(id2), fs.tombstoneFile(id), fs.tombstoneFile(id2)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed by recovery, got %v", path, err)
+		}
+	}
+	if n := countWalk(t, fs); n != 0 {
+		t.Fatalf("Expected no content after recovery, got %d", n)
+	}
+}
+
+func TestDeleteClearsTombstone(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(id); err == nil {
+		t.Fatal("Expected error deleting missing content")
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(fs.tombstoneFile(id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected no tombstones left, got %d", len(entries))
+	}
+}
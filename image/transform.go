@@ -0,0 +1,316 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// logicalIDKey is the metadata key under which a TransformingBackend records
+// the logical ID of the transformed content stored in its inner backend.
+const logicalIDKey = "logical-id"
+
+// Transformer reversibly transforms content on its way to and from a
+// StoreBackend, e.g. to compress or encrypt it.
+type Transformer interface {
+	// Encode returns a writer transforming the data written to it into w.
+	// The data is only guaranteed to be flushed to w on Close.
+	Encode(w io.Writer) io.WriteCloser
+	// Decode returns a reader reversing the transformation of r.
+	Decode(r io.Reader) io.Reader
+}
+
+// TransformingBackend is a StoreBackend that stores its content transformed
+// in an inner backend. IDs are computed over the original content, so the
+// transformation is invisible to its users.
+type TransformingBackend struct {
+	sync.RWMutex
+	inner        StoreBackend
+	transformers []Transformer
+	// physical maps logical IDs to the IDs of the transformed content in
+	// the inner backend.
+	physical map[ID]ID
+	// codecs are the codecs registered with the backend, by name.
+	codecs map[string]Codec
+}
+
+// NewTransformingBackend returns a backend storing content in inner after
+// passing it through transformers in order. On read the transformations are
+// reversed in the opposite order.
+func NewTransformingBackend(inner StoreBackend, transformers ...Transformer) (*TransformingBackend, error) {
+	tb := &TransformingBackend{
+		inner:        inner,
+		transformers: transformers,
+		physical:     make(map[ID]ID),
+	}
+	if err := inner.Walk(func(id ID) error {
+		logical, err := inner.GetMetadata(id, logicalIDKey)
+		if err != nil {
+			backendLogger(inner).Debug("skipping untransformed image content", "id", id, "err", err)
+			return nil
+		}
+		tb.physical[ID(logical)] = id
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return tb, nil
+}
+
+func (tb *TransformingBackend) encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writers := make([]io.WriteCloser, len(tb.transformers))
+	var w io.Writer = &buf
+	for i := len(tb.transformers) - 1; i >= 0; i-- {
+		writers[i] = tb.transformers[i].Encode(w)
+		w = writers[i]
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	for _, wc := range writers {
+		if err := wc.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (tb *TransformingBackend) decode(data []byte, codec Codec) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if codec != nil {
+		return ioutil.ReadAll(codec.Decode(r))
+	}
+	for i := len(tb.transformers) - 1; i >= 0; i-- {
+		r = tb.transformers[i].Decode(r)
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (tb *TransformingBackend) physicalID(op string, id ID) (ID, error) {
+	tb.RLock()
+	defer tb.RUnlock()
+
+	phys, ok := tb.physical[id]
+	if !ok {
+		return "", storeError(op, id, os.ErrNotExist)
+	}
+	return phys, nil
+}
+
+func (tb *TransformingBackend) wrapped() []StoreBackend {
+	return []StoreBackend{tb.inner}
+}
+
+// Walk calls the supplied callback for each logical image ID.
+func (tb *TransformingBackend) Walk(f IDWalkFunc) error {
+	tb.RLock()
+	ids := make([]ID, 0, len(tb.physical))
+	for id := range tb.physical {
+		ids = append(ids, id)
+	}
+	tb.RUnlock()
+
+	for _, id := range ids {
+		if err := f(id); err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
+
+// Get returns the original content stored under a given ID.
+func (tb *TransformingBackend) Get(id ID) ([]byte, error) {
+	tb.RLock()
+	defer tb.RUnlock()
+
+	phys, ok := tb.physical[id]
+	if !ok {
+		return nil, storeError("get", id, os.ErrNotExist)
+	}
+	return tb.get(id, phys)
+}
+
+// GetRaw returns the content stored under a given ID as it is stored in the
+// inner backend, after the transformations, for instance to forward
+// compressed content without compressing it again. The raw bytes don't match
+// the ID, which addresses the original content; they are verified against
+// their own ID in the inner backend.
+func (tb *TransformingBackend) GetRaw(id ID) ([]byte, error) {
+	tb.RLock()
+	defer tb.RUnlock()
+
+	phys, ok := tb.physical[id]
+	if !ok {
+		return nil, storeError("getraw", id, os.ErrNotExist)
+	}
+	return tb.inner.Get(phys)
+}
+
+// get reads and verifies the content of id stored as phys. It must be called
+// with tb locked.
+func (tb *TransformingBackend) get(id, phys ID) ([]byte, error) {
+	stored, err := tb.inner.Get(phys)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := tb.codec(phys)
+	if err != nil {
+		return nil, storeError("get", id, err)
+	}
+	content, err := tb.decode(stored, codec)
+	if err != nil {
+		return nil, storeError("get", id, err)
+	}
+	validated, err := digest.FromBytes(content)
+	if err != nil {
+		return nil, storeError("get", id, err)
+	}
+	if ID(validated) != id {
+		return nil, storeError("get", id, ErrCorrupt)
+	}
+	return content, nil
+}
+
+// Set transforms and stores content, returning the ID of the original
+// content.
+func (tb *TransformingBackend) Set(data []byte) (ID, error) {
+	if len(data) == 0 {
+		return "", storeError("set", "", ErrEmptyContent)
+	}
+
+	dgst, err := digest.FromBytes(data)
+	if err != nil {
+		return "", storeError("set", "", err)
+	}
+	id := ID(dgst)
+
+	tb.Lock()
+	defer tb.Unlock()
+
+	if _, exists := tb.physical[id]; exists {
+		return id, nil
+	}
+	stored, err := tb.encode(data)
+	if err != nil {
+		return "", storeError("set", id, err)
+	}
+	phys, err := tb.inner.Set(stored)
+	if err != nil {
+		return "", err
+	}
+	if err := setBackendMetadata(tb.inner, phys, logicalIDKey, []byte(id)); err != nil {
+		return "", err
+	}
+	tb.physical[id] = phys
+	return id, nil
+}
+
+// Delete removes the content and metadata associated with the ID.
+func (tb *TransformingBackend) Delete(id ID) error {
+	tb.Lock()
+	defer tb.Unlock()
+
+	phys, ok := tb.physical[id]
+	if !ok {
+		return storeError("delete", id, os.ErrNotExist)
+	}
+	if err := tb.inner.Delete(phys); err != nil {
+		return err
+	}
+	delete(tb.physical, id)
+	return nil
+}
+
+// SetMetadata sets metadata for a given ID.
+func (tb *TransformingBackend) SetMetadata(id ID, key string, data []byte) error {
+	if err := validateWritableMetadataKey(key); err != nil {
+		return storeError("setmetadata", id, err)
+	}
+	phys, err := tb.physicalID("setmetadata", id)
+	if err != nil {
+		return err
+	}
+	return tb.inner.SetMetadata(phys, key, data)
+}
+
+// GetMetadata returns metadata for a given ID.
+func (tb *TransformingBackend) GetMetadata(id ID, key string) ([]byte, error) {
+	phys, err := tb.physicalID("getmetadata", id)
+	if err != nil {
+		return nil, err
+	}
+	return tb.inner.GetMetadata(phys, key)
+}
+
+// DeleteMetadata removes the metadata associated with an ID.
+func (tb *TransformingBackend) DeleteMetadata(id ID, key string) error {
+	if err := validateWritableMetadataKey(key); err != nil {
+		return storeError("deletemetadata", id, err)
+	}
+	phys, err := tb.physicalID("deletemetadata", id)
+	if err != nil {
+		return err
+	}
+	return tb.inner.DeleteMetadata(phys, key)
+}
+
+// setReservedMetadata sets a reserved metadata key of the inner backend for
+// a given ID. The keys of tb itself can't be set.
+func (tb *TransformingBackend) setReservedMetadata(id ID, key string, data []byte) error {
+	if key == logicalIDKey || key == codecKey {
+		return storeError("setmetadata", id, fmt.Errorf("%w %q", ErrReservedMetadataKey, key))
+	}
+	phys, err := tb.physicalID("setmetadata", id)
+	if err != nil {
+		return err
+	}
+	return setBackendMetadata(tb.inner, phys, key, data)
+}
+
+// allMetadata returns the metadata of a given ID in the inner backend,
+// leaving out the keys of tb itself, which describe the stored content.
+func (tb *TransformingBackend) allMetadata(id ID) (map[string][]byte, error) {
+	phys, err := tb.physicalID("listmetadata", id)
+	if err != nil {
+		return nil, err
+	}
+	md, err := backendMetadata(tb.inner, phys)
+	if err != nil {
+		return nil, err
+	}
+	delete(md, logicalIDKey)
+	delete(md, codecKey)
+	return md, nil
+}
+
+// GzipTransformer compresses content with gzip.
+type GzipTransformer struct{}
+
+// Encode returns a gzip writer compressing into w.
+func (GzipTransformer) Encode(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+// Decode returns a reader decompressing r.
+func (GzipTransformer) Decode(r io.Reader) io.Reader {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errReader{err}
+	}
+	return gz
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,157 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// tagTransformer prefixes content with a tag byte.
+type tagTransformer struct {
+	tag byte
+}
+
+type tagWriter struct {
+	io.Writer
+	tagged bool
+	tag    byte
+}
+
+func (w *tagWriter) Write(p []byte) (int, error) {
+	if !w.tagged {
+		if _, err := w.Writer.Write([]byte{w.tag}); err != nil {
+			return 0, err
+		}
+		w.tagged = true
+	}
+	return w.Writer.Write(p)
+}
+
+func (w *tagWriter) Close() error {
+	if !w.tagged {
+		_, err := w.Write(nil)
+		return err
+	}
+	return nil
+}
+
+func (t tagTransformer) Encode(w io.Writer) io.WriteCloser {
+	return &tagWriter{Writer: w, tag: t.tag}
+}
+
+func (t tagTransformer) Decode(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	tag, err := br.ReadByte()
+	if err != nil {
+		return errReader{err}
+	}
+	if tag != t.tag {
+		return errReader{fmt.Errorf("expected tag %q, got %q", t.tag, tag)}
+	}
+	return br
+}
+
+func newTestTransformingBackend(t *testing.T, transformers ...Transformer) (*TransformingBackend, *fs, func()) {
+	inner, cleanup := newTestFSStore(t)
+	tb, err := NewTransformingBackend(inner, transformers...)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return tb, inner, cleanup
+}
+
+func TestTransformingGetSet(t *testing.T) {
+	tb, _, cleanup := newTestTransformingBackend(t, GzipTransformer{}, tagTransformer{'x'})
+	defer cleanup()
+
+	testGetSet(t, tb)
+	testMetadataGetSet(t, tb)
+}
+
+func TestTransformingDelete(t *testing.T) {
+	tb, _, cleanup := newTestTransformingBackend(t, GzipTransformer{})
+	defer cleanup()
+
+	testDelete(t, tb)
+}
+
+func TestTransformingWalker(t *testing.T) {
+	tb, _, cleanup := newTestTransformingBackend(t, GzipTransformer{})
+	defer cleanup()
+
+	testWalker(t, tb)
+}
+
+func TestTransformingOrder(t *testing.T) {
+	tb, inner, cleanup := newTestTransformingBackend(t, tagTransformer{'a'}, tagTransformer{'b'})
+	defer cleanup()
+
+	id, err := tb.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := inner.Get(tb.physical[id])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, []byte("bafoo")) {
+		t.Fatalf("Expected transformers applied in order, stored %q", stored)
+	}
+
+	// the index of transformed content is restored from the inner backend
+	tb2, err := NewTransformingBackend(inner, tagTransformer{'a'}, tagTransformer{'b'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := tb2.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("foo")) {
+		t.Fatalf("Expected data %q, got %q", "foo", data)
+	}
+}
+
+func TestTransformingGetRaw(t *testing.T) {
+	tb, _, cleanup := newTestTransformingBackend(t, GzipTransformer{})
+	defer cleanup()
+
+	content := bytes.Repeat([]byte("foo"), 100)
+	id, err := tb.Set(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := tb.GetRaw(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Expected gzip compressed raw content, got %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, content) {
+		t.Fatalf("Expected raw content to decompress to the content")
+	}
+
+	data, err := tb.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expected plain content from Get, got %q", data)
+	}
+
+	if _, err := tb.GetRaw("sha256:0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("Expected error for unknown ID")
+	}
+}
@@ -0,0 +1,291 @@
+package image
+
+import (
+	"crypto/rand"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// sessionsDirName holds a directory per upload session, named after its
+// token, with the content written so far and the state of the session.
+const sessionsDirName = "sessions"
+
+const (
+	uploadDataName  = "data"
+	uploadStateName = "state"
+)
+
+// uploadState is the state of an upload session persisted by Checkpoint.
+type uploadState struct {
+	// Size is the number of bytes of the content the state covers.
+	Size int64 `json:"size"`
+	// ExpectedSize is the size given to BeginUpload, or -1.
+	ExpectedSize int64 `json:"expectedSize"`
+	// Hash and CRC are the marshaled states of the digest of the content
+	// and of its weak checksum.
+	Hash []byte `json:"hash"`
+	CRC  []byte `json:"crc"`
+}
+
+// Upload is an upload session begun with BeginUpload, streaming content into
+// the store in one or more runs, across restarts of the store. It must be
+// committed or aborted to remove its files. An Upload is safe for concurrent
+// use, but a session must only be resumed once at a time.
+type Upload struct {
+	s     *fs
+	token string
+
+	mu           sync.Mutex
+	f            *os.File
+	digester     digest.Digester
+	crc          hash.Hash32
+	size         int64
+	expectedSize int64
+	resumed      bool
+	done         bool
+}
+
+func (s *fs) sessionsDir() string {
+	return filepath.Join(s.root, sessionsDirName, s.namespace)
+}
+
+func (s *fs) sessionDir(token string) string {
+	return filepath.Join(s.sessionsDir(), token)
+}
+
+// BeginUpload begins an upload session of content of the given size, or of
+// unknown size if size is negative, and returns it. The content is written
+// to the session with Write, and Checkpoint persists the progress so that,
+// after a restart, BeginUpload given the token of the session resumes it
+// from its last checkpoint: Offset tells where to continue from and size is
+// ignored. If the session can't be resumed, for instance because its state
+// is lost, it is restarted from offset zero under the same token, which
+// Resumed reports.
+func (s *fs) BeginUpload(token string, size int64) (*Upload, error) {
+	if s.idStrategy != nil || !s.algorithmAllowed(s.algorithm) {
+		return nil, storeError("beginupload", "", ErrUnsupportedAlgorithm)
+	}
+	if size < 0 {
+		size = -1
+	}
+	if token == "" {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, storeError("beginupload", "", err)
+		}
+		token = hex.EncodeToString(b[:])
+	} else if _, err := hex.DecodeString(token); err != nil {
+		return nil, storeError("beginupload", "", fmt.Errorf("invalid upload session token %q", token))
+	}
+
+	dir := s.sessionDir(token)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, storeError("beginupload", "", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, uploadDataName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, storeError("beginupload", "", err)
+	}
+	u := &Upload{
+		s:            s,
+		token:        token,
+		f:            f,
+		digester:     s.algorithm.New(),
+		crc:          crc32.NewIEEE(),
+		expectedSize: size,
+	}
+	if err := u.resume(); err != nil {
+		s.log.Info("restarting upload session", "token", token, "err", err)
+		u.digester = s.algorithm.New()
+		u.crc = crc32.NewIEEE()
+		u.size, u.expectedSize, u.resumed = 0, size, false
+	}
+	if err := f.Truncate(u.size); err != nil {
+		f.Close()
+		return nil, storeError("beginupload", "", err)
+	}
+	if _, err := f.Seek(u.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, storeError("beginupload", "", err)
+	}
+	if !u.resumed {
+		if err := s.preallocateFile(f.Name(), u.expectedSize); err != nil {
+			f.Close()
+			return nil, storeError("beginupload", "", err)
+		}
+	}
+	return u, nil
+}
+
+// resume restores the state of the session from its last checkpoint. The
+// content written after it is truncated by the caller.
+func (u *Upload) resume() error {
+	data, err := ioutil.ReadFile(filepath.Join(u.s.sessionDir(u.token), uploadStateName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("the session has no checkpoint")
+		}
+		return err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid upload session state: %v", err)
+	}
+	fi, err := u.f.Stat()
+	if err != nil {
+		return err
+	}
+	if state.Size < 0 || fi.Size() < state.Size {
+		return fmt.Errorf("upload session state covers %d bytes, the session holds %d", state.Size, fi.Size())
+	}
+	h, ok := u.digester.Hash().(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("the digest state can't be restored")
+	}
+	if err := h.UnmarshalBinary(state.Hash); err != nil {
+		return fmt.Errorf("invalid upload session digest state: %v", err)
+	}
+	if err := u.crc.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.CRC); err != nil {
+		return fmt.Errorf("invalid upload session checksum state: %v", err)
+	}
+	u.size, u.expectedSize, u.resumed = state.Size, state.ExpectedSize, true
+	return nil
+}
+
+// Token returns the token resuming the session with BeginUpload.
+func (u *Upload) Token() string {
+	return u.token
+}
+
+// Resumed returns whether BeginUpload resumed the session from a
+// checkpoint, rather than starting it or restarting it from zero.
+func (u *Upload) Resumed() bool {
+	return u.resumed
+}
+
+// Offset returns the number of bytes of the content written to the session,
+// where the writes of a resumed session continue from.
+func (u *Upload) Offset() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.size
+}
+
+// Write appends p to the content of the session.
+func (u *Upload) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return 0, storeError("upload", "", errors.New("upload session is closed"))
+	}
+	n, err := u.f.Write(p)
+	u.s.hashWriter(io.MultiWriter(u.digester.Hash(), u.crc)).Write(p[:n])
+	u.size += int64(n)
+	if err != nil {
+		return n, storeError("upload", "", err)
+	}
+	return n, nil
+}
+
+// Checkpoint persists the progress of the session, so that it resumes from
+// here if the store restarts. The digest state of the content is persisted
+// along with it, so the content written so far isn't read again.
+func (u *Upload) Checkpoint() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return storeError("checkpoint", "", errors.New("upload session is closed"))
+	}
+	m, ok := u.digester.Hash().(encoding.BinaryMarshaler)
+	if !ok {
+		return storeError("checkpoint", "", errors.New("the digest state can't be persisted"))
+	}
+	hashState, err := m.MarshalBinary()
+	if err != nil {
+		return storeError("checkpoint", "", err)
+	}
+	crcState, err := u.crc.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return storeError("checkpoint", "", err)
+	}
+	data, err := json.Marshal(uploadState{Size: u.size, ExpectedSize: u.expectedSize, Hash: hashState, CRC: crcState})
+	if err != nil {
+		return storeError("checkpoint", "", err)
+	}
+	// The content the state covers must be on disk before the state.
+	if err := u.f.Sync(); err != nil {
+		return storeError("checkpoint", "", err)
+	}
+	dir := u.s.sessionDir(u.token)
+	tempFile, err := ioutil.TempFile(dir, ".")
+	if err != nil {
+		return storeError("checkpoint", "", err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filepath.Join(dir, uploadStateName))
+	}
+	return storeError("checkpoint", "", err)
+}
+
+// Commit stores the content of the session, which must have the ID
+// expectedID and the size given to BeginUpload if it was known, and ends the
+// session. It fails with ErrSizeMismatch or ErrCorrupt otherwise, and
+// nothing is stored then.
+func (u *Upload) Commit(expectedID ID) (ID, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return "", storeError("commitupload", expectedID, errors.New("upload session is closed"))
+	}
+	u.done = true
+	defer os.RemoveAll(u.s.sessionDir(u.token))
+
+	if err := u.f.Close(); err != nil {
+		return "", storeError("commitupload", expectedID, err)
+	}
+	switch {
+	case u.expectedSize >= 0 && u.size != u.expectedSize:
+		return "", storeError("commitupload", expectedID, ErrSizeMismatch)
+	case u.size == 0 && !u.s.allowEmpty:
+		return "", storeError("commitupload", expectedID, ErrEmptyContent)
+	case ID(u.digester.Digest()) != expectedID:
+		return "", storeError("commitupload", expectedID, ErrCorrupt)
+	}
+	return u.s.placeVerified("commitupload", u.f.Name(), expectedID, u.size, u.crc.Sum32())
+}
+
+// Abort discards the content of the session and ends it.
+func (u *Upload) Abort() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return nil
+	}
+	u.done = true
+	u.f.Close()
+	return os.RemoveAll(u.s.sessionDir(u.token))
+}
@@ -0,0 +1,126 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestFSUploadResume(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	id := computeID(digest.Canonical, data)
+	half := int64(len(data) / 2)
+
+	u, err := fs.BeginUpload("", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Resumed() || u.Offset() != 0 {
+		t.Fatalf("Expected a new session, got resumed %v at %d", u.Resumed(), u.Offset())
+	}
+	if _, err := u.Write(data[:half]); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// Written after the checkpoint, lost with the restart.
+	if _, err := u.Write(data[half : half+100]); err != nil {
+		t.Fatal(err)
+	}
+	token := u.Token()
+
+	fs, err = newFSStore(fs.root, FSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = fs.BeginUpload(token, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Resumed() || u.Offset() != half {
+		t.Fatalf("Expected the session to resume at %d, got resumed %v at %d", half, u.Resumed(), u.Offset())
+	}
+	if _, err := u.Write(data[u.Offset():]); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := u.Commit(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed != id {
+		t.Fatalf("Expected ID %v, got %v", id, committed)
+	}
+	content, err := fs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("Expected the resumed upload to store the whole content")
+	}
+	if _, err := os.Stat(fs.sessionDir(token)); !os.IsNotExist(err) {
+		t.Fatalf("Expected committed session to be removed, got %v", err)
+	}
+}
+
+func TestFSUploadRestart(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	data := []byte("content uploaded twice")
+	id := computeID(digest.Canonical, data)
+
+	u, err := fs.BeginUpload("", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Write(data[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	token := u.Token()
+	if err := ioutil.WriteFile(filepath.Join(fs.sessionDir(token), uploadStateName), []byte("lost"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err = fs.BeginUpload(token, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Resumed() || u.Offset() != 0 {
+		t.Fatalf("Expected the session to restart, got resumed %v at %d", u.Resumed(), u.Offset())
+	}
+	if _, err := u.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Commit(id); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := fs.Get(id); err != nil || !bytes.Equal(content, data) {
+		t.Fatalf("Expected restarted upload to store %q, got %q, %v", data, content, err)
+	}
+
+	u, err = fs.BeginUpload("", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Commit(computeID(digest.Canonical, []byte("foo"))); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("Expected ErrSizeMismatch, got %v", err)
+	}
+	if _, err := fs.BeginUpload("../escape", -1); err == nil {
+		t.Fatal("Expected invalid session token to be rejected")
+	}
+}
@@ -0,0 +1,98 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidMetadataKey is returned for metadata keys that can't be used as
+// file names in the metadata directory of an ID: empty keys, keys
+// containing path separators or NUL bytes, and keys starting with a dot,
+// which include "." and "..".
+var ErrInvalidMetadataKey = errors.New("invalid metadata key")
+
+// validateMetadataKey returns ErrInvalidMetadataKey unless key stays within
+// the metadata directory of an ID as a file name.
+func validateMetadataKey(key string) error {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, "/\\\x00") {
+		return fmt.Errorf("%w %q", ErrInvalidMetadataKey, key)
+	}
+	return nil
+}
+
+// ErrReservedMetadataKey is returned when SetMetadata, DeleteMetadata or
+// CompareAndSwapMetadata is given a key that the store maintains itself. It
+// wraps ErrInvalidMetadataKey.
+var ErrReservedMetadataKey = fmt.Errorf("%w: reserved", ErrInvalidMetadataKey)
+
+// reservedMetadataKeys are the metadata keys maintained by the store and by
+// the backends wrapping it, like TransformingBackend.
+var reservedMetadataKeys = map[string]bool{
+	schemaVersionKey:   true,
+	sizeKey:            true,
+	provenanceKey:      true,
+	deltaDependentsKey: true,
+	weakChecksumKey:    true,
+	pinnedKey:          true,
+	hitsKey:            true,
+	lastUsedKey:        true,
+	diffIDKey:          true,
+	codecKey:           true,
+	logicalIDKey:       true,
+}
+
+// isReservedMetadataKey returns whether key is maintained by the store.
+// Reserved keys are hidden from ListMetadata and from migrations, and can't
+// be set or deleted with the public metadata API.
+func isReservedMetadataKey(key string) bool {
+	return reservedMetadataKeys[key]
+}
+
+// validateWritableMetadataKey returns ErrInvalidMetadataKey like
+// validateMetadataKey, or ErrReservedMetadataKey for reserved keys.
+func validateWritableMetadataKey(key string) error {
+	if err := validateMetadataKey(key); err != nil {
+		return err
+	}
+	if isReservedMetadataKey(key) {
+		return fmt.Errorf("%w %q", ErrReservedMetadataKey, key)
+	}
+	return nil
+}
+
+// ErrInvalidMetadataValue is returned when a metadata value is rejected by
+// the validator registered for its key.
+var ErrInvalidMetadataValue = errors.New("invalid metadata value")
+
+// RegisterMetadataValidator makes SetMetadata and CompareAndSwapMetadata
+// reject values of key for which fn returns an error. Registering a key
+// again replaces its validator, and a nil fn removes it. Keys without a
+// validator accept any value.
+func (s *fs) RegisterMetadataValidator(key string, fn func([]byte) error) {
+	s.validatorsMu.Lock()
+	defer s.validatorsMu.Unlock()
+
+	if fn == nil {
+		delete(s.validators, key)
+		return
+	}
+	if s.validators == nil {
+		s.validators = make(map[string]func([]byte) error)
+	}
+	s.validators[key] = fn
+}
+
+func (s *fs) validateMetadata(key string, data []byte) error {
+	s.validatorsMu.RLock()
+	fn := s.validators[key]
+	s.validatorsMu.RUnlock()
+
+	if fn == nil {
+		return nil
+	}
+	if err := fn(data); err != nil {
+		return fmt.Errorf("%w for key %s: %v", ErrInvalidMetadataValue, key, err)
+	}
+	return nil
+}
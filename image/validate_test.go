@@ -0,0 +1,111 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisterMetadataValidator(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.RegisterMetadataValidator("layers", func(data []byte) error {
+		var layers []string
+		return json.Unmarshal(data, &layers)
+	})
+
+	err = fs.SetMetadata(id, "layers", []byte(`{"not": "a list"}`))
+	if !errors.Is(err, ErrInvalidMetadataValue) {
+		t.Fatalf("Expected ErrInvalidMetadataValue, got %v", err)
+	}
+	if _, err := fs.GetMetadata(id, "layers"); err == nil {
+		t.Fatal("Expected rejected value not to be stored")
+	}
+
+	if err := fs.SetMetadata(id, "layers", []byte(`["sha256:a", "sha256:b"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "other", []byte(`{"not": "a list"}`)); err != nil {
+		t.Fatalf("Expected unregistered key to be unvalidated, got %v", err)
+	}
+
+	fs.RegisterMetadataValidator("layers", nil)
+	if err := fs.SetMetadata(id, "layers", []byte("anything")); err != nil {
+		t.Fatalf("Expected removed validator not to apply, got %v", err)
+	}
+}
+
+func TestFSMetadataKeys(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"foo/bar", "..", ".", ".hidden", `foo\bar`, ""} {
+		if err := fs.SetMetadata(id, key, []byte("data")); !errors.Is(err, ErrInvalidMetadataKey) {
+			t.Fatalf("Expected ErrInvalidMetadataKey setting %q, got %v", key, err)
+		}
+		if _, err := fs.GetMetadata(id, key); !errors.Is(err, ErrInvalidMetadataKey) {
+			t.Fatalf("Expected ErrInvalidMetadataKey getting %q, got %v", key, err)
+		}
+		if err := fs.DeleteMetadata(id, key); !errors.Is(err, ErrInvalidMetadataKey) {
+			t.Fatalf("Expected ErrInvalidMetadataKey deleting %q, got %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(fs.metadataDir(id), "foo")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no nested metadata directory, got %v", err)
+	}
+
+	if err := fs.SetMetadata(id, "foo.bar-baz_1", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.GetMetadata(id, "foo.bar-baz_1"); err != nil || string(data) != "data" {
+		t.Fatalf("Expected metadata %q, got %q, %v", "data", data, err)
+	}
+}
+
+func TestFSReservedMetadataKeys(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Pin(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(id, "user", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	for key := range reservedMetadataKeys {
+		if err := fs.SetMetadata(id, key, []byte("data")); !errors.Is(err, ErrReservedMetadataKey) {
+			t.Fatalf("Expected ErrReservedMetadataKey setting %q, got %v", key, err)
+		}
+		if err := fs.DeleteMetadata(id, key); !errors.Is(err, ErrReservedMetadataKey) {
+			t.Fatalf("Expected ErrReservedMetadataKey deleting %q, got %v", key, err)
+		}
+		if _, err := fs.CompareAndSwapMetadata(id, key, nil, []byte("data")); !errors.Is(err, ErrReservedMetadataKey) {
+			t.Fatalf("Expected ErrReservedMetadataKey swapping %q, got %v", key, err)
+		}
+	}
+	if !fs.isPinned(id) {
+		t.Fatal("Expected the pin to survive the rejected writes")
+	}
+	keys, err := fs.ListMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "user" {
+		t.Fatalf("Expected only key user to be listed, got %v", keys)
+	}
+}
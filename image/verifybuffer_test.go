@@ -0,0 +1,73 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFSVerifyBufferSize(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, size := range []int{0, 1, 7, 4096, 1 << 20} {
+		fs, cleanup := newTestFSStoreOptions(t, FSOptions{VerifyBufferSize: size})
+		defer cleanup()
+
+		id, err := fs.Set(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := fs.Get(id)
+		if err != nil {
+			t.Fatalf("Buffer size %d: %v", size, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Fatalf("Buffer size %d: unexpected content", size)
+		}
+		if err := fs.WalkReaders(func(id ID, r io.ReadCloser) error {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(data, content) {
+				t.Fatalf("Buffer size %d: unexpected reader content", size)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("Buffer size %d: %v", size, err)
+		}
+
+		corruptContent(t, fs, id)
+		if _, err := fs.Get(id); err == nil {
+			t.Fatalf("Buffer size %d: expected corrupt content to fail verification", size)
+		}
+	}
+
+	if _, err := newFSStore(os.TempDir(), FSOptions{VerifyBufferSize: -1}); err == nil {
+		t.Fatal("Expected error for negative verify buffer size")
+	}
+}
+
+func BenchmarkFSVerifyBufferSize(b *testing.B) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+	for _, size := range []int{0, 512, 32 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			fs, cleanup := newTestFSStoreOptions(b, FSOptions{VerifyBufferSize: size})
+			defer cleanup()
+			id, err := fs.Set(content)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fs.Get(id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package image
+
+import (
+	"sync"
+	"time"
+)
+
+// VerificationCache remembers the content files whose digest was verified,
+// by path, modification time and size, so that the stores sharing it don't
+// hash unchanged files again. A file modified since it was verified doesn't
+// match its entry anymore. Modifications keeping both the modification time
+// and the size, like silent corruption of the disk, go unnoticed until Fsck,
+// which doesn't use the cache.
+type VerificationCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[verificationKey]struct{}
+	hits       uint64
+}
+
+type verificationKey struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// NewVerificationCache returns a cache remembering up to maxEntries
+// verified files. Zero doesn't bound the cache.
+func NewVerificationCache(maxEntries int) *VerificationCache {
+	return &VerificationCache{
+		maxEntries: maxEntries,
+		entries:    make(map[verificationKey]struct{}),
+	}
+}
+
+// Hits returns the number of reads that skipped hashing thanks to the
+// cache.
+func (c *VerificationCache) Hits() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+func (c *VerificationCache) verified(key verificationKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		c.hits++
+		return true
+	}
+	return false
+}
+
+func (c *VerificationCache) add(key verificationKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = struct{}{}
+}
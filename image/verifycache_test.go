@@ -0,0 +1,92 @@
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVerificationCache(t *testing.T) {
+
+	cache := NewVerificationCache(0)
+	fs1, cleanup := newTestFSStoreOptions(t, FSOptions{VerificationCache: cache})
+	defer cleanup()
+	fs2, err := newFSStore(fs1.root, FSOptions{VerificationCache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := fs1.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs1.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	if hits := cache.Hits(); hits != 0 {
+		t.Fatalf("Expected the first read to hash, got %d cache hits", hits)
+	}
+	if _, err := fs2.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	if hits := cache.Hits(); hits != 1 {
+		t.Fatalf("Expected the second store to skip hashing, got %d cache hits", hits)
+	}
+
+	// Tampering changes the modification time.
+	path := fs1.contentFile(id)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.Get(id); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt after tampering, got %v", err)
+	}
+
+	// Fsck doesn't trust the cache.
+	if err := ioutil.WriteFile(path, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs1.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("baz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := fs2.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != id {
+		t.Fatalf("Expected Fsck to find %v corrupt, got %v", id, corrupt)
+	}
+}
+
+func TestVerificationCacheBound(t *testing.T) {
+	cache := NewVerificationCache(2)
+	for _, path := range []string{"a", "b", "c"} {
+		cache.add(verificationKey{path: path})
+	}
+	if len(cache.entries) != 2 {
+		t.Fatalf("Expected 2 cache entries, got %d", len(cache.entries))
+	}
+	if !cache.verified(verificationKey{path: "c"}) {
+		t.Fatal("Expected the latest entry to be kept")
+	}
+}
@@ -0,0 +1,85 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// VerifyExport checks an archive written by Export or ExportAs without
+// importing it. It streams the archive, hashing every blob, and returns the
+// number of blobs along with a description of each problem found: blobs
+// that don't match their recorded ID, duplicate entries, metadata of IDs
+// without content in the archive and unexpected entries. err is only set
+// if the archive can't be read. The store isn't modified.
+func (s *fs) VerifyExport(r io.Reader) (blobs int, bad []string, err error) {
+	seen := make(map[string]bool)
+	content := make(map[ID]bool)
+	// metadata maps the IDs with metadata entries to the first of them.
+	metadata := make(map[ID]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return blobs, bad, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if seen[name] {
+			bad = append(bad, fmt.Sprintf("%s: duplicate entry", name))
+			continue
+		}
+		seen[name] = true
+
+		parts := strings.Split(name, "/")
+		switch {
+		case len(parts) == 1 && parts[0] == exportIDMapName:
+		case len(parts) == 3 && parts[0] == contentDirName:
+			expected := digest.NewDigestFromHex(parts[1], parts[2])
+			if err := expected.Validate(); err != nil {
+				bad = append(bad, fmt.Sprintf("%s: invalid ID: %v", name, err))
+				continue
+			}
+			blobs++
+			content[ID(expected)] = true
+			digester := expected.Algorithm().New()
+			if _, err := io.Copy(digester.Hash(), tr); err != nil {
+				return blobs, bad, err
+			}
+			if digester.Digest() != expected {
+				bad = append(bad, fmt.Sprintf("%s: content has ID %s", name, digester.Digest()))
+			}
+		case len(parts) == 4 && parts[0] == metadataDirName:
+			id := ID(digest.NewDigestFromHex(parts[1], parts[2]))
+			if err := digest.Digest(id).Validate(); err != nil {
+				bad = append(bad, fmt.Sprintf("%s: invalid ID: %v", name, err))
+				continue
+			}
+			if _, ok := metadata[id]; !ok {
+				metadata[id] = name
+			}
+		default:
+			bad = append(bad, fmt.Sprintf("%s: unexpected entry", name))
+		}
+	}
+
+	var missing []string
+	for id, name := range metadata {
+		if !content[id] {
+			missing = append(missing, fmt.Sprintf("%s: no content for %s", name, id))
+		}
+	}
+	sort.Strings(missing)
+	return blobs, append(bad, missing...), nil
+}
@@ -0,0 +1,120 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestVerifyExport(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	foo, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar, err := fs.Set([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMetadata(foo, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := fs.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, bad, err := fs.VerifyExport(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 2 || len(bad) != 0 {
+		t.Fatalf("Expected 2 blobs and no problems, got %d, %v", blobs, bad)
+	}
+
+	// Rewrite the export with the content of bar corrupted, foo stored
+	// twice and metadata for content missing from the archive.
+	missing, err := digest.FromBytes([]byte("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	barName := "content/sha256/" + digest.Digest(bar).Hex()
+	fooName := "content/sha256/" + digest.Digest(foo).Hex()
+	missingName := "metadata/sha256/" + missing.Hex() + "/key"
+	var corrupted bytes.Buffer
+	tw := tar.NewWriter(&corrupted)
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := new(bytes.Buffer)
+		if _, err := io.Copy(data, tr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == barName {
+			data.Reset()
+			data.WriteString("baz")
+		}
+		if err := writeTarFile(tw, hdr.Name, data.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == fooName {
+			if err := writeTarFile(tw, hdr.Name, data.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writeTarFile(tw, missingName, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bazID, err := digest.FromBytes([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, bad, err = fs.VerifyExport(&corrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 2 {
+		t.Fatalf("Expected 2 blobs, got %d", blobs)
+	}
+	expected := []string{
+		barName + ": content has ID " + string(bazID),
+		fooName + ": duplicate entry",
+		missingName + ": no content for " + string(missing),
+	}
+	if len(bad) != len(expected) {
+		t.Fatalf("Expected problems %v, got %v", expected, bad)
+	}
+	for _, problem := range expected {
+		found := false
+		for _, b := range bad {
+			found = found || b == problem
+		}
+		if !found {
+			t.Fatalf("Expected problem %q, got %v", problem, bad)
+		}
+	}
+
+	ids, err := fs.sortedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("Expected the store to be unchanged, got %v", ids)
+	}
+}
@@ -0,0 +1,151 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// EntryKind classifies the entries reported by WalkAll.
+type EntryKind int
+
+const (
+	// ValidContent is an entry holding content under a valid ID.
+	ValidContent EntryKind = iota
+	// InvalidEntry is an entry the store ignores.
+	InvalidEntry
+)
+
+// Entry is a file or directory found in the content directory of a store.
+type Entry struct {
+	Kind EntryKind
+	// ID is the ID of ValidContent entries.
+	ID ID
+	// Path is the path of the entry.
+	Path string
+	// Reason tells why an InvalidEntry is ignored.
+	Reason string
+}
+
+// WalkAll calls f for every entry in the digest algorithm directories of
+// the content directory, or for every file of the content directory with
+// FSOptions.ContentLayout, including the invalid entries that Walk skips. The
+// content of valid entries isn't verified. An error returned by f stops the
+// walk.
+func (s *fs) WalkAll(f func(entry Entry) error) error {
+	s.RLock()
+	var entries []Entry
+	var dirs []string
+	var err error
+	if s.layout != nil {
+		entries, err = s.layoutEntries()
+	} else {
+		dirs, err = algorithmDirs(s.contentDir())
+	}
+	if err == nil {
+		for _, alg := range dirs {
+			var algEntries []Entry
+			algEntries, err = s.algorithmEntries(alg)
+			if err != nil {
+				break
+			}
+			entries = append(entries, algEntries...)
+		}
+	}
+	for id := range s.inline {
+		entries = append(entries, Entry{Kind: ValidContent, ID: id, Path: s.inlineIndexFile()})
+	}
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := f(entry); err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
+
+// WalkAlgorithm calls f for each image ID addressed with the digest
+// algorithm alg, like Walk, without reading the directories of the other
+// algorithms. It fails with ErrUnsupportedAlgorithm if the store doesn't
+// serve alg. An error returned by f stops the walk.
+func (s *fs) WalkAlgorithm(alg string, f IDWalkFunc) error {
+	if !s.algorithmAllowed(digest.Algorithm(alg)) || (s.idStrategy == nil && !digest.Algorithm(alg).Available()) {
+		return storeError("walkalgorithm", "", ErrUnsupportedAlgorithm)
+	}
+
+	s.RLock()
+	ids, err := s.listIDsOf(alg)
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := f(id); err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
+
+// listIDsOf returns the IDs of the stored content addressed with alg. It
+// must be called with the store lock held.
+func (s *fs) listIDsOf(alg string) ([]ID, error) {
+	if s.packed() || s.layout != nil {
+		all, err := s.listIDs()
+		if err != nil {
+			return nil, err
+		}
+		var ids []ID
+		for _, id := range all {
+			if string(digest.Digest(id).Algorithm()) == alg {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+	ids, err := s.listAlgorithmIDs(alg)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if alg == string(digest.Canonical) && s.idStrategy == nil {
+		for id := range s.inline {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// algorithmEntries classifies the entries of the content directory of alg.
+// It must be called with the store lock held.
+func (s *fs) algorithmEntries(alg string) ([]Entry, error) {
+	dir := filepath.Join(s.contentDir(), alg)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(infos))
+	for _, v := range infos {
+		entry := Entry{Kind: InvalidEntry, Path: filepath.Join(dir, v.Name())}
+		dgst := digest.NewDigestFromHex(alg, v.Name())
+		switch {
+		case v.IsDir():
+			entry.Reason = "unexpected directory"
+		case dgst.Validate() != nil:
+			entry.Reason = fmt.Sprintf("invalid digest: %v", dgst.Validate())
+		case !s.algorithmAllowed(digest.Algorithm(alg)):
+			entry.Reason = ErrUnsupportedAlgorithm.Error()
+		default:
+			entry.Kind = ValidContent
+			entry.ID = ID(dgst)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,98 @@
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestWalkAll(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := filepath.Join(fs.contentDir(), "sha256", "foobar")
+	if err := ioutil.WriteFile(junk, []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var valid, invalid []Entry
+	if err := fs.WalkAll(func(entry Entry) error {
+		switch entry.Kind {
+		case ValidContent:
+			valid = append(valid, entry)
+		case InvalidEntry:
+			invalid = append(invalid, entry)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(valid) != 1 || valid[0].ID != id || valid[0].Path != fs.contentFile(id) {
+		t.Fatalf("Expected valid entry for %v, got %+v", id, valid)
+	}
+	if len(invalid) != 1 || invalid[0].Path != junk || invalid[0].Reason == "" {
+		t.Fatalf("Expected invalid entry for %s with a reason, got %+v", junk, invalid)
+	}
+}
+
+func TestWalkAlgorithm(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{InlineThreshold: 4})
+	defer cleanup()
+	sha512fs, err := newFSStore(fs.root, FSOptions{Algorithm: digest.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[ID]bool)
+	for _, data := range []string{"foo", "foobar", "foobarbaz"} {
+		id, err := fs.Set([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[id] = true
+		if _, err := sha512fs.Set([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	visited := make(map[ID]bool)
+	if err := fs.WalkAlgorithm("sha256", func(id ID) error {
+		if digest.Digest(id).Algorithm() != digest.SHA256 {
+			t.Fatalf("Expected only sha256 IDs, got %v", id)
+		}
+		visited[id] = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("Expected to visit %v, got %v", expected, visited)
+	}
+
+	count := 0
+	if err := fs.WalkAlgorithm("sha512", func(id ID) error {
+		if digest.Digest(id).Algorithm() != digest.SHA512 {
+			t.Fatalf("Expected only sha512 IDs, got %v", id)
+		}
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 sha512 IDs, got %d", count)
+	}
+
+	if err := fs.WalkAlgorithm("../sha256", func(ID) error { return nil }); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("Expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+}
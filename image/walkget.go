@@ -0,0 +1,58 @@
+package image
+
+import (
+	"errors"
+	"os"
+)
+
+// WalkGetFunc is the function called by WalkGet with the verified content of
+// each image.
+type WalkGetFunc func(id ID, data []byte) error
+
+// WalkGet calls f with the content of every image in the store, in lexical
+// ID order, like a Walk calling Get for each ID. The content of the next
+// image is read and verified in the background while f processes the
+// current one, hiding the read latency from sequential workloads. Content
+// removed since it was listed is skipped. The first error, from f or from
+// reading content, stops the walk and is returned; no further content is
+// read ahead after that.
+func (s *fs) WalkGet(f WalkGetFunc) error {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	readAhead := func(id ID) <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			data, err := s.Get(id)
+			c <- result{data, err}
+		}()
+		return c
+	}
+
+	next := readAhead(ids[0])
+	for i, id := range ids {
+		r := <-next
+		if i+1 < len(ids) {
+			next = readAhead(ids[i+1])
+		}
+		if r.err != nil {
+			if errors.Is(r.err, os.ErrNotExist) {
+				continue
+			}
+			return r.err
+		}
+		if err := f(id, r.data); err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
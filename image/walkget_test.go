@@ -0,0 +1,73 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWalkGet(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	contents := make(map[ID][]byte)
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("content%d", i))
+		id, err := fs.Set(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[id] = data
+	}
+	delay := 10 * time.Millisecond
+	fs.fsys = slowOpenFS{delay: delay}
+
+	start := time.Now()
+	delivered := 0
+	if err := fs.WalkGet(func(id ID, data []byte) error {
+		if !bytes.Equal(data, contents[id]) {
+			t.Fatalf("Unexpected content %q for %v", data, id)
+		}
+		delivered++
+		time.Sleep(delay)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if delivered != len(contents) {
+		t.Fatalf("Expected %d blobs delivered, got %d", len(contents), delivered)
+	}
+	// Without read-ahead every blob costs a read plus a callback.
+	if sequential := 2 * delay * time.Duration(len(contents)); elapsed >= sequential*3/4 {
+		t.Fatalf("Expected reads to overlap callbacks, took %v against %v sequentially", elapsed, sequential)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	if err := fs.WalkGet(func(id ID, data []byte) error {
+		calls++
+		return errStop
+	}); err != errStop {
+		t.Fatalf("Expected callback error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected walk to stop after the first error, got %d calls", calls)
+	}
+}
+
+func TestWalkGetCorrupt(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, fs, id)
+	if err := fs.WalkGet(func(ID, []byte) error { return nil }); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+}
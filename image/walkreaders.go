@@ -0,0 +1,154 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/docker/distribution/digest"
+)
+
+// WalkReadersFunc is the function called by WalkReaders with a reader of the
+// content of each image.
+type WalkReadersFunc func(id ID, r io.ReadCloser) error
+
+// WalkReaders calls f with a reader of the content of every image in the
+// store, in lexical ID order, so the content can be copied onward without
+// buffering whole blobs. The reader verifies the content as it is read and
+// fails with ErrCorrupt at the end if it doesn't match its digest. f should
+// close the reader; WalkReaders closes it after f returns in any case.
+// Chunked, delta and inline content is read into memory first. Content
+// removed since it was listed is skipped. An error returned by f stops the
+// walk.
+func (s *fs) WalkReaders(f WalkReadersFunc) error {
+	ids, err := s.sortedIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		r, err := s.openVerified(id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return storeError("walkreaders", id, err)
+		}
+		err = f(id, r)
+		r.Close()
+		if err != nil {
+			return stopWalk(err)
+		}
+	}
+	return nil
+}
+
+// openVerified returns a reader of the content of id that verifies it
+// against its digest.
+func (s *fs) openVerified(id ID) (io.ReadCloser, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if _, ok := s.inline[s.normalizeID(id)]; ok || !s.algorithmAllowed(digest.Digest(id).Algorithm()) || s.idStrategy != nil || s.packed() {
+		return s.openBuffered(id)
+	}
+	f, err := s.openFile(s.contentFile(id))
+	if err != nil {
+		return nil, err
+	}
+	// Content files are replaced by rename, so the open file stays
+	// consistent after the lock is released.
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(len(chunkManifestHeader))
+	if bytes.HasPrefix(header, []byte(chunkManifestHeader)) || bytes.HasPrefix(header, []byte(deltaHeader)) {
+		f.Close()
+		return s.openBuffered(id)
+	}
+	digester := digest.Digest(id).Algorithm().New()
+	return &verifyingReader{
+		id:        s.normalizeID(id),
+		r:         br,
+		c:         f,
+		digester:  digester,
+		hash:      s.hashWriter(digester.Hash()),
+		blockSize: s.verifyBufferSize,
+		size:      s.recordedSize(id),
+	}, nil
+}
+
+// openBuffered returns a reader of the verified content of id read into
+// memory. It must be called with the store lock held.
+func (s *fs) openBuffered(id ID) (io.ReadCloser, error) {
+	content, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{id: s.normalizeID(id), r: bytes.NewReader(content)}, nil
+}
+
+// verifyingReader hashes the content it reads and fails at EOF unless the
+// content matches id. Content read into memory is verified already and has
+// no digester.
+type verifyingReader struct {
+	id       ID
+	r        io.Reader
+	c        io.Closer
+	digester digest.Digester
+	// hash writes to the hash of digester.
+	hash io.Writer
+	// blockSize bounds the bytes read and hashed at a time if it is set.
+	blockSize int
+	// size is the recorded size of the content, or -1. prefix is the
+	// digest of the first size bytes once more have been read.
+	size   int64
+	read   int64
+	prefix ID
+	closed bool
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.blockSize > 0 && len(p) > r.blockSize {
+		p = p[:r.blockSize]
+	}
+	n, err := r.r.Read(p)
+	if r.digester == nil {
+		return n, err
+	}
+	data := p[:n]
+	if r.size >= 0 && r.read <= r.size && r.read+int64(n) > r.size {
+		end := r.size - r.read
+		r.hash.Write(data[:end])
+		r.prefix = ID(r.digester.Digest())
+		data = data[end:]
+	}
+	r.hash.Write(data)
+	r.read += int64(n)
+	if err == io.EOF && ID(r.digester.Digest()) != r.id {
+		return n, storeError("walkreaders", r.id, r.mismatchError())
+	}
+	return n, err
+}
+
+// mismatchError tells appended data and truncation apart from other
+// corruption like fs.mismatchError.
+func (r *verifyingReader) mismatchError() error {
+	switch {
+	case r.size < 0:
+		return ErrCorrupt
+	case r.read < r.size:
+		return ErrTruncated
+	case r.read > r.size && r.prefix == r.id:
+		return ErrExtraData
+	}
+	return ErrCorrupt
+}
+
+// Close closes the content file. Closing a closed reader does nothing.
+func (r *verifyingReader) Close() error {
+	if r.closed || r.c == nil {
+		return nil
+	}
+	r.closed = true
+	return r.c.Close()
+}
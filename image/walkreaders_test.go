@@ -0,0 +1,84 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWalkReaders(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	expected := make(map[ID]string)
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("content%d", i)
+		id, err := fs.Set([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[id] = content
+	}
+	fsys := &fdCountingFS{}
+	fs.fsys = fsys
+
+	seen := 0
+	if err := fs.WalkReaders(func(id ID, r io.ReadCloser) error {
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if string(data) != expected[id] {
+			t.Fatalf("Expected content %q for %v, got %q", expected[id], id, data)
+		}
+		seen++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(expected) {
+		t.Fatalf("Expected %d readers, got %d", len(expected), seen)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := fs.WalkReaders(func(id ID, r io.ReadCloser) error {
+		calls++
+		if calls == 3 {
+			return stop
+		}
+		return r.Close()
+	})
+	if err != stop {
+		t.Fatalf("Expected callback error, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("Expected the walk to stop after 3 calls, got %d", calls)
+	}
+	if fsys.open != 0 {
+		t.Fatalf("Expected all readers to be closed, %d still open", fsys.open)
+	}
+}
+
+func TestWalkReadersCorrupt(t *testing.T) {
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	id, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptContent(t, fs, id)
+
+	err = fs.WalkReaders(func(id ID, r io.ReadCloser) error {
+		defer r.Close()
+		_, err := ioutil.ReadAll(r)
+		return err
+	})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/pkg/filenotify"
+	"golang.org/x/net/context"
+)
+
+// StartWatcher starts watching the content directories of the store for
+// changes made by other processes sharing it, like another daemon storing
+// or deleting content. The in-memory state of changed IDs is dropped and
+// onChange is called with them, so that caches layered on top, like a
+// CachingBackend, can be invalidated with it. Changes to the metadata
+// alone aren't reported.
+//
+// Where file watching is unavailable, the store is rescanned every rescan
+// instead. The returned channel is closed once the watcher stopped after
+// ctx is done.
+func (s *fs) StartWatcher(ctx context.Context, rescan time.Duration, onChange func(ID)) (<-chan struct{}, error) {
+	if rescan <= 0 {
+		return nil, fmt.Errorf("invalid rescan interval %v", rescan)
+	}
+	watcher, err := s.newWatcher()
+	if err == nil {
+		if err = s.addWatches(watcher); err != nil {
+			watcher.Close()
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err != nil {
+			s.log.Warn("file watching unavailable for image store, rescanning instead", "err", err)
+			s.rescan(ctx, rescan, onChange)
+			return
+		}
+		defer watcher.Close()
+		if !s.watch(ctx, watcher, onChange) {
+			s.log.Warn("image store watcher stopped, rescanning instead")
+			s.rescan(ctx, rescan, onChange)
+		}
+	}()
+	return done, nil
+}
+
+// addWatches watches the algorithm directories of the content, or the
+// directories holding the files of the content layout, and the directory of
+// the inline index.
+func (s *fs) addWatches(watcher filenotify.FileWatcher) error {
+	if s.layout != nil {
+		dirs, err := layoutDirs(s.contentDir(), s.layout, s.algorithm)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			dir = filepath.Join(s.contentDir(), dir)
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+			if err := watcher.Add(dir); err != nil {
+				return err
+			}
+		}
+		return s.watchInlineIndex(watcher)
+	}
+	algs, err := s.algorithmDirs(s.contentDir())
+	if err != nil {
+		return err
+	}
+	for _, alg := range algs {
+		if err := watcher.Add(filepath.Join(s.contentDir(), alg)); err != nil {
+			return err
+		}
+	}
+	return s.watchInlineIndex(watcher)
+}
+
+func (s *fs) watchInlineIndex(watcher filenotify.FileWatcher) error {
+	dir := filepath.Dir(s.inlineIndexFile())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return watcher.Add(dir)
+}
+
+// watch handles the events of watcher until ctx is done, and returns false
+// if the watcher stopped before.
+func (s *fs) watch(ctx context.Context, watcher filenotify.FileWatcher, onChange func(ID)) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case err, ok := <-watcher.Errors():
+			if !ok {
+				return false
+			}
+			s.log.Warn("error watching image store", "err", err)
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return false
+			}
+			if event.Name == s.inlineIndexFile() {
+				s.changed(s.reloadInline(), onChange)
+				continue
+			}
+			if id, ok := s.contentFileID(event.Name); ok {
+				s.changed([]ID{id}, onChange)
+			}
+		}
+	}
+}
+
+// rescan lists the stored content every interval until ctx is done,
+// reporting the IDs added or removed since the previous scan.
+func (s *fs) rescan(ctx context.Context, interval time.Duration, onChange func(ID)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var known map[ID]bool
+	for {
+		s.reloadInline()
+		s.RLock()
+		ids, err := s.listIDs()
+		s.RUnlock()
+		if err != nil {
+			s.log.Warn("failed to rescan image store", "err", err)
+		} else {
+			current := make(map[ID]bool, len(ids))
+			var changed []ID
+			for _, id := range ids {
+				current[id] = true
+				if known != nil && !known[id] {
+					changed = append(changed, id)
+				}
+			}
+			for id := range known {
+				if !current[id] {
+					changed = append(changed, id)
+				}
+			}
+			known = current
+			s.changed(changed, onChange)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reloadInline reads the inline index again and returns the IDs added to
+// or removed from it.
+func (s *fs) reloadInline() []ID {
+	s.Lock()
+	defer s.Unlock()
+
+	old := s.inline
+	if err := s.loadInline(); err != nil {
+		s.log.Warn("failed to reload inline image index", "err", err)
+		s.inline = old
+		return nil
+	}
+	var changed []ID
+	for id := range s.inline {
+		if _, ok := old[id]; !ok {
+			changed = append(changed, id)
+		}
+	}
+	for id := range old {
+		if _, ok := s.inline[id]; !ok {
+			changed = append(changed, id)
+		}
+	}
+	return changed
+}
+
+// changed drops the in-memory state of the removed ones of ids and reports
+// all of them to onChange.
+func (s *fs) changed(ids []ID, onChange func(ID)) {
+	for _, id := range ids {
+		s.RLock()
+		removed := os.IsNotExist(s.contentExists(id))
+		s.RUnlock()
+		if removed {
+			s.forget(id)
+		} else {
+			s.addToBloom(id)
+		}
+		if onChange != nil {
+			onChange(id)
+		}
+	}
+}
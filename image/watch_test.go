@@ -0,0 +1,171 @@
+package image
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/filenotify"
+	"golang.org/x/net/context"
+	"gopkg.in/fsnotify.v1"
+)
+
+// fakeWatcher delivers the events sent by the test.
+type fakeWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{events: make(chan fsnotify.Event), errors: make(chan error)}
+}
+
+func (w *fakeWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *fakeWatcher) Errors() <-chan error          { return w.errors }
+func (w *fakeWatcher) Add(name string) error         { return nil }
+func (w *fakeWatcher) Remove(name string) error      { return nil }
+func (w *fakeWatcher) Close() error                  { return nil }
+
+// newSharedFSStores returns two stores sharing a root, standing in for two
+// processes.
+func newSharedFSStores(t *testing.T) (*fs, *fs, func()) {
+	local, cleanup := newTestFSStore(t)
+	remote, err := newFSStore(local.root, FSOptions{})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return local, remote, cleanup
+}
+
+func waitChanged(t *testing.T, changes <-chan ID, expected ID) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case id := <-changes:
+			if id == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a change of %v", expected)
+		}
+	}
+}
+
+func TestFSWatcherInvalidatesCache(t *testing.T) {
+	local, remote, cleanup := newSharedFSStores(t)
+	defer cleanup()
+	watcher := newFakeWatcher()
+	local.newWatcher = func() (filenotify.FileWatcher, error) { return watcher, nil }
+
+	id, err := local.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCachingBackend(local, 1024)
+	if _, err := cache.Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan ID, 10)
+	done, err := local.StartWatcher(ctx, time.Hour, func(id ID) {
+		cache.Invalidate(id)
+		changes <- id
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	watcher.events <- fsnotify.Event{Name: local.contentFile(id), Op: fsnotify.Remove}
+	waitChanged(t, changes, id)
+	if _, err := cache.Get(id); err == nil {
+		t.Fatal("Expected externally deleted content to be dropped from the cache")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestFSWatcherRescan(t *testing.T) {
+	local, remote, cleanup := newSharedFSStores(t)
+	defer cleanup()
+	local.newWatcher = func() (filenotify.FileWatcher, error) {
+		return nil, errors.New("watching unavailable")
+	}
+
+	id, err := local.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCachingBackend(local, 1024)
+	if _, err := cache.Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan ID, 10)
+	done, err := local.StartWatcher(ctx, 10*time.Millisecond, func(id ID) {
+		cache.Invalidate(id)
+		changes <- id
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the first scan record the content before it is deleted.
+	time.Sleep(50 * time.Millisecond)
+	if err := remote.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	waitChanged(t, changes, id)
+	if _, err := cache.Get(id); err == nil {
+		t.Fatal("Expected externally deleted content to be dropped from the cache")
+	}
+
+	cancel()
+	<-done
+
+	if _, err := local.StartWatcher(context.Background(), 0, nil); err == nil {
+		t.Fatal("Expected error for zero rescan interval")
+	}
+}
+
+// recordingWatcher records the watched paths.
+type recordingWatcher struct {
+	*fakeWatcher
+	added []string
+}
+
+func (w *recordingWatcher) Add(name string) error {
+	w.added = append(w.added, name)
+	return nil
+}
+
+func TestFSWatcherContentLayout(t *testing.T) {
+	fs, cleanup := newTestFSStoreOptions(t, FSOptions{ContentLayout: flatLayout{}})
+	defer cleanup()
+	watcher := &recordingWatcher{fakeWatcher: newFakeWatcher()}
+	fs.newWatcher = func() (filenotify.FileWatcher, error) { return watcher, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done, err := fs.StartWatcher(ctx, time.Hour, func(ID) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-done
+
+	// Watches aren't recursive, the directory of the layout is watched.
+	dir := filepath.Join(fs.contentDir(), "blobs")
+	for _, name := range watcher.added {
+		if name == dir {
+			return
+		}
+	}
+	t.Fatalf("Expected %s to be watched, got %v", dir, watcher.added)
+}
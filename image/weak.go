@@ -0,0 +1,144 @@
+package image
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// weakChecksumKey is the metadata key holding the CRC-32 checksum and size
+// of content stored with FSOptions.WeakChecksums.
+const weakChecksumKey = "weak-checksum"
+
+type weakKey struct {
+	crc  uint32
+	size int64
+}
+
+// weakIndex maps weak checksums to the IDs of the content having them.
+type weakIndex struct {
+	ids  map[weakKey]map[ID]struct{}
+	keys map[ID]weakKey
+}
+
+func (wi *weakIndex) add(id ID, key weakKey) {
+	if _, ok := wi.ids[key]; !ok {
+		wi.ids[key] = make(map[ID]struct{})
+	}
+	wi.ids[key][id] = struct{}{}
+	wi.keys[id] = key
+}
+
+func (wi *weakIndex) remove(id ID) {
+	key, ok := wi.keys[id]
+	if !ok {
+		return
+	}
+	delete(wi.ids[key], id)
+	if len(wi.ids[key]) == 0 {
+		delete(wi.ids, key)
+	}
+	delete(wi.keys, id)
+}
+
+func formatWeakChecksum(key weakKey) []byte {
+	return []byte(fmt.Sprintf("%08x %d", key.crc, key.size))
+}
+
+func parseWeakChecksum(data []byte) (weakKey, error) {
+	var key weakKey
+	if _, err := fmt.Sscanf(string(data), "%08x %d", &key.crc, &key.size); err != nil {
+		return weakKey{}, err
+	}
+	return key, nil
+}
+
+// recordWeakChecksum must be called with the store write lock held.
+func (s *fs) recordWeakChecksum(id ID, crc uint32, size int64) {
+	key := weakKey{crc: crc, size: size}
+	if err := s.metadata.Set(id, weakChecksumKey, formatWeakChecksum(key)); err != nil {
+		s.log.Warn("failed to record weak checksum of image", "id", id, "err", err)
+	}
+
+	s.weakMu.Lock()
+	defer s.weakMu.Unlock()
+	if s.weakIndex != nil {
+		s.weakIndex.add(id, key)
+	}
+}
+
+func (s *fs) forgetWeakChecksum(id ID) {
+	s.weakMu.Lock()
+	defer s.weakMu.Unlock()
+	if s.weakIndex != nil {
+		s.weakIndex.remove(id)
+	}
+}
+
+// loadWeakIndex builds the weak checksums index from the metadata, computing
+// and recording the checksums missing from it.
+func (s *fs) loadWeakIndex() (*weakIndex, error) {
+	s.weakMu.Lock()
+	wi := s.weakIndex
+	s.weakMu.Unlock()
+	if wi != nil {
+		return wi, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	ids, err := s.listIDs()
+	if err != nil {
+		return nil, err
+	}
+	wi = &weakIndex{
+		ids:  make(map[weakKey]map[ID]struct{}),
+		keys: make(map[ID]weakKey),
+	}
+	for _, id := range ids {
+		data, err := s.metadata.Get(id, weakChecksumKey)
+		if err == nil {
+			if key, err := parseWeakChecksum(data); err == nil {
+				wi.add(id, key)
+				continue
+			}
+		}
+		content, err := s.get(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, storeError("existsweak", id, err)
+		}
+		key := weakKey{crc: crc32.ChecksumIEEE(content), size: int64(len(content))}
+		if err := s.metadata.Set(id, weakChecksumKey, formatWeakChecksum(key)); err != nil {
+			s.log.Warn("failed to record weak checksum of image", "id", id, "err", err)
+		}
+		wi.add(id, key)
+	}
+
+	s.weakMu.Lock()
+	s.weakIndex = wi
+	s.weakMu.Unlock()
+	return wi, nil
+}
+
+// ExistsWeak returns the IDs of the content with the given CRC-32 (IEEE)
+// checksum and size. The result only narrows down candidates: callers must
+// compare digests before assuming the content is present.
+func (s *fs) ExistsWeak(crc uint32, size int64) ([]ID, error) {
+	wi, err := s.loadWeakIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	s.weakMu.Lock()
+	defer s.weakMu.Unlock()
+
+	var ids []ID
+	for id := range wi.ids[weakKey{crc: crc, size: size}] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
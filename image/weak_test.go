@@ -0,0 +1,64 @@
+package image
+
+import (
+	"hash/crc32"
+	"testing"
+)
+
+func TestExistsWeak(t *testing.T) {
+
+	// content stored before weak checksums were enabled
+	fs, cleanup := newTestFSStore(t)
+	defer cleanup()
+	old, err := fs.Set([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = newFSStore(fs.root, FSOptions{WeakChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo, err := fs.Set([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Set([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		data     string
+		size     int64
+		expected []ID
+	}{
+		{"foo", 3, []ID{foo}},
+		{"old", 3, []ID{old}},
+		{"foo", 4, nil},
+		{"baz", 3, nil},
+	}
+	for _, tc := range tcases {
+		ids, err := fs.ExistsWeak(crc32.ChecksumIEEE([]byte(tc.data)), tc.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != len(tc.expected) || (len(ids) == 1 && ids[0] != tc.expected[0]) {
+			t.Fatalf("Expected candidates %v for %q/%d, got %v", tc.expected, tc.data, tc.size, ids)
+		}
+	}
+
+	// the index follows later changes
+	baz, err := fs.Set([]byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(foo); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := fs.ExistsWeak(crc32.ChecksumIEEE([]byte("baz")), 3); err != nil || len(ids) != 1 || ids[0] != baz {
+		t.Fatalf("Expected candidates [%v], got %v, %v", baz, ids, err)
+	}
+	if ids, err := fs.ExistsWeak(crc32.ChecksumIEEE([]byte("foo")), 3); err != nil || len(ids) != 0 {
+		t.Fatalf("Expected no candidates for deleted content, got %v, %v", ids, err)
+	}
+}